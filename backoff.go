@@ -0,0 +1,90 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BackoffStrategy computes the delays between the retries of an operation,
+// it's used by the Manager to restart the quarantined discoveries and by the
+// Client to retry the failed LISTs of the polling fallback. A BackoffStrategy
+// must be safe for concurrent use.
+type BackoffStrategy interface {
+	// Delay returns the delay to wait before the given retry, the first
+	// retry is the number 0.
+	Delay(retry int) time.Duration
+}
+
+// FixedBackoff waits the same delay before each retry.
+type FixedBackoff time.Duration
+
+// Delay returns the fixed delay.
+func (b FixedBackoff) Delay(retry int) time.Duration {
+	return time.Duration(b)
+}
+
+// ExponentialBackoff multiplies the delay by Multiplier at each retry,
+// starting from Initial and up to Max. A Multiplier lower than 1 is
+// considered 2, a Max of 0 means no limit.
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+// Delay returns the delay of the given retry.
+func (b *ExponentialBackoff) Delay(retry int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	delay := float64(b.Initial)
+	for i := 0; i < retry; i++ {
+		delay *= multiplier
+		if b.Max > 0 && delay >= float64(b.Max) {
+			return b.Max
+		}
+	}
+	if delay > float64(maxDuration) {
+		return maxDuration
+	}
+	return time.Duration(delay)
+}
+
+const maxDuration = time.Duration(1<<63 - 1)
+
+// JitteredBackoff randomizes the delays of another BackoffStrategy by up to
+// the Jitter fraction (between 0 and 1) in both directions, to spread the
+// retries of many clients failing at the same time.
+type JitteredBackoff struct {
+	Strategy BackoffStrategy
+	Jitter   float64
+}
+
+// Delay returns the delay of the given retry with a random jitter.
+func (b *JitteredBackoff) Delay(retry int) time.Duration {
+	delay := b.Strategy.Delay(retry)
+	jitter := min(max(b.Jitter, 0), 1)
+	if jitter == 0 || delay <= 0 {
+		return delay
+	}
+	spread := float64(delay) * jitter
+	return time.Duration(float64(delay) - spread + rand.Float64()*2*spread)
+}
@@ -0,0 +1,66 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffStrategies(t *testing.T) {
+	fixed := FixedBackoff(time.Second)
+	require.Equal(t, time.Second, fixed.Delay(0))
+	require.Equal(t, time.Second, fixed.Delay(10))
+
+	exp := &ExponentialBackoff{Initial: time.Second, Max: 10 * time.Second}
+	require.Equal(t, time.Second, exp.Delay(0))
+	require.Equal(t, 2*time.Second, exp.Delay(1))
+	require.Equal(t, 8*time.Second, exp.Delay(3))
+	require.Equal(t, 10*time.Second, exp.Delay(4))
+	require.Equal(t, 10*time.Second, exp.Delay(1000))
+
+	exp = &ExponentialBackoff{Initial: time.Second, Multiplier: 3}
+	require.Equal(t, 9*time.Second, exp.Delay(2))
+	require.Equal(t, maxDuration, exp.Delay(1000))
+
+	jittered := &JitteredBackoff{Strategy: FixedBackoff(time.Second), Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		delay := jittered.Delay(i)
+		require.GreaterOrEqual(t, delay, 500*time.Millisecond)
+		require.LessOrEqual(t, delay, 1500*time.Millisecond)
+	}
+	jittered.Jitter = 0
+	require.Equal(t, time.Second, jittered.Delay(0))
+}
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	policy := DefaultRestartPolicy()
+	require.Equal(t, time.Second, policy.backoff().Delay(0))
+	require.Equal(t, time.Minute, policy.backoff().Delay(10))
+	policy.Backoff = FixedBackoff(time.Hour)
+	require.Equal(t, time.Hour, policy.backoff().Delay(10))
+
+	cfg := &RestartPolicyConfig{Jitter: 0.1}
+	policy, err := cfg.restartPolicy()
+	require.NoError(t, err)
+	require.IsType(t, &JitteredBackoff{}, policy.Backoff)
+	_, err = (&RestartPolicyConfig{Jitter: 2}).restartPolicy()
+	require.Error(t, err)
+}
@@ -0,0 +1,272 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// A Broker allows many consumers to share a single discovery process. Each
+// consumer uses its own SharedClient, created with NewClient: the Broker
+// multiplexes the commands of all the SharedClients on the underlying Client
+// and duplicates the events of the discovery to all the SharedClients in sync
+// mode. The underlying discovery is started in sync mode at the first use of a
+// SharedClient and it's terminated when all the SharedClients have quit.
+//
+// The events are delivered to the SharedClients in order by a single goroutine:
+// a consumer that doesn't read the events slows down all the other consumers.
+type Broker struct {
+	disc *Client
+
+	// All the following fields are guarded by mutex, that also serializes the
+	// commands sent to the underlying Client.
+	mutex       sync.Mutex
+	clients     int
+	subscribers map[*SharedClient]*eventForwarder
+	sync        *brokerSync
+}
+
+// brokerSync is a sync session of the underlying Client. The ports are guarded
+// by a separate mutex, so the fan-out goroutine is never blocked by a command
+// in progress: otherwise the command response could be stuck in the decode loop
+// of the Client behind the events.
+type brokerSync struct {
+	subscribe  chan *eventForwarder
+	done       chan struct{}
+	portsMutex sync.Mutex
+	ports      map[string]*Port
+}
+
+// SharedClient is a facade of a discovery shared through a Broker.
+type SharedClient struct {
+	broker *Broker
+	closed bool
+}
+
+// NewBroker creates a new Broker sharing the given discovery Client. The Client
+// must not be used directly after the creation of the Broker.
+func NewBroker(disc *Client) *Broker {
+	return &Broker{
+		disc:        disc,
+		subscribers: map[*SharedClient]*eventForwarder{},
+	}
+}
+
+// NewClient returns a new SharedClient of the discovery.
+func (b *Broker) NewClient() *SharedClient {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.clients++
+	return &SharedClient{broker: b}
+}
+
+// ensureSync runs the discovery and starts the sync mode, if not already
+// done. The caller must hold the mutex.
+func (b *Broker) ensureSync() (*brokerSync, error) {
+	if b.sync != nil && b.disc.Alive() {
+		return b.sync, nil
+	}
+	if !b.disc.Alive() {
+		if err := b.disc.Run(); err != nil {
+			return nil, err
+		}
+	}
+	events, err := b.disc.StartSync(eventsBrokerBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	s := &brokerSync{
+		subscribe: make(chan *eventForwarder),
+		done:      make(chan struct{}),
+		ports:     map[string]*Port{},
+	}
+	b.sync = s
+	go b.fanOut(s, events)
+	return s, nil
+}
+
+// eventsBrokerBufferSize is the size of the event channel of the underlying Client.
+const eventsBrokerBufferSize = 10
+
+// fanOut delivers the events of the sync session to all the subscribers. The
+// subscribers receive an "add" event for each port already detected when they
+// subscribe.
+func (b *Broker) fanOut(s *brokerSync, events <-chan *Event) {
+	defer close(s.done)
+	subscribers := []*eventForwarder{}
+	for {
+		select {
+		case f := <-s.subscribe:
+			s.portsMutex.Lock()
+			ports := []*Port{}
+			for _, port := range s.ports {
+				ports = append(ports, port)
+			}
+			s.portsMutex.Unlock()
+			sort.Slice(ports, func(i, j int) bool { return ports[i].Address < ports[j].Address })
+			for _, port := range ports {
+				f.send(&Event{Type: EventTypeAdd, Port: port, DiscoveryID: b.disc.GetID()})
+			}
+			subscribers = append(subscribers, f)
+		case ev, ok := <-events:
+			if !ok {
+				b.mutex.Lock()
+				if b.sync == s {
+					b.sync = nil
+				}
+				b.mutex.Unlock()
+				for _, f := range subscribers {
+					f.close()
+				}
+				return
+			}
+			if ev.Type == EventTypeStop {
+				continue
+			}
+			if ev.Type == EventTypeAdd || ev.Type == EventTypeRemove {
+				id := ev.Port.Address + "|" + ev.Port.Protocol
+				s.portsMutex.Lock()
+				if ev.Type == EventTypeAdd {
+					s.ports[id] = ev.Port
+				} else {
+					delete(s.ports, id)
+				}
+				s.portsMutex.Unlock()
+			}
+			for _, f := range subscribers {
+				f.send(ev)
+			}
+		}
+
+		// Remove the subscribers that have been stopped
+		active := subscribers[:0]
+		for _, f := range subscribers {
+			if !f.isClosed() {
+				active = append(active, f)
+			}
+		}
+		subscribers = active
+	}
+}
+
+// StartSync puts the SharedClient in sync mode and returns the channel of the
+// events, see Client.StartSync. The first events are "add" events for the ports
+// already detected by the discovery.
+func (c *SharedClient) StartSync(size int) (<-chan *Event, error) {
+	b := c.broker
+	b.mutex.Lock()
+	if c.closed {
+		b.mutex.Unlock()
+		return nil, errors.New("shared discovery client already quit")
+	}
+	if f, ok := b.subscribers[c]; ok {
+		f.close()
+		delete(b.subscribers, c)
+	}
+	s, err := b.ensureSync()
+	if err != nil {
+		b.mutex.Unlock()
+		return nil, err
+	}
+	ch := make(chan *Event, size)
+	f := newEventForwarder(ch, b.disc.GetID(), nil)
+	b.subscribers[c] = f
+	b.mutex.Unlock()
+
+	select {
+	case s.subscribe <- f:
+	case <-s.done:
+		// The discovery terminated in the meantime
+		f.close()
+	}
+	return ch, nil
+}
+
+// Stop terminates the sync mode of the SharedClient, the event channel is
+// closed. The underlying discovery is not stopped.
+func (c *SharedClient) Stop() error {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if f, ok := b.subscribers[c]; ok {
+		f.close()
+		delete(b.subscribers, c)
+	}
+	return nil
+}
+
+// List returns the ports currently detected by the discovery. The ports are
+// collected through the sync mode of the underlying discovery, so right after
+// the first use of the Broker the list may be not complete yet.
+func (c *SharedClient) List() ([]*Port, error) {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if c.closed {
+		return nil, errors.New("shared discovery client already quit")
+	}
+	s, err := b.ensureSync()
+	if err != nil {
+		return nil, err
+	}
+	s.portsMutex.Lock()
+	res := []*Port{}
+	for _, port := range s.ports {
+		res = append(res, port.Clone())
+	}
+	s.portsMutex.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Address < res[j].Address })
+	return res, nil
+}
+
+// Describe returns the self-description of the discovery, see Client.Describe.
+func (c *SharedClient) Describe() (*Description, error) {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if c.closed {
+		return nil, errors.New("shared discovery client already quit")
+	}
+	if _, err := b.ensureSync(); err != nil {
+		return nil, err
+	}
+	return b.disc.Describe()
+}
+
+// Quit releases the SharedClient, that can not be used anymore. The underlying
+// discovery is terminated when all the SharedClients have quit.
+func (c *SharedClient) Quit() {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if f, ok := b.subscribers[c]; ok {
+		f.close()
+		delete(b.subscribers, c)
+	}
+	b.clients--
+	if b.clients == 0 {
+		b.disc.Quit()
+		b.sync = nil
+	}
+}
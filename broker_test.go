@@ -0,0 +1,92 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroker(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	disc := NewClient("dummy", "dummy-discovery/dummy-discovery")
+	broker := NewBroker(disc)
+	boardList := broker.NewClient()
+	uploader := broker.NewClient()
+	defer boardList.Quit()
+	defer uploader.Quit()
+
+	recv := func(events <-chan *Event) *Event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "event not received")
+			return nil
+		}
+	}
+
+	events1, err := boardList.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, "1", recv(events1).Port.Address)
+	require.Equal(t, "2", recv(events1).Port.Address)
+
+	// The second client receives the ports already detected
+	events2, err := uploader.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, "1", recv(events2).Port.Address)
+	require.Equal(t, "2", recv(events2).Port.Address)
+
+	ports, err := uploader.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 2)
+	desc, err := uploader.Describe()
+	require.NoError(t, err)
+	require.Equal(t, []string{"dummy"}, desc.Protocols)
+
+	// Both the clients receive the new events
+	ev := recv(events1)
+	require.Equal(t, EventTypeAdd, ev.Type)
+	require.Equal(t, "3", ev.Port.Address)
+	require.Equal(t, ev, recv(events2))
+
+	// Stopping a client doesn't affect the other
+	require.NoError(t, uploader.Stop())
+	require.Equal(t, EventTypeStop, recv(events2).Type)
+	_, ok := <-events2
+	require.False(t, ok)
+	ev = recv(events1)
+	require.Equal(t, EventTypeRemove, ev.Type)
+	require.Equal(t, "3", ev.Port.Address)
+
+	// The discovery terminates when all the clients have quit
+	uploader.Quit()
+	_, err = uploader.List()
+	require.Error(t, err)
+	require.True(t, disc.Alive())
+	boardList.Quit()
+	require.False(t, disc.Alive())
+	require.Equal(t, EventTypeStop, recv(events1).Type)
+}
@@ -0,0 +1,166 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrChaosConnectionDropped is the error reported when the chaos layer
+// drops the connection with the discovery.
+var ErrChaosConnectionDropped = errors.New("connection dropped by chaos layer")
+
+// ChaosConfig is the configuration of the chaos layer that can be
+// interposed between the Client and the discovery to test the resilience
+// of the code using the Client. The same Seed always produces the same
+// sequence of faults on each direction of the communication.
+type ChaosConfig struct {
+	// Seed initializes the random generator of the faults.
+	Seed int64
+	// MinLatency and MaxLatency bound the random delay added to each
+	// read and write.
+	MinLatency time.Duration
+	MaxLatency time.Duration
+	// MaxChunkSize, if greater than zero, splits the data read and written
+	// in chunks of random size up to MaxChunkSize bytes, so the message
+	// boundaries do not match the reads and the writes anymore.
+	MaxChunkSize int
+	// DropProbability is the probability, between 0 and 1, that the
+	// connection is dropped on each read or write.
+	DropProbability float64
+}
+
+// SetChaos enables the chaos layer on the communication with the
+// discovery, it takes effect the next time the discovery is run.
+// A nil config disables the chaos layer.
+//
+// Deprecated: use the WithChaos option of NewClientWithOptions.
+func (disc *Client) SetChaos(config *ChaosConfig) {
+	disc.chaos = config
+}
+
+// chaosConnection injects the faults in the communication with the
+// discovery, the connection dropped in a direction is dropped also in
+// the other one.
+type chaosConnection struct {
+	config  ChaosConfig
+	clock   Clock
+	mutex   sync.Mutex
+	dropped bool
+}
+
+func newChaosConnection(config *ChaosConfig, clock Clock) *chaosConnection {
+	return &chaosConnection{config: *config, clock: clock}
+}
+
+// reader wraps the stream of the messages coming from the discovery.
+func (c *chaosConnection) reader(in io.Reader) io.Reader {
+	return &chaosReader{conn: c, in: in, rand: rand.New(rand.NewSource(c.config.Seed))}
+}
+
+// writer wraps the stream of the commands sent to the discovery, the
+// underlying writer is closed when the connection is dropped.
+func (c *chaosConnection) writer(out io.Writer) io.Writer {
+	return &chaosWriter{conn: c, out: out, rand: rand.New(rand.NewSource(c.config.Seed + 1))}
+}
+
+func (c *chaosConnection) isDropped() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.dropped
+}
+
+// fault applies the latency and the drop faults, it returns an error if
+// the connection has been dropped.
+func (c *chaosConnection) fault(rnd *rand.Rand, closer io.Writer) error {
+	if delay := c.latency(rnd); delay > 0 {
+		<-c.clock.After(delay)
+	}
+	drop := c.config.DropProbability > 0 && rnd.Float64() < c.config.DropProbability
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if drop && !c.dropped {
+		c.dropped = true
+		if closer, ok := closer.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+	if c.dropped {
+		return ErrChaosConnectionDropped
+	}
+	return nil
+}
+
+func (c *chaosConnection) latency(rnd *rand.Rand) time.Duration {
+	delay := c.config.MinLatency
+	if spread := c.config.MaxLatency - c.config.MinLatency; spread > 0 {
+		delay += time.Duration(rnd.Int63n(int64(spread) + 1))
+	}
+	return delay
+}
+
+// chunk returns the number of bytes to transfer in the next chunk.
+func (c *chaosConnection) chunk(rnd *rand.Rand, size int) int {
+	if c.config.MaxChunkSize <= 0 || size <= 1 {
+		return size
+	}
+	return min(size, 1+rnd.Intn(c.config.MaxChunkSize))
+}
+
+type chaosReader struct {
+	conn *chaosConnection
+	in   io.Reader
+	rand *rand.Rand
+}
+
+func (r *chaosReader) Read(p []byte) (int, error) {
+	if err := r.conn.fault(r.rand, nil); err != nil {
+		return 0, err
+	}
+	n, err := r.in.Read(p[:r.conn.chunk(r.rand, len(p))])
+	if err != nil && r.conn.isDropped() {
+		// The stream has been interrupted by a drop on the other direction
+		return n, ErrChaosConnectionDropped
+	}
+	return n, err
+}
+
+type chaosWriter struct {
+	conn *chaosConnection
+	out  io.Writer
+	rand *rand.Rand
+}
+
+func (w *chaosWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if err := w.conn.fault(w.rand, w.out); err != nil {
+			return written, err
+		}
+		n, err := w.out.Write(p[written : written+w.conn.chunk(w.rand, len(p)-written)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,77 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type chunkRecorder struct {
+	chunks []string
+}
+
+func (r *chunkRecorder) Write(p []byte) (int, error) {
+	r.chunks = append(r.chunks, string(p))
+	return len(p), nil
+}
+
+func TestChaosSplitWrites(t *testing.T) {
+	write := func(seed int64) []string {
+		out := &chunkRecorder{}
+		conn := newChaosConnection(&ChaosConfig{Seed: seed, MaxChunkSize: 4}, systemClock{})
+		n, err := conn.writer(out).Write([]byte("START_SYNC\n"))
+		require.NoError(t, err)
+		require.Equal(t, 11, n)
+		return out.chunks
+	}
+	chunks := write(42)
+	require.Greater(t, len(chunks), 2)
+	for _, chunk := range chunks {
+		require.LessOrEqual(t, len(chunk), 4)
+	}
+	// The same seed produces the same faults
+	require.Equal(t, chunks, write(42))
+}
+
+func TestChaosClient(t *testing.T) {
+	cl := NewInProcessClient("1", "test-inprocess")
+	cl.SetChaos(&ChaosConfig{Seed: 1, MaxLatency: time.Millisecond, MaxChunkSize: 3})
+	require.NoError(t, cl.Run())
+	require.NoError(t, cl.Start())
+	ports, err := cl.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+	require.NoError(t, cl.Stop())
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, "1", (<-events).Port.Address)
+	cl.Quit()
+
+	// The connection is dropped
+	cl.SetChaos(&ChaosConfig{DropProbability: 1})
+	require.ErrorIs(t, cl.Run(), ErrChaosConnectionDropped)
+	require.False(t, cl.Alive())
+
+	// The chaos layer is disabled
+	cl.SetChaos(nil)
+	require.NoError(t, cl.Run())
+	cl.Quit()
+}
@@ -18,15 +18,20 @@
 package discovery
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/arduino/go-paths-helper"
 )
 
 // Client is a tool that detects communication ports to interact
@@ -34,16 +39,118 @@ import (
 type Client struct {
 	id                   string
 	processArgs          []string
-	process              *paths.Process
+	inProcessName        string
+	fallbackFactory      func() Discovery
+	process              *exec.Cmd
+	inProcess            *inProcessServer
+	processStartTime     time.Time
 	outgoingCommandsPipe io.Writer
 	incomingMessagesChan <-chan *discoveryMessage
 	userAgent            string
 	logger               ClientLogger
+	clock                Clock
+	protocolVersion      int
+	stderrMode           StderrMode
+	stderrFile           *rotatingFile
+	suppressDuplicates   bool
+	portSchemas          map[string]*PortSchema
+	configuration        []configurationSetting
+	portFilter           func(port *Port) bool
+	debounce             time.Duration
+	env                  []string
+	pollingInterval      time.Duration
+	pollingBackoff       BackoffStrategy
+	startTimeout         time.Duration
+	helloTimeout         time.Duration
+	adaptiveTimeouts     *AdaptiveTimeouts
+	diagnostics          *diagnosticSession
+	extraFiles           []*extraFile
+	chaos                *ChaosConfig
+	workspaceBase        string
+	protocolShim         bool
+	strictMode           bool
+	usePTY               bool
+	stdioEncryption      bool
+	maxPorts             int
+	compression          string
+	normalizeProtocols   bool
+	decodeOptions        DecodeOptions
+	listStreaming        bool
+	compactOutput        bool
+	handshakeStore       HandshakeStore
+	handshakeInfo        *HandshakeInfo
+	// capabilities are the optional commands advertised by the discovery in
+	// the DESCRIBE of the current run, nil if unknown; describeFailed is
+	// true if the discovery answered the DESCRIBE without a description.
+	capabilities       []string
+	describeFailed     bool
+	idempotentCommands bool
+	startParams        map[string]string
+	labelTemplate      *LabelTemplate
+	checksum           string
+	verifier           func(path string) error
+	processGroup       bool
+	redactor           *redactor
+	middlewares        []Middleware
+	vendorEventHandler func(ev *Event)
+	// tees mirror the events, see TeeEvents
+	tees []*eventTee
+
+	// eventsMutex serializes the delivery of the events to the eventForwarder
+	eventsMutex sync.Mutex
+	// commandMutex serializes the command round trips, so the response to a
+	// command is never received by another one
+	commandMutex sync.Mutex
+	// lateResponses are the event types of the responses to the commands
+	// timed out, still to be discarded, guarded by commandMutex
+	lateResponses []string
+	// The following fields, the cache of the ports of the sync session, are
+	// guarded by cacheMutex. It's never held while sending the events, so the
+	// cache can be read while the consumer is blocking the delivery.
+	cacheMutex     sync.Mutex
+	cacheForwarder *eventForwarder
+	cachedPorts    map[string]*Port
+	cacheSeq       uint64
+	// eventSeq is the sequence number of the last event generated
+	eventSeq atomic.Uint64
+	// consumerPanics counts the panics of the consumer code recovered
+	consumerPanics atomic.Uint64
+
+	// The following fields are guarded by listMutex
+	listMutex     sync.Mutex
+	listFreshness time.Duration
+	listCall      *listCall
+	lastList      *listCall
+	listSession   uint64
+
+	// The following fields are guarded by latenciesMutex
+	latenciesMutex sync.Mutex
+	latencies      map[string]*commandLatencies
 
 	// All the following fields are guarded by statusMutex
 	statusMutex           sync.Mutex
 	incomingMessagesError error
-	eventChan             chan<- *Event
+	eventForwarder        *eventForwarder
+	lastEventForwarder    *eventForwarder
+	lastHeartbeat         time.Time
+	decodeLoopDone        chan struct{}
+	quitRequested         bool
+	state                 State
+	syncPorts             map[string]*Port
+	filteredPorts         map[string]bool
+	pendingRemoves        map[string]*pendingRemove
+	lastAdds              map[string]*Port
+	poller                *syncPoller
+	lastPoller            *syncPoller
+	workspace             *workspace
+	ptyMaster             *os.File
+	shimProtocols         map[string]bool
+	shimPropertyKeys      map[string]bool
+	suppressedDuplicates  uint64
+	limitPorts            map[string]bool
+	portLimitExceeded     bool
+	rejectedPorts         uint64
+	warnings              []*Warning
 }
 
 // ClientLogger is the interface that must be implemented by a logger
@@ -59,12 +166,18 @@ func (l *nullClientLogger) Debugf(format string, args ...interface{}) {}
 func (l *nullClientLogger) Errorf(format string, args ...interface{}) {}
 
 type discoveryMessage struct {
-	EventType       string  `json:"eventType"`
-	Message         string  `json:"message"`
-	Error           bool    `json:"error"`
-	ProtocolVersion int     `json:"protocolVersion"` // Used in HELLO command
-	Ports           []*Port `json:"ports"`           // Used in LIST command
-	Port            *Port   `json:"port"`            // Used in add and remove events
+	EventType       string          `json:"eventType"`
+	Message         string          `json:"message"`
+	Note            string          `json:"note"` // Used in the acknowledgements of the repeated commands
+	Code            string          `json:"code"` // Used in warning messages
+	Error           bool            `json:"error"`
+	ProtocolVersion int             `json:"protocolVersion"` // Used in HELLO command
+	Ports           []*Port         `json:"ports"`           // Used in LIST command
+	Port            *Port           `json:"port"`            // Used in add and remove events
+	Description     *Description    `json:"description"`     // Used in DESCRIBE command
+	Payload         json.RawMessage `json:"payload"`         // Used in add, remove and warning events
+	// raw is the JSON the message has been decoded from, see Response.
+	raw json.RawMessage
 }
 
 func (msg discoveryMessage) String() string {
@@ -89,28 +202,147 @@ type Event struct {
 	Type        string
 	Port        *Port
 	DiscoveryID string
+	// Message is the text of the EventTypeWarning events, or the message of
+	// the vendor events (see WithVendorEventHandler).
+	Message string
+	// Code is the code of the EventTypeWarning events sent by the discovery,
+	// see WarningCodeDeprecated.
+	Code string
+	// Seq is the sequence number of the event, it increases by one for each
+	// event generated by the Client, across all the sync sessions: a gap
+	// means that some events have been dropped. The events generated by a
+	// Broker for a single SharedClient have sequence number 0.
+	Seq uint64
+	// ManagerSeq is the sequence number of the event among all the events
+	// received by a Manager, or 0 if the event has not been received by a
+	// Manager, see Manager.Snapshot.
+	ManagerSeq uint64
+	// Payload is the structured data attached to the event by the discovery,
+	// encoded as JSON, see PayloadAs.
+	Payload json.RawMessage
+	// Err is the error that terminated the discovery process, for the final
+	// EventTypeStop event of a sync session interrupted by the termination of
+	// the discovery, nil otherwise.
+	Err error
 }
 
 // NewClient create a new pluggable discovery client
 func NewClient(id string, args ...string) *Client {
 	return &Client{
-		id:          id,
-		processArgs: args,
-		userAgent:   "pluggable-discovery-protocol-handler",
-		logger:      &nullClientLogger{},
+		id:           id,
+		processArgs:  args,
+		userAgent:    "pluggable-discovery-protocol-handler",
+		logger:       &nullClientLogger{},
+		clock:        systemClock{},
+		helloTimeout: 10 * time.Second,
 	}
 }
 
+// ErrStartTimeout is returned by Run if the discovery process can not be
+// started within the start timeout, see SetStartTimeout.
+var ErrStartTimeout = errors.New("timeout starting the discovery process")
+
+// ErrHelloTimeout is returned by Run if the discovery process has been started
+// but it doesn't answer the HELLO command within the hello timeout, see
+// SetHelloTimeout.
+var ErrHelloTimeout = errors.New("timeout waiting for the HELLO response")
+
+// errMessageTimeout is returned by waitMessage if no message is received in time.
+var errMessageTimeout = errors.New("timeout waiting for message")
+
+// SetStartTimeout sets the maximum time allowed to the operating system to
+// start the discovery process in Run (on some platforms the start may hang, for
+// example while an antivirus scans the executable). A timeout of 0 (the default)
+// waits indefinitely. If the process starts after the timeout it's killed.
+//
+// Deprecated: use the WithTimeouts option of NewClientWithOptions.
+func (disc *Client) SetStartTimeout(timeout time.Duration) {
+	disc.startTimeout = timeout
+}
+
+// SetHelloTimeout sets the maximum time allowed to the discovery, once started,
+// to answer the HELLO command in Run, 10 seconds by default.
+//
+// Deprecated: use the WithTimeouts option of NewClientWithOptions.
+func (disc *Client) SetHelloTimeout(timeout time.Duration) {
+	disc.helloTimeout = timeout
+}
+
 // SetUserAgent sets the user agent to be used in the discovery
+//
+// Deprecated: use the WithUserAgent option of NewClientWithOptions.
 func (disc *Client) SetUserAgent(userAgent string) {
 	disc.userAgent = userAgent
 }
 
 // SetLogger sets the logger to be used in the discovery
+//
+// Deprecated: use the WithLogger option of NewClientWithOptions.
 func (disc *Client) SetLogger(logger ClientLogger) {
 	disc.logger = logger
 }
 
+// SetEnv sets additional environment variables, in the form "KEY=VALUE", for
+// the discovery process. The process inherits the environment of the current
+// process. It must be called before Run.
+//
+// Deprecated: use the WithEnv option of NewClientWithOptions.
+func (disc *Client) SetEnv(env []string) {
+	disc.env = env
+}
+
+// extraFile is a file inherited by the discovery process.
+type extraFile struct {
+	name string
+	file *os.File
+}
+
+// AddExtraFile passes the given open file (a device, a socket, ...) to the
+// discovery process as an inherited file descriptor. The file is announced to
+// the discovery with the given name in the HELLO command, the discovery must
+// implement the FileReceiver interface to use it. The name may contain only
+// letters, digits, '_', '.' and '-'. The caller keeps the ownership of the file
+// and may close it after Run. It must be called before Run, it's not supported
+// on Windows.
+func (disc *Client) AddExtraFile(name string, file *os.File) error {
+	if !helloFileNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid extra file name: '%s'", name)
+	}
+	for _, f := range disc.extraFiles {
+		if f.name == name {
+			return fmt.Errorf("extra file %s already added", name)
+		}
+	}
+	disc.extraFiles = append(disc.extraFiles, &extraFile{name: name, file: file})
+	return nil
+}
+
+// SetClock sets the clock used for timeouts and timestamps, by default
+// the system clock is used. It must be called before Run.
+//
+// Deprecated: use the WithClock option of NewClientWithOptions.
+func (disc *Client) SetClock(clock Clock) {
+	disc.clock = clock
+}
+
+// SetSuppressDuplicateAdds enables the suppression of the repeated "add" events
+// for a port identical to the one already added, with the same address, protocol
+// and properties. The suppressed events are counted in SuppressedDuplicates.
+// It must be called before StartSync.
+//
+// Deprecated: use the WithSuppressDuplicateAdds option of NewClientWithOptions.
+func (disc *Client) SetSuppressDuplicateAdds(suppress bool) {
+	disc.suppressDuplicates = suppress
+}
+
+// SuppressedDuplicates returns the number of duplicate "add" events suppressed,
+// see SetSuppressDuplicateAdds.
+func (disc *Client) SuppressedDuplicates() uint64 {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.suppressedDuplicates
+}
+
 // GetID returns the identifier for this discovery
 func (disc *Client) GetID() string {
 	return disc.id
@@ -120,15 +352,26 @@ func (disc *Client) String() string {
 	return disc.id
 }
 
-func (disc *Client) jsonDecodeLoop(in io.Reader, outChan chan<- *discoveryMessage) {
-	decoder := json.NewDecoder(in)
+func (disc *Client) jsonDecodeLoop(in io.Reader, diagnostics *diagnosticSession, outChan chan<- *discoveryMessage, done chan<- struct{}) {
+	if disc.decodeOptions.AllowBOM {
+		in = skipBOM(in)
+	}
+	// The compressed stream is checked once decompressed
+	decoder := json.NewDecoder(disc.messagesReader(diagnostics.receiving(in), disc.sessionCompression() == ""))
 	closeAndReportError := func(err error) {
 		disc.statusMutex.Lock()
-		disc.incomingMessagesError = err
-		disc.stopSync()
-		disc.killProcess()
+		// The discovery may have been already quit and run again, in that
+		// case the new session must not be affected.
+		if disc.decodeLoopDone == done {
+			disc.incomingMessagesError = err
+			disc.state = StateUninitialized
+			disc.eventForwarder.setTerminationError(err)
+			disc.stopSync()
+			disc.killProcess()
+		}
 		disc.statusMutex.Unlock()
 		close(outChan)
+		close(done)
 		if err != nil {
 			disc.logger.Errorf("Stopped decode loop: %v", err)
 		} else {
@@ -136,47 +379,193 @@ func (disc *Client) jsonDecodeLoop(in io.Reader, outChan chan<- *discoveryMessag
 		}
 	}
 
+	decode := decodeMessage
+	if disc.strictMode {
+		decode = decodeStrictMessage
+	} else if disc.listStreaming {
+		decode = func(decoder *json.Decoder) (*discoveryMessage, error) {
+			return decodeStreamingMessage(decoder, disc.streamPort)
+		}
+	}
+	decompressed := false
 	for {
-		var msg discoveryMessage
-		if err := decoder.Decode(&msg); err != nil {
+		msg, err := decode(decoder)
+		if err != nil {
 			closeAndReportError(err)
 			return
 		}
+		diagnostics.recordReceived(decoder)
 		disc.logger.Debugf("Received message %s", msg)
-		if msg.EventType == "add" {
-			if msg.Port == nil {
-				closeAndReportError(errors.New("invalid 'add' message: missing port"))
+		disc.normalizePortProtocol(msg.Port)
+		for _, port := range msg.Ports {
+			disc.normalizePortProtocol(port)
+		}
+		if msg.EventType == EventTypeHello && !msg.Error && !decompressed && disc.sessionCompression() != "" {
+			// The messages following the response to the HELLO are compressed
+			if decoder, err = disc.decompressedDecoder(decoder, in, diagnostics); err != nil {
+				closeAndReportError(fmt.Errorf("decompressing messages: %w", err))
 				return
 			}
-			disc.statusMutex.Lock()
-			if disc.eventChan != nil {
-				disc.eventChan <- &Event{"add", msg.Port, disc.GetID()}
+			decompressed = true
+		}
+		if msg.EventType == EventTypeAdd || msg.EventType == EventTypeRemove {
+			if msg.EventType == EventTypeAdd {
+				disc.applyLabelTemplate(msg.Port)
 			}
-			disc.statusMutex.Unlock()
-		} else if msg.EventType == "remove" {
-			if msg.Port == nil {
-				closeAndReportError(errors.New("invalid 'remove' message: missing port"))
-				return
+			if len(msg.Payload) > 0 {
+				msg.Port.payload = msg.Payload
 			}
+			disc.deliverEvent(msg.EventType, msg.Port)
+		} else if msg.EventType == EventTypeWarning {
+			disc.deliverWarning(msg)
+		} else if IsVendorEventType(msg.EventType) {
+			disc.deliverVendorEvent(msg)
+		} else if msg.EventType == EventTypeHeartbeat {
 			disc.statusMutex.Lock()
-			if disc.eventChan != nil {
-				disc.eventChan <- &Event{"remove", msg.Port, disc.GetID()}
-			}
+			disc.lastHeartbeat = disc.clock.Now()
 			disc.statusMutex.Unlock()
 		} else {
-			outChan <- &msg
+			outChan <- msg
+		}
+	}
+}
+
+// deliverEvent sends a port event to the consumer of the current sync
+// session, after applying the filters configured in the Client.
+func (disc *Client) deliverEvent(eventType string, port *Port) {
+	disc.eventsMutex.Lock()
+	defer disc.eventsMutex.Unlock()
+	disc.statusMutex.Lock()
+	forwarder := disc.eventForwarder
+	deliver := disc.filterEvent(eventType, port) &&
+		disc.debounceEvent(forwarder, eventType, port) &&
+		!disc.isDuplicateEvent(eventType, port)
+	var anomaly *Event
+	if deliver {
+		deliver, anomaly = disc.checkPortLimit(eventType, port)
+	}
+	disc.statusMutex.Unlock()
+	// The events are sent without holding the statusMutex, in this way a
+	// slow consumer can not block the other Client methods.
+	if anomaly != nil {
+		anomaly.Seq = disc.eventSeq.Add(1)
+		disc.sendEvent(forwarder, anomaly)
+	}
+	if !deliver {
+		return
+	}
+	if eventType == EventTypeAdd {
+		for _, violation := range disc.checkPortSchema(port) {
+			disc.sendEvent(forwarder, &Event{Type: EventTypeWarning, Port: port, DiscoveryID: disc.GetID(), Message: violation.Error(), Seq: disc.eventSeq.Add(1)})
+		}
+	}
+	disc.sendEvent(forwarder, &Event{Type: eventType, Port: port, DiscoveryID: disc.GetID(), Seq: disc.eventSeq.Add(1), Payload: encodePayload(port)})
+	telemetry.count(&telemetry.clientEvents)
+	if eventType == EventTypeAdd {
+		disc.shimRecordPorts(port)
+	}
+}
+
+// isDuplicateEvent returns true if the event is an "add" of a port identical to
+// the one already added in the current sync session, and the suppression of the
+// duplicates is enabled. The caller must hold the statusMutex.
+func (disc *Client) isDuplicateEvent(eventType string, port *Port) bool {
+	if !disc.suppressDuplicates || disc.eventForwarder == nil {
+		return false
+	}
+	if disc.syncPorts == nil {
+		disc.syncPorts = map[string]*Port{}
+	}
+	id := port.Address + "|" + port.Protocol
+	if eventType == EventTypeRemove {
+		delete(disc.syncPorts, id)
+		return false
+	}
+	if old, ok := disc.syncPorts[id]; ok && old.isIdentical(port) {
+		disc.suppressedDuplicates++
+		return true
+	}
+	disc.syncPorts[id] = port
+	return false
+}
+
+// decodeMessage reads the next message from the decoder and checks that
+// it's well-formed, the decoder trusts arbitrary data coming from the
+// discovery process so it must never panic.
+func decodeMessage(decoder *json.Decoder) (*discoveryMessage, error) {
+	var raw json.RawMessage
+	var msg discoveryMessage
+	err := decoder.Decode(&raw)
+	if err == nil {
+		err = json.Unmarshal(raw, &msg)
+	}
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			telemetry.count(&telemetry.decodeErrors)
 		}
+		return nil, err
 	}
+	msg.raw = raw
+	switch msg.EventType {
+	case EventTypeAdd, EventTypeRemove:
+		if msg.Port == nil {
+			telemetry.count(&telemetry.decodeErrors)
+			return nil, fmt.Errorf("invalid '%s' message: missing port", msg.EventType)
+		}
+	}
+	return &msg, nil
 }
 
 // Alive returns true if the discovery is running and false otherwise.
 func (disc *Client) Alive() bool {
 	disc.statusMutex.Lock()
 	defer disc.statusMutex.Unlock()
-	return disc.process != nil
+	return disc.process != nil || disc.inProcess != nil
+}
+
+// processTerminated returns a channel that is closed when the current
+// discovery process terminates, or nil if the discovery has never been run.
+func (disc *Client) processTerminated() <-chan struct{} {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.decodeLoopDone
+}
+
+// terminationError returns the error that caused the termination of
+// the last discovery process.
+func (disc *Client) terminationError() error {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.incomingMessagesError
+}
+
+// isQuitRequested returns true if the current discovery process has been
+// terminated (or is being terminated) through Quit.
+func (disc *Client) isQuitRequested() bool {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.quitRequested
+}
+
+// LastHeartbeat returns the time of the last "heartbeat" message received from
+// the discovery during the current sync session. A zero time is returned if no
+// heartbeat has been received yet, if the discovery is not in sync mode or if the
+// discovery doesn't support heartbeats (that are available since protocol version 2).
+func (disc *Client) LastHeartbeat() time.Time {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.lastHeartbeat
 }
 
 func (disc *Client) waitMessage(timeout time.Duration) (*discoveryMessage, error) {
+	msg, err := disc.receiveMessage(timeout)
+	disc.observeResponse(msg, err)
+	return msg, err
+}
+
+func (disc *Client) receiveMessage(timeout time.Duration) (*discoveryMessage, error) {
 	select {
 	case msg := <-disc.incomingMessagesChan:
 		if msg == nil {
@@ -186,14 +575,36 @@ func (disc *Client) waitMessage(timeout time.Duration) (*discoveryMessage, error
 			return nil, err
 		}
 		return msg, nil
-	case <-time.After(timeout):
-		return nil, fmt.Errorf("timeout waiting for message from %s", disc)
+	case <-disc.clock.After(timeout):
+		return nil, fmt.Errorf("%w from %s", errMessageTimeout, disc)
 	}
 }
 
+// roundTrip sends the command line and waits for the response to the command,
+// holding the commandMutex for the whole round trip.
+func (disc *Client) roundTrip(command, line string) (*discoveryMessage, error) {
+	disc.commandMutex.Lock()
+	defer disc.commandMutex.Unlock()
+	if err := disc.sendCommand(line); err != nil {
+		return nil, err
+	}
+	msg, err := disc.waitResponse(command)
+	if err != nil {
+		return nil, fmt.Errorf("calling %s: %w", command, err)
+	}
+	return msg, nil
+}
+
 func (disc *Client) sendCommand(command string) error {
-	disc.logger.Debugf("Sending command %s", strings.TrimSpace(command))
-	data := []byte(command)
+	redacted := disc.redactor.command(command)
+	disc.logger.Debugf("Sending command %s", strings.TrimSpace(redacted))
+	disc.diagnostics.recordSent(redacted)
+	telemetry.count(&telemetry.clientCommands)
+	return disc.writeCommand(command)
+}
+
+// writeData writes the data to the discovery.
+func (disc *Client) writeData(data []byte) error {
 	for {
 		n, err := disc.outgoingCommandsPipe.Write(data)
 		if err != nil {
@@ -208,53 +619,337 @@ func (disc *Client) sendCommand(command string) error {
 
 func (disc *Client) runProcess() error {
 	disc.logger.Debugf("Starting discovery process")
-	proc, err := paths.NewProcess(nil, disc.processArgs...)
-	if err != nil {
-		return err
+	if disc.inProcessName != "" {
+		factory, err := registeredFactory(disc.inProcessName)
+		if err != nil {
+			return err
+		}
+		return disc.runInProcess(factory)
+	}
+	if len(disc.processArgs) == 0 {
+		return errors.New("no executable specified")
+	}
+	if disc.fallbackFactory != nil {
+		if _, err := exec.LookPath(disc.processArgs[0]); err != nil {
+			disc.logger.Errorf("Discovery %s not available (%v), running the fallback discovery", disc, err)
+			return disc.runInProcess(disc.fallbackFactory)
+		}
+	}
+	if disc.stdioEncryption && disc.usePTY {
+		return errors.New("stdio encryption is not supported with the pseudo-terminal transport")
+	}
+	if disc.compression != "" && disc.usePTY {
+		return errors.New("compression is not supported with the pseudo-terminal transport")
+	}
+	executable := disc.processArgs[0]
+	if disc.workspaceBase != "" {
+		// The process runs in the workspace, a relative path of the
+		// executable must be resolved before changing the directory
+		abs, err := absExecutable(executable)
+		if err != nil {
+			return err
+		}
+		executable = abs
 	}
-	stdout, err := proc.StdoutPipe()
+	// The executable verified is the one started
+	executable, err := disc.verifyExecutable(executable)
 	if err != nil {
 		return err
 	}
+	proc := exec.Command(executable, disc.processArgs[1:]...)
+	tellCommandNotToSpawnShell(proc)
+	if disc.processGroup {
+		setProcessGroup(proc)
+	}
+	if len(disc.env) > 0 {
+		proc.Env = append(os.Environ(), disc.env...)
+	}
+	for _, f := range disc.extraFiles {
+		proc.ExtraFiles = append(proc.ExtraFiles, f.file)
+	}
+	if stderr := disc.diagnostics.stderrWriter(disc.stderrWriter()); stderr != nil {
+		proc.Stderr = stderr
+	}
+	var messages io.Reader
+	var ptyMaster, ptySlave *os.File
+	if disc.usePTY {
+		master, slave, err := openPTY()
+		if err != nil {
+			return fmt.Errorf("allocating pseudo-terminal: %w", err)
+		}
+		ptyMaster, ptySlave = master, slave
+		defer ptySlave.Close() // the slave side is owned by the process
+		proc.Stdout = ptySlave
+		messages = &ptyReader{master: ptyMaster}
+	} else {
+		stdout, err := proc.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		messages = stdout
+	}
+	closePTY := func() {
+		if ptyMaster != nil {
+			ptyMaster.Close()
+		}
+	}
 	stdin, err := proc.StdinPipe()
 	if err != nil {
+		closePTY()
 		return err
 	}
-	disc.outgoingCommandsPipe = stdin
+	if disc.workspaceBase != "" {
+		ws, err := newWorkspace(disc.workspaceBase, disc.id)
+		if err != nil {
+			closePTY()
+			return fmt.Errorf("creating discovery workspace: %w", err)
+		}
+		proc.Dir = ws.workDir
+		proc.Env = append(append(os.Environ(), disc.env...), ws.env()...)
+		disc.statusMutex.Lock()
+		disc.removeWorkspace()
+		disc.workspace = ws
+		disc.statusMutex.Unlock()
+	}
+	var commands io.Writer = stdin
+	if disc.stdioEncryption {
+		key, err := newStdioKey()
+		if err != nil {
+			closePTY()
+			return err
+		}
+		if proc.Env == nil {
+			proc.Env = os.Environ()
+		}
+		proc.Env = append(proc.Env, StdioKeyEnv+"="+hex.EncodeToString(key))
+		if commands, messages, err = wrapStdioEncryption(key, stdin, messages); err != nil {
+			closePTY()
+			return err
+		}
+	}
+	disc.outgoingCommandsPipe, messages = disc.wrapChaos(commands, messages)
 
 	messageChan := make(chan *discoveryMessage)
 	disc.incomingMessagesChan = messageChan
-	go disc.jsonDecodeLoop(stdout, messageChan)
+	done := make(chan struct{})
+	disc.statusMutex.Lock()
+	disc.decodeLoopDone = done
+	disc.quitRequested = false
+	disc.state = StateUninitialized
+	disc.statusMutex.Unlock()
+	disc.invalidateList()
+	go disc.jsonDecodeLoop(messages, disc.diagnostics, messageChan, done)
 
-	if err := proc.Start(); err != nil {
+	if err := disc.startProcess(proc); err != nil {
+		disc.statusMutex.Lock()
+		disc.removeWorkspace()
+		disc.statusMutex.Unlock()
+		closePTY()
 		return err
 	}
 
+	if disc.processGroup {
+		if err := attachProcessGroup(proc); err != nil {
+			disc.logger.Errorf("Tracking the processes spawned by discovery %s: %v", disc, err)
+		}
+	}
+
 	disc.statusMutex.Lock()
 	defer disc.statusMutex.Unlock()
 	disc.process = proc
+	disc.ptyMaster = ptyMaster
+	disc.processStartTime = disc.clock.Now()
 	disc.logger.Debugf("Discovery process started")
 	return nil
 }
 
+// startProcess starts the process within the start timeout, if set.
+func (disc *Client) startProcess(proc *exec.Cmd) error {
+	if disc.startTimeout <= 0 {
+		return proc.Start()
+	}
+	started := make(chan error, 1)
+	go func() { started <- proc.Start() }()
+	select {
+	case err := <-started:
+		return err
+	case <-disc.clock.After(disc.startTimeout):
+	}
+	go func() {
+		// The process started too late is not used
+		if err := <-started; err == nil {
+			_ = proc.Process.Kill()
+			_ = proc.Wait()
+		}
+	}()
+	return fmt.Errorf("%w: %s not started within %s", ErrStartTimeout, disc, disc.startTimeout)
+}
+
+// runInProcess starts the Discovery created by the factory in-process, in
+// place of the discovery process.
+func (disc *Client) runInProcess(factory func() Discovery) error {
+	server, messages := disc.startInProcessServer(factory)
+	disc.outgoingCommandsPipe, messages = disc.wrapChaos(server.commands, messages)
+
+	messageChan := make(chan *discoveryMessage)
+	disc.incomingMessagesChan = messageChan
+	done := make(chan struct{})
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	disc.decodeLoopDone = done
+	disc.quitRequested = false
+	disc.state = StateUninitialized
+	disc.inProcess = server
+	disc.invalidateList()
+	disc.processStartTime = disc.clock.Now()
+	go disc.jsonDecodeLoop(messages, disc.diagnostics, messageChan, done)
+	disc.logger.Debugf("Discovery started in-process")
+	return nil
+}
+
+// wrapChaos interposes the chaos layer, if enabled, on the communication
+// with the discovery.
+func (disc *Client) wrapChaos(commands io.Writer, messages io.Reader) (io.Writer, io.Reader) {
+	if disc.chaos == nil {
+		return commands, messages
+	}
+	conn := newChaosConnection(disc.chaos, disc.clock)
+	return conn.writer(commands), conn.reader(messages)
+}
+
 func (disc *Client) killProcess() {
 	disc.logger.Debugf("Killing discovery process")
 	if process := disc.process; process != nil {
 		disc.process = nil
-		if err := process.Kill(); err != nil {
+		kill := process.Process.Kill
+		if disc.processGroup {
+			// Kill also the helpers spawned by the discovery, even if the
+			// discovery itself already terminated
+			kill = func() error { return killProcessGroup(process) }
+		}
+		if err := kill(); err != nil {
 			disc.logger.Errorf("Killing discovery process: %v", err)
 		}
 		if err := process.Wait(); err != nil {
 			disc.logger.Errorf("Waiting discovery process termination: %v", err)
 		}
 	}
+	if server := disc.inProcess; server != nil {
+		disc.inProcess = nil
+		server.kill()
+	}
+	if disc.ptyMaster != nil {
+		disc.ptyMaster.Close()
+		disc.ptyMaster = nil
+	}
+	disc.removeWorkspace()
+	if disc.stderrFile != nil {
+		if err := disc.stderrFile.Close(); err != nil {
+			disc.logger.Errorf("Closing discovery stderr file: %v", err)
+		}
+	}
 	disc.logger.Debugf("Discovery process killed")
 }
 
+// kill terminates the discovery process without sending the QUIT command.
+func (disc *Client) kill() {
+	disc.statusMutex.Lock()
+	disc.quitRequested = true
+	disc.state = StateUninitialized
+	disc.stopSync()
+	disc.killProcess()
+	disc.statusMutex.Unlock()
+}
+
+// abort terminates the discovery process without sending the QUIT command,
+// like a crash: unlike kill the discovery is restarted by the Manager, if
+// supervised.
+func (disc *Client) abort() {
+	disc.statusMutex.Lock()
+	disc.killProcess()
+	disc.statusMutex.Unlock()
+}
+
+// State returns the state of the protocol state machine of the discovery, as
+// tracked by the client.
+func (disc *Client) State() State {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.state
+}
+
+// checkCommand returns an error wrapping ErrCommandNotAllowed if the command
+// is not allowed in the current state. The violation is also logged, since
+// it's a misuse of the Client by the caller.
+func (disc *Client) checkCommand(command string) error {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if _, err := NextState(disc.state, command); err != nil {
+		disc.logger.Errorf("Discovery %s: %v", disc, err)
+		return fmt.Errorf("calling %s: %w", command, err)
+	}
+	return nil
+}
+
+// alreadyIn returns true if the idempotent commands are enabled and the
+// running discovery is already in one of the given states, see
+// WithIdempotentCommands.
+func (disc *Client) alreadyIn(states ...State) bool {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	alive := disc.process != nil || disc.inProcess != nil
+	return disc.idempotentCommands && alive && slices.Contains(states, disc.state)
+}
+
+// transition moves the state machine after the command has been executed
+// successfully by the discovery.
+func (disc *Client) transition(command string) {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if next, err := NextState(disc.state, command); err == nil {
+		disc.state = next
+	}
+}
+
+// ProcessInfo contains information about a running discovery process.
+type ProcessInfo struct {
+	PID        int
+	StartTime  time.Time
+	Executable string
+}
+
+// ProcessInfo returns the PID, the start time and the executable path of the
+// running discovery process, or nil if the discovery is not running or runs
+// in-process (see NewInProcessClient).
+func (disc *Client) ProcessInfo() *ProcessInfo {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.process == nil {
+		return nil
+	}
+	executable := disc.process.Path
+	if abs, err := filepath.Abs(executable); err == nil {
+		executable = abs
+	}
+	return &ProcessInfo{
+		PID:        disc.process.Process.Pid,
+		StartTime:  disc.processStartTime,
+		Executable: executable,
+	}
+}
+
 // Run starts the discovery executable process and sends the HELLO command to the discovery to agree on the
 // pluggable discovery protocol. This must be the first command to run in the communication with the discovery.
 // If the process is started but the HELLO command fails the process is killed.
 func (disc *Client) Run() (err error) {
+	if disc.alreadyIn(StateIdle, StateStarted, StateSyncing) {
+		return nil
+	}
+	helloTimeout := disc.loadHandshake()
+	disc.statusMutex.Lock()
+	disc.capabilities = nil
+	disc.describeFailed = false
+	disc.statusMutex.Unlock()
 	if err = disc.runProcess(); err != nil {
 		return err
 	}
@@ -271,19 +966,45 @@ func (disc *Client) Run() (err error) {
 		disc.statusMutex.Unlock()
 	}()
 
-	if err = disc.sendCommand("HELLO 1 \"arduino-cli " + disc.userAgent + "\"\n"); err != nil {
+	// The extra files are inherited as file descriptors 3, 4, ... in the order they've been added
+	files := map[string]int{}
+	for i, f := range disc.extraFiles {
+		files[f.name] = 3 + i
+	}
+	format := ""
+	if disc.compactOutput {
+		format = OutputFormatCompact
+	}
+	disc.commandMutex.Lock()
+	if err = disc.sendCommand(BuildHelloWithCompression(maxProtocolVersion, "arduino-cli "+disc.userAgent, files, format, disc.sessionCompression())); err != nil {
+		disc.commandMutex.Unlock()
 		return err
 	}
-	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
+	disc.lateResponses = nil
+	msg, err := disc.waitMessage(helloTimeout)
+	disc.commandMutex.Unlock()
+	if errors.Is(err, errMessageTimeout) {
+		return fmt.Errorf("calling HELLO: %w: no response from %s within %s", ErrHelloTimeout, disc, helloTimeout)
+	} else if err != nil {
 		return fmt.Errorf("calling HELLO: %w", err)
-	} else if msg.EventType != "hello" {
-		return fmt.Errorf("event out of sync, expected 'hello', received '%s'", msg.EventType)
-	} else if msg.Error {
-		return fmt.Errorf("command failed: %s", msg.Message)
-	} else if strings.ToUpper(msg.Message) != "OK" {
-		return fmt.Errorf("communication out of sync, expected 'OK', received '%s'", msg.Message)
-	} else if msg.ProtocolVersion > 1 {
-		return fmt.Errorf("protocol version not supported: requested 1, got %d", msg.ProtocolVersion)
+	} else if protocolVersion, err := helloResponse(msg); err != nil {
+		return err
+	} else {
+		disc.protocolVersion = protocolVersion
+	}
+	disc.transition(CommandHello)
+	disc.statusMutex.Lock()
+	startupTime := disc.clock.Now().Sub(disc.processStartTime)
+	disc.statusMutex.Unlock()
+	disc.saveHandshake(startupTime, nil)
+	if disc.ShimActive() {
+		disc.logger.Debugf("Discovery %s supports protocol version 1, the configuration is not sent", disc)
+		return nil
+	}
+	for _, setting := range disc.configuration {
+		if err = disc.sendConfigure(setting.key, setting.value); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -291,18 +1012,18 @@ func (disc *Client) Run() (err error) {
 // Start initializes and start the discovery internal subroutines. This command must be
 // called before List.
 func (disc *Client) Start() error {
-	if err := disc.sendCommand("START\n"); err != nil {
+	if disc.alreadyIn(StateStarted) {
+		return nil
+	}
+	if err := disc.checkCommand(CommandStart); err != nil {
 		return err
 	}
-	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
-		return fmt.Errorf("calling START: %w", err)
-	} else if msg.EventType != "start" {
-		return fmt.Errorf("event out of sync, expected 'start', received '%s'", msg.EventType)
-	} else if msg.Error {
-		return fmt.Errorf("command failed: %s", msg.Message)
-	} else if strings.ToUpper(msg.Message) != "OK" {
-		return fmt.Errorf("communication out of sync, expected 'OK', received '%s'", msg.Message)
+	if msg, err := disc.roundTrip(CommandStart, disc.buildStart(CommandStart)); err != nil {
+		return err
+	} else if err := checkOkResponse(msg, EventTypeStart); err != nil {
+		return err
 	}
+	disc.transition(CommandStart)
 	return nil
 }
 
@@ -310,59 +1031,225 @@ func (disc *Client) Start() error {
 // used resources. This command should be called if the client wants to pause the
 // discovery for a while.
 func (disc *Client) Stop() error {
-	if err := disc.sendCommand("STOP\n"); err != nil {
-		return err
+	if disc.alreadyIn(StateIdle) {
+		return nil
 	}
-	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
-		return fmt.Errorf("calling STOP: %w", err)
-	} else if msg.EventType != "stop" {
-		return fmt.Errorf("event out of sync, expected 'stop', received '%s'", msg.EventType)
-	} else if msg.Error {
-		return fmt.Errorf("command failed: %s", msg.Message)
-	} else if strings.ToUpper(msg.Message) != "OK" {
-		return fmt.Errorf("communication out of sync, expected 'OK', received '%s'", msg.Message)
+	if err := disc.checkCommand(CommandStop); err != nil {
+		return err
 	}
+	disc.invalidateList()
+	// The event channel is closed before sending the command, otherwise a
+	// consumer not reading the channel may prevent the reception of the response.
 	disc.statusMutex.Lock()
-	defer disc.statusMutex.Unlock()
 	disc.stopSync()
+	disc.statusMutex.Unlock()
+	disc.waitPolling()
+
+	if msg, err := disc.roundTrip(CommandStop, BuildCommand(CommandStop)); err != nil {
+		return err
+	} else if err := checkOkResponse(msg, EventTypeStop); err != nil {
+		return err
+	}
+	disc.transition(CommandStop)
 	return nil
 }
 
+// buildStart returns the START or START_SYNC command with the parameters set
+// by WithStartParams, if supported by the discovery.
+func (disc *Client) buildStart(command string) string {
+	if len(disc.startParams) == 0 {
+		return BuildCommand(command)
+	}
+	if disc.protocolVersion < 2 {
+		disc.logger.Debugf("Discovery %s supports protocol version 1, the %s parameters are not sent", disc, command)
+		return BuildCommand(command)
+	}
+	return BuildStart(command, disc.startParams)
+}
+
 func (disc *Client) stopSync() {
-	if disc.eventChan != nil {
-		disc.eventChan <- &Event{"stop", nil, disc.GetID()}
-		close(disc.eventChan)
-		disc.eventChan = nil
+	disc.lastHeartbeat = time.Time{}
+	disc.resetEventFilters()
+	disc.stopPolling()
+	if disc.eventForwarder != nil {
+		disc.eventForwarder.close()
+		disc.eventForwarder = nil
+	}
+}
+
+// Drain blocks until the event channel returned by the last call to StartSync
+// has been closed, this happens after a Stop, a Quit, a new StartSync or if the
+// discovery terminates unexpectedly. Drain returns immediately if StartSync has
+// never been called, otherwise it returns nil when the channel has been closed
+// or the context error if the context is done before.
+func (disc *Client) Drain(ctx context.Context) error {
+	disc.statusMutex.Lock()
+	forwarder := disc.lastEventForwarder
+	disc.statusMutex.Unlock()
+	if forwarder == nil {
+		return nil
 	}
+	select {
+	case <-forwarder.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until the last run of the discovery has terminated, after a Quit,
+// a kill or an unexpected termination, and all its resources have been released:
+// the decode loop has exited, the process has been reaped, the event channel has
+// been closed and the polling has stopped. Wait returns immediately if the
+// discovery has never been run, otherwise it returns nil when the discovery has
+// terminated or the context error if the context is done before.
+func (disc *Client) Wait(ctx context.Context) error {
+	disc.statusMutex.Lock()
+	pending := []<-chan struct{}{}
+	if disc.decodeLoopDone != nil {
+		pending = append(pending, disc.decodeLoopDone)
+	}
+	if disc.lastEventForwarder != nil {
+		pending = append(pending, disc.lastEventForwarder.done)
+	}
+	if disc.lastPoller != nil {
+		pending = append(pending, disc.lastPoller.done)
+	}
+	disc.statusMutex.Unlock()
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
 // Quit terminates the discovery. No more commands can be accepted by the discovery.
 func (disc *Client) Quit() {
-	_ = disc.sendCommand("QUIT\n")
-	if _, err := disc.waitMessage(time.Second * 5); err != nil {
+	disc.statusMutex.Lock()
+	disc.quitRequested = true
+	disc.stopSync()
+	disc.statusMutex.Unlock()
+	disc.waitPolling()
+
+	if _, err := disc.roundTrip(CommandQuit, BuildCommand(CommandQuit)); err != nil {
 		disc.logger.Errorf("Quitting discovery: %s", err)
 	}
 	disc.statusMutex.Lock()
-	disc.stopSync()
+	disc.state = StateQuit
 	disc.killProcess()
 	disc.statusMutex.Unlock()
 }
 
-// List executes an enumeration of the ports and returns a list of the available
-// ports at the moment of the call.
-func (disc *Client) List() ([]*Port, error) {
-	if err := disc.sendCommand("LIST\n"); err != nil {
+// configurationSetting is a setting sent to the discovery with the CONFIGURE command.
+type configurationSetting struct {
+	key   string
+	value string
+}
+
+// Configure sends a runtime setting to the discovery with the CONFIGURE command,
+// available since protocol version 2 if the discovery reports the "CONFIGURE"
+// capability (see Describe): the first setting sent in each run sends a DESCRIBE
+// to get the capabilities, and the setting is refused if the discovery doesn't
+// report the capability. The setting is persistent: it's sent again each time
+// the discovery is restarted with Run. If the discovery is not running the setting
+// is only stored and it's sent at the next Run.
+func (disc *Client) Configure(key, value string) error {
+	if key == "" || strings.ContainsAny(key, " \t\r\n") {
+		return fmt.Errorf("invalid configuration key: '%s'", key)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid value for configuration key %s: newlines are not allowed", key)
+	}
+	if disc.Alive() && !disc.ShimActive() {
+		if err := disc.sendConfigure(key, value); err != nil {
+			return err
+		}
+	}
+	for i, setting := range disc.configuration {
+		if setting.key == key {
+			disc.configuration[i].value = value
+			return nil
+		}
+	}
+	disc.configuration = append(disc.configuration, configurationSetting{key: key, value: value})
+	return nil
+}
+
+func (disc *Client) sendConfigure(key, value string) error {
+	if disc.protocolVersion < 2 {
+		return fmt.Errorf("CONFIGURE not supported by discovery %s: protocol version %d", disc, disc.protocolVersion)
+	}
+	if ok, err := disc.advertises(CommandConfigure); err != nil {
+		return fmt.Errorf("calling CONFIGURE: %w", err)
+	} else if !ok {
+		return fmt.Errorf("CONFIGURE not supported by discovery %s: not in the capabilities", disc)
+	}
+	if err := disc.checkCommand(CommandConfigure); err != nil {
+		return err
+	}
+	if msg, err := disc.roundTrip(CommandConfigure, BuildConfigure(key, value)); err != nil {
+		return err
+	} else if err := checkOkResponse(msg, EventTypeConfigure); err != nil {
+		return err
+	}
+	return nil
+}
+
+// list sends the LIST command and waits for the response.
+func (disc *Client) list() ([]*Port, error) {
+	if err := disc.checkCommand(CommandList); err != nil {
+		return nil, err
+	}
+	if msg, err := disc.roundTrip(CommandList, BuildCommand(CommandList)); err != nil {
+		return nil, err
+	} else if ports, err := listResponse(msg); err != nil {
+		return nil, err
+	} else {
+		ports = disc.truncateToPortLimit(ports)
+		for _, port := range ports {
+			disc.applyLabelTemplate(port)
+			for _, violation := range disc.checkPortSchema(port) {
+				disc.logger.Errorf("Discovery %s: %v", disc, violation)
+			}
+		}
+		disc.shimRecordPorts(ports...)
+		return ports, nil
+	}
+}
+
+// Describe returns the self-description of the discovery: the protocols of
+// the ports it may detect, the property keys it may emit and its polling
+// characteristics. The DESCRIBE command is available since protocol version 2.
+func (disc *Client) Describe() (*Description, error) {
+	if disc.ShimActive() {
+		return disc.shimDescribe(), nil
+	}
+	if disc.protocolVersion < 2 {
+		return nil, fmt.Errorf("DESCRIBE not supported by discovery %s: protocol version %d", disc, disc.protocolVersion)
+	}
+	if err := disc.checkCommand(CommandDescribe); err != nil {
+		return nil, err
+	}
+	msg, err := disc.roundTrip(CommandDescribe, BuildCommand(CommandDescribe))
+	if err != nil {
 		return nil, err
 	}
-	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
-		return nil, fmt.Errorf("calling LIST: %w", err)
-	} else if msg.EventType != "list" {
-		return nil, fmt.Errorf("event out of sync, expected 'list', received '%s'", msg.EventType)
-	} else if msg.Error {
-		return nil, fmt.Errorf("command failed: %s", msg.Message)
+	desc, err := describeResponse(msg)
+	disc.statusMutex.Lock()
+	if err != nil {
+		disc.describeFailed = true
 	} else {
-		return msg.Ports, nil
+		disc.capabilities = append([]string{}, desc.Capabilities...)
+	}
+	disc.statusMutex.Unlock()
+	if err != nil {
+		return nil, err
 	}
+	disc.saveHandshake(0, append([]string{}, desc.Capabilities...))
+	return desc, nil
 }
 
 // StartSync puts the discovery in "events" mode: the discovery will send "add"
@@ -373,25 +1260,144 @@ func (disc *Client) List() ([]*Port, error) {
 // The event channel must be consumed as quickly as possible since it may block the
 // discovery if it becomes full. The channel size is configurable.
 func (disc *Client) StartSync(size int) (<-chan *Event, error) {
-	if err := disc.sendCommand("START_SYNC\n"); err != nil {
+	// In case there is already an existing event channel in use we close it before creating a new one.
+	// The new channel is ready before sending the command, so the events sent by the discovery
+	// immediately after the response are not lost.
+	if err := disc.checkCommand(CommandStartSync); err != nil {
 		return nil, err
 	}
-
-	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
-		return nil, fmt.Errorf("calling START_SYNC: %w", err)
-	} else if msg.EventType != "start_sync" {
-		return nil, fmt.Errorf("evemt out of sync, expected 'start_sync', received '%s'", msg.EventType)
-	} else if msg.Error {
-		return nil, fmt.Errorf("command failed: %s", msg.Message)
-	} else if strings.ToUpper(msg.Message) != "OK" {
-		return nil, fmt.Errorf("communication out of sync, expected 'OK', received '%s'", msg.Message)
+	c := make(chan *Event, size)
+	forwarder := newEventForwarder(c, disc.GetID(), &disc.eventSeq)
+	if len(disc.tees) > 0 {
+		forwarder.onStop = disc.teeStop
 	}
-
-	// In case there is already an existing event channel in use we close it before creating a new one.
 	disc.statusMutex.Lock()
-	defer disc.statusMutex.Unlock()
 	disc.stopSync()
-	c := make(chan *Event, size)
-	disc.eventChan = c
+	disc.eventForwarder = forwarder
+	disc.lastEventForwarder = forwarder
+	disc.statusMutex.Unlock()
+	disc.waitPolling()
+
+	closeForwarder := func() {
+		disc.statusMutex.Lock()
+		if disc.eventForwarder == forwarder {
+			disc.stopSync()
+		}
+		disc.statusMutex.Unlock()
+	}
+
+	if msg, err := disc.roundTrip(CommandStartSync, disc.buildStart(CommandStartSync)); err != nil {
+		closeForwarder()
+		return nil, err
+	} else if err := checkOkResponse(msg, EventTypeStartSync); err != nil {
+		if msg.EventType == EventTypeStartSync && disc.pollingInterval > 0 {
+			disc.logger.Errorf("Discovery %s: %v, falling back to polling", disc, err)
+			if err := disc.startPolling(forwarder); err == nil {
+				return c, nil
+			}
+		}
+		closeForwarder()
+		return nil, err
+	}
+	disc.transition(CommandStartSync)
 	return c, nil
 }
+
+// eventForwarder delivers the events of a sync session to the consumer channel.
+// The forwarder goroutine is the only owner of the channel, so the channel can
+// be closed at any moment, even if the consumer is not reading it, without
+// blocking the caller: the events still pending when the forwarder is closed,
+// including the final "stop" event, are delivered only if there is room in the
+// channel, otherwise they are dropped.
+type eventForwarder struct {
+	in        chan *Event
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	// err is the error reported in the final "stop" event, it must be set
+	// before closing the forwarder.
+	err error
+	// onStop, if not nil, is called with the final "stop" event, even if
+	// it's dropped. It must be set before closing the forwarder.
+	onStop func(ev *Event)
+}
+
+// newEventForwarder starts a forwarder delivering the events to out. The final
+// "stop" event is numbered with the given sequence, if not nil.
+func newEventForwarder(out chan<- *Event, discoveryID string, seq *atomic.Uint64) *eventForwarder {
+	f := &eventForwarder{
+		in:      make(chan *Event),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(f.done)
+		defer close(out)
+		for {
+			select {
+			case ev := <-f.in:
+				select {
+				case out <- ev:
+					continue
+				case <-f.closing:
+					trySend(out, ev)
+				}
+			case <-f.closing:
+			}
+			stop := &Event{Type: EventTypeStop, DiscoveryID: discoveryID, Err: f.err}
+			if seq != nil {
+				stop.Seq = seq.Add(1)
+			}
+			if f.onStop != nil {
+				f.onStop(stop)
+			}
+			trySend(out, stop)
+			return
+		}
+	}()
+	return f
+}
+
+// send delivers the event to the consumer, blocking if the consumer channel
+// is full. The event is dropped if the forwarder is closed, or nil.
+func (f *eventForwarder) send(ev *Event) {
+	if f == nil {
+		return
+	}
+	select {
+	case f.in <- ev:
+	case <-f.closing:
+	}
+}
+
+// close stops the forwarder without waiting for the consumer channel to be closed.
+// It's safe to call close more than once.
+func (f *eventForwarder) close() {
+	f.closeOnce.Do(func() { close(f.closing) })
+}
+
+// setTerminationError sets the error that terminated the discovery, to be
+// reported in the final "stop" event. It must be called before close.
+func (f *eventForwarder) setTerminationError(err error) {
+	if f == nil || f.isClosed() {
+		return
+	}
+	f.err = err
+}
+
+// isClosed returns true if the forwarder has been closed.
+func (f *eventForwarder) isClosed() bool {
+	select {
+	case <-f.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func trySend(out chan<- *Event, ev *Event) {
+	select {
+	case out <- ev:
+	default:
+	}
+}
@@ -0,0 +1,115 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ListFromCache returns the ports detected in the current sync session, as
+// reported by the events delivered so far, without sending a LIST command to
+// the discovery. The returned sequence number is a consistency token: the
+// ports include exactly the events with a sequence number (see Event.Seq) up to
+// seq, so the consumer can apply the following events, discarding the ones
+// with a lower or equal sequence number, without races or duplicates. The
+// ports are sorted by address and protocol. An error is returned if the
+// discovery is not in sync mode, see StartSync.
+func (disc *Client) ListFromCache() (ports []*Port, seq uint64, err error) {
+	disc.statusMutex.Lock()
+	forwarder := disc.eventForwarder
+	disc.statusMutex.Unlock()
+	if forwarder == nil {
+		return nil, 0, fmt.Errorf("discovery %s not in sync mode", disc)
+	}
+
+	ports = []*Port{}
+	disc.cacheMutex.Lock()
+	if disc.cacheForwarder == forwarder {
+		for _, port := range disc.cachedPorts {
+			ports = append(ports, port.Clone())
+		}
+	}
+	seq = disc.cacheSeq
+	disc.cacheMutex.Unlock()
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Address != ports[j].Address {
+			return ports[i].Address < ports[j].Address
+		}
+		return ports[i].Protocol < ports[j].Protocol
+	})
+	return ports, seq, nil
+}
+
+// cacheEvent updates the ports of the sync session of the forwarder with the
+// event about to be delivered to the consumer. The caller must hold the
+// eventsMutex, so the events are cached in the order of their sequence
+// numbers.
+func (disc *Client) cacheEvent(forwarder *eventForwarder, ev *Event) {
+	if forwarder == nil {
+		// The event is not delivered to a sync session
+		return
+	}
+	disc.cacheMutex.Lock()
+	defer disc.cacheMutex.Unlock()
+	disc.cacheSeq = ev.Seq
+	if disc.cacheForwarder != forwarder {
+		// A new sync session begins
+		disc.cacheForwarder = forwarder
+		disc.cachedPorts = map[string]*Port{}
+	}
+	if ev.Port == nil {
+		return
+	}
+	id := ev.Port.Address + "|" + ev.Port.Protocol
+	switch ev.Type {
+	case EventTypeAdd:
+		// The consumer owns the port of the event
+		disc.cachedPorts[id] = ev.Port.Clone()
+	case EventTypeRemove:
+		delete(disc.cachedPorts, id)
+	}
+}
+
+// SyncWithSnapshot puts the discovery in sync mode, like StartSync, and returns
+// atomically the ports currently detected and a channel receiving the following
+// events, with no gap or overlap between the two: the events already applied to
+// the snapshot are not sent to the channel (see ListFromCache). This implements
+// the list+watch pattern for the consumers that need the whole state of the
+// ports. The channel is closed as the one returned by StartSync.
+func (disc *Client) SyncWithSnapshot(size int) (snapshot []*Port, ch <-chan *Event, err error) {
+	events, err := disc.StartSync(size)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot, seq, err := disc.ListFromCache()
+	if err != nil {
+		// The sync session has already ended, the channel is closed
+		return nil, nil, err
+	}
+	out := make(chan *Event, size)
+	go func() {
+		defer close(out)
+		for ev := range events {
+			if ev.Seq > seq {
+				out <- ev
+			}
+		}
+	}()
+	return snapshot, out, nil
+}
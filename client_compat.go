@@ -0,0 +1,83 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import "sort"
+
+// SetProtocolShim enables the emulation of the features of protocol version 2
+// when the discovery supports only protocol version 1, so the consumers of the
+// Client can be written against the version 2 API only. With a version 1
+// discovery:
+//   - Describe returns a Description inferred from the ports reported so far,
+//     by LIST or in sync mode: the protocols and the property keys seen;
+//   - Configure stores the settings without sending them (Run doesn't fail
+//     because of the stored settings);
+//   - CancelList has no effect, the LIST in progress completes normally.
+//
+// The shim is disabled by default. It must be called before Run.
+//
+// Deprecated: use the WithProtocolShim option of NewClientWithOptions.
+func (disc *Client) SetProtocolShim(enabled bool) {
+	disc.protocolShim = enabled
+}
+
+// ShimActive returns true if the discovery negotiated protocol version 1 and
+// the version 2 features are emulated, see SetProtocolShim.
+func (disc *Client) ShimActive() bool {
+	return disc.protocolShim && disc.protocolVersion == 1
+}
+
+// shimRecordPorts records the protocols and the property keys of the
+// ports reported by the discovery, to emulate the DESCRIBE command.
+func (disc *Client) shimRecordPorts(ports ...*Port) {
+	if !disc.ShimActive() {
+		return
+	}
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.shimProtocols == nil {
+		disc.shimProtocols = map[string]bool{}
+		disc.shimPropertyKeys = map[string]bool{}
+	}
+	for _, port := range ports {
+		disc.shimProtocols[port.Protocol] = true
+		if port.Properties != nil {
+			for _, key := range port.Properties.Keys() {
+				disc.shimPropertyKeys[key] = true
+			}
+		}
+	}
+}
+
+// shimDescribe returns the Description inferred from the ports reported.
+func (disc *Client) shimDescribe() *Description {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	sortedKeys := func(set map[string]bool) []string {
+		res := []string{}
+		for key := range set {
+			res = append(res, key)
+		}
+		sort.Strings(res)
+		return res
+	}
+	return &Description{
+		Protocols:    sortedKeys(disc.shimProtocols),
+		PropertyKeys: sortedKeys(disc.shimPropertyKeys),
+	}
+}
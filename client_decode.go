@@ -0,0 +1,182 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidJSONLines is the error wrapped by the errors reported when the
+// output of the discovery violates the JSON Lines format required with
+// DecodeOptions.JSONLines.
+var ErrInvalidJSONLines = errors.New("invalid JSON Lines")
+
+// utf8BOM is the UTF-8 byte order mark.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// DecodeOptions controls the strictness of the parser of the messages sent by
+// the discovery, see WithDecodeOptions. The zero value follows the
+// specification: the messages are a stream of JSON objects separated by any
+// JSON whitespace, so a message may span several lines (like the indented
+// output of the Server), several messages may share a line and the lines may
+// be terminated by CRLF. The stricter settings are meant to catch the
+// discoveries drifting from the output format they declare, the laxer ones
+// to support the known quirky discoveries.
+type DecodeOptions struct {
+	// JSONLines requires each message to be on its own line, in the JSON
+	// Lines format: the messages spanning several lines and the data
+	// trailing a message on its line are rejected, the lines may be
+	// terminated only by LF. It's meant for the discoveries sending the
+	// compact output, see WithCompactOutput.
+	JSONLines bool `json:"jsonLines,omitempty"`
+	// MultipleObjectsPerLine accepts, in JSONLines mode, several messages on
+	// the same line.
+	MultipleObjectsPerLine bool `json:"multipleObjectsPerLine,omitempty"`
+	// AllowCRLF accepts, in JSONLines mode, the lines terminated by CRLF,
+	// like the output of the discoveries written for Windows, or of any
+	// discovery run with TransportPTY.
+	AllowCRLF bool `json:"allowCRLF,omitempty"`
+	// AllowBOM skips the UTF-8 byte order mark that some discoveries send at
+	// the beginning of their output, it's an invalid JSON value otherwise.
+	AllowBOM bool `json:"allowBOM,omitempty"`
+}
+
+// WithDecodeOptions sets the strictness of the parser of the messages sent by
+// the discovery, see DecodeOptions.
+func WithDecodeOptions(opts DecodeOptions) ClientOption {
+	return func(disc *Client) {
+		disc.decodeOptions = opts
+	}
+}
+
+// skipBOM returns the stream without the leading byte order mark, if any.
+func skipBOM(in io.Reader) io.Reader {
+	r := bufio.NewReader(in)
+	if prefix, _ := r.Peek(len(utf8BOM)); bytes.Equal(prefix, utf8BOM) {
+		_, _ = r.Discard(len(utf8BOM))
+	}
+	return r
+}
+
+// jsonLinesReader passes through the data of the stream, checking that it
+// follows the JSON Lines format: when a violation is found the data before it
+// is returned with the error, the following reads return the error too.
+type jsonLinesReader struct {
+	in   io.Reader
+	opts DecodeOptions
+	err  error
+
+	line     int
+	depth    int
+	inString bool
+	escape   bool
+	// afterValue is true if a message ended on the current line
+	afterValue bool
+	pendingCR  bool
+}
+
+func newJSONLinesReader(in io.Reader, opts DecodeOptions) *jsonLinesReader {
+	return &jsonLinesReader{in: in, opts: opts, line: 1}
+}
+
+func (r *jsonLinesReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.in.Read(p)
+	for i, c := range p[:n] {
+		if violation := r.scan(c); violation != "" {
+			r.err = fmt.Errorf("%w: %s at line %d", ErrInvalidJSONLines, violation, r.line)
+			return i, r.err
+		}
+	}
+	return n, err
+}
+
+// scan checks the next byte of the stream, returning the violation found.
+func (r *jsonLinesReader) scan(c byte) string {
+	if r.pendingCR && c != '\n' {
+		return "carriage return not followed by a line feed"
+	}
+	if r.inString {
+		switch {
+		case r.escape:
+			r.escape = false
+		case c == '\\':
+			r.escape = true
+		case c == '"':
+			r.inString = false
+			r.endValue()
+		}
+		return ""
+	}
+	switch c {
+	case '\r':
+		r.pendingCR = true
+	case '\n':
+		if r.pendingCR && !r.opts.AllowCRLF {
+			return "line terminated by CRLF"
+		}
+		if r.depth > 0 {
+			return "message spanning several lines"
+		}
+		r.pendingCR = false
+		r.afterValue = false
+		r.line++
+	case ' ', '\t':
+	case '{', '[', '"':
+		if r.depth == 0 && r.afterValue && !r.opts.MultipleObjectsPerLine {
+			return "several messages on the same line"
+		}
+		if c == '"' {
+			r.inString = true
+		} else {
+			r.depth++
+		}
+	case '}', ']':
+		r.depth--
+		r.endValue()
+	default:
+		if r.depth == 0 && r.afterValue {
+			return "data trailing the message"
+		}
+	}
+	return ""
+}
+
+// endValue records the end of a value, a message if at the top level.
+func (r *jsonLinesReader) endValue() {
+	if r.depth == 0 {
+		r.afterValue = true
+	}
+}
+
+// messagesReader returns the stream of the messages of the discovery, read
+// from in, following the DecodeOptions of the Client. The JSON Lines format
+// is checked only if lines is true, that is when the stream is not going to
+// be compressed.
+func (disc *Client) messagesReader(in io.Reader, lines bool) io.Reader {
+	if lines && disc.decodeOptions.JSONLines {
+		return newJSONLinesReader(in, disc.decodeOptions)
+	}
+	return in
+}
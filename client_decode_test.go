@@ -0,0 +1,88 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// decodeStream decodes a synthetic stream of messages with the given options,
+// returning the types of the messages decoded and the error stopping the
+// decode loop before the end of the stream.
+func decodeStream(t *testing.T, name string, opts DecodeOptions) ([]string, error) {
+	in, err := os.Open(filepath.Join("testdata", "streams", name))
+	require.NoError(t, err)
+	defer in.Close()
+
+	disc := NewClientWithOptions("decode", "decode", WithDecodeOptions(opts))
+	outChan := make(chan *discoveryMessage, 10)
+	done := make(chan struct{})
+	disc.decodeLoopDone = done
+	disc.jsonDecodeLoop(in, nil, outChan, done)
+	types := []string{}
+	for msg := range outChan {
+		types = append(types, msg.EventType)
+	}
+	if disc.incomingMessagesError == io.EOF {
+		return types, nil
+	}
+	return types, disc.incomingMessagesError
+}
+
+func TestDecodeOptions(t *testing.T) {
+	all := []string{EventTypeHello, EventTypeList}
+	spec := DecodeOptions{}
+	jsonLines := DecodeOptions{JSONLines: true}
+	tests := []struct {
+		stream  string
+		opts    DecodeOptions
+		decoded []string
+		err     string
+	}{
+		{"jsonlines.txt", spec, all, ""},
+		{"jsonlines.txt", jsonLines, all, ""},
+		// The indented output of the Server is valid only as a JSON stream
+		{"indented.txt", spec, all, ""},
+		{"indented.txt", jsonLines, []string{}, "invalid JSON Lines: message spanning several lines at line 1"},
+		{"bom.txt", spec, []string{}, `invalid character '\ufeff' looking for beginning of value`},
+		{"bom.txt", DecodeOptions{AllowBOM: true}, all, ""},
+		{"bom.txt", DecodeOptions{JSONLines: true, AllowBOM: true}, all, ""},
+		{"crlf.txt", spec, all, ""},
+		{"crlf.txt", jsonLines, []string{EventTypeHello}, "invalid JSON Lines: line terminated by CRLF at line 1"},
+		{"crlf.txt", DecodeOptions{JSONLines: true, AllowCRLF: true}, all, ""},
+		{"multiple-per-line.txt", spec, all, ""},
+		{"multiple-per-line.txt", jsonLines, []string{EventTypeHello}, "invalid JSON Lines: several messages on the same line at line 1"},
+		{"multiple-per-line.txt", DecodeOptions{JSONLines: true, MultipleObjectsPerLine: true}, all, ""},
+		{"trailing-data.txt", spec, all, "invalid character 'O' looking for beginning of value"},
+		{"trailing-data.txt", jsonLines, all, "invalid JSON Lines: data trailing the message at line 2"},
+	}
+	for _, test := range tests {
+		decoded, err := decodeStream(t, test.stream, test.opts)
+		require.Equal(t, test.decoded, decoded, "%s %+v", test.stream, test.opts)
+		if test.err == "" {
+			require.NoError(t, err, "%s %+v", test.stream, test.opts)
+		} else {
+			require.EqualError(t, err, test.err, "%s %+v", test.stream, test.opts)
+		}
+	}
+}
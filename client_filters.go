@@ -0,0 +1,153 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import "time"
+
+// SetPortFilter sets a filter for the ports received in sync mode: the "add"
+// events of the ports for which the filter returns false are dropped, together
+// with the following "remove" events of the same ports. A nil filter (the
+// default) forwards all the ports. It must be called before StartSync.
+//
+// Deprecated: use the WithPortFilter option of NewClientWithOptions.
+func (disc *Client) SetPortFilter(filter func(port *Port) bool) {
+	disc.portFilter = filter
+}
+
+// SetDebounce delays the delivery of the "remove" events by the given duration:
+// if the same port is added again in the meantime the "remove" event is discarded,
+// together with the new "add" event if the port is not changed. This absorbs the
+// ports that quickly disappear and reappear, for example during the reset of a
+// board. A duration of 0 (the default) disables the debounce. It must be called
+// before StartSync.
+//
+// Deprecated: use the WithDebounce option of NewClientWithOptions.
+func (disc *Client) SetDebounce(debounce time.Duration) {
+	disc.debounce = debounce
+}
+
+// pendingRemove is a "remove" event delayed by the debounce.
+type pendingRemove struct {
+	port    *Port
+	lastAdd *Port
+	cancel  chan struct{}
+}
+
+// filterEvent returns true if the event passes the port filter.
+// The caller must hold the statusMutex.
+func (disc *Client) filterEvent(eventType string, port *Port) bool {
+	if disc.portFilter == nil {
+		return true
+	}
+	if disc.filteredPorts == nil {
+		disc.filteredPorts = map[string]bool{}
+	}
+	id := port.Address + "|" + port.Protocol
+	if eventType == EventTypeRemove {
+		if disc.filteredPorts[id] {
+			delete(disc.filteredPorts, id)
+			return false
+		}
+		return true
+	}
+	if !disc.portFilter(port) {
+		disc.filteredPorts[id] = true
+		return false
+	}
+	delete(disc.filteredPorts, id)
+	return true
+}
+
+// debounceEvent returns true if the event must be delivered immediately, the
+// "remove" events are delivered later by a timer if not cancelled by an "add".
+// The caller must hold the statusMutex.
+func (disc *Client) debounceEvent(forwarder *eventForwarder, eventType string, port *Port) bool {
+	if disc.debounce <= 0 || forwarder == nil {
+		return true
+	}
+	if disc.pendingRemoves == nil {
+		disc.pendingRemoves = map[string]*pendingRemove{}
+		disc.lastAdds = map[string]*Port{}
+	}
+	id := port.Address + "|" + port.Protocol
+	if eventType == EventTypeRemove {
+		if _, ok := disc.pendingRemoves[id]; ok {
+			return false
+		}
+		pending := &pendingRemove{
+			port:    port,
+			lastAdd: disc.lastAdds[id],
+			cancel:  make(chan struct{}),
+		}
+		disc.pendingRemoves[id] = pending
+		go disc.deliverPendingRemove(forwarder, id, pending, disc.clock.After(disc.debounce))
+		return false
+	}
+
+	disc.lastAdds[id] = port
+	if pending, ok := disc.pendingRemoves[id]; ok {
+		close(pending.cancel)
+		delete(disc.pendingRemoves, id)
+		if pending.lastAdd != nil && pending.lastAdd.isIdentical(port) {
+			return false
+		}
+	}
+	return true
+}
+
+// deliverPendingRemove sends the pending "remove" event when the debounce
+// expires, unless it's cancelled before.
+func (disc *Client) deliverPendingRemove(forwarder *eventForwarder, id string, pending *pendingRemove, expired <-chan time.Time) {
+	select {
+	case <-expired:
+	case <-pending.cancel:
+		return
+	}
+
+	// The eventsMutex keeps the order of the events with the decode loop.
+	disc.eventsMutex.Lock()
+	defer disc.eventsMutex.Unlock()
+	disc.statusMutex.Lock()
+	if disc.pendingRemoves[id] != pending || disc.eventForwarder != forwarder {
+		disc.statusMutex.Unlock()
+		return
+	}
+	delete(disc.pendingRemoves, id)
+	delete(disc.lastAdds, id)
+	disc.isDuplicateEvent(EventTypeRemove, pending.port)
+	accepted, _ := disc.checkPortLimit(EventTypeRemove, pending.port)
+	disc.statusMutex.Unlock()
+	if !accepted {
+		return
+	}
+	disc.sendEvent(forwarder, &Event{Type: EventTypeRemove, Port: pending.port, DiscoveryID: disc.GetID(), Seq: disc.eventSeq.Add(1)})
+}
+
+// resetEventFilters cancels the pending events and clears the status of the
+// filters at the end of a sync session. The caller must hold the statusMutex.
+func (disc *Client) resetEventFilters() {
+	for _, pending := range disc.pendingRemoves {
+		close(pending.cancel)
+	}
+	disc.pendingRemoves = nil
+	disc.lastAdds = nil
+	disc.filteredPorts = nil
+	disc.syncPorts = nil
+	disc.limitPorts = nil
+	disc.portLimitExceeded = false
+}
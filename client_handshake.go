@@ -0,0 +1,285 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// handshakeTimeoutFactor is the multiple of the average startup time of a
+// discovery allowed to answer the HELLO, see WithHandshakeStore.
+const handshakeTimeoutFactor = 4
+
+// handshakeMaxSamples is the maximum number of startups averaged in the
+// StartupTime of a HandshakeInfo: the older startups weigh less and less.
+const handshakeMaxSamples = 10
+
+// HandshakeInfo is the last known good configuration of a discovery, the
+// result of its last successful handshake, see HandshakeStore.
+type HandshakeInfo struct {
+	// ProtocolVersion is the protocol version agreed in the HELLO.
+	ProtocolVersion int `json:"protocolVersion"`
+	// Capabilities are the optional commands supported by the discovery, as
+	// reported by the last DESCRIBE, nil if unknown.
+	Capabilities []string `json:"capabilities"`
+	// StartupTime is the average time taken by the discovery, from the start
+	// of the process, to answer the HELLO.
+	StartupTime time.Duration `json:"startupTime"`
+	// Samples is the number of startups averaged in StartupTime.
+	Samples int `json:"samples"`
+	// UpdatedAt is the time of the last update.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// HandshakeStore persists the HandshakeInfo of the discoveries, indexed by
+// discovery ID, see WithHandshakeStore. The implementations must be safe for
+// concurrent use.
+type HandshakeStore interface {
+	// LoadHandshake returns the HandshakeInfo of the discovery, or nil if the
+	// discovery is unknown.
+	LoadHandshake(id string) (*HandshakeInfo, error)
+	// SaveHandshake stores the HandshakeInfo of the discovery.
+	SaveHandshake(id string, info *HandshakeInfo) error
+}
+
+// WithHandshakeStore keeps in the given store the last known good
+// configuration of the discovery (see HandshakeInfo), and uses it at the next
+// Run to tune the client to the discovery: the HELLO timeout is extended if the
+// discovery is known to start slowly (for example on slow machines), and
+// Ping doesn't send the PING command to the discoveries known not to support
+// it. The errors of the store are logged and otherwise ignored.
+func WithHandshakeStore(store HandshakeStore) ClientOption {
+	return func(disc *Client) {
+		disc.handshakeStore = store
+	}
+}
+
+// LastHandshake returns the last known good configuration of the discovery,
+// loaded from the HandshakeStore at Run and updated after the handshake, or
+// nil if unknown. See WithHandshakeStore.
+func (disc *Client) LastHandshake() *HandshakeInfo {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.handshakeInfo == nil {
+		return nil
+	}
+	info := *disc.handshakeInfo
+	info.Capabilities = slices.Clone(info.Capabilities)
+	return &info
+}
+
+// loadHandshake loads the HandshakeInfo of the discovery from the store and
+// returns the HELLO timeout tuned on its startup time.
+func (disc *Client) loadHandshake() time.Duration {
+	if disc.handshakeStore == nil {
+		return disc.helloTimeout
+	}
+	info, err := disc.handshakeStore.LoadHandshake(disc.GetID())
+	if err != nil {
+		disc.logger.Errorf("Loading the last handshake of discovery %s: %v", disc, err)
+		return disc.helloTimeout
+	}
+	disc.statusMutex.Lock()
+	disc.handshakeInfo = info
+	disc.statusMutex.Unlock()
+	if info == nil {
+		return disc.helloTimeout
+	}
+	if timeout := handshakeTimeoutFactor * info.StartupTime; timeout > disc.helloTimeout {
+		disc.logger.Debugf("Discovery %s is known to start in %s, HELLO timeout extended to %s", disc, info.StartupTime, timeout)
+		return timeout
+	}
+	return disc.helloTimeout
+}
+
+// saveHandshake updates the HandshakeInfo of the discovery, after a successful
+// HELLO or DESCRIBE, and saves it to the store. If startupTime is 0 the
+// average startup time is left unchanged.
+func (disc *Client) saveHandshake(startupTime time.Duration, capabilities []string) {
+	if disc.handshakeStore == nil {
+		return
+	}
+	disc.statusMutex.Lock()
+	info := &HandshakeInfo{}
+	if disc.handshakeInfo != nil {
+		*info = *disc.handshakeInfo
+	}
+	info.ProtocolVersion = disc.protocolVersion
+	if capabilities != nil {
+		info.Capabilities = slices.Clone(capabilities)
+	}
+	if startupTime > 0 {
+		samples := min(info.Samples, handshakeMaxSamples-1)
+		info.StartupTime = (info.StartupTime*time.Duration(samples) + startupTime) / time.Duration(samples+1)
+		info.Samples = samples + 1
+	}
+	info.UpdatedAt = disc.clock.Now()
+	disc.handshakeInfo = info
+	disc.statusMutex.Unlock()
+
+	if err := disc.handshakeStore.SaveHandshake(disc.GetID(), info); err != nil {
+		disc.logger.Errorf("Saving the last handshake of discovery %s: %v", disc, err)
+	}
+}
+
+// advertises returns false if the discovery doesn't advertise the given
+// optional command in its capabilities. The capabilities are requested with a
+// DESCRIBE the first time, if the discovery doesn't support the DESCRIBE they
+// are taken from its last handshake (see WithHandshakeStore), and if they are
+// still unknown the command is assumed to be supported. The error is returned
+// if the discovery failed to answer the DESCRIBE.
+func (disc *Client) advertises(command string) (bool, error) {
+	disc.statusMutex.Lock()
+	known := disc.capabilities != nil || disc.describeFailed
+	disc.statusMutex.Unlock()
+	if !known {
+		if _, err := disc.Describe(); err != nil {
+			disc.statusMutex.Lock()
+			answered := disc.describeFailed
+			disc.statusMutex.Unlock()
+			if !answered {
+				return false, err
+			}
+			disc.logger.Debugf("Capabilities of discovery %s not available: %v", disc, err)
+		}
+	}
+	disc.statusMutex.Lock()
+	capabilities := disc.capabilities
+	disc.statusMutex.Unlock()
+	if capabilities != nil {
+		return slices.Contains(capabilities, command), nil
+	}
+	return !disc.knownUnsupported(command), nil
+}
+
+// knownUnsupported returns true if the discovery is known, from its last
+// handshake, not to support the given command.
+func (disc *Client) knownUnsupported(command string) bool {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	info := disc.handshakeInfo
+	return info != nil && info.Capabilities != nil && !slices.Contains(info.Capabilities, command)
+}
+
+// MemoryHandshakeStore is a HandshakeStore keeping the HandshakeInfo in
+// memory, for the lifetime of the application.
+type MemoryHandshakeStore struct {
+	mutex sync.Mutex
+	infos map[string]*HandshakeInfo
+}
+
+// NewMemoryHandshakeStore creates an empty MemoryHandshakeStore.
+func NewMemoryHandshakeStore() *MemoryHandshakeStore {
+	return &MemoryHandshakeStore{infos: map[string]*HandshakeInfo{}}
+}
+
+// LoadHandshake implements HandshakeStore.
+func (s *MemoryHandshakeStore) LoadHandshake(id string) (*HandshakeInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info, ok := s.infos[id]
+	if !ok {
+		return nil, nil
+	}
+	res := *info
+	return &res, nil
+}
+
+// SaveHandshake implements HandshakeStore.
+func (s *MemoryHandshakeStore) SaveHandshake(id string, info *HandshakeInfo) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	saved := *info
+	s.infos[id] = &saved
+	return nil
+}
+
+// FileHandshakeStore is a HandshakeStore keeping the HandshakeInfo of all the
+// discoveries in a JSON file, to be reused across the runs of the
+// application. The file is replaced atomically at each update.
+type FileHandshakeStore struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewFileHandshakeStore creates a FileHandshakeStore backed by the file at
+// the given path, the file is created at the first save.
+func NewFileHandshakeStore(path string) *FileHandshakeStore {
+	return &FileHandshakeStore{path: path}
+}
+
+// LoadHandshake implements HandshakeStore.
+func (s *FileHandshakeStore) LoadHandshake(id string) (*HandshakeInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	infos, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return infos[id], nil
+}
+
+// SaveHandshake implements HandshakeStore.
+func (s *FileHandshakeStore) SaveHandshake(id string, info *HandshakeInfo) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	infos, err := s.read()
+	if err != nil {
+		// A corrupted file is overwritten
+		infos = map[string]*HandshakeInfo{}
+	}
+	infos[id] = info
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *FileHandshakeStore) read() (map[string]*HandshakeInfo, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]*HandshakeInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	infos := map[string]*HandshakeInfo{}
+	if err := json.Unmarshal(data, &infos); err != nil {
+		return nil, fmt.Errorf("invalid handshake store %s: %w", s.path, err)
+	}
+	return infos, nil
+}
@@ -0,0 +1,120 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import "fmt"
+
+// EventTypeAnomaly is the type of the Event sent by the Client, in sync mode,
+// when the discovery exceeds the maximum number of ports (see WithMaxPorts):
+// the "add" events of the new ports are rejected until some ports are removed.
+// The Event Message contains the description of the anomaly, the Port is the
+// first port rejected.
+const EventTypeAnomaly = "anomaly"
+
+// DefaultMaxPorts is the maximum number of ports accepted from a discovery,
+// if not configured with WithMaxPorts. It's well beyond the number of ports
+// of any real host, only a misbehaving discovery reaches it.
+const DefaultMaxPorts = 4096
+
+// WithMaxPorts sets the maximum number of ports accepted from the discovery,
+// protecting the host from a buggy discovery enumerating an unbounded sequence
+// of ports: in sync mode the "add" events of the new ports beyond the limit
+// are rejected, and an EventTypeAnomaly event is sent, the LIST responses are
+// truncated to the limit. The rejected ports are counted in RejectedPorts.
+// Zero sets DefaultMaxPorts, a negative value removes the limit.
+func WithMaxPorts(max int) ClientOption {
+	return func(disc *Client) {
+		disc.maxPorts = max
+	}
+}
+
+// RejectedPorts returns the number of ports rejected because the discovery
+// exceeded the maximum number of ports, see WithMaxPorts.
+func (disc *Client) RejectedPorts() uint64 {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.rejectedPorts
+}
+
+// portLimit returns the maximum number of ports accepted, or -1 if the ports
+// are not limited.
+func (disc *Client) portLimit() int {
+	switch {
+	case disc.maxPorts == 0:
+		return DefaultMaxPorts
+	case disc.maxPorts < 0:
+		return -1
+	}
+	return disc.maxPorts
+}
+
+// checkPortLimit tracks the ports added in the current sync session and
+// returns false if the event must be rejected because the limit has been
+// exceeded. The anomaly event to send, if any, is returned too: it's sent
+// once each time the limit is exceeded. The caller must hold the statusMutex.
+func (disc *Client) checkPortLimit(eventType string, port *Port) (bool, *Event) {
+	limit := disc.portLimit()
+	if limit < 0 {
+		return true, nil
+	}
+	if disc.limitPorts == nil {
+		disc.limitPorts = map[string]bool{}
+	}
+	id := port.Address + "|" + port.Protocol
+	if eventType == EventTypeRemove {
+		if !disc.limitPorts[id] {
+			// The port has been rejected, its removal too
+			return false, nil
+		}
+		delete(disc.limitPorts, id)
+		if len(disc.limitPorts) < limit {
+			disc.portLimitExceeded = false
+		}
+		return true, nil
+	}
+	if disc.limitPorts[id] || len(disc.limitPorts) < limit {
+		disc.limitPorts[id] = true
+		return true, nil
+	}
+	disc.rejectedPorts++
+	if disc.portLimitExceeded {
+		return false, nil
+	}
+	disc.portLimitExceeded = true
+	disc.logger.Errorf("Discovery %s exceeded the maximum number of ports (%d), rejecting port %s", disc, limit, port)
+	return false, &Event{
+		Type:        EventTypeAnomaly,
+		Port:        port,
+		DiscoveryID: disc.GetID(),
+		Message:     fmt.Sprintf("discovery %s exceeded the maximum number of ports (%d)", disc, limit),
+	}
+}
+
+// truncateToPortLimit truncates the ports of a LIST response to the maximum
+// number of ports.
+func (disc *Client) truncateToPortLimit(ports []*Port) []*Port {
+	limit := disc.portLimit()
+	if limit < 0 || len(ports) <= limit {
+		return ports
+	}
+	disc.logger.Errorf("Discovery %s listed %d ports, exceeding the maximum number of ports (%d)", disc, len(ports), limit)
+	disc.statusMutex.Lock()
+	disc.rejectedPorts += uint64(len(ports) - limit)
+	disc.statusMutex.Unlock()
+	return ports[:limit]
+}
@@ -0,0 +1,105 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// unboundedDiscovery enumerates more ports than the limit of the tests
+type unboundedDiscovery struct {
+	nullDiscovery
+}
+
+func (d *unboundedDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		add := func(address string) { eventCB(EventTypeAdd, &Port{Address: address, Protocol: "unbounded"}) }
+		remove := func(address string) { eventCB(EventTypeRemove, &Port{Address: address, Protocol: "unbounded"}) }
+		add("0")
+		add("1")
+		add("2")
+		add("3")
+		add("4")
+		add("1")
+		remove("3")
+		remove("0")
+		add("5")
+	}()
+	return nil
+}
+
+func (d *unboundedDiscovery) List(ctx context.Context) ([]*Port, error) {
+	ports := []*Port{}
+	for i := 0; i < 10; i++ {
+		ports = append(ports, &Port{Address: fmt.Sprint(i), Protocol: "unbounded"})
+	}
+	return ports, nil
+}
+
+func init() {
+	Register("test-unbounded", func() Discovery { return &unboundedDiscovery{} })
+}
+
+func TestClientMaxPorts(t *testing.T) {
+	disc := NewClientWithOptions("unbounded", "test-unbounded", WithTransport(TransportInProcess), WithMaxPorts(3))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	events, err := disc.StartSync(20)
+	require.NoError(t, err)
+
+	received := []string{}
+	for len(received) < 7 {
+		select {
+		case ev := <-events:
+			received = append(received, ev.Type+" "+ev.Port.Address)
+			if ev.Type == EventTypeAnomaly {
+				require.Equal(t, "discovery unbounded exceeded the maximum number of ports (3)", ev.Message)
+			}
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "events not received", "%v", received)
+		}
+	}
+	require.Equal(t, []string{"add 0", "add 1", "add 2", "anomaly 3", "add 1", "remove 0", "add 5"}, received)
+	require.Equal(t, uint64(2), disc.RejectedPorts())
+	require.NoError(t, disc.Stop())
+
+	// The LIST responses are truncated
+	require.NoError(t, disc.Start())
+	ports, err := disc.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 3)
+	require.Equal(t, uint64(9), disc.RejectedPorts())
+
+	// The default limit is generous, and the limit can be removed
+	disc = NewClientWithOptions("unbounded", "test-unbounded", WithTransport(TransportInProcess))
+	require.Equal(t, DefaultMaxPorts, disc.portLimit())
+	disc = NewClientWithOptions("unbounded", "test-unbounded", WithTransport(TransportInProcess), WithMaxPorts(-1))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	require.NoError(t, disc.Start())
+	ports, err = disc.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 10)
+	require.Zero(t, disc.RejectedPorts())
+}
@@ -0,0 +1,131 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrListCancelled is the error returned by List when the LIST command has
+// been cancelled with CancelList.
+var ErrListCancelled = errors.New("LIST cancelled")
+
+// listCall is a LIST round trip, whose result is shared by all the callers
+// of List waiting for it.
+type listCall struct {
+	done    chan struct{}
+	session uint64
+	time    time.Time
+	ports   []*Port
+	err     error
+	// stream is the callback of a ListStream, whose result can't be shared
+	stream func(*Port)
+	// streamed is the number of ports passed to stream
+	streamed int
+}
+
+// SetListFreshness sets how long the result of a LIST command is reused by the
+// following calls to List, to reduce the load on the discoveries whose
+// enumeration is expensive. The result is never reused after a Stop or a new
+// Run. A freshness of 0 (the default) disables the reuse, anyway the concurrent
+// calls to List are always coalesced in a single LIST command.
+//
+// Deprecated: use the WithListFreshness option of NewClientWithOptions.
+func (disc *Client) SetListFreshness(freshness time.Duration) {
+	disc.listMutex.Lock()
+	defer disc.listMutex.Unlock()
+	disc.listFreshness = freshness
+}
+
+// List executes an enumeration of the ports and returns a list of the available
+// ports at the moment of the call. If List is called while a LIST command is
+// already in progress, it waits for its result instead of sending a new command,
+// see also SetListFreshness.
+func (disc *Client) List() ([]*Port, error) {
+	disc.listMutex.Lock()
+	// Wait for the ListStream in progress, if any
+	for disc.listCall != nil && disc.listCall.stream != nil {
+		pending := disc.listCall
+		disc.listMutex.Unlock()
+		<-pending.done
+		disc.listMutex.Lock()
+	}
+	call := disc.listCall
+	if call == nil && disc.lastList != nil && disc.clock.Now().Sub(disc.lastList.time) < disc.listFreshness {
+		call = disc.lastList
+	}
+	if call == nil {
+		call = &listCall{done: make(chan struct{}), session: disc.listSession}
+		disc.listCall = call
+		disc.listMutex.Unlock()
+
+		call.ports, call.err = disc.list()
+		call.time = disc.clock.Now()
+
+		disc.listMutex.Lock()
+		disc.listCall = nil
+		if call.err == nil && call.session == disc.listSession {
+			disc.lastList = call
+		}
+		close(call.done)
+	}
+	disc.listMutex.Unlock()
+
+	<-call.done
+	if call.err != nil {
+		return nil, call.err
+	}
+	// Each caller gets its own copy of the shared result
+	ports := make([]*Port, len(call.ports))
+	for i, port := range call.ports {
+		ports[i] = port.Clone()
+	}
+	return ports, nil
+}
+
+// invalidateList prevents the reuse of the result of the last LIST command.
+func (disc *Client) invalidateList() {
+	disc.listMutex.Lock()
+	defer disc.listMutex.Unlock()
+	disc.lastList = nil
+	disc.listSession++
+}
+
+// CancelList asks the discovery to cancel the LIST command in progress, if any,
+// by sending a STOP_LIST command: the pending calls to List return
+// ErrListCancelled, unless the discovery completes the enumeration first.
+// The STOP_LIST command is available since protocol version 2.
+func (disc *Client) CancelList() error {
+	if disc.ShimActive() {
+		return nil
+	}
+	if disc.protocolVersion < 2 {
+		return fmt.Errorf("STOP_LIST not supported by discovery %s: protocol version %d", disc, disc.protocolVersion)
+	}
+	disc.listMutex.Lock()
+	defer disc.listMutex.Unlock()
+	if disc.listCall == nil {
+		return nil
+	}
+	if err := disc.sendCommand(BuildCommand(CommandStopList)); err != nil {
+		return fmt.Errorf("calling STOP_LIST: %w", err)
+	}
+	return nil
+}
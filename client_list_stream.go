@@ -0,0 +1,203 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SetListStreaming enables the streaming decode of the LIST responses: the
+// ports are decoded one at a time as they are received, instead of buffering
+// the whole message, reducing the peak memory and the time to the first port
+// of the discoveries reporting hundreds of ports. The ports may then be
+// received as they are decoded with ListStream. The strict mode (see
+// SetStrictMode) takes precedence over the streaming decode. It must be called
+// before Run.
+//
+// Deprecated: use the WithListStreaming option of NewClientWithOptions.
+func (disc *Client) SetListStreaming(enabled bool) {
+	disc.listStreaming = enabled
+}
+
+// ListStream executes an enumeration of the ports like List, calling the given
+// callback for each port. If the streaming decode is enabled (see
+// SetListStreaming) the callback is called as soon as each port is decoded,
+// and the ports are not retained by the Client, otherwise it's called once
+// the whole LIST response has been received. The callback is called from the
+// goroutine decoding the messages of the discovery, so it must not block or
+// call other methods of the Client. ListStream always sends a new LIST
+// command: its result is not shared with the concurrent calls to List.
+func (disc *Client) ListStream(callback func(port *Port)) error {
+	if !disc.listStreaming || disc.strictMode {
+		ports, err := disc.List()
+		if err != nil {
+			return err
+		}
+		for _, port := range ports {
+			callback(port)
+		}
+		return nil
+	}
+
+	disc.listMutex.Lock()
+	for disc.listCall != nil {
+		pending := disc.listCall
+		disc.listMutex.Unlock()
+		<-pending.done
+		disc.listMutex.Lock()
+	}
+	call := &listCall{done: make(chan struct{}), session: disc.listSession, stream: callback}
+	disc.listCall = call
+	disc.listMutex.Unlock()
+
+	_, err := disc.list()
+
+	disc.listMutex.Lock()
+	disc.listCall = nil
+	close(call.done)
+	disc.listMutex.Unlock()
+	return err
+}
+
+// streamPort passes a port decoded from a LIST response to the callback of
+// the ListStream in progress, returns false if there is none.
+func (disc *Client) streamPort(port *Port) bool {
+	disc.normalizePortProtocol(port)
+	disc.listMutex.Lock()
+	var callback func(*Port)
+	streamed := 0
+	if disc.listCall != nil {
+		callback = disc.listCall.stream
+		disc.listCall.streamed++
+		streamed = disc.listCall.streamed
+	}
+	disc.listMutex.Unlock()
+	if callback == nil {
+		return false
+	}
+	if limit := disc.portLimit(); limit >= 0 && streamed > limit {
+		if streamed == limit+1 {
+			disc.logger.Errorf("Discovery %s exceeded the maximum number of ports (%d) in a LIST response", disc, limit)
+		}
+		disc.statusMutex.Lock()
+		disc.rejectedPorts++
+		disc.statusMutex.Unlock()
+		return true
+	}
+	disc.applyLabelTemplate(port)
+	for _, violation := range disc.checkPortSchema(port) {
+		disc.logger.Errorf("Discovery %s: %v", disc, violation)
+	}
+	disc.shimRecordPorts(port)
+	callback(port)
+	return true
+}
+
+// decodeStreamingMessage reads the next message from the decoder like
+// decodeMessage, but the elements of the "ports" array are decoded one at a
+// time and passed to onPort: the ports consumed by onPort are not added to
+// the message.
+func decodeStreamingMessage(decoder *json.Decoder, onPort func(*Port) bool) (*discoveryMessage, error) {
+	countError := func(err error) error {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			telemetry.count(&telemetry.decodeErrors)
+		}
+		return err
+	}
+	if tok, err := decoder.Token(); err != nil {
+		return nil, countError(err)
+	} else if tok != json.Delim('{') {
+		telemetry.count(&telemetry.decodeErrors)
+		return nil, fmt.Errorf("invalid message: expected an object, got %v", tok)
+	}
+
+	fields := map[string]json.RawMessage{}
+	var ports []*Port
+	hasPorts := false
+	for decoder.More() {
+		tok, err := decoder.Token()
+		if err != nil {
+			return nil, countError(err)
+		}
+		key, _ := tok.(string)
+		// The field names are matched case-insensitively, like json.Unmarshal does
+		if strings.EqualFold(key, "ports") {
+			if ports, err = decodeStreamingPorts(decoder, onPort); err != nil {
+				return nil, countError(err)
+			}
+			hasPorts = true
+			continue
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, countError(err)
+		}
+		fields[key] = value
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, countError(err)
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := decodeMessage(json.NewDecoder(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	if hasPorts {
+		msg.Ports = ports
+	}
+	return msg, nil
+}
+
+// decodeStreamingPorts decodes the "ports" array of a message, the null ports
+// are never passed to onPort so they are reported by listResponse.
+func decodeStreamingPorts(decoder *json.Decoder, onPort func(*Port) bool) ([]*Port, error) {
+	tok, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if tok != json.Delim('[') {
+		return nil, fmt.Errorf("invalid ports: expected an array, got %v", tok)
+	}
+	ports := []*Port{}
+	for decoder.More() {
+		var port *Port
+		if err := decoder.Decode(&port); err != nil {
+			return nil, err
+		}
+		if port == nil || !onPort(port) {
+			ports = append(ports, port)
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return ports, nil
+}
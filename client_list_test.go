@@ -0,0 +1,217 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var listCalls atomic.Int32
+
+var listRelease = make(chan struct{})
+
+type slowListDiscovery struct {
+	nullDiscovery
+}
+
+func (d *slowListDiscovery) List(ctx context.Context) ([]*Port, error) {
+	listCalls.Add(1)
+	<-listRelease
+	return []*Port{{Address: "1", Protocol: "slow"}}, nil
+}
+
+func init() {
+	Register("test-slow-list", func() Discovery { return &slowListDiscovery{} })
+}
+
+func TestClientListCoalescing(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	cl := NewInProcessClient("1", "test-slow-list")
+	cl.SetClock(clock)
+	require.NoError(t, cl.Run())
+	defer cl.Quit()
+	require.NoError(t, cl.Start())
+	listCalls.Store(0)
+
+	// The concurrent calls share the same LIST round trip
+	var wg sync.WaitGroup
+	results := make([][]*Port, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ports, err := cl.List()
+			require.NoError(t, err)
+			results[i] = ports
+		}(i)
+	}
+	require.Eventually(t, func() bool { return listCalls.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	listRelease <- struct{}{}
+	wg.Wait()
+	require.Equal(t, int32(1), listCalls.Load())
+	for _, ports := range results {
+		require.Len(t, ports, 1)
+		require.Equal(t, "slow", ports[0].Protocol)
+	}
+	require.NotSame(t, results[0][0], results[1][0])
+
+	// The result is reused within the freshness window
+	cl.SetListFreshness(time.Minute)
+	_, err := cl.List()
+	require.NoError(t, err)
+	require.Equal(t, int32(1), listCalls.Load())
+
+	clock.Advance(time.Minute)
+	go func() { listRelease <- struct{}{} }()
+	_, err = cl.List()
+	require.NoError(t, err)
+	_, err = cl.List()
+	require.NoError(t, err)
+	require.Equal(t, int32(2), listCalls.Load())
+
+	// ...but not after a Stop
+	require.NoError(t, cl.Stop())
+	require.NoError(t, cl.Start())
+	go func() { listRelease <- struct{}{} }()
+	_, err = cl.List()
+	require.NoError(t, err)
+	require.Equal(t, int32(3), listCalls.Load())
+}
+
+var cancellableListEntered = make(chan struct{}, 1)
+
+type cancellableListDiscovery struct {
+	nullDiscovery
+	calls int
+}
+
+// List blocks until cancelled the first time, and returns immediately the
+// following times.
+func (d *cancellableListDiscovery) List(ctx context.Context) ([]*Port, error) {
+	d.calls++
+	if d.calls > 1 {
+		return []*Port{{Address: "1", Protocol: "cancellable"}}, nil
+	}
+	cancellableListEntered <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func init() {
+	Register("test-cancellable-list", func() Discovery { return &cancellableListDiscovery{} })
+}
+
+func TestClientCancelList(t *testing.T) {
+	cl := NewInProcessClient("1", "test-cancellable-list")
+	require.NoError(t, cl.Run())
+	defer cl.Quit()
+	require.NoError(t, cl.Start())
+
+	// Nothing to cancel
+	require.NoError(t, cl.CancelList())
+
+	listErr := make(chan error)
+	go func() {
+		_, err := cl.List()
+		listErr <- err
+	}()
+	<-cancellableListEntered
+	require.NoError(t, cl.CancelList())
+	require.ErrorIs(t, <-listErr, ErrListCancelled)
+
+	// The following LIST is not affected
+	ports, err := cl.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+}
+
+type manyPortsDiscovery struct {
+	nullDiscovery
+}
+
+func (d *manyPortsDiscovery) List(ctx context.Context) ([]*Port, error) {
+	ports := []*Port{}
+	for i := 0; i < 500; i++ {
+		ports = append(ports, &Port{Address: strconv.Itoa(i), Protocol: "network"})
+	}
+	return ports, nil
+}
+
+func init() {
+	Register("test-many-ports", func() Discovery { return &manyPortsDiscovery{} })
+}
+
+func TestClientListStream(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		cl := NewInProcessClient("1", "test-many-ports")
+		cl.SetListStreaming(streaming)
+		require.NoError(t, cl.Run())
+		require.NoError(t, cl.Start())
+		addresses := []string{}
+		require.NoError(t, cl.ListStream(func(port *Port) {
+			addresses = append(addresses, port.Address)
+		}))
+		require.Len(t, addresses, 500)
+		require.Equal(t, "0", addresses[0])
+		require.Equal(t, "499", addresses[499])
+
+		// List is not affected by the streaming decode
+		ports, err := cl.List()
+		require.NoError(t, err)
+		require.Len(t, ports, 500)
+		cl.Quit()
+	}
+
+	decode := func(data string, onPort func(*Port) bool) (*discoveryMessage, error) {
+		return decodeStreamingMessage(json.NewDecoder(strings.NewReader(data)), onPort)
+	}
+	streamed := []string{}
+	onPort := func(port *Port) bool {
+		streamed = append(streamed, port.Address)
+		return true
+	}
+	msg, err := decode(`{"Ports":[{"address":"1"},null,{"address":"2","properties":{"b":"1","a":"2"}}],"eventType":"list","message":"OK"}`, onPort)
+	require.NoError(t, err)
+	require.Equal(t, EventTypeList, msg.EventType)
+	require.Equal(t, []string{"1", "2"}, streamed)
+	require.Equal(t, []*Port{nil}, msg.Ports)
+	_, err = listResponse(msg)
+	require.Error(t, err)
+
+	msg, err = decode(`{"eventType":"list","ports":[{"address":"1"}]}`, func(*Port) bool { return false })
+	require.NoError(t, err)
+	require.Len(t, msg.Ports, 1)
+	msg, err = decode(`{"eventType":"list","ports":null}`, onPort)
+	require.NoError(t, err)
+	require.Nil(t, msg.Ports)
+
+	for _, invalid := range []string{`[1]`, `{"eventType":"list","ports":{}}`, `{"eventType":"list","ports":[1]}`, `{"eventType":"add"}`, `{"eventType":`} {
+		_, err := decode(invalid, onPort)
+		require.Error(t, err, invalid)
+	}
+}
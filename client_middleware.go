@@ -0,0 +1,134 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"strings"
+)
+
+// Exchange is a command sent to the discovery, the response to a command or an
+// event delivered to the consumer of the events, as seen by the middlewares of
+// the Client (see Client.Use).
+type Exchange struct {
+	// DiscoveryID is the ID of the discovery.
+	DiscoveryID string
+	// Command is the command sent to the discovery, without the final
+	// newline, it's set only for the commands.
+	Command string
+	// Event is the event delivered, it's set only for the events.
+	Event *Event
+	// Response is the event type of the response received from the
+	// discovery, it's set only for the responses. The responses are
+	// received in the same order of the commands.
+	Response string
+	// Err is the error of the response, if the command failed or no
+	// response has been received.
+	Err error
+}
+
+// IsResponse returns true if the Exchange is the response to a command.
+func (x *Exchange) IsResponse() bool {
+	return x.Command == "" && x.Event == nil
+}
+
+// Handler processes an Exchange. The Handler at the end of the chain sends the
+// command to the discovery or delivers the event to the consumer.
+type Handler func(x *Exchange) error
+
+// Middleware wraps a Handler to add a behavior before and after the
+// processing of each Exchange: for example to open a tracing span, to update
+// a metric or to write an audit log. A middleware may also change the
+// Exchange, or drop an event by not calling the next Handler. A command not
+// passed to the next Handler must be rejected with an error, otherwise the
+// Client waits for a response that never comes.
+type Middleware func(next Handler) Handler
+
+// Use adds a middleware to the chain wrapping the commands sent to the
+// discovery and the events delivered to the consumer. The middlewares are
+// called in the order they've been added, the first added is the outermost.
+// An error returned for a command is returned to the caller of the Client
+// method that sent the command, the errors returned for the events are logged,
+// the responses can only be observed.
+// It must be called before Run.
+func (disc *Client) Use(middleware Middleware) {
+	disc.middlewares = append(disc.middlewares, middleware)
+}
+
+// handle processes the Exchange through the middlewares and then the
+// given final handler.
+func (disc *Client) handle(x *Exchange, final Handler) error {
+	h := final
+	for i := len(disc.middlewares) - 1; i >= 0; i-- {
+		h = disc.middlewares[i](h)
+	}
+	return h(x)
+}
+
+// sendEvent delivers the event to the forwarder through the middlewares, the
+// events delivered are recorded for ListFromCache.
+func (disc *Client) sendEvent(forwarder *eventForwarder, ev *Event) {
+	if len(disc.middlewares) == 0 {
+		disc.cacheEvent(forwarder, ev)
+		forwarder.send(ev)
+		return
+	}
+	var err error
+	if panicErr := callConsumer("event middleware", func() {
+		err = disc.handle(&Exchange{DiscoveryID: disc.GetID(), Event: ev}, func(x *Exchange) error {
+			if x.Event != nil {
+				disc.cacheEvent(forwarder, x.Event)
+				forwarder.send(x.Event)
+			}
+			return nil
+		})
+	}); panicErr != nil {
+		disc.failConsumer(forwarder, panicErr)
+		return
+	}
+	if err != nil {
+		disc.logger.Errorf("Delivering event of discovery %s: %v", disc, err)
+	}
+}
+
+// observeResponse passes the response to a command through the middlewares,
+// the middlewares can only observe it.
+func (disc *Client) observeResponse(msg *discoveryMessage, err error) {
+	if len(disc.middlewares) == 0 {
+		return
+	}
+	x := &Exchange{DiscoveryID: disc.GetID(), Err: err}
+	if msg != nil {
+		x.Response = msg.EventType
+		if msg.Error {
+			x.Err = errors.New(msg.Message)
+		}
+	}
+	_ = disc.handle(x, func(x *Exchange) error { return nil })
+}
+
+// writeCommand sends the command to the discovery through the middlewares.
+func (disc *Client) writeCommand(command string) error {
+	if len(disc.middlewares) == 0 {
+		return disc.writeData([]byte(command))
+	}
+	x := &Exchange{DiscoveryID: disc.GetID(), Command: strings.TrimSuffix(command, "\n")}
+	return disc.handle(x, func(x *Exchange) error {
+		return disc.writeData([]byte(x.Command + "\n"))
+	})
+}
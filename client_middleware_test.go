@@ -0,0 +1,121 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientMiddleware(t *testing.T) {
+	var logMutex sync.Mutex
+	log := []string{}
+	record := func(s string) {
+		logMutex.Lock()
+		log = append(log, s)
+		logMutex.Unlock()
+	}
+
+	cl := NewInProcessClient("1", "test-inprocess")
+	cl.Use(func(next Handler) Handler {
+		return func(x *Exchange) error {
+			switch {
+			case x.IsResponse() && x.Err != nil:
+				record("response " + x.Response + ": " + x.Err.Error())
+			case x.IsResponse():
+				record("response " + x.Response)
+			case x.Command != "":
+				record("outer " + strings.Fields(x.Command)[0])
+			default:
+				record("outer " + x.Event.Type)
+			}
+			return next(x)
+		}
+	})
+	cl.Use(func(next Handler) Handler {
+		return func(x *Exchange) error {
+			if x.Command == CommandList {
+				return errors.New("LIST not allowed")
+			}
+			if x.Event != nil && x.Event.Type == EventTypeAdd {
+				// The events may be changed
+				x.Event.Port.AddressLabel = "audited"
+			}
+			if x.Command != "" {
+				record("inner " + strings.Fields(x.Command)[0])
+			}
+			return next(x)
+		}
+	})
+	require.NoError(t, cl.Run())
+	defer cl.Quit()
+	require.NoError(t, cl.Start())
+	_, err := cl.List()
+	require.EqualError(t, err, "LIST not allowed")
+	require.NoError(t, cl.Stop())
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	ev := <-events
+	require.Equal(t, "audited", ev.Port.AddressLabel)
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	require.Equal(t, []string{
+		"outer HELLO", "inner HELLO", "response hello",
+		"outer START", "inner START", "response start",
+		"outer LIST",
+		"outer STOP", "inner STOP", "response stop",
+		"outer START_SYNC", "inner START_SYNC",
+	}, log[:12])
+	// The events are delivered concurrently with the response
+	require.ElementsMatch(t, []string{"response start_sync", "outer add"}, log[12:])
+}
+
+func TestClientMiddlewarePanic(t *testing.T) {
+	cl := NewInProcessClient("1", "test-inprocess")
+	cl.Use(func(next Handler) Handler {
+		return func(x *Exchange) error {
+			if x.Event != nil {
+				panic("broken consumer")
+			}
+			return next(x)
+		}
+	})
+	require.NoError(t, cl.Run())
+	defer cl.Quit()
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+
+	// Only the event channel of the consumer is closed
+	var last *Event
+	for ev := range events {
+		last = ev
+	}
+	require.Equal(t, EventTypeStop, last.Type)
+	var panicErr *PanicError
+	require.ErrorAs(t, last.Err, &panicErr)
+	require.Equal(t, "event middleware", panicErr.Method)
+	require.Equal(t, "broken consumer", panicErr.Value)
+	require.Equal(t, uint64(1), cl.ConsumerPanics())
+	require.True(t, cl.Alive())
+	require.NoError(t, cl.Stop())
+}
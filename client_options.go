@@ -0,0 +1,324 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"maps"
+	"time"
+)
+
+// ClientOption is an option of the Client, see NewClientWithOptions. The
+// options are applied in order, a later option overrides an earlier one.
+type ClientOption func(disc *Client)
+
+// Transport is the way the Client communicates with the discovery, see
+// WithTransport.
+type Transport int
+
+const (
+	// TransportPipe runs the discovery executable as a subprocess connected
+	// through pipes, this is the default.
+	TransportPipe Transport = iota
+	// TransportPTY runs the discovery executable as a subprocess with its
+	// standard output connected to a pseudo-terminal, see Client.SetPTY.
+	TransportPTY
+	// TransportInProcess runs the Discovery registered with the command name
+	// in-process, see NewInProcessClient.
+	TransportInProcess
+)
+
+// NewClientWithOptions creates a new pluggable discovery client running the
+// given command (the path of the discovery executable, or the name of the
+// registered Discovery for TransportInProcess) configured with the given
+// options. The options replace the setters of the Client, that are kept for
+// compatibility: new settings are added as options without changing the
+// signature of the constructor.
+func NewClientWithOptions(id, command string, opts ...ClientOption) *Client {
+	disc := NewClient(id, command)
+	for _, opt := range opts {
+		opt(disc)
+	}
+	return disc
+}
+
+// WithArgs sets the command line arguments of the discovery executable.
+func WithArgs(args ...string) ClientOption {
+	return func(disc *Client) {
+		disc.processArgs = append(disc.processArgs[:1:1], args...)
+	}
+}
+
+// WithEnv sets additional environment variables, in the form "KEY=VALUE", for
+// the discovery process.
+func WithEnv(env ...string) ClientOption {
+	return func(disc *Client) {
+		disc.env = env
+	}
+}
+
+// WithLogger sets the logger of the Client.
+func WithLogger(logger ClientLogger) ClientOption {
+	return func(disc *Client) {
+		disc.logger = logger
+	}
+}
+
+// WithUserAgent sets the user agent sent to the discovery in the HELLO command.
+func WithUserAgent(userAgent string) ClientOption {
+	return func(disc *Client) {
+		disc.userAgent = userAgent
+	}
+}
+
+// WithTimeouts sets the maximum time allowed to start the discovery process
+// and to answer the HELLO command in Run, a start timeout of 0 waits
+// indefinitely (see Client.SetStartTimeout and Client.SetHelloTimeout).
+func WithTimeouts(start, hello time.Duration) ClientOption {
+	return func(disc *Client) {
+		disc.startTimeout = start
+		disc.helloTimeout = hello
+	}
+}
+
+// WithClock sets the clock used for timeouts and timestamps.
+func WithClock(clock Clock) ClientOption {
+	return func(disc *Client) {
+		disc.clock = clock
+	}
+}
+
+// WithTransport sets the way the Client communicates with the discovery.
+func WithTransport(transport Transport) ClientOption {
+	return func(disc *Client) {
+		disc.usePTY = transport == TransportPTY
+		disc.inProcessName = ""
+		if transport == TransportInProcess && len(disc.processArgs) > 0 {
+			disc.inProcessName = disc.processArgs[0]
+		}
+	}
+}
+
+// WithWorkspace gives each run of the discovery process a dedicated working
+// directory and temp directory inside the given base directory, see
+// Client.SetWorkspace.
+func WithWorkspace(base string) ClientOption {
+	return func(disc *Client) {
+		disc.workspaceBase = base
+	}
+}
+
+// WithStdioEncryption encrypts the communication with the discovery process
+// with a random pre-shared key generated at each run, and passed to the
+// process in the StdioKeyEnv environment variable: the commands and the
+// messages are authenticated, so the other local processes (for example on a
+// multi-user lab machine) can not inject port events in the stream. The
+// discovery must enable the encryption too, see Server.SetStdioEncryption.
+// The option is not supported with TransportPTY, and it's ignored by the
+// in-process discoveries.
+func WithStdioEncryption(enabled bool) ClientOption {
+	return func(disc *Client) {
+		disc.stdioEncryption = enabled
+	}
+}
+
+// WithProcessGroup runs the discovery process in its own process group, and
+// kills the whole group when the discovery is quit or killed: in this way the
+// helper processes spawned by the discovery don't survive it, holding the
+// serial ports open. On Windows the discovery process is assigned to a job
+// object, and the whole job is killed.
+func WithProcessGroup(enabled bool) ClientOption {
+	return func(disc *Client) {
+		disc.processGroup = enabled
+	}
+}
+
+// WithCompactOutput requests the discovery to send the messages in the compact
+// single-line JSON format, reducing the IO and the parsing time of the chatty
+// discoveries (see OutputFormatCompact). The option is sent in the HELLO
+// command: it must be enabled only for the discoveries supporting it, the
+// others refuse the HELLO.
+func WithCompactOutput(enabled bool) ClientOption {
+	return func(disc *Client) {
+		disc.compactOutput = enabled
+	}
+}
+
+// WithIdempotentCommands makes the commands idempotent: Run does nothing if
+// the discovery is already running, Start if it's already started and Stop if
+// it's already stopped, instead of returning an error wrapping
+// ErrCommandNotAllowed. See also Server.SetIdempotentCommands.
+func WithIdempotentCommands(enabled bool) ClientOption {
+	return func(disc *Client) {
+		disc.idempotentCommands = enabled
+	}
+}
+
+// WithStartParams sets the parameters sent to the discovery with each START
+// and START_SYNC command, for example the HostHints of the host (see
+// HostHints.Params). The parameters are available since protocol version 2,
+// they are not sent to the discoveries supporting only protocol version 1.
+func WithStartParams(params map[string]string) ClientOption {
+	return func(disc *Client) {
+		disc.startParams = maps.Clone(params)
+	}
+}
+
+// WithVendorEventHandler sets the handler of the vendor events sent by the
+// discovery (see VendorEventPrefix): the handler receives an Event with the
+// vendor event type, the message and the payload of the event, that may be
+// decoded with PayloadAs. The handler is called from the goroutine reading
+// the messages of the discovery, so it must not block, a panic of the handler
+// is recovered (see Client.ConsumerPanics). Without a handler the vendor
+// events are ignored.
+func WithVendorEventHandler(handler func(ev *Event)) ClientOption {
+	return func(disc *Client) {
+		disc.vendorEventHandler = handler
+	}
+}
+
+// WithMiddleware adds the middlewares to the chain wrapping the commands and
+// the events, see Client.Use.
+func WithMiddleware(middlewares ...Middleware) ClientOption {
+	return func(disc *Client) {
+		disc.middlewares = append(disc.middlewares, middlewares...)
+	}
+}
+
+// WithChaos enables the chaos layer on the communication with the discovery,
+// injecting the faults described by the config. A nil config disables the
+// chaos layer.
+func WithChaos(config *ChaosConfig) ClientOption {
+	return func(disc *Client) {
+		disc.chaos = config
+	}
+}
+
+// WithSuppressDuplicateAdds suppresses the repeated "add" events for a port
+// identical to the one already added, with the same address, protocol and
+// properties. The suppressed events are counted in SuppressedDuplicates.
+func WithSuppressDuplicateAdds(enabled bool) ClientOption {
+	return func(disc *Client) {
+		disc.suppressDuplicates = enabled
+	}
+}
+
+// WithProtocolShim emulates the features of protocol version 2 when the
+// discovery supports only protocol version 1, see Client.ShimActive.
+func WithProtocolShim(enabled bool) ClientOption {
+	return func(disc *Client) {
+		disc.protocolShim = enabled
+	}
+}
+
+// WithPortFilter sets a filter for the ports received in sync mode: the "add"
+// events of the ports for which the filter returns false are dropped, together
+// with the following "remove" events of the same ports.
+func WithPortFilter(filter func(port *Port) bool) ClientOption {
+	return func(disc *Client) {
+		disc.portFilter = filter
+	}
+}
+
+// WithDebounce delays the delivery of the "remove" events by the given
+// duration, discarding them if the same port is added again in the meantime.
+// A duration of 0 (the default) disables the debounce.
+func WithDebounce(debounce time.Duration) ClientOption {
+	return func(disc *Client) {
+		disc.debounce = debounce
+	}
+}
+
+// WithListFreshness sets how long the result of a LIST command is reused by
+// the following calls to List. A freshness of 0 (the default) disables the
+// reuse.
+func WithListFreshness(freshness time.Duration) ClientOption {
+	return func(disc *Client) {
+		disc.listFreshness = freshness
+	}
+}
+
+// WithListStreaming decodes the ports of the LIST responses one at a time, so
+// they may be received as they are decoded with ListStream.
+func WithListStreaming(enabled bool) ClientOption {
+	return func(disc *Client) {
+		disc.listStreaming = enabled
+	}
+}
+
+// WithPollingFallback emulates the sync mode, by listing the ports every
+// interval, when the START_SYNC command fails. An interval of 0 (the default)
+// disables the fallback.
+func WithPollingFallback(interval time.Duration) ClientOption {
+	return func(disc *Client) {
+		disc.pollingInterval = interval
+	}
+}
+
+// WithPollingBackoff sets the strategy used by the polling fallback to retry
+// the LISTs that failed, in place of the polling interval.
+func WithPollingBackoff(strategy BackoffStrategy) ClientOption {
+	return func(disc *Client) {
+		disc.pollingBackoff = strategy
+	}
+}
+
+// WithStrictMode reports any message of the discovery not strictly following
+// the specification as a *StrictModeError, terminating the discovery.
+func WithStrictMode(enabled bool) ClientOption {
+	return func(disc *Client) {
+		disc.strictMode = enabled
+	}
+}
+
+// WithPortSchema sets the schema that the ports of the given protocol,
+// received from the discovery, are checked against. A nil schema removes the
+// checks for the protocol. The option may be repeated for each protocol.
+func WithPortSchema(protocol string, schema *PortSchema) ClientOption {
+	return func(disc *Client) {
+		if schema == nil {
+			delete(disc.portSchemas, protocol)
+			return
+		}
+		if disc.portSchemas == nil {
+			disc.portSchemas = map[string]*PortSchema{}
+		}
+		disc.portSchemas[protocol] = schema
+	}
+}
+
+// WithStderr sets how the stderr of the discovery process is handled. To
+// write the stderr to a file use WithStderrFile.
+func WithStderr(mode StderrMode) ClientOption {
+	return func(disc *Client) {
+		disc.stderrMode = mode
+	}
+}
+
+// WithStderrFile writes the stderr of the discovery process to the file at the
+// given path, rotated when it grows over maxSize bytes keeping at most
+// maxBackups old files. A maxSize of 0 disables the rotation.
+func WithStderrFile(path string, maxSize int64, maxBackups int) ClientOption {
+	return func(disc *Client) {
+		disc.stderrMode = StderrFile
+		disc.stderrFile = &rotatingFile{
+			path:       path,
+			maxSize:    maxSize,
+			maxBackups: maxBackups,
+		}
+	}
+}
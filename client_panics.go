@@ -0,0 +1,58 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import "runtime/debug"
+
+// ConsumerPanics returns the number of panics of the code of the consumer
+// recovered by the Client: the event middlewares (see Use) and the vendor
+// event handler (see WithVendorEventHandler) are called from the goroutine
+// reading the messages of the discovery, a panic there would terminate the
+// whole process. When an event middleware panics the sync session of the
+// consumer is considered failed: its event channel is closed, and the final
+// "stop" event carries a *PanicError. The discovery is left in sync mode, it
+// can be stopped or synced again as usual.
+func (disc *Client) ConsumerPanics() uint64 {
+	return disc.consumerPanics.Load()
+}
+
+// callConsumer calls the code of a consumer of the events, converting a panic
+// into a *PanicError whose Method is the given name.
+func callConsumer(name string, call func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Method: name, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	call()
+	return nil
+}
+
+// failConsumer closes the event channel of the sync session whose consumer
+// panicked, reporting the panic in the final "stop" event.
+func (disc *Client) failConsumer(forwarder *eventForwarder, err error) {
+	disc.consumerPanics.Add(1)
+	disc.logger.Errorf("Consumer of discovery %s panicked, closing its event channel: %v", disc, err)
+	if forwarder == nil {
+		return
+	}
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	forwarder.setTerminationError(err)
+	forwarder.close()
+}
@@ -0,0 +1,145 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPingNotSupported is returned by Ping when the discovery doesn't support
+// the PING command.
+var ErrPingNotSupported = errors.New("PING not supported")
+
+// Ping checks that the discovery is responsive with the PING command, that is
+// answered by the Server without involving the Discovery implementation, and
+// returns the round trip time. A successful Ping updates LastHeartbeat. The
+// PING command is available since protocol version 2, and it's advertised in
+// the capabilities of the Description: the first Ping of each run sends a
+// DESCRIBE to get them, and ErrPingNotSupported is returned if the discovery
+// doesn't advertise the PING, or if it's known not to support it from its last
+// handshake (see WithHandshakeStore) when it doesn't support the DESCRIBE.
+func (disc *Client) Ping() (time.Duration, error) {
+	if disc.protocolVersion < 2 {
+		return 0, fmt.Errorf("%w by discovery %s: protocol version %d", ErrPingNotSupported, disc, disc.protocolVersion)
+	}
+	if ok, err := disc.advertises(CommandPing); err != nil {
+		return 0, fmt.Errorf("calling PING: %w", err)
+	} else if !ok {
+		return 0, fmt.Errorf("%w by discovery %s: not in the capabilities", ErrPingNotSupported, disc)
+	}
+	if err := disc.checkCommand(CommandPing); err != nil {
+		return 0, err
+	}
+	start := disc.clock.Now()
+	msg, err := disc.roundTrip(CommandPing, BuildCommand(CommandPing))
+	if err != nil {
+		return 0, err
+	}
+	if msg.EventType == EventTypeCommandError {
+		return 0, fmt.Errorf("%w by discovery %s: %s", ErrPingNotSupported, disc, msg.Message)
+	}
+	if err := checkOkResponse(msg, EventTypePong); err != nil {
+		return 0, err
+	}
+	now := disc.clock.Now()
+	disc.statusMutex.Lock()
+	disc.lastHeartbeat = now
+	disc.statusMutex.Unlock()
+	return now.Sub(start), nil
+}
+
+// PingAll pings all the running discoveries in parallel, see Client.Ping, to
+// check their health without the cost of a LIST: the Health snapshot reports
+// as stale the discoveries not answering within the heartbeat timeout. The
+// returned map contains the errors of the discoveries that failed to answer,
+// indexed by discovery ID, the discoveries not running are skipped.
+func (m *Manager) PingAll() map[string]error {
+	return m.forEachDiscovery(func(disc *Client) error {
+		if !disc.Alive() {
+			return nil
+		}
+		_, err := disc.Ping()
+		return err
+	})
+}
+
+// SetPingInterval makes the Manager ping the running discoveries every
+// interval, see PingAll: the successful pings update LastHeartbeat, so the
+// Health snapshot tracks also the discoveries that don't send heartbeats. A
+// discovery failing to answer is reported with a HealthEventUnresponsive and,
+// if it's supervised (see SetRestartPolicy), it's killed to be restarted as
+// if it crashed. The discoveries not supporting the PING command are skipped.
+// An interval of 0, the default, disables the pings. It must be called before
+// Start.
+func (m *Manager) SetPingInterval(interval time.Duration) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	m.pingInterval = interval
+}
+
+// startPinging starts the goroutine pinging the discoveries, if the pings are
+// enabled and it's not already running.
+func (m *Manager) startPinging() {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	if m.pingInterval <= 0 || m.pingStop != nil {
+		return
+	}
+	m.pingStop = make(chan struct{})
+	go m.pingLoop(m.pingInterval, m.clock, m.pingStop)
+}
+
+// stopPinging stops the goroutine pinging the discoveries, if running.
+func (m *Manager) stopPinging() {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	if m.pingStop != nil {
+		close(m.pingStop)
+		m.pingStop = nil
+	}
+}
+
+func (m *Manager) pingLoop(interval time.Duration, clock Clock, stop chan struct{}) {
+	for {
+		select {
+		case <-clock.After(interval):
+		case <-stop:
+			return
+		}
+		m.forEachDiscovery(func(disc *Client) error {
+			if !disc.Alive() || disc.State() == StateUninitialized {
+				return nil
+			}
+			_, err := disc.Ping()
+			if err == nil || errors.Is(err, ErrPingNotSupported) || errors.Is(err, ErrCommandNotAllowed) || !disc.Alive() {
+				// The discoveries terminated are handled by the supervisor
+				return nil
+			}
+			m.emitHealthEvent(HealthEventUnresponsive, disc, err)
+			m.discoveriesMutex.Lock()
+			supervised := m.supervisors[disc.GetID()] != nil
+			m.discoveriesMutex.Unlock()
+			if supervised {
+				disc.abort()
+			}
+			return nil
+		})
+	}
+}
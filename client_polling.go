@@ -0,0 +1,152 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetPollingFallback enables the emulation of the sync mode when the START_SYNC
+// command fails: the discovery is started with START and the ports are listed
+// every interval with LIST, the differences between two consecutive lists are
+// delivered on the event channel as "add" and "remove" events. The emulation is
+// transparent to the consumer of the events, but the List method must not be
+// called while it's running. An interval of 0 (the default) disables the fallback.
+//
+// Deprecated: use the WithPollingFallback option of NewClientWithOptions.
+func (disc *Client) SetPollingFallback(interval time.Duration) {
+	disc.pollingInterval = interval
+}
+
+// SetPollingBackoff sets the strategy used by the polling fallback to retry
+// the LISTs that failed, in place of the polling interval. The strategy is
+// restarted after each successful LIST. A nil strategy (the default) retries
+// at the polling interval.
+//
+// Deprecated: use the WithPollingBackoff option of NewClientWithOptions.
+func (disc *Client) SetPollingBackoff(strategy BackoffStrategy) {
+	disc.pollingBackoff = strategy
+}
+
+// syncPoller is a goroutine emulating the sync mode by polling.
+type syncPoller struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startPolling starts the discovery with the START command and runs the
+// goroutine that emulates the sync mode, delivering the events to the
+// given forwarder.
+func (disc *Client) startPolling(forwarder *eventForwarder) error {
+	if err := disc.Start(); err != nil {
+		return fmt.Errorf("starting discovery %s for polling: %w", disc, err)
+	}
+	p := &syncPoller{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.eventForwarder != forwarder {
+		return fmt.Errorf("sync of discovery %s stopped", disc)
+	}
+	disc.poller = p
+	disc.lastPoller = p
+	go disc.pollLoop(p)
+	return nil
+}
+
+// stopPolling signals the polling goroutine to terminate, if running. The
+// caller must hold the statusMutex and call waitPolling after releasing it.
+func (disc *Client) stopPolling() {
+	if disc.poller != nil {
+		close(disc.poller.stop)
+		disc.poller = nil
+	}
+}
+
+// waitPolling waits for the termination of the last polling goroutine,
+// so its pending LIST command doesn't overlap with the following commands.
+func (disc *Client) waitPolling() {
+	disc.statusMutex.Lock()
+	p := disc.lastPoller
+	disc.statusMutex.Unlock()
+	if p != nil {
+		<-p.done
+	}
+}
+
+func (disc *Client) pollLoop(p *syncPoller) {
+	defer close(p.done)
+	known := map[string]*Port{}
+	failures := 0
+	for {
+		delay := disc.pollingInterval
+		if ports, err := disc.List(); err != nil {
+			disc.logger.Errorf("Polling discovery %s: %v", disc, err)
+			if !disc.Alive() {
+				return
+			}
+			if disc.pollingBackoff != nil {
+				delay = disc.pollingBackoff.Delay(failures)
+			}
+			failures++
+		} else {
+			failures = 0
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
+			known = diffPorts(known, ports, disc.deliverEvent)
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-disc.clock.After(delay):
+		}
+	}
+}
+
+// diffPorts compares the ports with the known ones, calling emit with a
+// "remove" event for each port disappeared and an "add" event for each port
+// new or changed. It returns the ports indexed by address and protocol, to be
+// used as the known ports of the next call.
+func diffPorts(known map[string]*Port, ports []*Port, emit func(event string, port *Port)) map[string]*Port {
+	current := map[string]*Port{}
+	for _, port := range ports {
+		current[port.Address+"|"+port.Protocol] = port
+	}
+	for id, port := range known {
+		if _, ok := current[id]; !ok {
+			emit(EventTypeRemove, &Port{Address: port.Address, Protocol: port.Protocol})
+		}
+	}
+	for _, port := range ports {
+		id := port.Address + "|" + port.Protocol
+		if current[id] != port {
+			continue // duplicated port, the last one wins
+		}
+		if old, ok := known[id]; !ok || !old.isIdentical(port) {
+			emit(EventTypeAdd, port)
+		}
+	}
+	return current
+}
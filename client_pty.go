@@ -0,0 +1,80 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"syscall"
+)
+
+// ErrPTYNotSupported is returned by Run when a pseudo-terminal is requested,
+// see Client.SetPTY, on a platform where it can't be allocated.
+var ErrPTYNotSupported = errors.New("pseudo-terminal not supported on this platform")
+
+// SetPTY makes the Client connect the standard output of the discovery
+// process to a pseudo-terminal in place of a pipe. Some discoveries buffer
+// their output when it's not a terminal, delaying the delivery of the events
+// until the buffer is full. The CRLF line endings added by the terminal are
+// normalized before decoding the messages. The PTY is supported only on Linux,
+// macOS and FreeBSD, elsewhere (including the other BSDs) Run fails with
+// ErrPTYNotSupported. It must be called before Run, it has no effect on the
+// discoveries running in-process.
+//
+// Deprecated: use the WithTransport option of NewClientWithOptions.
+func (disc *Client) SetPTY(enabled bool) {
+	disc.usePTY = enabled
+}
+
+// ptyReader reads the output of the discovery from the master side of a PTY,
+// replacing the CRLF sequences with LF. The EIO error returned when the
+// process closes the terminal is reported as io.EOF.
+type ptyReader struct {
+	master  io.Reader
+	pending []byte
+	cr      bool // a trailing CR is held until the next byte is read
+	err     error
+}
+
+func (r *ptyReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 && r.err == nil {
+		chunk := make([]byte, 4096)
+		n, err := r.master.Read(chunk)
+		if errors.Is(err, syscall.EIO) {
+			err = io.EOF
+		}
+		data := chunk[:n]
+		if r.cr {
+			data = append([]byte{'\r'}, data...)
+			r.cr = false
+		}
+		if err == nil && len(data) > 0 && data[len(data)-1] == '\r' {
+			r.cr = true
+			data = data[:len(data)-1]
+		}
+		r.pending = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+		r.err = err
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	if n > 0 {
+		return n, nil
+	}
+	return 0, r.err
+}
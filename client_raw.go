@@ -0,0 +1,96 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Response is a message received from the discovery in response to a command
+// sent with SendRawCommand.
+type Response struct {
+	EventType string
+	Message   string
+	Error     bool
+	// Fields are all the fields of the message, including the ones above,
+	// as raw JSON indexed by field name.
+	Fields map[string]json.RawMessage
+}
+
+// Field decodes the field of the response with the given name into v. An
+// error is returned if the field is not present.
+func (r *Response) Field(name string, v any) error {
+	data, ok := r.Fields[name]
+	if !ok {
+		return fmt.Errorf("field %s not present in the %s response", name, r.EventType)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// SendRawCommand sends a command not covered by the typed methods of the
+// Client, for example an experimental or vendor-specific command, and returns
+// the message received in response. It's a low-level API meant to prototype
+// the extensions of the protocol: the command is sent as is, followed by a
+// newline, and the first message received that is not an event is returned
+// with all its fields. The commands of the specification must be sent with
+// the typed methods, since they update the state tracked by the Client, and
+// they are rejected. If the discovery answers with an error the response is
+// returned together with the error. The responses must not use a vendor event
+// type, since the vendor events are delivered to the handler set with
+// WithVendorEventHandler. Note that the responses with an unknown event type
+// are rejected in strict mode, see SetStrictMode.
+func (disc *Client) SendRawCommand(cmd string) (*Response, error) {
+	cmd = strings.TrimSuffix(cmd, "\n")
+	if cmd == "" || strings.ContainsAny(cmd, "\r\n") {
+		return nil, errors.New("raw command must be a single non empty line")
+	}
+	name, _, _ := strings.Cut(cmd, " ")
+	if _, ok := responseEventTypes[name]; ok || name == CommandStopList {
+		return nil, fmt.Errorf("command %s must be sent with the typed methods of the Client", name)
+	}
+	if !disc.Alive() {
+		return nil, fmt.Errorf("discovery %s not running", disc)
+	}
+	disc.commandMutex.Lock()
+	if err := disc.sendCommand(cmd + "\n"); err != nil {
+		disc.commandMutex.Unlock()
+		return nil, err
+	}
+	msg, err := disc.waitFreshMessage(time.Second * 10)
+	disc.commandMutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("calling %s: %w", name, err)
+	}
+	res := &Response{
+		EventType: msg.EventType,
+		Message:   msg.Message,
+		Error:     msg.Error,
+		Fields:    map[string]json.RawMessage{},
+	}
+	if err := json.Unmarshal(msg.raw, &res.Fields); err != nil {
+		return nil, fmt.Errorf("decoding %s response: %w", name, err)
+	}
+	if msg.Error {
+		return res, fmt.Errorf("command %s failed: %s", name, msg.Message)
+	}
+	return res, nil
+}
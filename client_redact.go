@@ -0,0 +1,202 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// RedactedValue replaces the values of the redacted properties in the logs
+// and in the diagnostic reports, see WithRedactedProperties.
+const RedactedValue = "***"
+
+// WithRedactedProperties masks the values of the given property keys, compared
+// case-insensitively, in the logs of the Client and in the DiagnosticReport
+// (see Client.Diagnose): the credentials used by the network discoveries, like
+// passwords and tokens, are not leaked in the debug logs submitted by the users.
+// The same keys are masked in the CONFIGURE commands. The ports delivered in
+// the events and returned by List keep the real values.
+func WithRedactedProperties(keys ...string) ClientOption {
+	return func(disc *Client) {
+		if disc.redactor == nil {
+			disc.redactor = &redactor{keys: map[string]bool{}}
+		}
+		for _, key := range keys {
+			disc.redactor.keys[strings.ToLower(key)] = true
+		}
+	}
+}
+
+// redactor masks the values of the redacted properties, a nil redactor
+// leaves everything unchanged.
+type redactor struct {
+	keys map[string]bool
+}
+
+func (r *redactor) redacted(key string) bool {
+	return r != nil && r.keys[strings.ToLower(key)]
+}
+
+// port returns a copy of the port with the redacted properties masked, or
+// the port itself if there is nothing to mask.
+func (r *redactor) port(port *Port) *Port {
+	if r == nil || port == nil || port.Properties == nil {
+		return port
+	}
+	var res *Port
+	for _, key := range port.Properties.Keys() {
+		if !r.redacted(key) {
+			continue
+		}
+		if res == nil {
+			res = port.Clone()
+			res.raw = nil
+		}
+		res.Properties.Set(key, RedactedValue)
+	}
+	if res == nil {
+		return port
+	}
+	return res
+}
+
+// ports returns the ports with the redacted properties masked.
+func (r *redactor) ports(ports []*Port) []*Port {
+	if r == nil {
+		return ports
+	}
+	res := make([]*Port, len(ports))
+	for i, port := range ports {
+		res[i] = r.port(port)
+	}
+	return res
+}
+
+// command returns the command with the value masked, if it's a CONFIGURE
+// of a redacted key.
+func (r *redactor) command(command string) string {
+	if r == nil {
+		return command
+	}
+	cmd, args := parseCommand(command)
+	if cmd != CommandConfigure {
+		return command
+	}
+	key, _, _ := strings.Cut(args, " ")
+	if !r.redacted(key) {
+		return command
+	}
+	return BuildConfigure(key, RedactedValue)
+}
+
+// message returns the JSON message received from the discovery with the
+// values of the redacted properties masked. The masked messages are
+// re-encoded in compact form, the others are returned unchanged.
+func (r *redactor) message(data string) string {
+	if r == nil || !strings.Contains(data, `"properties"`) {
+		return data
+	}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	w := &jsonRedaction{redactor: r, dec: dec}
+	if err := w.copyValue(&w.out, false); err != nil || !w.masked {
+		return data
+	}
+	return w.out.String()
+}
+
+// jsonRedaction copies a JSON value masking the redacted properties, that
+// are the redacted keys of the "properties" objects.
+type jsonRedaction struct {
+	redactor *redactor
+	dec      *json.Decoder
+	out      bytes.Buffer
+	masked   bool
+}
+
+// copyValue copies the next JSON value to out, if properties is true the
+// value is a properties object.
+func (w *jsonRedaction) copyValue(out *bytes.Buffer, properties bool) error {
+	tok, err := w.dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return writeToken(out, tok)
+	}
+	if delim == '[' {
+		out.WriteByte('[')
+		for i := 0; w.dec.More(); i++ {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := w.copyValue(out, false); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+		_, err := w.dec.Token()
+		return err
+	}
+	out.WriteByte('{')
+	for i := 0; w.dec.More(); i++ {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		tok, err := w.dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		if err := writeToken(out, key); err != nil {
+			return err
+		}
+		out.WriteByte(':')
+		if properties && w.redactor.redacted(key) {
+			// The real value is discarded
+			if err := w.copyValue(&bytes.Buffer{}, false); err != nil {
+				return err
+			}
+			w.masked = true
+			if err := writeToken(out, RedactedValue); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.copyValue(out, key == "properties"); err != nil {
+			return err
+		}
+	}
+	out.WriteByte('}')
+	_, err = w.dec.Token()
+	return err
+}
+
+// writeToken writes a JSON scalar token.
+func writeToken(out io.Writer, tok json.Token) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
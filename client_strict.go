@@ -0,0 +1,134 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// SetStrictMode enables the strict mode of the Client: any message of the
+// discovery not strictly following the specification (an unknown event type,
+// a response without the exact "OK" message, a field unknown or not expected in
+// the message) is reported as a *StrictModeError and terminates the discovery.
+// The vendor events are allowed, see VendorEventPrefix.
+// The strict mode is meant to test the discoveries in CI, by default the Client
+// is lenient. It must be called before Run.
+//
+// Deprecated: use the WithStrictMode option of NewClientWithOptions.
+func (disc *Client) SetStrictMode(strict bool) {
+	disc.strictMode = strict
+}
+
+// StrictModeError is a violation of the specification detected in strict
+// mode, see Client.SetStrictMode.
+type StrictModeError struct {
+	// Violation is the description of the violation.
+	Violation string
+	// Message is the raw JSON message received from the discovery.
+	Message string
+}
+
+func (e *StrictModeError) Error() string {
+	return fmt.Sprintf("strict mode: %s in message %s", e.Violation, e.Message)
+}
+
+// decodeStrictMessage decodes the next message and checks it against the
+// specification.
+func decodeStrictMessage(decoder *json.Decoder) (*discoveryMessage, error) {
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	msg, err := decodeMessage(json.NewDecoder(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, &StrictModeError{Violation: err.Error(), Message: string(raw)}
+	}
+	if violation := strictViolation(raw, msg); violation != "" {
+		return nil, &StrictModeError{Violation: violation, Message: string(raw)}
+	}
+	return msg, nil
+}
+
+// strictViolation returns the first violation of the specification found
+// in the message, or an empty string.
+func strictViolation(raw json.RawMessage, msg *discoveryMessage) string {
+	switch msg.EventType {
+	case EventTypeHello, EventTypeStart, EventTypeStop, EventTypeQuit, EventTypeList,
+		EventTypeStartSync, EventTypeDescribe, EventTypeConfigure, EventTypeAdd,
+		EventTypeRemove, EventTypeHeartbeat, EventTypePong, EventTypeWarning, EventTypeCommandError:
+	default:
+		if IsVendorEventType(msg.EventType) {
+			break
+		}
+		return fmt.Sprintf("unknown event type '%s'", msg.EventType)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return err.Error()
+	}
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		eventTypes, known := messageFields[name]
+		if !known {
+			return fmt.Sprintf("unknown field '%s'", name)
+		}
+		vendorPayload := name == "payload" && IsVendorEventType(msg.EventType)
+		if eventTypes != nil && !slices.Contains(eventTypes, msg.EventType) && !vendorPayload {
+			return fmt.Sprintf("field '%s' not expected in '%s' message", name, msg.EventType)
+		}
+	}
+
+	if slices.Contains(okEventTypes, msg.EventType) && !msg.Error && msg.Message != "OK" {
+		return fmt.Sprintf("expected message 'OK' in '%s' response, received '%s'", msg.EventType, msg.Message)
+	}
+	if msg.Error && msg.Message == "" {
+		return "missing message in error response"
+	}
+	ports := msg.Ports
+	if msg.Port != nil {
+		ports = append(ports, msg.Port)
+	}
+	for _, port := range ports {
+		if port == nil {
+			return "null port"
+		}
+		if port.Protocol != "" {
+			if err := ValidateProtocol(port.Protocol); err != nil {
+				return "invalid port: " + err.Error()
+			}
+		}
+		if len(port.Extra) > 0 {
+			extra := []string{}
+			for name := range port.Extra {
+				extra = append(extra, name)
+			}
+			sort.Strings(extra)
+			return fmt.Sprintf("unknown port field '%s'", extra[0])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrictViolations(t *testing.T) {
+	for raw, violation := range map[string]string{
+		`{"eventType":"start","message":"OK"}`:                                        "",
+		`{"eventType":"hello","protocolVersion":2,"message":"OK"}`:                    "",
+		`{"eventType":"list","error":true,"message":"failed"}`:                        "",
+		`{"eventType":"add","port":{"address":"1","protocol":"serial"}}`:              "",
+		`{"eventType":"list","ports":[{"address":"1","protocol":"serial"}]}`:          "",
+		`{"eventType":"unknown"}`:                                                     "unknown event type 'unknown'",
+		`{"eventType":"start","message":"ok"}`:                                        "expected message 'OK' in 'start' response, received 'ok'",
+		`{"eventType":"start"}`:                                                       "expected message 'OK' in 'start' response, received ''",
+		`{"eventType":"start","message":"OK","extra":1}`:                              "unknown field 'extra'",
+		`{"eventType":"start","message":"OK","protocolVersion":2}`:                    "field 'protocolVersion' not expected in 'start' message",
+		`{"eventType":"start","message":"OK","note":"Discovery already STARTed"}`:     "",
+		`{"eventType":"list","ports":[],"note":"repeated"}`:                           "field 'note' not expected in 'list' message",
+		`{"eventType":"list","error":true}`:                                           "missing message in error response",
+		`{"eventType":"add","port":{"address":"1","protocol":"serial","extra":true}}`: "unknown port field 'extra'",
+		`{"eventType":"add","port":{"address":"1","protocol":"Serial"}}`:              "invalid port: protocol 'Serial' is not normalized, expected 'serial'",
+	} {
+		t.Run(raw, func(t *testing.T) {
+			msg, err := decodeStrictMessage(json.NewDecoder(strings.NewReader(raw)))
+			if violation == "" {
+				require.NoError(t, err)
+				require.NotNil(t, msg)
+				return
+			}
+			var strictErr *StrictModeError
+			require.ErrorAs(t, err, &strictErr)
+			require.Equal(t, violation, strictErr.Violation)
+			require.Equal(t, raw, strictErr.Message)
+		})
+	}
+}
+
+func TestClientStrictMode(t *testing.T) {
+	// The Server follows the specification
+	cl := NewInProcessClient("1", "test-inprocess")
+	cl.SetStrictMode(true)
+	require.NoError(t, cl.Run())
+	defer cl.Quit()
+	require.NoError(t, cl.Start())
+	_, err := cl.List()
+	require.NoError(t, err)
+	require.NoError(t, cl.Stop())
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, EventTypeAdd, (<-events).Type)
+	require.NoError(t, cl.Stop())
+}
+
+func TestClientStrictModeViolation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	script := `read cmd; echo '{"eventType":"hello","protocolVersion":1,"message":"ok"}'; cat`
+	cl := NewClient("lenient", "sh", "-c", script)
+	require.NoError(t, cl.Run())
+	cl.Quit()
+
+	cl = NewClient("strict", "sh", "-c", script)
+	cl.SetStrictMode(true)
+	var strictErr *StrictModeError
+	require.ErrorAs(t, cl.Run(), &strictErr)
+	require.Equal(t, "expected message 'OK' in 'hello' response, received 'ok'", strictErr.Violation)
+	require.False(t, cl.Alive())
+}
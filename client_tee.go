@@ -0,0 +1,179 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// The formats of the events mirrored by Client.TeeEvents.
+const (
+	// TeeFormatNDJSON writes each event as a JSON object on a single line.
+	TeeFormatNDJSON = "ndjson"
+	// TeeFormatCSV writes each event as a CSV record, after a header line.
+	// The properties of the port are encoded as a JSON object.
+	TeeFormatCSV = "csv"
+)
+
+// teeBufferSize is the maximum number of events waiting to be written by
+// TeeEvents, the following ones are dropped until the writer catches up.
+const teeBufferSize = 1024
+
+// teeCSVHeader is the header of the events mirrored in CSV format.
+var teeCSVHeader = []string{"seq", "eventType", "discoveryId", "address", "protocol", "label", "hardwareId", "properties", "message"}
+
+// teeRecord is an event mirrored in NDJSON format.
+type teeRecord struct {
+	Seq         uint64          `json:"seq"`
+	EventType   string          `json:"eventType"`
+	DiscoveryID string          `json:"discoveryId"`
+	Port        *Port           `json:"port,omitempty"`
+	Message     string          `json:"message,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+// TeeEvents mirrors all the events delivered by the Client to the given
+// writer, in NDJSON (TeeFormatNDJSON) or CSV (TeeFormatCSV) format, together
+// with their normal delivery: in this way it's possible to see exactly what
+// the discovery is emitting without writing any consumer code. The properties
+// masked by WithRedactedProperties are masked in the mirrored events too, and
+// the final "stop" event of each sync session is mirrored as well. The events
+// are written to w from a separate goroutine, so a slow writer doesn't delay
+// their delivery: up to teeBufferSize events wait to be written, the following
+// ones are dropped and the number of the events dropped is logged. The errors
+// writing to w are logged and don't affect the delivery of the events. It's
+// implemented as a middleware (see Use), so it must be called before Run.
+func (disc *Client) TeeEvents(w io.Writer, format string) error {
+	var write func(ev *Event) error
+	switch format {
+	case TeeFormatNDJSON:
+		encoder := json.NewEncoder(w)
+		write = func(ev *Event) error {
+			return encoder.Encode(&teeRecord{
+				Seq:         ev.Seq,
+				EventType:   ev.Type,
+				DiscoveryID: ev.DiscoveryID,
+				Port:        disc.redactor.port(ev.Port),
+				Message:     ev.Message,
+				Payload:     ev.Payload,
+			})
+		}
+	case TeeFormatCSV:
+		writer := csv.NewWriter(w)
+		header := false
+		write = func(ev *Event) error {
+			if !header {
+				header = true
+				if err := writer.Write(teeCSVHeader); err != nil {
+					return err
+				}
+			}
+			record := []string{strconv.FormatUint(ev.Seq, 10), ev.Type, ev.DiscoveryID, "", "", "", "", "", ev.Message}
+			if port := disc.redactor.port(ev.Port); port != nil {
+				props, err := marshalOrderedProperties(port.Properties)
+				if err != nil {
+					return err
+				}
+				copy(record[3:], []string{port.Address, port.Protocol, port.AddressLabel, port.HardwareID, string(props)})
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+			writer.Flush()
+			return writer.Error()
+		}
+	default:
+		return fmt.Errorf("invalid tee format: '%s'", format)
+	}
+
+	tee := &eventTee{disc: disc, write: write}
+	disc.tees = append(disc.tees, tee)
+	disc.Use(func(next Handler) Handler {
+		return func(x *Exchange) error {
+			if x.Event != nil {
+				tee.enqueue(x.Event)
+			}
+			return next(x)
+		}
+	})
+	return nil
+}
+
+// teeStop mirrors the final "stop" event of a sync session, that is generated
+// by the eventForwarder without going through the middlewares.
+func (disc *Client) teeStop(ev *Event) {
+	for _, tee := range disc.tees {
+		tee.enqueue(ev)
+	}
+}
+
+// eventTee writes the events mirrored by TeeEvents from its own goroutine,
+// started when there are events to write.
+type eventTee struct {
+	disc    *Client
+	write   func(ev *Event) error
+	mutex   sync.Mutex
+	pending []*Event
+	writing bool
+	dropped int
+}
+
+// enqueue adds the event to the events to write, or drops it if there are
+// already teeBufferSize events waiting.
+func (t *eventTee) enqueue(ev *Event) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.pending) >= teeBufferSize {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, ev)
+	if !t.writing {
+		t.writing = true
+		go t.writeLoop()
+	}
+}
+
+// writeLoop writes the pending events, until there are no more.
+func (t *eventTee) writeLoop() {
+	for {
+		t.mutex.Lock()
+		if len(t.pending) == 0 {
+			t.writing = false
+			t.mutex.Unlock()
+			return
+		}
+		ev := t.pending[0]
+		t.pending = t.pending[1:]
+		dropped := t.dropped
+		t.dropped = 0
+		t.mutex.Unlock()
+
+		if dropped > 0 {
+			t.disc.logger.Errorf("Mirroring events of discovery %s: %d events dropped, the writer is too slow", t.disc, dropped)
+		}
+		if err := t.write(ev); err != nil {
+			t.disc.logger.Errorf("Mirroring event of discovery %s: %v", t.disc, err)
+		}
+	}
+}
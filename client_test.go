@@ -18,10 +18,23 @@
 package discovery
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/arduino/go-paths-helper"
@@ -102,6 +115,69 @@ func TestClient(t *testing.T) {
 	builder.SetDir("dummy-discovery")
 	require.NoError(t, builder.Run())
 
+	t.Run("WithStdioEncryption", func(t *testing.T) {
+		cl := NewClientWithOptions("1", "dummy-discovery/dummy-discovery", WithStdioEncryption(true))
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+		require.NoError(t, cl.Start())
+		ports, err := cl.List()
+		require.NoError(t, err)
+		require.NotEmpty(t, ports)
+
+		// The plain text HELLO is not accepted by the discovery
+		cl = NewClientWithOptions("2", "sh", WithArgs("-c", "PLUGGABLE_DISCOVERY_STDIO_KEY=0000000000000000000000000000000000000000000000000000000000000000 dummy-discovery/dummy-discovery"))
+		require.Error(t, cl.Run())
+	})
+
+	t.Run("WithCompression", func(t *testing.T) {
+		for _, compression := range []string{CompressionGzip, CompressionZstd} {
+			cl := NewClientWithOptions("1", "dummy-discovery/dummy-discovery", WithCompression(compression))
+			require.NoError(t, cl.Run())
+			events, err := cl.StartSync(10)
+			require.NoError(t, err)
+			ev := <-events
+			require.Equal(t, EventTypeAdd, ev.Type)
+			require.NoError(t, cl.Stop())
+			require.NoError(t, cl.Start())
+			ports, err := cl.List()
+			require.NoError(t, err)
+			require.NotEmpty(t, ports)
+			cl.Quit()
+
+			// The transcript contains the decompressed messages
+			report, err := cl.Diagnose()
+			require.NoError(t, err)
+			received := []string{}
+			for _, entry := range report.Transcript {
+				if entry.Direction == TranscriptReceived {
+					var msg message
+					require.NoError(t, json.Unmarshal([]byte(entry.Data), &msg))
+					received = append(received, msg.EventType)
+				}
+			}
+			require.Equal(t, []string{"hello", "describe", "start", "list"}, received[:4])
+		}
+	})
+
+	t.Run("WithLatencyProbe", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery", "--latency-probe")
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+		require.NoError(t, cl.Start())
+		for probe := 1; probe <= 2; probe++ {
+			sentAt := time.Now()
+			ports, err := cl.List()
+			require.NoError(t, err)
+			require.Len(t, ports, 1)
+			require.Equal(t, "latency-probe", ports[0].Address)
+			require.Equal(t, fmt.Sprint(probe), ports[0].Properties.Get("probe"))
+			receivedAt, err := strconv.ParseInt(ports[0].Properties.Get("receivedAt"), 10, 64)
+			require.NoError(t, err)
+			require.GreaterOrEqual(t, receivedAt, sentAt.UnixNano())
+			require.LessOrEqual(t, receivedAt, time.Now().UnixNano())
+		}
+	})
+
 	t.Run("WithDiscoveryCrashingOnStartup", func(t *testing.T) {
 		// Run client with discovery crashing on startup
 		cl := NewClient("1", "dummy-discovery/dummy-discovery", "--invalid")
@@ -148,4 +224,1222 @@ func TestClient(t *testing.T) {
 
 		cl.Quit()
 	})
+
+	t.Run("Describe", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+
+		desc, err := cl.Describe()
+		require.NoError(t, err)
+		require.Equal(t, []string{"dummy"}, desc.Protocols)
+		require.Equal(t, []string{"vid", "pid", "mac"}, desc.PropertyKeys)
+		require.False(t, desc.Polling)
+	})
+
+	t.Run("EmulatedProperties", func(t *testing.T) {
+		for _, emulate := range []string{"serial", "mdns"} {
+			cl := NewClient("1", "dummy-discovery/dummy-discovery", "--emulate", emulate)
+			require.NoError(t, cl.Run())
+			require.NoError(t, cl.Start())
+			time.Sleep(100 * time.Millisecond)
+			ports, err := cl.List()
+			require.NoError(t, err)
+			require.NotEmpty(t, ports)
+			desc, err := cl.Describe()
+			require.NoError(t, err)
+			for _, port := range ports {
+				require.Equal(t, desc.Protocols[0], port.Protocol)
+				for _, key := range desc.PropertyKeys {
+					require.True(t, port.Properties.ContainsKey(key), "missing property %s", key)
+				}
+			}
+			cl.Quit()
+		}
+
+		cl := NewClient("1", "dummy-discovery/dummy-discovery", "--emulate", "invalid")
+		require.Error(t, cl.Run())
+	})
+
+	t.Run("PortSchemaWarnings", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery", "--emulate", "serial")
+		cl.SetPortSchema("serial", &PortSchema{
+			RequiredKeys: []string{"vid", "pid", "serialNumber"},
+			Values:       map[string]*regexp.Regexp{"pid": regexp.MustCompile("^0x0042$")},
+		})
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		ev := <-events
+		require.Equal(t, EventTypeWarning, ev.Type)
+		require.Contains(t, ev.Message, "invalid value '0x0043' for property pid")
+		require.Equal(t, "serial", ev.Port.Protocol)
+		ev = <-events
+		require.Equal(t, EventTypeAdd, ev.Type)
+	})
+
+	t.Run("Configure", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.Error(t, cl.Configure("invalid key", "1s"))
+		require.Error(t, cl.Configure("interval", "1s\nQUIT"))
+
+		// The configuration is stored and sent at startup
+		require.NoError(t, cl.Configure("interval", "2h"))
+		require.NoError(t, cl.Configure("interval", "50ms"))
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+
+		desc, err := cl.Describe()
+		require.NoError(t, err)
+		require.Equal(t, []string{CommandConfigure, CommandPing}, desc.Capabilities)
+		require.ErrorContains(t, cl.Configure("unknown", "1"), "unknown setting: unknown")
+
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		for i := 0; i < 4; i++ {
+			select {
+			case <-events:
+			case <-time.After(time.Second):
+				require.FailNow(t, "events not received with the configured interval")
+			}
+		}
+	})
+
+	t.Run("StateMachine", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.NoError(t, cl.Run())
+		require.Equal(t, StateIdle, cl.State())
+
+		_, err := cl.List()
+		require.ErrorIs(t, err, ErrCommandNotAllowed)
+		require.NoError(t, cl.Start())
+		require.Equal(t, StateStarted, cl.State())
+		_, err = cl.StartSync(10)
+		require.ErrorIs(t, err, ErrCommandNotAllowed)
+		require.NoError(t, cl.Stop())
+		require.ErrorIs(t, cl.Stop(), ErrCommandNotAllowed)
+		_, err = cl.StartSync(10)
+		require.NoError(t, err)
+		require.Equal(t, StateSyncing, cl.State())
+
+		cl.Quit()
+		require.Equal(t, StateQuit, cl.State())
+		require.ErrorIs(t, cl.Start(), ErrCommandNotAllowed)
+	})
+
+	t.Run("Diagnose", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		cl.SetUserAgent("test")
+		report, err := cl.Diagnose()
+		require.NoError(t, err)
+		require.False(t, cl.Alive())
+		require.Equal(t, "1", report.DiscoveryID)
+		require.Equal(t, 2, report.ProtocolVersion)
+		require.Equal(t, []string{"dummy"}, report.Description.Protocols)
+		require.NotEmpty(t, report.Ports)
+		require.Empty(t, report.Error)
+		require.Positive(t, report.Timings.Startup)
+
+		// The transcript holds the raw protocol, including the ports listed
+		var commands []string
+		for _, entry := range report.Transcript {
+			if entry.Direction == TranscriptSent {
+				commands = append(commands, entry.Data)
+				continue
+			}
+			var msg discoveryMessage
+			require.NoError(t, json.Unmarshal([]byte(entry.Data), &msg))
+			if msg.EventType == EventTypeList {
+				require.Len(t, msg.Ports, len(report.Ports))
+			}
+		}
+		require.Equal(t, []string{`HELLO 2 "arduino-cli test"`, "DESCRIBE", "START", "LIST", "STOP", "QUIT"}, commands)
+		require.Len(t, report.Transcript, 12)
+
+		// The failures are reported together with the stderr of the discovery
+		cl = NewClient("1", "dummy-discovery/dummy-discovery", "--invalid")
+		report, err = cl.Diagnose()
+		require.Error(t, err)
+		require.Equal(t, err.Error(), report.Error)
+		require.Equal(t, "invalid argument: --invalid\n", report.Stderr)
+		require.Equal(t, []string{"dummy-discovery/dummy-discovery", "--invalid"}, report.Command)
+	})
+
+	t.Run("DiagnoseRedacted", func(t *testing.T) {
+		cl := NewClientWithOptions("1", "dummy-discovery/dummy-discovery", WithRedactedProperties("MAC", "interval"))
+		require.NoError(t, cl.Configure("interval", "100ms"))
+		report, err := cl.Diagnose()
+		require.NoError(t, err)
+		require.NotEmpty(t, report.Ports)
+		for _, port := range report.Ports {
+			require.Equal(t, RedactedValue, port.Properties.Get("mac"))
+			require.NotEqual(t, RedactedValue, port.Properties.Get("vid"))
+		}
+		configured := false
+		for _, entry := range report.Transcript {
+			require.NotContains(t, entry.Data, "100ms")
+			configured = configured || entry.Data == "CONFIGURE interval "+RedactedValue
+			var msg discoveryMessage
+			if entry.Direction == TranscriptReceived && json.Unmarshal([]byte(entry.Data), &msg) == nil && msg.EventType == EventTypeList {
+				require.Equal(t, RedactedValue, msg.Ports[0].Properties.Get("mac"))
+			}
+		}
+		require.True(t, configured)
+
+		// The real values are returned by List
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+		require.NoError(t, cl.Start())
+		ports, err := cl.List()
+		require.NoError(t, err)
+		require.NotEqual(t, RedactedValue, ports[0].Properties.Get("mac"))
+	})
+
+	t.Run("ResetPort", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+		require.NoError(t, cl.Configure("resetDelay", "50ms"))
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		board := <-events
+		require.Equal(t, EventTypeAdd, board.Type)
+		<-events
+
+		// The board disappears and comes back with a new address
+		require.NoError(t, cl.Configure("reset", board.Port.Address))
+		ev := <-events
+		require.Equal(t, EventTypeRemove, ev.Type)
+		require.Equal(t, board.Port.Address, ev.Port.Address)
+		ev = <-events
+		require.Equal(t, EventTypeAdd, ev.Type)
+		require.NotEqual(t, board.Port.Address, ev.Port.Address)
+		require.Equal(t, board.Port.HardwareID, ev.Port.HardwareID)
+
+		// The reset of a port not connected is ignored
+		require.NoError(t, cl.Configure("reset", board.Port.Address))
+	})
+
+	t.Run("HandshakeStore", func(t *testing.T) {
+		store := NewFileHandshakeStore(filepath.Join(t.TempDir(), "handshakes.json"))
+		cl := NewClientWithOptions("1", "dummy-discovery/dummy-discovery", WithHandshakeStore(store))
+		require.Nil(t, cl.LastHandshake())
+		require.NoError(t, cl.Run())
+		info := cl.LastHandshake()
+		require.Equal(t, 2, info.ProtocolVersion)
+		require.Equal(t, 1, info.Samples)
+		require.Greater(t, info.StartupTime, time.Duration(0))
+		require.Nil(t, info.Capabilities)
+		_, err := cl.Describe()
+		require.NoError(t, err)
+		require.Contains(t, cl.LastHandshake().Capabilities, CommandPing)
+		cl.Quit()
+
+		// The last handshake is reloaded by the next client
+		cl = NewClientWithOptions("1", "dummy-discovery/dummy-discovery", WithHandshakeStore(store))
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+		info = cl.LastHandshake()
+		require.Equal(t, 2, info.Samples)
+		require.Contains(t, info.Capabilities, CommandPing)
+		_, err = cl.Ping()
+		require.NoError(t, err)
+		// The capabilities are described again by the first Ping
+		info = cl.LastHandshake()
+		saved, err := store.LoadHandshake("1")
+		require.NoError(t, err)
+		require.True(t, info.UpdatedAt.Equal(saved.UpdatedAt))
+		saved.UpdatedAt = info.UpdatedAt
+		require.Equal(t, info, saved)
+	})
+
+	t.Run("StartParams", func(t *testing.T) {
+		hints := &HostHints{ExcludePorts: []string{"1", "3"}}
+		cl := NewClientWithOptions("1", "dummy-discovery/dummy-discovery", WithStartParams(hints.Params()))
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+		require.NoError(t, cl.Configure("interval", "10ms"))
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		for _, address := range []string{"2", "4"} {
+			ev := <-events
+			require.Equal(t, EventTypeAdd, ev.Type)
+			require.Equal(t, address, ev.Port.Address)
+		}
+	})
+
+	t.Run("ExtraFiles", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("extra files are not supported on Windows")
+		}
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		defer r.Close()
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.Error(t, cl.AddExtraFile("invalid name", w))
+		require.NoError(t, cl.AddExtraFile("test", w))
+		require.Error(t, cl.AddExtraFile("test", w))
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+		require.NoError(t, w.Close())
+
+		greeting, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "Hello test from dummy-discovery\n", string(greeting))
+	})
+
+	t.Run("PollingFallback", func(t *testing.T) {
+		cl := NewClientWithOptions("1", "dummy-discovery/dummy-discovery", WithPollingFallback(50*time.Millisecond))
+		require.NoError(t, cl.Configure("interval", "200ms"))
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+
+		// The dummy discovery fails START_SYNC every 5 times
+		for i := 0; i < 4; i++ {
+			_, err := cl.StartSync(10)
+			require.NoError(t, err)
+			require.NoError(t, cl.Stop())
+		}
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		require.NotNil(t, cl.lastPoller)
+
+		// The events are emulated by polling
+		added := map[string]bool{}
+		for removed := false; !removed; {
+			select {
+			case ev := <-events:
+				if ev.Type == EventTypeAdd {
+					added[ev.Port.Address] = true
+				} else {
+					require.Equal(t, EventTypeRemove, ev.Type)
+					require.True(t, added[ev.Port.Address])
+					removed = true
+				}
+			case <-time.After(2 * time.Second):
+				require.FailNow(t, "polling events not received")
+			}
+		}
+		require.Len(t, added, 3)
+		require.NoError(t, cl.Stop())
+		_, err = cl.StartSync(10)
+		require.NoError(t, err)
+		require.NoError(t, cl.Stop())
+	})
+
+	t.Run("WithConsumerNotReadingEvents", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+
+		ch, err := cl.StartSync(0)
+		require.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+
+		// The events are not consumed, but the Stop must not block
+		require.NoError(t, cl.Stop())
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		require.NoError(t, cl.Drain(ctx))
+		for range ch {
+		}
+	})
+
+	t.Run("ProcessInfo", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.Nil(t, cl.ProcessInfo())
+		require.NoError(t, cl.Run())
+
+		info := cl.ProcessInfo()
+		require.NotNil(t, info)
+		require.Greater(t, info.PID, 0)
+		require.WithinDuration(t, time.Now(), info.StartTime, 10*time.Second)
+		require.True(t, filepath.IsAbs(info.Executable))
+		require.Equal(t, "dummy-discovery", filepath.Base(info.Executable))
+
+		cl.Quit()
+		require.Nil(t, cl.ProcessInfo())
+	})
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add([]byte(`{"eventType":"hello","protocolVersion":1,"message":"OK"}`))
+	f.Add([]byte(`{"eventType":"list","ports":[{"address":"1","protocol":"dummy","properties":{"vid":"0x2341"}}]}`))
+	f.Add([]byte(`{"eventType":"add","port":{"address":"1","protocol":"dummy"}}{"eventType":"remove","port":null}`))
+	f.Add([]byte(`{"eventType":"list","ports":[null]}`))
+	f.Add([]byte(`{"eventType":"describe","message":"OK","description":{"protocols":["dummy"]}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for {
+			msg, err := decodeMessage(decoder)
+			if err != nil {
+				return
+			}
+			_ = msg.String()
+			if msg.EventType == EventTypeAdd || msg.EventType == EventTypeRemove {
+				require.NotNil(t, msg.Port)
+				_ = msg.Port.Clone()
+			}
+			_, _ = helloResponse(msg)
+			if ports, err := listResponse(msg); err == nil {
+				for _, port := range ports {
+					require.NotNil(t, port)
+					_ = port.Clone()
+				}
+			}
+			_, _ = describeResponse(msg)
+		}
+	})
+}
+
+func TestClientTimeouts(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("testdata/netcat")
+	require.NoError(t, builder.Run())
+
+	listener, err := net.ListenTCP("tcp", nil)
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		// Accept the connection without ever answering
+		if conn, err := listener.Accept(); err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+
+	disc := NewClient("test", "testdata/netcat/netcat", listener.Addr().String())
+	disc.SetStartTimeout(10 * time.Second)
+	disc.SetHelloTimeout(100 * time.Millisecond)
+	err = disc.Run()
+	require.ErrorIs(t, err, ErrHelloTimeout)
+	require.NotErrorIs(t, err, ErrStartTimeout)
+	require.False(t, disc.Alive())
+}
+
+func TestClientSuppressDuplicateAdds(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("testdata/netcat")
+	require.NoError(t, builder.Run())
+
+	listener, err := net.ListenTCP("tcp", nil)
+	require.NoError(t, err)
+
+	disc := NewClientWithOptions("test", "testdata/netcat/netcat",
+		WithArgs(listener.Addr().String()),
+		WithSuppressDuplicateAdds(true))
+	require.NoError(t, disc.runProcess())
+	// The HELLO handshake is skipped, the netcat doesn't answer to it
+	disc.transition(CommandHello)
+	defer func() {
+		disc.statusMutex.Lock()
+		disc.killProcess()
+		disc.statusMutex.Unlock()
+	}()
+
+	listener.SetDeadline(time.Now().Add(time.Second))
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	go io.Copy(io.Discard, conn)
+
+	_, err = conn.Write([]byte(`{"eventType":"start_sync","message":"OK"}`))
+	require.NoError(t, err)
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte(`
+		{"eventType":"add","port":{"address":"1","protocol":"test","properties":{"pid":"1"}}}
+		{"eventType":"add","port":{"address":"1","protocol":"test","properties":{"pid":"1"}}}
+		{"eventType":"add","port":{"address":"1","protocol":"test","properties":{"pid":"2"}}}
+		{"eventType":"remove","port":{"address":"1","protocol":"test"}}
+		{"eventType":"add","port":{"address":"1","protocol":"test","properties":{"pid":"2"}}}
+		{"eventType":"add","port":{"address":"1","protocol":"test","properties":{"pid":"2"}}}
+	`))
+	require.NoError(t, err)
+
+	expected := []string{"add 1", "add 2", "remove", "add 2"}
+	for _, exp := range expected {
+		select {
+		case ev := <-events:
+			desc := ev.Type
+			if ev.Type == EventTypeAdd {
+				desc += " " + ev.Port.Properties.Get("pid")
+			}
+			require.Equal(t, exp, desc)
+		case <-time.After(time.Second):
+			require.FailNow(t, "event not received", exp)
+		}
+	}
+	require.Eventually(t, func() bool { return disc.SuppressedDuplicates() == 2 }, time.Second, 10*time.Millisecond)
+	select {
+	case ev := <-events:
+		require.FailNow(t, "unexpected event", ev.Type)
+	default:
+	}
+}
+
+func TestClientDebounceAndFilter(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("testdata/netcat")
+	require.NoError(t, builder.Run())
+
+	listener, err := net.ListenTCP("tcp", nil)
+	require.NoError(t, err)
+
+	clock := NewManualClock(time.Now())
+	disc := NewClient("test", "testdata/netcat/netcat", listener.Addr().String())
+	disc.SetClock(clock)
+	disc.SetDebounce(time.Second)
+	disc.SetPortFilter(func(port *Port) bool { return port.Protocol == "serial" })
+	require.NoError(t, disc.runProcess())
+	// The HELLO handshake is skipped, the netcat doesn't answer to it
+	disc.transition(CommandHello)
+	defer func() {
+		disc.statusMutex.Lock()
+		disc.killProcess()
+		disc.statusMutex.Unlock()
+	}()
+
+	listener.SetDeadline(time.Now().Add(time.Second))
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	go io.Copy(io.Discard, conn)
+
+	_, err = conn.Write([]byte(`{"eventType":"start_sync","message":"OK"}`))
+	require.NoError(t, err)
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+
+	recv := func() *Event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			require.FailNow(t, "event not received")
+			return nil
+		}
+	}
+
+	_, err = conn.Write([]byte(`
+		{"eventType":"add","port":{"address":"1","protocol":"serial"}}
+		{"eventType":"add","port":{"address":"2","protocol":"network"}}
+		{"eventType":"remove","port":{"address":"1","protocol":"serial"}}
+		{"eventType":"add","port":{"address":"1","protocol":"serial"}}
+		{"eventType":"remove","port":{"address":"2","protocol":"network"}}
+		{"eventType":"remove","port":{"address":"1","protocol":"serial"}}
+		{"eventType":"add","port":{"address":"3","protocol":"serial"}}
+	`))
+	require.NoError(t, err)
+
+	// The port removed and added again is not reported, the filtered port is ignored
+	ev := recv()
+	require.Equal(t, EventTypeAdd, ev.Type)
+	require.Equal(t, "1", ev.Port.Address)
+	ev = recv()
+	require.Equal(t, EventTypeAdd, ev.Type)
+	require.Equal(t, "3", ev.Port.Address)
+
+	// The remove is delivered after the debounce
+	select {
+	case ev := <-events:
+		require.FailNow(t, "unexpected event", ev.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	ev = recv()
+	require.Equal(t, EventTypeRemove, ev.Type)
+	require.Equal(t, "1", ev.Port.Address)
+}
+
+func TestClientWorkspace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	base := t.TempDir()
+	disc := NewClient("test:1", "sh", "-c", `touch "$DISCOVERY_TEMP_DIR/$DISCOVERY_WORK_DIR_MARKER" "$TMPDIR/tmp" cwd && exec cat`)
+	disc.SetEnv([]string{"DISCOVERY_WORK_DIR_MARKER=env"})
+	disc.SetWorkspace(base)
+	require.Empty(t, disc.WorkDir())
+	require.NoError(t, disc.runProcess())
+	workDir := disc.WorkDir()
+	require.NotEmpty(t, workDir)
+	root := filepath.Dir(workDir)
+	require.Equal(t, base, filepath.Dir(root))
+	require.True(t, strings.HasPrefix(filepath.Base(root), "discovery-test_1-"))
+	tempDir := filepath.Join(root, "tmp")
+	require.Eventually(t, func() bool {
+		for _, file := range []string{filepath.Join(workDir, "cwd"), filepath.Join(tempDir, "env"), filepath.Join(tempDir, "tmp")} {
+			if _, err := os.Stat(file); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The workspace is removed when the process terminates
+	disc.kill()
+	require.Empty(t, disc.WorkDir())
+	_, err := os.Stat(root)
+	require.True(t, os.IsNotExist(err))
+
+	// A relative path of the executable is resolved against the working
+	// directory of the caller, not the workspace
+	script := filepath.Join(t.TempDir(), "discovery.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\ntouch started && exec cat\n"), 0755))
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	relScript, err := filepath.Rel(cwd, script)
+	require.NoError(t, err)
+	disc = NewClientWithOptions("test:2", relScript, WithWorkspace(base))
+	require.NoError(t, disc.runProcess())
+	defer disc.kill()
+	workDir = disc.WorkDir()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(workDir, "started"))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// legacyDiscoveryScript is a shell script emulating a discovery supporting only
+// the protocol version 1.
+const legacyDiscoveryScript = `while read cmd rest; do
+  case $cmd in
+    HELLO) echo '{"eventType":"hello","protocolVersion":1,"message":"OK"}' ;;
+    START) echo '{"eventType":"start","message":"OK"}' ;;
+    LIST) echo '{"eventType":"list","ports":[{"address":"1","protocol":"serial","properties":{"vid":"0x2341","pid":"0x0043"}}]}' ;;
+    QUIT) echo '{"eventType":"quit","message":"OK"}'; exit ;;
+    *) echo '{"eventType":"command_error","error":true,"message":"Command not supported"}' ;;
+  esac
+done`
+
+func TestClientProtocolShim(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+
+	// Without the shim the v2 features are not available
+	disc := NewClient("legacy", "sh", "-c", legacyDiscoveryScript)
+	require.NoError(t, disc.Run())
+	require.False(t, disc.ShimActive())
+	_, err := disc.Describe()
+	require.Error(t, err)
+	require.Error(t, disc.Configure("interval", "1s"))
+	disc.Quit()
+
+	disc = NewClient("legacy", "sh", "-c", legacyDiscoveryScript)
+	disc.SetProtocolShim(true)
+	require.NoError(t, disc.Configure("interval", "1s"))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	require.True(t, disc.ShimActive())
+	require.NoError(t, disc.Configure("interval", "2s"))
+	require.NoError(t, disc.CancelList())
+
+	desc, err := disc.Describe()
+	require.NoError(t, err)
+	require.Empty(t, desc.Protocols)
+	require.NoError(t, disc.Start())
+	ports, err := disc.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+	desc, err = disc.Describe()
+	require.NoError(t, err)
+	require.Equal(t, []string{"serial"}, desc.Protocols)
+	require.Equal(t, []string{"pid", "vid"}, desc.PropertyKeys)
+}
+
+func TestClientPTY(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "freebsd" {
+		disc := NewClient("pty", "sh", "-c", "exit")
+		disc.SetPTY(true)
+		require.ErrorIs(t, disc.Run(), ErrPTYNotSupported)
+		return
+	}
+	script := `if [ -t 1 ]; then label=tty; else label=pipe; fi
+` + strings.Replace(legacyDiscoveryScript, `"address":"1"`, `"address":"1","label":"'$label'"`, 1)
+	for _, usePTY := range []bool{false, true} {
+		disc := NewClient("pty", "sh", "-c", script)
+		disc.SetPTY(usePTY)
+		require.NoError(t, disc.Run())
+		require.NoError(t, disc.Start())
+		ports, err := disc.List()
+		require.NoError(t, err)
+		require.Len(t, ports, 1)
+		if usePTY {
+			require.Equal(t, "tty", ports[0].AddressLabel)
+		} else {
+			require.Equal(t, "pipe", ports[0].AddressLabel)
+		}
+		disc.Quit()
+		require.False(t, disc.Alive())
+	}
+
+	// The CRLF line endings are normalized, even when split across reads
+	r := &ptyReader{master: iotest.OneByteReader(strings.NewReader("{\"a\":1}\r\n\r{}\r\n\r"))}
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "{\"a\":1}\n\r{}\n\r", string(data))
+}
+
+func TestClientOptions(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	disc := NewClientWithOptions("opts", "discovery-bin",
+		WithArgs("-v", "--port", "1"),
+		WithEnv("A=1", "B=2"),
+		WithUserAgent("test-agent"),
+		WithTimeouts(time.Second, 2*time.Second),
+		WithClock(clock),
+		WithTransport(TransportPTY),
+		WithWorkspace("/tmp/base"),
+		WithMiddleware(nil, nil),
+		WithCompactOutput(true),
+	)
+	require.Equal(t, []string{"discovery-bin", "-v", "--port", "1"}, disc.processArgs)
+	require.Equal(t, []string{"A=1", "B=2"}, disc.env)
+	require.Equal(t, "test-agent", disc.userAgent)
+	require.Equal(t, time.Second, disc.startTimeout)
+	require.Equal(t, 2*time.Second, disc.helloTimeout)
+	require.Same(t, clock, disc.clock)
+	require.True(t, disc.usePTY)
+	require.Equal(t, "/tmp/base", disc.workspaceBase)
+	require.Len(t, disc.middlewares, 2)
+	require.True(t, disc.compactOutput)
+
+	// The defaults are the same of NewClient
+	require.Equal(t, NewClient("opts", "discovery-bin"), NewClientWithOptions("opts", "discovery-bin"))
+
+	// The in-process transport runs the registered Discovery
+	disc = NewClientWithOptions("opts", "test-inprocess", WithTransport(TransportInProcess), WithLogger(&testLogger{}))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	require.Nil(t, disc.ProcessInfo())
+	require.NoError(t, disc.Start())
+	ports, err := disc.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+
+	// The compact output is negotiated in the HELLO
+	compact := NewClientWithOptions("compact", "test-inprocess", WithTransport(TransportInProcess), WithCompactOutput(true))
+	require.NoError(t, compact.Run())
+	defer compact.Quit()
+	require.NoError(t, compact.Start())
+	ports, err = compact.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+}
+
+func TestClientPing(t *testing.T) {
+	m := NewManager()
+	require.NoError(t, m.Add(NewInProcessClient("inprocess", "test-inprocess")))
+	require.NoError(t, m.Add(NewInProcessClient("stopped", "test-inprocess")))
+	defer m.QuitAll(context.Background())
+	disc := m.discoveries["inprocess"]
+	require.NoError(t, disc.Run())
+	require.True(t, disc.LastHeartbeat().IsZero())
+	_, err := disc.Ping()
+	require.NoError(t, err)
+	require.False(t, disc.LastHeartbeat().IsZero())
+	require.Empty(t, m.PingAll())
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	legacy := NewClient("legacy", "sh", "-c", legacyDiscoveryScript)
+	require.NoError(t, legacy.Run())
+	defer legacy.Quit()
+	_, err = legacy.Ping()
+	require.ErrorIs(t, err, ErrPingNotSupported)
+
+	// The PING is not sent if not advertised in the capabilities
+	noPing := NewClient("noping", "sh", "-c", strings.ReplaceAll(hungPingDiscoveryScript, `["PING"]`, `[]`))
+	require.NoError(t, noPing.Run())
+	defer noPing.Quit()
+	_, err = noPing.Ping()
+	require.ErrorIs(t, err, ErrPingNotSupported)
+	// Neither the CONFIGURE
+	require.ErrorContains(t, noPing.Configure("interval", "1s"), "CONFIGURE not supported by discovery noping: not in the capabilities")
+}
+
+// hungPingDiscoveryScript is a discovery advertising the PING command
+// without ever answering it.
+const hungPingDiscoveryScript = `while read cmd rest; do
+  case $cmd in
+    HELLO) echo '{"eventType":"hello","protocolVersion":2,"message":"OK"}' ;;
+    START) echo '{"eventType":"start","message":"OK"}' ;;
+    DESCRIBE) echo '{"eventType":"describe","message":"OK","description":{"capabilities":["PING"]}}' ;;
+    QUIT) echo '{"eventType":"quit","message":"OK"}'; exit ;;
+  esac
+done`
+
+func TestManagerPingInterval(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	m := NewManager()
+	m.SetClock(clock)
+	m.SetPingInterval(time.Minute)
+	disc := NewClientWithOptions("inprocess", "test-inprocess", WithTransport(TransportInProcess), WithClock(clock))
+	require.NoError(t, m.Add(disc))
+	require.Empty(t, m.Start())
+	require.True(t, disc.LastHeartbeat().IsZero())
+	require.Eventually(t, func() bool { return clock.PendingTimers() > 0 }, time.Second, time.Millisecond)
+	clock.Advance(time.Minute)
+	require.Eventually(t, func() bool { return !disc.LastHeartbeat().IsZero() }, time.Second, time.Millisecond)
+	require.NoError(t, m.QuitAll(context.Background()))
+
+	// The pings don't receive the responses to the concurrent commands
+	m = NewManager()
+	m.SetPingInterval(time.Microsecond)
+	m.SetRestartPolicy(DefaultRestartPolicy())
+	unresponsive := make(chan error, 1)
+	m.OnHealthEvent(func(ev *HealthEvent) {
+		if ev.Type != HealthEventUnresponsive {
+			return
+		}
+		select {
+		case unresponsive <- ev.Err:
+		default:
+		}
+	})
+	disc = NewInProcessClient("inprocess", "test-inprocess")
+	disc.Use(func(next Handler) Handler {
+		return func(x *Exchange) error {
+			err := next(x)
+			if x.Command == CommandList {
+				// Let the pings wait for a response before the LIST
+				time.Sleep(5 * time.Millisecond)
+			}
+			return err
+		}
+	})
+	require.NoError(t, m.Add(disc))
+	require.Empty(t, m.Start())
+	for i := 0; i < 20; i++ {
+		_, err := disc.List()
+		require.NoError(t, err)
+	}
+	require.False(t, disc.LastHeartbeat().IsZero())
+	require.Empty(t, unresponsive)
+	require.NoError(t, m.QuitAll(context.Background()))
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// A supervised discovery not answering the pings is restarted
+	clock = NewManualClock(time.Now())
+	m = NewManager()
+	m.SetClock(clock)
+	m.SetPingInterval(time.Minute)
+	m.SetRestartPolicy(DefaultRestartPolicy())
+	healthEvents := make(chan string, 10)
+	m.OnHealthEvent(func(ev *HealthEvent) {
+		select {
+		case healthEvents <- ev.Type:
+		default:
+		}
+	})
+	hung := NewClientWithOptions("hung", "sh", WithArgs("-c", hungPingDiscoveryScript), WithClock(clock))
+	require.NoError(t, m.Add(hung))
+	defer m.QuitAll(context.Background())
+	require.Empty(t, m.Start())
+	require.Eventually(t, func() bool {
+		clock.Advance(10 * time.Second)
+		return len(healthEvents) >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, HealthEventUnresponsive, <-healthEvents)
+	require.Equal(t, HealthEventCrashed, <-healthEvents)
+	require.Equal(t, HealthEventRestarted, <-healthEvents)
+}
+
+func TestClientVerifyExecutable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	script := filepath.Join(t.TempDir(), "discovery.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n"+legacyDiscoveryScript+"\n"), 0755))
+	sum, err := fileSHA256(script)
+	require.NoError(t, err)
+	require.Len(t, sum, 64)
+
+	disc := NewClientWithOptions("verified", script, WithChecksum(strings.ToUpper(sum)))
+	require.NoError(t, disc.Run())
+	disc.Quit()
+
+	disc = NewClientWithOptions("corrupted", script, WithChecksum(strings.Repeat("0", 64)))
+	err = disc.Run()
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.False(t, disc.Alive())
+
+	verified := ""
+	disc = NewClientWithOptions("signed", script, WithVerifier(func(path string) error {
+		verified = path
+		return errors.New("invalid signature")
+	}))
+	require.ErrorContains(t, disc.Run(), "invalid signature")
+	require.Equal(t, script, verified)
+
+	// The executable verified is the one started, also when the path is
+	// relative and the process runs in its workspace
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	relScript, err := filepath.Rel(cwd, script)
+	require.NoError(t, err)
+	disc = NewClientWithOptions("relative", relScript, WithWorkspace(t.TempDir()), WithChecksum(sum), WithVerifier(func(path string) error {
+		verified = path
+		return nil
+	}))
+	require.NoError(t, disc.Run())
+	disc.Quit()
+	require.Equal(t, script, verified)
+
+	m := NewManager()
+	require.Error(t, m.LoadConfig(&ManagerConfig{Discoveries: []*DiscoveryConfig{{ID: "a", InProcess: "test-inprocess", SHA256: sum}}}))
+	require.NoError(t, m.LoadConfig(&ManagerConfig{Discoveries: []*DiscoveryConfig{{ID: "a", Command: script, SHA256: "bad"}}}))
+	require.ErrorIs(t, m.Start()["a"], ErrChecksumMismatch)
+}
+
+func TestClientWait(t *testing.T) {
+	disc := NewInProcessClient("inprocess", "test-inprocess")
+	require.NoError(t, disc.Wait(context.Background()))
+
+	require.NoError(t, disc.Run())
+	_, err := disc.StartSync(10)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, disc.Wait(ctx), context.DeadlineExceeded)
+
+	disc.Quit()
+	require.NoError(t, disc.Wait(context.Background()))
+	require.False(t, disc.Alive())
+	select {
+	case <-disc.processTerminated():
+	default:
+		require.Fail(t, "decode loop still running")
+	}
+
+	// An unexpected termination is waited as well
+	require.NoError(t, disc.Run())
+	disc.kill()
+	require.NoError(t, disc.Wait(context.Background()))
+}
+
+// burstDiscovery sends the number of "add" events received from burstTrigger,
+// after the START_SYNC response has been sent.
+type burstDiscovery struct {
+	nullDiscovery
+}
+
+var burstTrigger = make(chan int)
+
+func (d *burstDiscovery) StartSyncWithContext(ctx context.Context, eventCB EventCallback, _ ErrorCallback) error {
+	go func() {
+		select {
+		case n := <-burstTrigger:
+			for i := 0; i < n; i++ {
+				eventCB(EventTypeAdd, &Port{Address: strconv.Itoa(i), Protocol: "network"})
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return nil
+}
+
+func init() {
+	Register("test-burst", func() Discovery { return &burstDiscovery{} })
+}
+
+func TestClientListFromCache(t *testing.T) {
+	disc := NewInProcessClient("payload", "test-payload")
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	_, _, err := disc.ListFromCache()
+	require.Error(t, err)
+
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+	ports, seq, err := disc.ListFromCache()
+	require.NoError(t, err)
+
+	// The events up to seq are already in the cache
+	state := map[string]bool{}
+	for _, port := range ports {
+		state[port.Address] = true
+	}
+	for len(state) < 3 {
+		ev := <-events
+		if ev.Seq <= seq {
+			require.True(t, state[ev.Port.Address])
+			continue
+		}
+		require.False(t, state[ev.Port.Address], "duplicated event %d", ev.Seq)
+		state[ev.Port.Address] = true
+	}
+
+	ports, _, err = disc.ListFromCache()
+	require.NoError(t, err)
+	require.Len(t, ports, 3)
+	require.Equal(t, "1", ports[0].Address)
+
+	// The cache is available only in sync mode
+	require.NoError(t, disc.Stop())
+	_, _, err = disc.ListFromCache()
+	require.Error(t, err)
+
+	// The cache is available while the consumer is blocking the delivery
+	burst := NewInProcessClient("burst", "test-burst")
+	require.NoError(t, burst.Run())
+	defer burst.Quit()
+	events, err = burst.StartSync(1)
+	require.NoError(t, err)
+	burstTrigger <- 5
+	require.Eventually(t, func() bool {
+		ports, _, err := burst.ListFromCache()
+		return err == nil && len(ports) >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+	ports, seq, err = burst.ListFromCache()
+	require.NoError(t, err)
+	state = map[string]bool{}
+	for _, port := range ports {
+		state[port.Address] = true
+	}
+	for len(state) < 5 {
+		ev := <-events
+		if ev.Seq > seq {
+			state[ev.Port.Address] = true
+		}
+	}
+}
+
+func TestClientSyncWithSnapshot(t *testing.T) {
+	disc := NewInProcessClient("payload", "test-payload")
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+
+	// The events sent before the START_SYNC response are in the snapshot
+	snapshot, events, err := disc.SyncWithSnapshot(10)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 3)
+	require.NoError(t, disc.Stop())
+	ev, ok := <-events
+	require.True(t, ok)
+	require.Equal(t, EventTypeStop, ev.Type)
+	_, ok = <-events
+	require.False(t, ok)
+
+	// A burst larger than the channel, sent after the START_SYNC response, is
+	// split between the snapshot and the events, without waiting on the clock
+	burst := NewClientWithOptions("burst", "test-burst", WithTransport(TransportInProcess), WithClock(NewManualClock(time.Now())))
+	require.NoError(t, burst.Run())
+	defer burst.Quit()
+	go func() { burstTrigger <- 20 }()
+	snapshot, events, err = burst.SyncWithSnapshot(2)
+	require.NoError(t, err)
+	state := map[string]bool{}
+	for _, port := range snapshot {
+		state[port.Address] = true
+	}
+	for len(state) < 20 {
+		ev := <-events
+		require.False(t, state[ev.Port.Address], "overlapping event %d", ev.Seq)
+		state[ev.Port.Address] = true
+	}
+	require.NoError(t, burst.Stop())
+	ev = <-events
+	require.Equal(t, EventTypeStop, ev.Type)
+}
+
+// teeWriter is a writer safe for concurrent use, blocking the writes while
+// blocked is not nil.
+type teeWriter struct {
+	mutex   sync.Mutex
+	out     strings.Builder
+	blocked chan struct{}
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	if w.blocked != nil {
+		<-w.blocked
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.out.Write(p)
+}
+
+func (w *teeWriter) String() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.out.String()
+}
+
+func TestClientTeeEvents(t *testing.T) {
+	ndjson, csvOut := &teeWriter{}, &teeWriter{}
+	disc := NewClientWithOptions("payload", "test-payload", WithTransport(TransportInProcess))
+	require.NoError(t, disc.TeeEvents(ndjson, TeeFormatNDJSON))
+	require.NoError(t, disc.TeeEvents(csvOut, TeeFormatCSV))
+	require.Error(t, disc.TeeEvents(ndjson, "xml"))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		<-events
+	}
+	// The final stop event is mirrored too
+	require.NoError(t, disc.Stop())
+	require.Equal(t, EventTypeStop, (<-events).Type)
+
+	require.Eventually(t, func() bool { return strings.Count(ndjson.String(), "\n") == 4 }, time.Second, time.Millisecond)
+	lines := strings.Split(strings.TrimSpace(ndjson.String()), "\n")
+	require.JSONEq(t, `{"seq":1,"eventType":"add","discoveryId":"payload","port":{"address":"1","protocol":"ble"},"payload":{"rssi":-42,"band":"2.4GHz"}}`, lines[0])
+	require.JSONEq(t, `{"seq":4,"eventType":"stop","discoveryId":"payload"}`, lines[3])
+	expected := strings.Join([]string{
+		"seq,eventType,discoveryId,address,protocol,label,hardwareId,properties,message",
+		"1,add,payload,1,ble,,,,",
+		"2,add,payload,2,ble,,,,",
+		"3,add,payload,3,ble,,,,",
+		"4,stop,payload,,,,,,",
+	}, "\n") + "\n"
+	require.Eventually(t, func() bool { return csvOut.String() == expected }, time.Second, time.Millisecond)
+
+	// A blocked writer doesn't delay the delivery of the events
+	blocked := &teeWriter{blocked: make(chan struct{})}
+	disc = NewClientWithOptions("blocked", "test-payload", WithTransport(TransportInProcess))
+	require.NoError(t, disc.TeeEvents(blocked, TeeFormatNDJSON))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	events, err = disc.StartSync(10)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		<-events
+	}
+	require.Empty(t, blocked.String())
+	close(blocked.blocked)
+	require.Eventually(t, func() bool { return strings.Count(blocked.String(), "\n") == 3 }, time.Second, time.Millisecond)
+}
+
+func TestClientHandshakeStore(t *testing.T) {
+	store := NewMemoryHandshakeStore()
+	info, err := store.LoadHandshake("slow")
+	require.NoError(t, err)
+	require.Nil(t, info)
+
+	// The HELLO timeout is extended for the discoveries known to start slowly
+	require.NoError(t, store.SaveHandshake("slow", &HandshakeInfo{ProtocolVersion: 2, StartupTime: 5 * time.Second, Samples: 1}))
+	disc := NewClientWithOptions("slow", "test-inprocess", WithHandshakeStore(store), WithTimeouts(0, 10*time.Second))
+	require.Equal(t, 20*time.Second, disc.loadHandshake())
+	disc = NewClientWithOptions("fast", "test-inprocess", WithHandshakeStore(store), WithTimeouts(0, 10*time.Second))
+	require.Equal(t, 10*time.Second, disc.loadHandshake())
+
+	// The average startup time is updated at each run
+	disc = NewClientWithOptions("slow", "test-inprocess", WithTransport(TransportInProcess), WithHandshakeStore(store))
+	require.NoError(t, disc.Run())
+	disc.Quit()
+	info, err = store.LoadHandshake("slow")
+	require.NoError(t, err)
+	require.Equal(t, 2, info.Samples)
+	require.Less(t, info.StartupTime, 5*time.Second)
+
+	// The commands known not to be supported are not sent
+	require.NoError(t, store.SaveHandshake("noping", &HandshakeInfo{ProtocolVersion: 2, Capabilities: []string{}}))
+	disc = NewClientWithOptions("noping", "test-inprocess", WithTransport(TransportInProcess), WithHandshakeStore(store))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	_, err = disc.Ping()
+	require.ErrorIs(t, err, ErrPingNotSupported)
+
+	// A corrupted file store is reported and then overwritten
+	path := filepath.Join(t.TempDir(), "handshakes.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0644))
+	fileStore := NewFileHandshakeStore(path)
+	_, err = fileStore.LoadHandshake("1")
+	require.Error(t, err)
+	require.NoError(t, fileStore.SaveHandshake("1", &HandshakeInfo{ProtocolVersion: 1}))
+	info, err = fileStore.LoadHandshake("1")
+	require.NoError(t, err)
+	require.Equal(t, 1, info.ProtocolVersion)
+}
+
+func TestClientIdempotentCommands(t *testing.T) {
+	disc := NewClientWithOptions("idempotent", "test-inprocess", WithTransport(TransportInProcess), WithIdempotentCommands(true))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	require.NoError(t, disc.Run())
+	require.NoError(t, disc.Stop())
+	require.NoError(t, disc.Start())
+	require.NoError(t, disc.Start())
+	require.Equal(t, StateStarted, disc.State())
+	require.NoError(t, disc.Stop())
+	require.NoError(t, disc.Stop())
+	require.Equal(t, StateIdle, disc.State())
+
+	// The commands not allowed in the current state are still refused
+	_, err := disc.StartSync(10)
+	require.NoError(t, err)
+	require.ErrorIs(t, disc.Start(), ErrCommandNotAllowed)
+
+	// Without the option the repeated commands are refused
+	disc = NewClientWithOptions("strict", "test-inprocess", WithTransport(TransportInProcess))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	require.NoError(t, disc.Start())
+	require.ErrorIs(t, disc.Start(), ErrCommandNotAllowed)
+}
+
+func TestClientSendRawCommand(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("testdata/netcat")
+	require.NoError(t, builder.Run())
+
+	listener, err := net.ListenTCP("tcp", nil)
+	require.NoError(t, err)
+
+	disc := NewClient("test", "testdata/netcat/netcat", listener.Addr().String())
+	_, err = disc.SendRawCommand("X_VENDOR_SCAN")
+	require.Error(t, err)
+	require.NoError(t, disc.runProcess())
+	// The HELLO handshake is skipped, the netcat doesn't answer to it
+	disc.transition(CommandHello)
+	defer func() {
+		disc.statusMutex.Lock()
+		disc.killProcess()
+		disc.statusMutex.Unlock()
+	}()
+
+	listener.SetDeadline(time.Now().Add(time.Second))
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	commands := bufio.NewReader(conn)
+
+	_, err = disc.SendRawCommand("START")
+	require.ErrorContains(t, err, "typed methods")
+	_, err = disc.SendRawCommand("X_VENDOR_SCAN\nQUIT")
+	require.Error(t, err)
+
+	_, err = conn.Write([]byte(`{"eventType":"vendor_scan","message":"OK","devices":[{"id":1}]}`))
+	require.NoError(t, err)
+	res, err := disc.SendRawCommand("X_VENDOR_SCAN usb")
+	require.NoError(t, err)
+	cmd, err := commands.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "X_VENDOR_SCAN usb\n", cmd)
+	require.Equal(t, "vendor_scan", res.EventType)
+	require.Equal(t, "OK", res.Message)
+	var devices []struct{ ID int }
+	require.NoError(t, res.Field("devices", &devices))
+	require.Equal(t, 1, devices[0].ID)
+	require.Error(t, res.Field("missing", &devices))
+
+	_, err = conn.Write([]byte(`{"eventType":"command_error","error":true,"message":"Command X_UNKNOWN not supported"}`))
+	require.NoError(t, err)
+	res, err = disc.SendRawCommand("X_UNKNOWN")
+	require.ErrorContains(t, err, "not supported")
+	require.True(t, res.Error)
 }
@@ -0,0 +1,235 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// defaultResponseTimeout is the maximum time allowed to the discovery to
+// answer a command, if the timeouts are not adaptive.
+const defaultResponseTimeout = 10 * time.Second
+
+// quitResponseTimeout is the maximum time allowed to the discovery to answer
+// the QUIT command, if the timeouts are not adaptive.
+const quitResponseTimeout = 5 * time.Second
+
+// latencyWindow is the number of the most recent response latencies of each
+// command kept to compute the LatencyStats.
+const latencyWindow = 64
+
+// AdaptiveTimeouts is the policy of the adaptive timeouts of the commands, see
+// WithAdaptiveTimeouts. The zero value of each field takes the default.
+type AdaptiveTimeouts struct {
+	// Factor is the multiple of the 95th percentile of the latencies of a
+	// command allowed to the discovery to answer it, 5 by default.
+	Factor float64
+	// Floor is the minimum timeout, 1s by default.
+	Floor time.Duration
+	// Ceiling is the maximum timeout, 30s by default.
+	Ceiling time.Duration
+	// MinSamples is the number of responses to a command received before
+	// adapting its timeout, 5 by default: until then the fixed timeout is used.
+	MinSamples int
+}
+
+// WithAdaptiveTimeouts adapts the timeout of each command to the latencies of
+// the responses observed (see LatencyStats), in place of the fixed 10s (5s for
+// the QUIT): the failures of an unresponsive discovery are detected much
+// sooner on the fast systems, while the slow responses of a loaded machine
+// (for example a CI runner) don't cause spurious timeouts. A timeout counts as
+// a response with a latency equal to the timeout, so the timeout grows toward
+// the Ceiling if the discovery becomes slower. The HELLO timeout is not
+// affected, see SetHelloTimeout. A nil policy disables the adaptive timeouts.
+func WithAdaptiveTimeouts(policy *AdaptiveTimeouts) ClientOption {
+	return func(disc *Client) {
+		if policy == nil {
+			disc.adaptiveTimeouts = nil
+			return
+		}
+		p := *policy
+		if p.Factor <= 0 {
+			p.Factor = 5
+		}
+		if p.Floor <= 0 {
+			p.Floor = time.Second
+		}
+		if p.Ceiling <= 0 {
+			p.Ceiling = 30 * time.Second
+		}
+		p.Ceiling = max(p.Ceiling, p.Floor)
+		if p.MinSamples <= 0 {
+			p.MinSamples = 5
+		}
+		disc.adaptiveTimeouts = &p
+	}
+}
+
+// LatencyStats are the latencies of the responses to a command observed by the
+// Client, computed on the most recent responses.
+type LatencyStats struct {
+	Command string `json:"command"`
+	// Samples is the number of responses the latencies are computed on.
+	Samples int           `json:"samples"`
+	Mean    time.Duration `json:"mean"`
+	P50     time.Duration `json:"p50"`
+	P95     time.Duration `json:"p95"`
+	Max     time.Duration `json:"max"`
+	// Timeout is the timeout currently applied to the command.
+	Timeout time.Duration `json:"timeout"`
+	// Timeouts is the number of times the discovery failed to answer the
+	// command in time.
+	Timeouts uint64 `json:"timeouts"`
+}
+
+// commandLatencies are the most recent latencies of the responses to a command.
+type commandLatencies struct {
+	samples  []time.Duration
+	next     int
+	timeouts uint64
+}
+
+// LatencyStats returns the latencies of the responses to the commands observed
+// during all the runs of the discovery, sorted by command.
+func (disc *Client) LatencyStats() []*LatencyStats {
+	disc.latenciesMutex.Lock()
+	defer disc.latenciesMutex.Unlock()
+	commands := []string{}
+	for command := range disc.latencies {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	res := []*LatencyStats{}
+	for _, command := range commands {
+		res = append(res, disc.latencyStats(command))
+	}
+	return res
+}
+
+// latencyStats computes the LatencyStats of the command, the latenciesMutex
+// must be held.
+func (disc *Client) latencyStats(command string) *LatencyStats {
+	stats := &LatencyStats{Command: command, Timeout: fixedResponseTimeout(command)}
+	l := disc.latencies[command]
+	if l == nil {
+		return stats
+	}
+	stats.Timeouts = l.timeouts
+	stats.Samples = len(l.samples)
+	if stats.Samples > 0 {
+		sorted := append([]time.Duration(nil), l.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		var total time.Duration
+		for _, sample := range sorted {
+			total += sample
+		}
+		stats.Mean = total / time.Duration(len(sorted))
+		stats.P50 = sorted[(len(sorted)-1)*50/100]
+		stats.P95 = sorted[(len(sorted)-1)*95/100]
+		stats.Max = sorted[len(sorted)-1]
+	}
+	if p := disc.adaptiveTimeouts; p != nil && stats.Samples >= p.MinSamples {
+		timeout := time.Duration(p.Factor * float64(stats.P95))
+		stats.Timeout = min(max(timeout, p.Floor), p.Ceiling)
+	}
+	return stats
+}
+
+// fixedResponseTimeout returns the maximum time allowed to the discovery to
+// answer the command, if the timeouts are not adaptive.
+func fixedResponseTimeout(command string) time.Duration {
+	if command == CommandQuit {
+		return quitResponseTimeout
+	}
+	return defaultResponseTimeout
+}
+
+// responseTimeout returns the maximum time allowed to the discovery to answer
+// the command.
+func (disc *Client) responseTimeout(command string) time.Duration {
+	if disc.adaptiveTimeouts == nil {
+		return fixedResponseTimeout(command)
+	}
+	disc.latenciesMutex.Lock()
+	defer disc.latenciesMutex.Unlock()
+	return disc.latencyStats(command).Timeout
+}
+
+// waitResponse waits the response to the command, within the response timeout
+// of the command, and records its latency. If the command times out its
+// response is expected to arrive late, and it's discarded by the next command.
+func (disc *Client) waitResponse(command string) (*discoveryMessage, error) {
+	start := disc.clock.Now()
+	msg, err := disc.waitFreshMessage(disc.responseTimeout(command))
+	disc.recordLatency(command, disc.clock.Now().Sub(start), err)
+	if errors.Is(err, errMessageTimeout) {
+		disc.lateResponses = append(disc.lateResponses, responseEventTypes[command])
+	}
+	return msg, err
+}
+
+// waitFreshMessage waits for a message like waitMessage, discarding the late
+// responses to the commands timed out before: the discovery answers the
+// commands in order, so they're received before the response to the command
+// in progress. It must be called holding the commandMutex.
+func (disc *Client) waitFreshMessage(timeout time.Duration) (*discoveryMessage, error) {
+	deadline := disc.clock.Now().Add(timeout)
+	for {
+		msg, err := disc.waitMessage(deadline.Sub(disc.clock.Now()))
+		if err != nil || len(disc.lateResponses) == 0 {
+			return msg, err
+		}
+		if msg.EventType != disc.lateResponses[0] && msg.EventType != EventTypeCommandError {
+			// The timed out commands have never been answered
+			disc.lateResponses = nil
+			return msg, nil
+		}
+		disc.lateResponses = disc.lateResponses[1:]
+		disc.logger.Debugf("Discarded late %s response from discovery %s", msg.EventType, disc)
+	}
+}
+
+// recordLatency records the latency of a response to the command, or the
+// timeout waiting for it: the time waited is a lower bound of the latency, and
+// it's recorded as well, otherwise the timeout would never grow.
+func (disc *Client) recordLatency(command string, latency time.Duration, err error) {
+	disc.latenciesMutex.Lock()
+	defer disc.latenciesMutex.Unlock()
+	if disc.latencies == nil {
+		disc.latencies = map[string]*commandLatencies{}
+	}
+	l := disc.latencies[command]
+	if l == nil {
+		l = &commandLatencies{}
+		disc.latencies[command] = l
+	}
+	if errors.Is(err, errMessageTimeout) {
+		l.timeouts++
+	} else if err != nil {
+		// The discovery terminated, the latency is meaningless
+		return
+	}
+	if len(l.samples) < latencyWindow {
+		l.samples = append(l.samples, latency)
+	} else {
+		l.samples[l.next] = latency
+		l.next = (l.next + 1) % latencyWindow
+	}
+}
@@ -0,0 +1,114 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sluggishDiscovery answers the LIST after a while, once the first lists have
+// been answered quickly
+type sluggishDiscovery struct {
+	nullDiscovery
+	lists int
+}
+
+func (d *sluggishDiscovery) List(ctx context.Context) ([]*Port, error) {
+	d.lists++
+	if d.lists > 3 {
+		select {
+		case <-time.After(150 * time.Millisecond):
+		case <-ctx.Done():
+		}
+	}
+	return []*Port{}, nil
+}
+
+func init() {
+	Register("test-sluggish", func() Discovery { return &sluggishDiscovery{} })
+}
+
+func TestClientAdaptiveTimeouts(t *testing.T) {
+	disc := NewClientWithOptions("sluggish", "test-sluggish",
+		WithTransport(TransportInProcess),
+		WithAdaptiveTimeouts(&AdaptiveTimeouts{MinSamples: 3, Floor: 50 * time.Millisecond, Ceiling: 5 * time.Second}))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	require.NoError(t, disc.Start())
+	list := func() *LatencyStats {
+		for _, stats := range disc.LatencyStats() {
+			if stats.Command == CommandList {
+				return stats
+			}
+		}
+		return nil
+	}
+
+	// The fixed timeout is used until enough responses have been observed
+	_, err := disc.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, list().Samples)
+	require.Equal(t, 10*time.Second, list().Timeout)
+	for i := 0; i < 2; i++ {
+		_, err := disc.List()
+		require.NoError(t, err)
+	}
+	stats := list()
+	require.Equal(t, 3, stats.Samples)
+	require.LessOrEqual(t, stats.P50, stats.P95)
+	require.LessOrEqual(t, stats.P95, stats.Max)
+	// The fast responses are bounded by the floor
+	require.Equal(t, 50*time.Millisecond, stats.Timeout)
+
+	// A discovery slower than usual times out sooner
+	start := time.Now()
+	_, err = disc.List()
+	require.ErrorIs(t, err, errMessageTimeout)
+	require.Less(t, time.Since(start), 150*time.Millisecond)
+	require.Equal(t, uint64(1), list().Timeouts)
+	require.Equal(t, 4, list().Samples)
+
+	// The timeouts count as slow responses: the timeout grows until the
+	// discovery, that became slower, answers in time, after the late
+	// responses to the LIST timed out have been discarded
+	for i := 0; ; i++ {
+		require.Less(t, i, 5, "timeout stuck at %s", list().Timeout)
+		_, err = disc.List()
+		if err == nil {
+			break
+		}
+		require.ErrorIs(t, err, errMessageTimeout)
+	}
+	require.GreaterOrEqual(t, list().Max, 150*time.Millisecond)
+	// The next command receives its own response
+	require.NoError(t, disc.Stop())
+
+	// The other commands are tracked separately
+	var startStats *LatencyStats
+	for _, stats := range disc.LatencyStats() {
+		if stats.Command == CommandStart {
+			startStats = stats
+		}
+	}
+	require.NotNil(t, startStats)
+	require.Equal(t, 1, startStats.Samples)
+}
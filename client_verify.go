@@ -0,0 +1,102 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned by Run when the SHA-256 checksum of the
+// discovery executable differs from the expected one, see WithChecksum.
+var ErrChecksumMismatch = errors.New("discovery executable checksum mismatch")
+
+// WithChecksum makes Run verify the SHA-256 checksum of the discovery
+// executable, given in hexadecimal, before starting it: if the checksum
+// differs Run fails with ErrChecksumMismatch, in place of running a corrupted
+// executable. The executable is then started by the absolute path verified.
+// It has no effect on the discoveries running in-process.
+func WithChecksum(sha256Hex string) ClientOption {
+	return func(disc *Client) {
+		disc.checksum = strings.ToLower(strings.TrimSpace(sha256Hex))
+	}
+}
+
+// WithVerifier makes Run call the given function with the path of the
+// discovery executable before starting it, for example to check its signature:
+// if the function returns an error Run fails with it. The verifier is called
+// after the checksum verification, see WithChecksum. It has no effect on the
+// discoveries running in-process.
+func WithVerifier(verify func(path string) error) ClientOption {
+	return func(disc *Client) {
+		disc.verifier = verify
+	}
+}
+
+// verifyExecutable verifies the checksum and runs the verifier of the
+// discovery executable at the given path, if set, and returns the absolute
+// path of the executable verified: it must be the one started, a lookup in
+// the PATH, or in another directory, may find a different file.
+func (disc *Client) verifyExecutable(executable string) (string, error) {
+	if disc.checksum == "" && disc.verifier == nil {
+		return executable, nil
+	}
+	path, err := exec.LookPath(executable)
+	if err != nil {
+		return "", fmt.Errorf("verifying discovery executable: %w", err)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return "", fmt.Errorf("verifying discovery executable: %w", err)
+	}
+	if disc.checksum != "" {
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return "", fmt.Errorf("verifying discovery executable: %w", err)
+		}
+		if sum != disc.checksum {
+			return "", fmt.Errorf("%w: %s has SHA-256 %s, expected %s", ErrChecksumMismatch, path, sum, disc.checksum)
+		}
+	}
+	if disc.verifier != nil {
+		if err := disc.verifier(path); err != nil {
+			return "", fmt.Errorf("verifying discovery executable %s: %w", path, err)
+		}
+	}
+	return path, nil
+}
+
+// fileSHA256 returns the SHA-256 checksum of the file in hexadecimal.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
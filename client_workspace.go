@@ -0,0 +1,133 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The environment variables passing the paths of the workspace to the
+// discovery process, see Client.SetWorkspace.
+const (
+	EnvWorkDir = "DISCOVERY_WORK_DIR"
+	EnvTempDir = "DISCOVERY_TEMP_DIR"
+)
+
+// SetWorkspace gives each run of the discovery process a dedicated working
+// directory and temp directory, created by the Client inside the given base
+// directory and removed with all their content when the process terminates.
+// The paths are passed to the process in the EnvWorkDir and EnvTempDir
+// environment variables, the temp directory is also set in TMPDIR, TMP and
+// TEMP. An empty base (the default) disables the workspace, the process then
+// runs in the current working directory. It must be called before Run, it has
+// no effect on the discoveries running in-process.
+//
+// Deprecated: use the WithWorkspace option of NewClientWithOptions.
+func (disc *Client) SetWorkspace(base string) {
+	disc.workspaceBase = base
+}
+
+// WorkDir returns the working directory of the running discovery process, or
+// an empty string if the workspace is not enabled or the process is not running.
+func (disc *Client) WorkDir() string {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.workspace == nil {
+		return ""
+	}
+	return disc.workspace.workDir
+}
+
+// workspace is the directory tree reserved to a run of the discovery process.
+type workspace struct {
+	root    string
+	workDir string
+	tempDir string
+}
+
+// newWorkspace creates a new workspace inside the given base directory.
+func newWorkspace(base, id string) (*workspace, error) {
+	if err := os.MkdirAll(base, 0o755); err != nil {
+		return nil, err
+	}
+	root, err := os.MkdirTemp(base, "discovery-"+sanitizeFileName(id)+"-")
+	if err != nil {
+		return nil, err
+	}
+	ws := &workspace{
+		root:    root,
+		workDir: filepath.Join(root, "work"),
+		tempDir: filepath.Join(root, "tmp"),
+	}
+	for _, dir := range []string{ws.workDir, ws.tempDir} {
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			ws.remove()
+			return nil, err
+		}
+	}
+	return ws, nil
+}
+
+// env returns the environment variables passing the workspace to the process.
+func (ws *workspace) env() []string {
+	return []string{
+		EnvWorkDir + "=" + ws.workDir,
+		EnvTempDir + "=" + ws.tempDir,
+		"TMPDIR=" + ws.tempDir,
+		"TMP=" + ws.tempDir,
+		"TEMP=" + ws.tempDir,
+	}
+}
+
+func (ws *workspace) remove() error {
+	return os.RemoveAll(ws.root)
+}
+
+// sanitizeFileName replaces the characters that are not safe in a file name.
+func sanitizeFileName(name string) string {
+	safe := []rune(name)
+	for i, r := range safe {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			safe[i] = '_'
+		}
+	}
+	return string(safe)
+}
+
+// removeWorkspace removes the workspace of the terminated discovery process,
+// the caller must hold the statusMutex.
+func (disc *Client) removeWorkspace() {
+	if ws := disc.workspace; ws != nil {
+		disc.workspace = nil
+		if err := ws.remove(); err != nil {
+			disc.logger.Errorf("Removing discovery workspace: %v", err)
+		}
+	}
+}
+
+// absExecutable returns the path of the executable made absolute, relative to
+// the current working directory. The executables given by name, without a
+// directory, are returned unchanged to be looked up in the PATH.
+func absExecutable(path string) (string, error) {
+	if filepath.IsAbs(path) || !strings.ContainsAny(path, `/`+string(filepath.Separator)) {
+		return path, nil
+	}
+	return filepath.Abs(path)
+}
@@ -0,0 +1,109 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by the Client and the Manager for
+// timeouts and timestamps. It can be replaced, for example with a
+// ManualClock, to make the tests deterministic and fast.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current
+	// time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// ManualClock is a Clock whose time is advanced manually by calling
+// the Advance method, it's intended to be used in tests.
+type ManualClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewManualClock creates a new ManualClock set at the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the current time once the
+// clock has been advanced by at least the given duration.
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &manualTimer{deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+	return timer.c
+}
+
+// Advance moves the clock forward by the given duration and fires
+// all the expired timers.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	pending := []*manualTimer{}
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// PendingTimers returns the number of timers waiting for the clock to
+// be advanced, it can be used by the tests to synchronize with the code
+// waiting on the clock.
+func (c *ManualClock) PendingTimers() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.timers)
+}
@@ -0,0 +1,60 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	require.Equal(t, start, clock.Now())
+
+	c1 := clock.After(time.Second)
+	c2 := clock.After(10 * time.Second)
+	require.Equal(t, 2, clock.PendingTimers())
+
+	clock.Advance(5 * time.Second)
+	require.Equal(t, start.Add(5*time.Second), <-c1)
+	require.Empty(t, c2)
+	require.Equal(t, 1, clock.PendingTimers())
+
+	clock.Advance(5 * time.Second)
+	require.Equal(t, start.Add(10*time.Second), <-c2)
+	require.Equal(t, 0, clock.PendingTimers())
+}
+
+func TestClientTimeoutWithManualClock(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	disc := NewClient("test")
+	disc.SetClock(clock)
+	disc.incomingMessagesChan = make(chan *discoveryMessage)
+
+	res := make(chan error)
+	go func() {
+		_, err := disc.waitMessage(10 * time.Second)
+		res <- err
+	}()
+	require.Eventually(t, func() bool { return clock.PendingTimers() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(10 * time.Second)
+	require.EqualError(t, <-res, "timeout waiting for message from test")
+}
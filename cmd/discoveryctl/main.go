@@ -0,0 +1,450 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// discoveryctl is a debugging tool for the pluggable discoveries: it runs a
+// discovery executable and issues the commands of the pluggable discovery
+// protocol, printing the results in a human readable form or as JSON.
+//
+// Usage:
+//
+//	discoveryctl <command> [flags] <discovery executable> [discovery args...]
+//
+// The commands are:
+//
+//	list         start the discovery and print the ports listed
+//	sync         put the discovery in sync mode and print the events
+//	describe     print the description of the discovery capabilities
+//	conformance  check that the discovery follows the specification
+//	fuzz-proxy   run the discovery behind a fuzzing proxy
+//	remote-proxy run the discovery behind a proxy compacting its events
+//	install-service
+//	             install the units serving the discovery through TCP
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/arduino/pluggable-discovery-protocol-handler/v2/service"
+)
+
+const usage = `Usage: discoveryctl <command> [flags] <discovery executable> [discovery args...]
+
+Commands:
+  list         start the discovery and print the ports listed
+  sync         put the discovery in sync mode and print the events
+  describe     print the description of the discovery capabilities
+  conformance  check that the discovery follows the specification
+  fuzz-proxy   run the discovery behind a fuzzing proxy
+  remote-proxy run the discovery behind a proxy compacting its events
+  install-service
+               install the units serving the discovery through TCP
+
+Run 'discoveryctl <command> -h' for the flags of each command.
+`
+
+// stderrLogger logs the protocol exchanged with the discovery on stderr.
+type stderrLogger struct{}
+
+func (l *stderrLogger) Debugf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+func (l *stderrLogger) Errorf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+}
+
+// options are the flags shared by all the commands.
+type options struct {
+	json    bool
+	verbose bool
+	env     stringList
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := run(ctx, os.Args[1], os.Args[2:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "discoveryctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, command string, args []string, out io.Writer) error {
+	opts := &options{}
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.BoolVar(&opts.json, "json", false, "print the output as JSON")
+	flags.BoolVar(&opts.verbose, "verbose", false, "log the protocol exchanged with the discovery on stderr")
+	flags.Var(&opts.env, "env", "additional environment variable of the discovery, in the form KEY=VALUE (repeatable)")
+	var duration time.Duration
+	fuzz := &discovery.FuzzProxyConfig{}
+	var reportFile string
+	var queueSize int
+	unit := &service.Unit{}
+	install := &installOptions{}
+	switch command {
+	case "sync":
+		flags.DurationVar(&duration, "duration", 0, "time to wait for the events, 0 to wait until interrupted")
+	case "conformance":
+		flags.DurationVar(&duration, "duration", 5*time.Second, "time to wait for the events in sync mode")
+	case "fuzz-proxy":
+		flags.Int64Var(&fuzz.Seed, "seed", time.Now().UnixNano(), "seed of the mutations")
+		flags.Float64Var(&fuzz.MutationProbability, "probability", 0.05, "probability that each command and message is mutated")
+		flags.StringVar(&reportFile, "report", "", "file where the findings are appended as JSON lines, stderr if empty")
+	case "remote-proxy":
+		flags.IntVar(&queueSize, "queue", 64, "number of messages of the discovery queued while the client is slow")
+	case "install-service":
+		flags.StringVar(&unit.Name, "name", "", "name of the units, the name of the discovery executable if empty")
+		flags.StringVar(&unit.Listen, "listen", ":9000", "TCP address to listen on, in the form host:port or :port")
+		flags.StringVar(&install.system, "system", "", "service manager, systemd or launchd, the one of the OS if empty")
+		flags.StringVar(&install.dir, "dir", "", "directory of the units, the user-level units directory if empty")
+		flags.BoolVar(&install.print, "print", false, "print the units without installing them")
+		flags.BoolVar(&install.enable, "enable", false, "enable the units after installing them")
+	case "list", "describe":
+	case "help", "-h", "--help":
+		fmt.Fprint(out, usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command '%s'", command)
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: discoveryctl %s [flags] <discovery executable> [discovery args...]\n", command)
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("missing discovery executable")
+	}
+	if command == "fuzz-proxy" {
+		return fuzzProxy(fuzz, reportFile, opts, flags.Args(), out)
+	}
+	if command == "remote-proxy" {
+		return remoteProxy(queueSize, opts, flags.Args(), out)
+	}
+	if command == "install-service" {
+		unit.Env = opts.env
+		return installService(unit, install, flags.Args(), out)
+	}
+
+	clientOpts := []discovery.ClientOption{
+		discovery.WithArgs(flags.Args()[1:]...),
+		discovery.WithUserAgent("discoveryctl"),
+		discovery.WithEnv(opts.env...),
+	}
+	if opts.verbose {
+		clientOpts = append(clientOpts, discovery.WithLogger(&stderrLogger{}))
+	}
+	disc := discovery.NewClientWithOptions("discoveryctl", flags.Arg(0), clientOpts...)
+
+	switch command {
+	case "list":
+		return list(disc, opts, out)
+	case "sync":
+		return sync(ctx, disc, opts, duration, out)
+	case "describe":
+		return describe(disc, opts, out)
+	default:
+		return conformance(ctx, disc, duration, out)
+	}
+}
+
+func list(disc *discovery.Client, opts *options, out io.Writer) error {
+	if err := disc.Run(); err != nil {
+		return err
+	}
+	defer disc.Quit()
+	if err := disc.Start(); err != nil {
+		return err
+	}
+	ports, err := disc.List()
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(out, ports)
+	}
+	return printPorts(out, ports)
+}
+
+func sync(ctx context.Context, disc *discovery.Client, opts *options, duration time.Duration, out io.Writer) error {
+	if opts.json {
+		if err := disc.TeeEvents(out, discovery.TeeFormatNDJSON); err != nil {
+			return err
+		}
+	}
+	if err := disc.Run(); err != nil {
+		return err
+	}
+	defer disc.Quit()
+	events, err := disc.StartSync(16)
+	if err != nil {
+		return err
+	}
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok || ev.Type == discovery.EventTypeStop {
+				return errors.New("the discovery stopped sending events")
+			}
+			if !opts.json {
+				fmt.Fprintf(out, "%-7s %s\n", ev.Type, portSummary(ev.Port))
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func describe(disc *discovery.Client, opts *options, out io.Writer) error {
+	if err := disc.Run(); err != nil {
+		return err
+	}
+	defer disc.Quit()
+	desc, err := disc.Describe()
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(out, desc)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Protocols:\t%s\n", strings.Join(desc.Protocols, ", "))
+	fmt.Fprintf(w, "Property keys:\t%s\n", strings.Join(desc.PropertyKeys, ", "))
+	fmt.Fprintf(w, "Capabilities:\t%s\n", strings.Join(desc.Capabilities, ", "))
+	if desc.Polling {
+		fmt.Fprintf(w, "Polling interval:\t%s\n", time.Duration(desc.PollingIntervalMs)*time.Millisecond)
+	}
+	return w.Flush()
+}
+
+// conformance checks the discovery with discovery.ValidateClient, and reports
+// the result of each command.
+func conformance(ctx context.Context, disc *discovery.Client, duration time.Duration, out io.Writer) error {
+	failures := 0
+	err := discovery.ValidateClient(ctx, disc, duration, func(command string, err error) {
+		if err != nil {
+			failures++
+			fmt.Fprintf(out, "FAIL  %s: %v\n", command, err)
+			return
+		}
+		fmt.Fprintf(out, "ok    %s\n", command)
+	})
+	if err != nil {
+		return fmt.Errorf("conformance check failed: %d failures", failures)
+	}
+	return nil
+}
+
+// fuzzProxy runs the discovery behind a FuzzProxy, using the standard input
+// and output of discoveryctl: discoveryctl is used in place of the discovery
+// executable by the client under test.
+func fuzzProxy(config *discovery.FuzzProxyConfig, reportFile string, opts *options, args []string, out io.Writer) error {
+	report := io.Writer(os.Stderr)
+	if reportFile != "" {
+		f, err := os.OpenFile(reportFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		report = f
+	}
+	encoder := json.NewEncoder(report)
+	config.Report = func(finding *discovery.FuzzFinding) {
+		_ = encoder.Encode(finding)
+	}
+
+	proc := exec.Command(args[0], args[1:]...)
+	proc.Env = append(os.Environ(), opts.env...)
+	proc.Stderr = os.Stderr
+	toDiscovery, err := proc.StdinPipe()
+	if err != nil {
+		return err
+	}
+	fromDiscovery, err := proc.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	err = discovery.NewFuzzProxy(config).Run(os.Stdin, out, toDiscovery, fromDiscovery)
+	_ = proc.Wait()
+	return err
+}
+
+// remoteProxy runs the discovery behind a RemoteProxy, using the standard
+// input and output of discoveryctl: discoveryctl is used in place of the
+// discovery executable on the host reached through the network.
+func remoteProxy(queueSize int, opts *options, args []string, out io.Writer) error {
+	proc := exec.Command(args[0], args[1:]...)
+	proc.Env = append(os.Environ(), opts.env...)
+	proc.Stderr = os.Stderr
+	toDiscovery, err := proc.StdinPipe()
+	if err != nil {
+		return err
+	}
+	fromDiscovery, err := proc.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	err = discovery.NewRemoteProxy(queueSize).Run(os.Stdin, out, toDiscovery, fromDiscovery)
+	_ = proc.Wait()
+	return err
+}
+
+// installOptions are the flags of the install-service command.
+type installOptions struct {
+	system string
+	dir    string
+	print  bool
+	enable bool
+}
+
+func installService(unit *service.Unit, opts *installOptions, args []string, out io.Writer) error {
+	executable, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	if executable, err = filepath.Abs(executable); err != nil {
+		return err
+	}
+	unit.Command = append([]string{executable}, args[1:]...)
+	if unit.Name == "" {
+		unit.Name = strings.TrimSuffix(filepath.Base(executable), filepath.Ext(executable))
+	}
+	system := service.System(opts.system)
+	if system == "" {
+		if system, err = service.DefaultSystem(); err != nil {
+			return err
+		}
+	}
+
+	if opts.print {
+		units := []func() (string, error){unit.LaunchdPlist}
+		if system == service.Systemd {
+			units = []func() (string, error){unit.SystemdSocket, unit.SystemdService}
+		}
+		for _, generate := range units {
+			content, err := generate()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(out, content)
+		}
+		return nil
+	}
+
+	dir := opts.dir
+	if dir == "" {
+		if dir, err = service.UserUnitDir(system); err != nil {
+			return err
+		}
+	}
+	installation, err := unit.Install(system, dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range installation.Files {
+		fmt.Fprintf(out, "Installed %s\n", file)
+	}
+	if !opts.enable {
+		fmt.Fprintln(out, "Enable the units with:")
+		for _, command := range installation.Commands {
+			fmt.Fprintf(out, "  %s\n", strings.Join(command, " "))
+		}
+		return nil
+	}
+	return installation.Enable()
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// printPorts prints the ports as a table.
+func printPorts(out io.Writer, ports []*discovery.Port) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tPROTOCOL\tLABEL\tHARDWARE ID\tPROPERTIES")
+	for _, port := range ports {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", port.Address, port.Protocol, port.AddressLabel, port.HardwareID, properties(port))
+	}
+	return w.Flush()
+}
+
+// portSummary returns a single line description of the port.
+func portSummary(port *discovery.Port) string {
+	if port == nil {
+		return ""
+	}
+	res := port.Address + " (" + port.Protocol + ")"
+	if port.AddressLabel != "" {
+		res += " " + port.AddressLabel
+	}
+	if props := properties(port); props != "" {
+		res += " " + props
+	}
+	return res
+}
+
+// properties returns the properties of the port as space separated
+// key=value pairs, sorted by key.
+func properties(port *discovery.Port) string {
+	if port.Properties == nil {
+		return ""
+	}
+	keys := port.Properties.Keys()
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+port.Properties.Get(key))
+	}
+	return strings.Join(pairs, " ")
+}
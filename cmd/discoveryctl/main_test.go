@@ -0,0 +1,71 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/arduino/pluggable-discovery-protocol-handler/v2/dummy-discovery/dummy"
+	"github.com/stretchr/testify/require"
+)
+
+// dummyEnv makes the test executable run the dummy discovery in place of the
+// tests, so it can be used as the discovery executable.
+const dummyEnv = "DISCOVERYCTL_TEST_DUMMY=1"
+
+func TestMain(m *testing.M) {
+	if os.Getenv("DISCOVERYCTL_TEST_DUMMY") == "1" {
+		server := discovery.NewServer(dummy.NewDiscovery(&dummy.Options{EventsInterval: time.Second}))
+		if err := server.Run(os.Stdin, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestCommands(t *testing.T) {
+	runCommand := func(command string, args ...string) (string, error) {
+		var out strings.Builder
+		args = append(args, "-env", dummyEnv, os.Args[0])
+		err := run(context.Background(), command, args, &out)
+		return out.String(), err
+	}
+
+	out, err := runCommand("list")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(out, "ADDRESS"), out)
+
+	out, err = runCommand("describe", "-json")
+	require.NoError(t, err)
+	require.Contains(t, out, `"protocols"`)
+
+	out, err = runCommand("sync", "-duration", "200ms")
+	require.NoError(t, err)
+	require.Contains(t, out, "add")
+
+	out, err = runCommand("conformance", "-duration", "200ms")
+	require.NoError(t, err, out)
+	require.Contains(t, out, "ok    START_SYNC")
+	require.NotContains(t, out, "FAIL")
+}
@@ -0,0 +1,54 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// protocolgen generates the Go definitions of the pluggable discovery
+// protocol from its machine-readable specification.
+//
+// Usage:
+//
+//	protocolgen [-spec protocol_spec.json] [-out protocol_spec_gen.go] [-package discovery]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/arduino/pluggable-discovery-protocol-handler/v2/internal/protocolgen"
+)
+
+func main() {
+	specPath := flag.String("spec", "protocol_spec.json", "the specification of the protocol")
+	outPath := flag.String("out", "protocol_spec_gen.go", "the Go file to generate")
+	pkg := flag.String("package", "discovery", "the package of the generated file")
+	flag.Parse()
+
+	spec, err := os.ReadFile(*specPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	src, err := protocolgen.Generate(spec, *pkg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*outPath, src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
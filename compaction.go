@@ -0,0 +1,148 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"slices"
+	"sync"
+)
+
+// outputCompactor is the output queue of the RemoteProxy: the events waiting
+// to be written are compacted, so that only the latest state of each port is
+// transmitted. The other messages are never compacted and they keep their
+// order with respect to the events.
+type outputCompactor struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	size    int
+	entries []*outputEntry
+	// pending are the queued events, indexed by port, that may be compacted:
+	// only the events queued after the last message that is not an event
+	pending map[string]*outputEntry
+	// sent are the ports whose last event written is an "add"
+	sent      map[string]bool
+	compacted uint64
+	closed    bool
+}
+
+type outputEntry struct {
+	data      []byte
+	key       string
+	eventType string
+}
+
+func newOutputCompactor(size int) *outputCompactor {
+	c := &outputCompactor{
+		size:    size,
+		pending: map[string]*outputEntry{},
+		sent:    map[string]bool{},
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// pushMessage queues a message that is not an event, waiting for room in the queue.
+func (c *outputCompactor) pushMessage(data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.entries) >= c.size && !c.closed {
+		c.cond.Wait()
+	}
+	c.entries = append(c.entries, &outputEntry{data: data})
+	c.pending = map[string]*outputEntry{}
+	c.cond.Broadcast()
+}
+
+// pushEvent queues the event of the given port, compacting it with the event
+// of the same port already queued, if any, otherwise waiting for room in the queue.
+func (c *outputCompactor) pushEvent(eventType string, port *Port, data []byte) {
+	key := port.Protocol + "|" + port.Address
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for {
+		if queued := c.pending[key]; queued != nil {
+			c.compact(queued, eventType, data)
+			c.cond.Broadcast()
+			return
+		}
+		if len(c.entries) < c.size || c.closed {
+			break
+		}
+		c.cond.Wait()
+	}
+	entry := &outputEntry{data: data, key: key, eventType: eventType}
+	c.entries = append(c.entries, entry)
+	c.pending[key] = entry
+	c.cond.Broadcast()
+}
+
+func (c *outputCompactor) compact(queued *outputEntry, eventType string, data []byte) {
+	switch {
+	case eventType == EventTypeAdd:
+		// The port is updated to the latest state
+		queued.eventType = EventTypeAdd
+		queued.data = data
+		c.compacted++
+	case queued.eventType == EventTypeAdd && !c.sent[queued.key]:
+		// The port never reached the client: the add and the remove cancel out
+		c.entries = slices.DeleteFunc(c.entries, func(e *outputEntry) bool { return e == queued })
+		delete(c.pending, queued.key)
+		c.compacted += 2
+	case queued.eventType == EventTypeAdd:
+		queued.eventType = EventTypeRemove
+		queued.data = data
+		c.compacted++
+	default:
+		// The port is already being removed
+		c.compacted++
+	}
+}
+
+// pop returns the next message to be written, waiting for it, or nil if the
+// queue has been closed and all the messages have been written.
+func (c *outputCompactor) pop() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.entries) == 0 {
+		if c.closed {
+			return nil
+		}
+		c.cond.Wait()
+	}
+	entry := c.entries[0]
+	c.entries = c.entries[1:]
+	if entry.key != "" {
+		if c.pending[entry.key] == entry {
+			delete(c.pending, entry.key)
+		}
+		if entry.eventType == EventTypeAdd {
+			c.sent[entry.key] = true
+		} else {
+			delete(c.sent, entry.key)
+		}
+	}
+	c.cond.Broadcast()
+	return entry.data
+}
+
+func (c *outputCompactor) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+}
@@ -0,0 +1,166 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compressions of the messages sent by the discovery that may be
+// requested in the HELLO command (see BuildHelloWithCompression): all the
+// messages following the response to the HELLO are sent as a single
+// compressed stream, flushed after each message. The compression reduces the
+// bandwidth used by the chatty discoveries reached through slow links, for
+// example when the discovery is run on a remote host through ssh or a lab
+// proxy; it's useless on a local pipe.
+const (
+	// CompressionGzip sends the messages as a gzip stream.
+	CompressionGzip = "gzip"
+	// CompressionZstd sends the messages as a zstd stream, it's cheaper than
+	// gzip for both the discovery and the client.
+	CompressionZstd = "zstd"
+)
+
+// isSupportedCompression returns true if the given compression may be
+// requested in the HELLO command.
+func isSupportedCompression(compression string) bool {
+	return compression == CompressionGzip || compression == CompressionZstd
+}
+
+// WithCompression requests the discovery to compress the messages it sends,
+// see CompressionGzip and CompressionZstd. The compression is requested in the HELLO command: it
+// must be enabled only for the discoveries supporting it, the others refuse
+// the HELLO. The option is not supported with TransportPTY, and it's ignored
+// by the in-process discoveries. An empty compression disables it.
+func WithCompression(compression string) ClientOption {
+	return func(disc *Client) {
+		disc.compression = compression
+	}
+}
+
+// sessionCompression returns the compression requested to the discovery, the
+// in-process discoveries are not compressed.
+func (disc *Client) sessionCompression() string {
+	if disc.inProcessName != "" {
+		return ""
+	}
+	return disc.compression
+}
+
+// compressedOutput is the output stream of the Server, compressed once the
+// response to the HELLO requesting the compression has been written.
+type compressedOutput struct {
+	mutex      sync.Mutex
+	out        io.Writer
+	compressor flushWriter
+	// after is the message after which the compression starts
+	after       []byte
+	compression string
+}
+
+// flushWriter is a compressed stream that can be flushed after each message.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+func newCompressedOutput(out io.Writer) *compressedOutput {
+	return &compressedOutput{out: out}
+}
+
+// enableAfter starts the given compression after the given message has been
+// written. The messages may be written by the goroutine of the output queue,
+// so the compression can't be started right away.
+func (c *compressedOutput) enableAfter(msg []byte, compression string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.after = msg
+	c.compression = compression
+}
+
+func (c *compressedOutput) Write(data []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.compressor == nil {
+		n, err := c.out.Write(data)
+		if err == nil && len(data) > 0 && len(c.after) > 0 && &data[0] == &c.after[0] {
+			c.after = nil
+			c.compressor, err = newCompressor(c.compression, c.out)
+		}
+		return n, err
+	}
+	if _, err := c.compressor.Write(data); err != nil {
+		return 0, err
+	}
+	if err := c.compressor.Flush(); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func newCompressor(compression string, out io.Writer) (flushWriter, error) {
+	switch compression {
+	case CompressionGzip:
+		gz := gzip.NewWriter(out)
+		// The header is sent right away, so the client is not left waiting
+		// for it until the next message
+		return gz, gz.Flush()
+	case CompressionZstd:
+		// The messages are compressed synchronously, they are flushed one by
+		// one anyway
+		return zstd.NewWriter(out, zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, errors.New("Unsupported compression: " + compression)
+	}
+}
+
+// decompressedDecoder returns the decoder of the messages following the
+// response to the HELLO, decoded by the given decoder from in: the messages
+// already buffered by the decoder are decompressed too.
+func (disc *Client) decompressedDecoder(decoder *json.Decoder, in io.Reader, diagnostics *diagnosticSession) (*json.Decoder, error) {
+	var compressed io.Reader
+	var err error
+	switch stream := compressedStream(decoder, in); disc.sessionCompression() {
+	case CompressionZstd:
+		// The synchronous decoder doesn't start any goroutine, so it's
+		// never closed
+		compressed, err = zstd.NewReader(stream, zstd.WithDecoderConcurrency(1))
+	default:
+		compressed, err = gzip.NewReader(stream)
+	}
+	if err != nil {
+		return nil, err
+	}
+	diagnostics.resetReceived()
+	return json.NewDecoder(disc.messagesReader(diagnostics.receiving(compressed), true)), nil
+}
+
+// compressedStream returns the compressed stream following the response to
+// the HELLO decoded by the given decoder from in, skipping the newline
+// terminating the response.
+func compressedStream(decoder *json.Decoder, in io.Reader) io.Reader {
+	buffered, _ := io.ReadAll(decoder.Buffered())
+	return io.MultiReader(bytes.NewReader(bytes.TrimLeft(buffered, " \t\r\n")), in)
+}
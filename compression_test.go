@@ -0,0 +1,80 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerCompression(t *testing.T) {
+	// The compressions work with all the output queues
+	for _, test := range []struct {
+		compression string
+		policy      EventBackpressurePolicy
+	}{
+		{CompressionGzip, -1},
+		{CompressionGzip, EventBackpressureBlock},
+		{CompressionGzip, EventBackpressureDrop},
+		{CompressionZstd, -1},
+		{CompressionZstd, EventBackpressureBlock},
+	} {
+		policy := test.policy
+		server := NewServer(&fuzzTestDiscovery{})
+		if policy >= 0 {
+			server.SetEventBackpressurePolicy(policy, 16)
+		}
+		inR, inW := io.Pipe()
+		outR, outW := io.Pipe()
+		go server.Run(inR, outW)
+
+		// The response to the HELLO is not compressed
+		_, err := io.WriteString(inW, `HELLO 2 "test" compression=`+test.compression+"\n")
+		require.NoError(t, err)
+		decoder := json.NewDecoder(outR)
+		msg := &message{}
+		require.NoError(t, decoder.Decode(msg))
+		require.Equal(t, EventTypeHello, msg.EventType)
+		require.False(t, msg.Error)
+
+		// The following messages are compressed, and flushed one by one
+		var compressed io.Reader
+		if test.compression == CompressionZstd {
+			compressed, err = zstd.NewReader(compressedStream(decoder, outR), zstd.WithDecoderConcurrency(1))
+		} else {
+			compressed, err = gzip.NewReader(compressedStream(decoder, outR))
+		}
+		require.NoError(t, err)
+		decoder = json.NewDecoder(compressed)
+		_, err = io.WriteString(inW, "START_SYNC\n")
+		require.NoError(t, err)
+		require.NoError(t, decoder.Decode(msg))
+		require.Equal(t, EventTypeStartSync, msg.EventType)
+		require.NoError(t, decoder.Decode(msg))
+		require.Equal(t, EventTypeAdd, msg.EventType)
+		_, err = io.WriteString(inW, "QUIT\n")
+		require.NoError(t, err)
+		require.NoError(t, decoder.Decode(msg))
+		require.Equal(t, EventTypeQuit, msg.EventType)
+	}
+}
@@ -0,0 +1,251 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// validationSyncDuration is the time Validate waits for the events of the
+// discovery in sync mode.
+var validationSyncDuration = 2 * time.Second
+
+// Validate runs the given Discovery implementation through a HELLO, START_SYNC,
+// STOP and QUIT cycle, without a client, and returns the violations of the
+// pluggable discovery specification detected, joined in a single error.
+// Validate is meant to be used in the tests of a discovery implementation:
+// it may block for a few seconds while waiting for the events of the discovery.
+func Validate(impl Discovery) error {
+	violationsMutex := sync.Mutex{}
+	violations := []error{}
+	report := func(violation error) {
+		violationsMutex.Lock()
+		violations = append(violations, violation)
+		violationsMutex.Unlock()
+	}
+	checker := &conformanceChecker{report: report}
+
+	if err := impl.Hello("pluggable-discovery-validator", maxProtocolVersion); err != nil {
+		return fmt.Errorf("calling Hello: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	eventCB := func(event string, port *Port) {
+		if ctx.Err() == nil {
+			checker.checkEvent(event, port)
+		}
+	}
+	errorCB := func(msg string) {
+		if ctx.Err() == nil {
+			report(fmt.Errorf("error reported in sync mode: %s", msg))
+		}
+	}
+	checker.begin(false)
+	var err error
+	if implWithContext, ok := impl.(DiscoveryWithContext); ok {
+		err = implWithContext.StartSyncWithContext(ctx, eventCB, errorCB)
+	} else {
+		err = impl.StartSync(eventCB, errorCB)
+	}
+	if err != nil {
+		report(fmt.Errorf("calling StartSync: %w", err))
+	} else {
+		checker.ack()
+		time.Sleep(validationSyncDuration)
+	}
+
+	cancel()
+	if err := impl.Stop(); err != nil {
+		report(fmt.Errorf("calling Stop: %w", err))
+	}
+	impl.Quit()
+
+	violationsMutex.Lock()
+	defer violationsMutex.Unlock()
+	return errors.Join(violations...)
+}
+
+// ValidateClient runs the discovery of the given Client, not yet running,
+// through all the commands of the protocol in strict mode (see
+// Client.SetStrictMode): HELLO, DESCRIBE, START, LIST, STOP, START_SYNC, STOP
+// and QUIT. The events received in sync mode during syncDuration are checked
+// as in Validate. The result of each command is passed to the step function,
+// if not nil, and the failures are returned joined in a single error.
+// ValidateClient is meant to check the discovery executables, as Validate
+// does for the Discovery implementations.
+func ValidateClient(ctx context.Context, disc *Client, syncDuration time.Duration, step func(command string, err error)) error {
+	failures := []error{}
+	check := func(command string, f func() error) bool {
+		err := f()
+		if step != nil {
+			step(command, err)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", command, err))
+			return false
+		}
+		return true
+	}
+
+	WithStrictMode(true)(disc)
+	if !check(CommandHello, disc.Run) {
+		return errors.Join(failures...)
+	}
+	defer disc.Quit()
+	check(CommandDescribe, func() error {
+		_, err := disc.Describe()
+		return err
+	})
+	if check(CommandStart, disc.Start) {
+		check(CommandList, func() error {
+			_, err := disc.List()
+			return err
+		})
+		check(CommandStop, disc.Stop)
+	}
+	check(CommandStartSync, func() error {
+		return validateClientSync(ctx, disc, syncDuration)
+	})
+	check(CommandStop, disc.Stop)
+	return errors.Join(failures...)
+}
+
+// validateClientSync puts the discovery in sync mode and checks the events
+// received during the given duration.
+func validateClientSync(ctx context.Context, disc *Client, duration time.Duration) error {
+	violations := []error{}
+	checker := &conformanceChecker{report: func(violation error) {
+		violations = append(violations, violation)
+	}}
+	// The order of the events with the response is not observable
+	checker.begin(true)
+	events, err := disc.StartSync(16)
+	if err != nil {
+		return err
+	}
+	timeout := time.After(duration)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok || ev.Type == EventTypeStop {
+				violations = append(violations, errors.New("the discovery terminated in sync mode"))
+				return errors.Join(violations...)
+			}
+			switch ev.Type {
+			case EventTypeAdd, EventTypeRemove:
+				checker.checkEvent(ev.Type, ev.Port)
+			case EventTypeWarning:
+				violations = append(violations, errors.New(ev.Message))
+			}
+		case <-timeout:
+			return errors.Join(violations...)
+		case <-ctx.Done():
+			return errors.Join(append(violations, ctx.Err())...)
+		}
+	}
+}
+
+// SetConformanceChecks enables the runtime checks of the events sent by the
+// Discovery implementation: each violation of the pluggable discovery
+// specification is passed to the report function. The checks are meant to be
+// enabled during the development of a discovery. This method must be called
+// before Run.
+func (d *Server) SetConformanceChecks(report func(violation error)) {
+	d.conformance = &conformanceChecker{report: report}
+}
+
+// conformanceChecker tracks the events sent by a Discovery during a session
+// and reports the violations of the specification. All the methods are
+// no-op on a nil conformanceChecker.
+type conformanceChecker struct {
+	report func(violation error)
+
+	mutex sync.Mutex
+	acked bool
+	ports map[string]bool
+}
+
+// begin resets the status of the checker at the start of a new session,
+// acked tells if the events are allowed before the call to ack.
+func (c *conformanceChecker) begin(acked bool) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.acked = acked
+	c.ports = map[string]bool{}
+}
+
+// ack marks the START_SYNC command as acknowledged to the client.
+func (c *conformanceChecker) ack() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.acked = true
+}
+
+// reportCommand reports a command sent by the client that is not allowed
+// by the protocol state machine.
+func (c *conformanceChecker) reportCommand(err error) {
+	if c == nil {
+		return
+	}
+	c.report(fmt.Errorf("client protocol violation: %w", err))
+}
+
+func (c *conformanceChecker) checkEvent(event string, port *Port) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if port == nil {
+		c.report(fmt.Errorf("%q event sent without a port: the port is mandatory", event))
+		return
+	}
+	if event != EventTypeAdd && event != EventTypeRemove {
+		c.report(fmt.Errorf("unknown event type %q for port %s: only %q and %q events are allowed", event, port, EventTypeAdd, EventTypeRemove))
+		return
+	}
+	if port.Address == "" {
+		c.report(fmt.Errorf("%q event sent for a port without address: the address is mandatory", event))
+	}
+	if !c.acked {
+		c.report(fmt.Errorf("%q event for port %s sent before the START_SYNC acknowledgement: the events must be sent after StartSync returns, for example from a goroutine", event, port))
+	}
+	id := port.Address + "|" + port.Protocol
+	if event == EventTypeAdd {
+		if c.ports[id] {
+			c.report(fmt.Errorf("duplicate %q event for port %s (protocol %q): the port must be removed before being added again", event, port, port.Protocol))
+		}
+		c.ports[id] = true
+	}
+	if event == EventTypeRemove {
+		if !c.ports[id] {
+			c.report(fmt.Errorf("%q event for port %s (protocol %q) that was never added", event, port, port.Protocol))
+		}
+		delete(c.ports, id)
+	}
+}
@@ -0,0 +1,220 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pgregory.net/rapid"
+)
+
+// stateMachineResponseTimeout is the time CheckStateMachine waits for the
+// response to each command.
+var stateMachineResponseTimeout = 10 * time.Second
+
+// CheckStateMachine runs the Discovery implementations created by the factory
+// in a Server, and sends them random sequences of commands allowed by the
+// protocol state machine, checking that the Server follows the model of the
+// state machine (see NextState): each command must be answered with its own
+// response, the commands allowed in the state reached must be accepted, and
+// the "add" and "remove" events must be sent only in sync mode and must follow
+// the rules checked by the conformance checks (see SetConformanceChecks).
+// The sequences are generated by the state machine tests of rapid, each one
+// with a new Discovery: a failing sequence is shrunk by rapid to a minimal
+// one, reported as a failure of t with its commands and its violations. The
+// number of sequences and the seed are set with the rapid flags, for example
+// -rapid.checks and -rapid.seed. CheckStateMachine is meant to be used in the
+// tests of a discovery implementation.
+func CheckStateMachine(t rapid.TB, factory func() Discovery) {
+	t.Helper()
+	rapid.Check(t, func(rt *rapid.T) {
+		run := startStateMachineRun(factory())
+		defer run.close()
+		run.protocolVersion = rapid.IntRange(1, maxProtocolVersion).Draw(rt, "protocolVersion")
+		run.send(rt, BuildHello(run.protocolVersion, "pluggable-discovery-state-machine-check"))
+		if run.state != StateUninitialized {
+			actions := map[string]func(*rapid.T){"": run.checkViolations}
+			for _, command := range stateMachineCommands() {
+				command := command
+				actions[command] = func(rt *rapid.T) {
+					if !run.allowed(command) {
+						rt.Skipf("%s not allowed in state %s", command, run.state)
+					}
+					if command == CommandConfigure {
+						run.send(rt, BuildConfigure("state-machine-check", "1"))
+					} else {
+						run.send(rt, BuildCommand(command))
+					}
+				}
+			}
+			rt.Repeat(actions)
+		}
+		run.send(rt, BuildCommand(CommandQuit))
+		run.checkViolations(rt)
+	})
+}
+
+// stateMachineCommands returns the commands of the state machine, except HELLO
+// and QUIT, sorted.
+func stateMachineCommands() []string {
+	commands := []string{}
+	for _, allowed := range transitions {
+		for command := range allowed {
+			if command != CommandHello && command != CommandQuit && !slices.Contains(commands, command) {
+				commands = append(commands, command)
+			}
+		}
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// stateMachineRun is a sequence of commands sent by CheckStateMachine.
+type stateMachineRun struct {
+	protocolVersion int
+	commands        []string
+	state           State
+	violationsMutex sync.Mutex
+	violations      []error
+	messages        chan *message
+	readErr         error
+	commandsWriter  *io.PipeWriter
+	messagesReader  *io.PipeReader
+}
+
+// startStateMachineRun runs the Discovery in a Server, reading its messages.
+func startStateMachineRun(impl Discovery) *stateMachineRun {
+	r := &stateMachineRun{messages: make(chan *message)}
+	commandsReader, commandsWriter := io.Pipe()
+	messagesReader, messagesWriter := io.Pipe()
+	r.commandsWriter, r.messagesReader = commandsWriter, messagesReader
+	server := NewServer(impl)
+	// The commands allowed by the model and rejected by the Server, and the
+	// events violating the specification, are reported by the Server
+	server.SetConformanceChecks(r.report)
+	go func() {
+		_ = server.Run(commandsReader, disconnectedWriter{messagesWriter})
+		messagesWriter.Close()
+	}()
+	go func() {
+		defer close(r.messages)
+		decoder := json.NewDecoder(messagesReader)
+		for {
+			msg := &message{}
+			if err := decoder.Decode(msg); err != nil {
+				r.readErr = err
+				return
+			}
+			r.messages <- msg
+		}
+	}()
+	return r
+}
+
+func (r *stateMachineRun) close() {
+	r.commandsWriter.Close()
+	r.messagesReader.Close()
+}
+
+// send sends the command and waits for its response.
+func (r *stateMachineRun) send(rt *rapid.T, command string) {
+	r.commands = append(r.commands, strings.TrimSpace(command))
+	if _, err := io.WriteString(r.commandsWriter, command); err != nil {
+		rt.Fatalf("commands %q: sending %s: %v", r.commands, strings.TrimSpace(command), err)
+	}
+	if err := r.receiveResponse(strings.Fields(command)[0]); err != nil {
+		r.report(err)
+	}
+}
+
+// checkViolations fails the run if any violation has been reported.
+func (r *stateMachineRun) checkViolations(rt *rapid.T) {
+	r.violationsMutex.Lock()
+	defer r.violationsMutex.Unlock()
+	if len(r.violations) > 0 {
+		rt.Fatalf("commands %q: %v", r.commands, errors.Join(r.violations...))
+	}
+}
+
+// allowed returns true if the command is allowed in the current state of the
+// model.
+func (r *stateMachineRun) allowed(command string) bool {
+	if r.protocolVersion < 2 && (command == CommandDescribe || command == CommandConfigure || command == CommandPing) {
+		return false
+	}
+	_, ok := transitions[r.state][command]
+	return ok
+}
+
+// receiveResponse waits for the response to the command and updates the
+// state of the model. The events received meanwhile are checked.
+func (r *stateMachineRun) receiveResponse(command string) error {
+	expected := responseEventTypes[command]
+	timeout := time.After(stateMachineResponseTimeout)
+	for {
+		var msg *message
+		select {
+		case m, ok := <-r.messages:
+			if !ok {
+				return fmt.Errorf("waiting the response to %s: %w", command, r.readErr)
+			}
+			msg = m
+		case <-timeout:
+			return fmt.Errorf("response to %s not received within %s", command, stateMachineResponseTimeout)
+		}
+
+		switch msg.EventType {
+		case EventTypeHeartbeat, EventTypeWarning:
+			continue
+		case EventTypeAdd, EventTypeRemove:
+			if r.state != StateSyncing && command != CommandStartSync {
+				r.report(fmt.Errorf("%q event received in state %s", msg.EventType, r.state))
+			}
+			continue
+		case expected:
+		default:
+			return fmt.Errorf("unexpected %q message in response to %s: %s", msg.EventType, command, msg.Message)
+		}
+
+		if msg.Error {
+			// The implementation failed, the state is unchanged
+			return nil
+		}
+		next, err := NextState(r.state, command)
+		if err != nil {
+			return fmt.Errorf("%s accepted in state %s", command, r.state)
+		}
+		r.state = next
+		return nil
+	}
+}
+
+// report records a violation, it's called by the Server too.
+func (r *stateMachineRun) report(violation error) {
+	r.violationsMutex.Lock()
+	defer r.violationsMutex.Unlock()
+	r.violations = append(r.violations, violation)
+}
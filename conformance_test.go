@@ -0,0 +1,201 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// badDiscovery sends events that violate the specification
+type badDiscovery struct {
+	nullDiscovery
+}
+
+func (d *badDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	// Event sent before StartSync returns
+	eventCB(EventTypeAdd, &Port{Address: "1", Protocol: "bad"})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		eventCB(EventTypeAdd, &Port{Address: "1", Protocol: "bad"})
+		eventCB(EventTypeRemove, &Port{Address: "2", Protocol: "bad"})
+		eventCB(EventTypeAdd, nil)
+	}()
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	defer func(d time.Duration) { validationSyncDuration = d }(validationSyncDuration)
+	validationSyncDuration = 200 * time.Millisecond
+
+	require.NoError(t, Validate(&nullDiscovery{}))
+
+	err := Validate(&badDiscovery{})
+	require.Error(t, err)
+	violations := strings.Split(err.Error(), "\n")
+	require.Len(t, violations, 4)
+	require.Contains(t, violations[0], "before the START_SYNC acknowledgement")
+	require.Contains(t, violations[1], "duplicate \"add\" event for port 1")
+	require.Contains(t, violations[2], "\"remove\" event for port 2")
+	require.Contains(t, violations[3], "without a port")
+}
+
+// describedDiscovery implements all the commands of the protocol
+type describedDiscovery struct {
+	registeredDiscovery
+}
+
+func (d *describedDiscovery) Describe() *Description {
+	return &Description{Protocols: []string{"inprocess"}}
+}
+
+func init() {
+	Register("test-described", func() Discovery { return &describedDiscovery{} })
+	Register("test-bad", func() Discovery { return &badDiscovery{} })
+}
+
+func TestValidateClient(t *testing.T) {
+	steps := []string{}
+	step := func(command string, err error) {
+		steps = append(steps, fmt.Sprintf("%s %v", command, err))
+	}
+	require.NoError(t, ValidateClient(context.Background(), NewInProcessClient("1", "test-described"), 100*time.Millisecond, step))
+	require.Equal(t, []string{"HELLO <nil>", "DESCRIBE <nil>", "START <nil>", "LIST <nil>", "STOP <nil>", "START_SYNC <nil>", "STOP <nil>"}, steps)
+
+	err := ValidateClient(context.Background(), NewInProcessClient("2", "test-bad"), 200*time.Millisecond, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "START_SYNC: ")
+	require.Contains(t, err.Error(), "duplicate \"add\" event for port 1")
+}
+
+func TestServerConformanceChecks(t *testing.T) {
+	violationsMutex := sync.Mutex{}
+	violations := []error{}
+	server := NewServer(&badDiscovery{})
+	server.SetConformanceChecks(func(violation error) {
+		violationsMutex.Lock()
+		violations = append(violations, violation)
+		violationsMutex.Unlock()
+	})
+	conn := runTestServer(t, server)
+	conn.send("HELLO 1 \"test\"")
+	require.Equal(t, EventTypeHello, conn.recv().EventType)
+
+	conn.send("START_SYNC")
+	require.Equal(t, EventTypeAdd, conn.recv().EventType)
+	require.Equal(t, EventTypeStartSync, conn.recv().EventType)
+	require.Equal(t, EventTypeAdd, conn.recv().EventType)
+	require.Equal(t, EventTypeRemove, conn.recv().EventType)
+
+	conn.send("STOP")
+	require.Equal(t, EventTypeStop, conn.recv().EventType)
+	violationsMutex.Lock()
+	require.Len(t, violations, 4)
+	violationsMutex.Unlock()
+
+	// The commands not allowed by the state machine are reported too
+	conn.send("LIST")
+	require.True(t, conn.recv().Error)
+	violationsMutex.Lock()
+	require.Len(t, violations, 5)
+	require.ErrorIs(t, violations[4], ErrCommandNotAllowed)
+	violationsMutex.Unlock()
+
+	conn.send("QUIT")
+	require.Equal(t, EventTypeQuit, conn.recv().EventType)
+}
+
+// modelDiscovery adds and removes ports at random while in sync mode
+type modelDiscovery struct {
+	nullDiscovery
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (d *modelDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.done = make(chan struct{})
+	go func() {
+		defer close(d.done)
+		added := map[string]bool{}
+		for i := 0; ctx.Err() == nil; i++ {
+			address := fmt.Sprint(rand.Intn(3))
+			if added[address] {
+				eventCB(EventTypeRemove, &Port{Address: address, Protocol: "model"})
+			} else {
+				eventCB(EventTypeAdd, &Port{Address: address, Protocol: "model"})
+			}
+			added[address] = !added[address]
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return nil
+}
+
+func (d *modelDiscovery) Stop() error {
+	if d.cancel != nil {
+		d.cancel()
+		<-d.done
+		d.cancel = nil
+	}
+	return nil
+}
+
+func (d *modelDiscovery) Quit() {
+	_ = d.Stop()
+}
+
+// failureRecorder records the failures reported by rapid instead of failing
+// the test.
+type failureRecorder struct {
+	*testing.T
+	failures []string
+}
+
+func (r *failureRecorder) Errorf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+func (r *failureRecorder) Error(args ...any)                 { r.failures = append(r.failures, fmt.Sprint(args...)) }
+func (r *failureRecorder) Fatalf(format string, args ...any) { r.Errorf(format, args...) }
+func (r *failureRecorder) Fatal(args ...any)                 { r.Error(args...) }
+func (r *failureRecorder) FailNow()                          {}
+func (r *failureRecorder) Fail()                             {}
+func (r *failureRecorder) Failed() bool                      { return len(r.failures) > 0 }
+
+func TestCheckStateMachine(t *testing.T) {
+	require.NoError(t, flag.Set("rapid.nofailfile", "true"))
+	CheckStateMachine(t, func() Discovery { return &nullDiscovery{} })
+	CheckStateMachine(t, func() Discovery { return &modelDiscovery{} })
+
+	// The failing sequence is shrunk to the commands reproducing the violation
+	recorder := &failureRecorder{T: t}
+	CheckStateMachine(recorder, func() Discovery { return &badDiscovery{} })
+	require.True(t, recorder.Failed())
+	failure := strings.Join(recorder.failures, "\n")
+	require.Contains(t, failure, "before the START_SYNC acknowledgement")
+	require.Contains(t, failure, `["HELLO 1 \"pluggable-discovery-state-machine-check\"" "START_SYNC"]`)
+}
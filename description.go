@@ -0,0 +1,48 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+// Description is a machine-readable description of the capabilities of
+// a discovery, it's returned by the DESCRIBE command (available since
+// protocol version 2).
+type Description struct {
+	// Protocols is the list of the protocols of the ports that the
+	// discovery may detect (for example "serial" or "network").
+	Protocols []string `json:"protocols"`
+
+	// PropertyKeys is the list of the property keys that the discovery
+	// may set in the ports properties.
+	PropertyKeys []string `json:"propertyKeys,omitempty"`
+
+	// Polling is true if the discovery detects ports by periodically
+	// polling the system, instead of being notified by the OS.
+	Polling bool `json:"polling,omitempty"`
+
+	// PollingIntervalMs is the interval between two polls in milliseconds.
+	PollingIntervalMs int `json:"pollingIntervalMs,omitempty"`
+
+	// Capabilities is the list of the optional commands supported by the
+	// discovery (for example "CONFIGURE").
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Describer is an optional interface that a Discovery may implement to
+// answer the DESCRIBE command.
+type Describer interface {
+	Describe() *Description
+}
@@ -0,0 +1,247 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultDeviceDir is the directory watched by the DeviceWatchDiscovery, if
+// not specified.
+const DefaultDeviceDir = "/dev"
+
+// DefaultDevicePatterns are the patterns of the names of the serial devices
+// of the boards on Linux and macOS, used by the DeviceWatchDiscovery if not
+// specified.
+var DefaultDevicePatterns = []string{"ttyACM*", "ttyUSB*", "cu.usbmodem*", "cu.usbserial*", "cu.wchusbserial*"}
+
+// DeviceWatchDiscovery is a lightweight Discovery of the serial ports, meant
+// as a fallback when no serial-discovery is installed: the ports are the
+// device files of a directory whose names match some glob patterns, reported
+// with ProtocolSerial and the path of the device as address. In sync mode
+// the directory is watched with the notifications of the system (see
+// fsnotify). The ports carry no properties, so the boards can't be
+// identified: it's up to the user to select the board.
+type DeviceWatchDiscovery struct {
+	dir      string
+	patterns []string
+	mutex    sync.Mutex
+}
+
+// NewDeviceWatchDiscovery returns a DeviceWatchDiscovery of the devices of
+// the given directory matching one of the glob patterns (see filepath.Match).
+// An empty dir means DefaultDeviceDir, no patterns mean DefaultDevicePatterns.
+func NewDeviceWatchDiscovery(dir string, patterns ...string) *DeviceWatchDiscovery {
+	if dir == "" {
+		dir = DefaultDeviceDir
+	}
+	if len(patterns) == 0 {
+		patterns = DefaultDevicePatterns
+	}
+	return &DeviceWatchDiscovery{dir: dir, patterns: patterns}
+}
+
+// Hello does nothing.
+func (d *DeviceWatchDiscovery) Hello(userAgent string, protocolVersion int) error {
+	return nil
+}
+
+// Describe returns the description of the discovery.
+func (d *DeviceWatchDiscovery) Describe() *Description {
+	return &Description{Protocols: []string{ProtocolSerial}}
+}
+
+// List returns the devices currently in the directory.
+func (d *DeviceWatchDiscovery) List(ctx context.Context) ([]*Port, error) {
+	return d.scan()
+}
+
+// StartSync is required to implement the Discovery interface, the Server
+// always calls StartSyncWithContext in its place.
+func (d *DeviceWatchDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	return d.StartSyncWithContext(context.Background(), eventCB, errorCB)
+}
+
+// StartSyncWithContext watches the directory until the context is cancelled:
+// in background it sends an "add" event for each device in the directory,
+// after the START_SYNC response, and then the events of the devices added and
+// removed. The errors of the scans are signalled with the errorCB.
+func (d *DeviceWatchDiscovery) StartSyncWithContext(ctx context.Context, eventCB EventCallback, errorCB ErrorCallback) error {
+	// The watch is started before the first scan, so no device is missed
+	watch, err := startDirWatch(ctx, d.dir)
+	if err != nil {
+		return err
+	}
+	current := map[string]*Port{}
+	rescan := func() error {
+		ports, err := d.scan()
+		if err != nil {
+			return err
+		}
+		found := map[string]*Port{}
+		for _, port := range ports {
+			found[port.Address] = port
+			if _, ok := current[port.Address]; !ok {
+				eventCB(EventTypeAdd, port)
+			}
+		}
+		for _, address := range sortedPortAddresses(current) {
+			if _, ok := found[address]; !ok {
+				eventCB(EventTypeRemove, &Port{Address: address, Protocol: ProtocolSerial})
+			}
+		}
+		current = found
+		return nil
+	}
+	go func() {
+		if err := rescan(); err != nil {
+			errorCB(err.Error())
+			return
+		}
+		for range watch.changes {
+			if err := rescan(); err != nil {
+				errorCB(err.Error())
+				return
+			}
+		}
+		if watch.err != nil {
+			errorCB(watch.err.Error())
+		}
+	}()
+	return nil
+}
+
+// Stop does nothing, the watch is stopped by the cancellation of the context
+// of StartSyncWithContext.
+func (d *DeviceWatchDiscovery) Stop() error {
+	return nil
+}
+
+// Quit does nothing.
+func (d *DeviceWatchDiscovery) Quit() {}
+
+// scan returns the devices in the directory, sorted by address.
+func (d *DeviceWatchDiscovery) scan() ([]*Port, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	ports := []*Port{}
+	for _, entry := range entries {
+		for _, pattern := range d.patterns {
+			if ok, _ := filepath.Match(pattern, entry.Name()); ok {
+				address := filepath.Join(d.dir, entry.Name())
+				ports = append(ports, &Port{
+					Address:       address,
+					AddressLabel:  address,
+					Protocol:      ProtocolSerial,
+					ProtocolLabel: "Serial Port",
+				})
+				break
+			}
+		}
+	}
+	return ports, nil
+}
+
+func sortedPortAddresses(ports map[string]*Port) []string {
+	addresses := make([]string, 0, len(ports))
+	for address := range ports {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// dirWatch notifies the changes of the entries of a directory: changes
+// receives a value after each change, the notifications not yet received
+// are coalesced. When the watch terminates changes is closed, and err is
+// the error that terminated it, if any.
+type dirWatch struct {
+	changes chan struct{}
+	err     error
+}
+
+func newDirWatch() *dirWatch {
+	return &dirWatch{changes: make(chan struct{}, 1)}
+}
+
+// notify records a change of the directory.
+func (w *dirWatch) notify() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
+
+// startDirWatch watches the entries of the directory, until the context is
+// cancelled.
+func startDirWatch(ctx context.Context, dir string) (*dirWatch, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("watching %s: %w", dir, err)
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("watching %s: %w", dir, err)
+	}
+	watch := newDirWatch()
+	go func() {
+		defer close(watch.changes)
+		defer watcher.Close()
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if ev.Has(fsnotify.Create) || ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+					watch.notify()
+				}
+			case err, ok := <-watcher.Errors:
+				if ok {
+					watch.err = fmt.Errorf("watching %s: %w", dir, err)
+				}
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return watch, nil
+}
+
+// WithDeviceWatchFallback runs a DeviceWatchDiscovery in-process, of the
+// devices of the given directory matching the patterns (see
+// NewDeviceWatchDiscovery), when the discovery executable is not installed:
+// the clients of the serial ports keep working, with reduced functionality,
+// on the hosts where the serial-discovery is not available.
+func WithDeviceWatchFallback(dir string, patterns ...string) ClientOption {
+	return func(disc *Client) {
+		disc.fallbackFactory = func() Discovery { return NewDeviceWatchDiscovery(dir, patterns...) }
+	}
+}
@@ -0,0 +1,65 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceWatchFallback(t *testing.T) {
+	dir := t.TempDir()
+	createDevice := func(name string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+	createDevice("ttyACM0")
+	createDevice("null")
+
+	// The discovery executable is not installed
+	disc := NewClientWithOptions("serial", "not-installed-serial-discovery", WithDeviceWatchFallback(dir, "ttyACM*", "ttyUSB*"))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+	nextEvent := func() string {
+		select {
+		case ev := <-events:
+			require.Equal(t, ProtocolSerial, ev.Port.Protocol)
+			return ev.Type + " " + filepath.Base(ev.Port.Address)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "event not received")
+		}
+		return ""
+	}
+	require.Equal(t, "add ttyACM0", nextEvent())
+	createDevice("ttyUSB0")
+	require.Equal(t, "add ttyUSB0", nextEvent())
+	require.NoError(t, os.Remove(filepath.Join(dir, "ttyACM0")))
+	require.Equal(t, "remove ttyACM0", nextEvent())
+	require.NoError(t, disc.Stop())
+
+	require.NoError(t, disc.Start())
+	ports, err := disc.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+	require.Equal(t, filepath.Join(dir, "ttyUSB0"), ports[0].Address)
+}
@@ -0,0 +1,239 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDiagnosticStderrSize is the maximum number of bytes of the stderr of the
+// discovery process recorded in a DiagnosticReport.
+const maxDiagnosticStderrSize = 64 * 1024
+
+// DiagnosticReport is the result of a diagnostic session of a discovery, see
+// Client.Diagnose. The fields are filled up to the step that failed, if any.
+type DiagnosticReport struct {
+	DiscoveryID     string             `json:"discoveryId"`
+	Command         []string           `json:"command"`
+	ProtocolVersion int                `json:"protocolVersion,omitempty"`
+	Description     *Description       `json:"description,omitempty"`
+	Ports           []*Port            `json:"ports"`
+	Timings         *DiagnosticTimings `json:"timings"`
+	// Latencies are the latencies of the responses to the commands, see
+	// Client.LatencyStats.
+	Latencies  []*LatencyStats    `json:"latencies"`
+	Transcript []*TranscriptEntry `json:"transcript"`
+	Stderr     string             `json:"stderr"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// DiagnosticTimings are the durations of the steps of a diagnostic session.
+type DiagnosticTimings struct {
+	Startup time.Duration `json:"startup"`
+	Start   time.Duration `json:"start"`
+	List    time.Duration `json:"list"`
+	Stop    time.Duration `json:"stop"`
+	Quit    time.Duration `json:"quit"`
+}
+
+// The directions of a TranscriptEntry.
+const (
+	TranscriptSent     = "sent"
+	TranscriptReceived = "received"
+)
+
+// TranscriptEntry is a command sent to the discovery, or a message received
+// from it, as it was transmitted.
+type TranscriptEntry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Data      string    `json:"data"`
+}
+
+// Diagnose runs a one-shot diagnostic session of the discovery: the discovery
+// is started, the ports are enumerated with LIST and the discovery is quit,
+// recording the stderr of the process, the duration of each step and the raw
+// protocol exchanged. The report is returned even if a step fails, together
+// with the error. The discovery must not be running.
+func (disc *Client) Diagnose() (*DiagnosticReport, error) {
+	if disc.Alive() {
+		return nil, fmt.Errorf("discovery %s already running", disc)
+	}
+	session := &diagnosticSession{clock: disc.clock, redactor: disc.redactor}
+	disc.diagnostics = session
+	defer func() { disc.diagnostics = nil }()
+
+	report := &DiagnosticReport{
+		DiscoveryID: disc.id,
+		Command:     slices.Clone(disc.processArgs),
+		Ports:       []*Port{},
+		Timings:     &DiagnosticTimings{},
+	}
+	err := disc.diagnose(report)
+	report.Ports = disc.redactor.ports(report.Ports)
+	report.Latencies = disc.LatencyStats()
+	report.Transcript = session.transcript()
+	report.Stderr = session.stderrString()
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report, err
+}
+
+func (disc *Client) diagnose(report *DiagnosticReport) (err error) {
+	timed := func(duration *time.Duration, step func() error) error {
+		start := disc.clock.Now()
+		err := step()
+		*duration = disc.clock.Now().Sub(start)
+		return err
+	}
+
+	if err := timed(&report.Timings.Startup, disc.Run); err != nil {
+		return fmt.Errorf("starting discovery %s: %w", disc, err)
+	}
+	defer func() {
+		_ = timed(&report.Timings.Quit, func() error {
+			disc.Quit()
+			return nil
+		})
+	}()
+	report.ProtocolVersion = disc.protocolVersion
+	if disc.protocolVersion >= 2 {
+		// The description is informative, the session goes on without it
+		if desc, err := disc.Describe(); err == nil {
+			report.Description = desc
+		}
+	}
+	if err := timed(&report.Timings.Start, disc.Start); err != nil {
+		return err
+	}
+	if err := timed(&report.Timings.List, func() error {
+		ports, err := disc.List()
+		if ports != nil {
+			report.Ports = ports
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	return timed(&report.Timings.Stop, disc.Stop)
+}
+
+// diagnosticSession records the stderr and the protocol of a discovery
+// process during a diagnostic session.
+type diagnosticSession struct {
+	clock    Clock
+	redactor *redactor
+	mutex    sync.Mutex
+	entries  []*TranscriptEntry
+	stderr   bytes.Buffer
+
+	// received and receivedOffset are used only by the decode loop
+	received       bytes.Buffer
+	receivedOffset int64
+}
+
+func (s *diagnosticSession) record(direction, data string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries = append(s.entries, &TranscriptEntry{
+		Time:      s.clock.Now(),
+		Direction: direction,
+		Data:      data,
+	})
+}
+
+// recordSent records a command sent to the discovery.
+func (s *diagnosticSession) recordSent(command string) {
+	if s == nil {
+		return
+	}
+	s.record(TranscriptSent, strings.TrimSpace(command))
+}
+
+// receiving returns a reader that keeps a copy of the data read from in,
+// to be recorded with recordReceived.
+func (s *diagnosticSession) receiving(in io.Reader) io.Reader {
+	if s == nil {
+		return in
+	}
+	return io.TeeReader(in, &s.received)
+}
+
+// recordReceived records the data received from the discovery up to the
+// given input offset of the decoder, that is a whole message.
+func (s *diagnosticSession) recordReceived(decoder *json.Decoder) {
+	if s == nil {
+		return
+	}
+	offset := decoder.InputOffset()
+	data := s.received.Next(int(offset - s.receivedOffset))
+	s.receivedOffset = offset
+	s.record(TranscriptReceived, s.redactor.message(strings.TrimSpace(string(data))))
+}
+
+// resetReceived discards the data received and not yet recorded, when the
+// decoder is replaced.
+func (s *diagnosticSession) resetReceived() {
+	if s == nil {
+		return
+	}
+	s.received.Reset()
+	s.receivedOffset = 0
+}
+
+func (s *diagnosticSession) transcript() []*TranscriptEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.entries)
+}
+
+// stderrWriter returns a writer recording the stderr of the discovery process
+// and forwarding it to w, if not nil.
+func (s *diagnosticSession) stderrWriter(w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+	if w == nil {
+		return s
+	}
+	return io.MultiWriter(s, w)
+}
+
+// Write records the stderr of the discovery process, up to maxDiagnosticStderrSize bytes.
+func (s *diagnosticSession) Write(data []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if room := maxDiagnosticStderrSize - s.stderr.Len(); room > 0 {
+		s.stderr.Write(data[:min(len(data), room)])
+	}
+	return len(data), nil
+}
+
+func (s *diagnosticSession) stderrString() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stderr.String()
+}
@@ -24,18 +24,24 @@
 // the methods of the Discovery interface are the only functions that must be implemented to get a fully working pluggable discovery
 // using this library.
 //
-// A usage example is provided in the dummy-discovery package.
+// A usage example is provided in the dummy-discovery/dummy package.
 package discovery
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Discovery is an interface that represents the business logic that
@@ -61,9 +67,50 @@ type Discovery interface {
 	Quit()
 }
 
+// DiscoveryWithContext is an optional interface that a Discovery may implement
+// to receive a context in StartSync. If implemented, the Server calls
+// StartSyncWithContext instead of StartSync. The context is cancelled when the
+// STOP or QUIT command is received or when the client disconnects, so the
+// discovery can use it to terminate all the goroutines started to look
+// for ports without additional bookkeeping.
+type DiscoveryWithContext interface {
+	StartSyncWithContext(ctx context.Context, eventCB EventCallback, errorCB ErrorCallback) error
+}
+
+// PortLister is an optional interface that a Discovery may implement to
+// perform an enumeration of the ports each time the LIST command is received.
+// If implemented, the Server calls List instead of reporting the ports
+// collected through StartSync after the START command. The context is cancelled
+// when the STOP or QUIT command is received or when the client disconnects.
+type PortLister interface {
+	List(ctx context.Context) ([]*Port, error)
+}
+
+// Configurer is an optional interface that a Discovery may implement to
+// receive runtime settings from the client through the CONFIGURE command
+// (available since protocol version 2). The accepted keys and values are
+// specific to each discovery, an error must be returned for unknown keys
+// or invalid values.
+type Configurer interface {
+	Configure(key, value string) error
+}
+
+// FileReceiver is an optional interface that a Discovery may implement to
+// receive the files (devices, sockets, ...) opened by the client and passed
+// to the discovery process as inherited file descriptors. The files are
+// announced by the client in the HELLO command and ReceiveFiles is called,
+// before Hello, with the files indexed by name. The discovery takes the
+// ownership of the files. If a Discovery doesn't implement this interface
+// the announced files are ignored.
+type FileReceiver interface {
+	ReceiveFiles(files map[string]*os.File) error
+}
+
 // EventCallback is a callback function to call to transmit port
 // metadata when the discovery is in "sync" mode and a new event
-// is detected.
+// is detected. The callback may be called concurrently from multiple
+// goroutines, the events received after the end of the sync session
+// (for example after a STOP) are ignored.
 type EventCallback func(event string, port *Port)
 
 // ErrorCallback is a callback function to signal unrecoverable errors to the
@@ -72,19 +119,60 @@ type EventCallback func(event string, port *Port)
 // performs a STOP+START_SYNC cycle.
 type ErrorCallback func(err string)
 
+// EventBackpressurePolicy defines the behavior of the EventCallback when the
+// client doesn't consume the events as fast as the discovery produces them.
+type EventBackpressurePolicy int
+
+const (
+	// EventBackpressureBlock makes the EventCallback block until the event
+	// has been written to the output stream. This is the default policy.
+	EventBackpressureBlock EventBackpressurePolicy = iota
+
+	// EventBackpressureDrop makes the EventCallback drop the event if the
+	// output queue is full.
+	EventBackpressureDrop
+)
+
+// maxProtocolVersion is the highest protocol version supported by the Server.
+const maxProtocolVersion = 2
+
 // A Server is a pluggable discovery protocol handler,
 // it must be created using the NewServer function.
 type Server struct {
 	impl               Discovery
 	userAgent          string
 	reqProtocolVersion int
-	initialized        bool
-	started            bool
-	syncStarted        bool
+	protocolVersion    atomic.Int32
+	state              State
 	cachedPorts        map[string]*Port
 	cachedErr          string
 	output             io.Writer
 	outputMutex        sync.Mutex
+	outputQueue        chan []byte
+	outputQueueSize    int
+	eventPolicy        EventBackpressurePolicy
+	droppedEvents      uint64
+	callbacksMutex     sync.Mutex
+	heartbeatInterval  time.Duration
+	heartbeatStop      chan<- struct{}
+	heartbeatDone      <-chan struct{}
+	ctx                context.Context
+	sessionCtx         context.Context
+	sessionCancel      context.CancelFunc
+	conformance        *conformanceChecker
+	recoveredPanics    atomic.Uint64
+	transformers       []PortTransformer
+	compactOutput      atomic.Bool
+	idempotentCommands bool
+	helloArgs          string
+	stdioKey           []byte
+	compression        *compressedOutput
+
+	// The following fields are guarded by listMutex, they are shared with
+	// the goroutine reading the commands to cancel an in-flight LIST.
+	listMutex         sync.Mutex
+	listStop          chan struct{}
+	stopListSupported bool
 }
 
 // NewServer creates a new discovery server backed by the
@@ -96,109 +184,402 @@ func NewServer(impl Discovery) *Server {
 	}
 }
 
+// SetHeartbeatInterval enables the periodic emission of "heartbeat" messages
+// while the discovery is in sync mode, this allows the client to distinguish
+// between a discovery that is alive but has no ports to report and a discovery
+// that is stuck. Heartbeats are sent only if the client negotiated protocol
+// version 2 or later. An interval of 0 (the default) disables heartbeats.
+func (d *Server) SetHeartbeatInterval(interval time.Duration) {
+	d.heartbeatInterval = interval
+}
+
+// SetEventBackpressurePolicy sets the behavior of the EventCallback when the output
+// stream can't keep up with the events produced by the discovery. If queueSize is
+// greater than 0 the messages are written to the output stream by a separate
+// goroutine through a queue of the given size, otherwise they are written directly
+// by the caller. The EventBackpressureDrop policy requires a queue: when the queue
+// is full the events are discarded and counted in DroppedEvents.
+// Command responses and errors are never dropped. This method must be called
+// before Run.
+func (d *Server) SetEventBackpressurePolicy(policy EventBackpressurePolicy, queueSize int) {
+	d.eventPolicy = policy
+	d.outputQueueSize = queueSize
+}
+
+// SetOutputFormat sets the format of the JSON messages sent by the discovery:
+// OutputFormatIndented (the default) or OutputFormatCompact. The compact
+// format reduces the IO and the parsing time of the chatty discoveries. The
+// client may override the format in the HELLO command, see
+// BuildHelloWithOptions. This method must be called before Run.
+func (d *Server) SetOutputFormat(format string) error {
+	switch format {
+	case OutputFormatIndented:
+		d.compactOutput.Store(false)
+	case OutputFormatCompact:
+		d.compactOutput.Store(true)
+	default:
+		return fmt.Errorf("invalid output format: %s", format)
+	}
+	return nil
+}
+
+// DroppedEvents returns the number of events discarded due to the
+// EventBackpressureDrop policy.
+func (d *Server) DroppedEvents() uint64 {
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	return d.droppedEvents
+}
+
 // Run starts the protocol handling loop on the given input and
 // output stream, usually `os.Stdin` and `os.Stdout` are used.
 // The function blocks until the `QUIT` command is received or
 // the input stream is closed. In case of IO error the error is
 // returned.
 func (d *Server) Run(in io.Reader, out io.Writer) error {
-	d.output = out
-	reader := bufio.NewReader(in)
-	for {
-		fullCmd, err := reader.ReadString('\n')
+	if d.stdioKey != nil {
+		conn, err := newStdioServer(d.stdioKey, in, out)
 		if err != nil {
-			d.send(messageError("command_error", err.Error()))
 			return err
 		}
-		fullCmd = strings.TrimSpace(fullCmd)
-		split := strings.Split(fullCmd, " ")
-		cmd := strings.ToUpper(split[0])
+		in, out = conn, conn
+	}
+	d.compression = newCompressedOutput(out)
+	d.output = d.compression
+	if d.outputQueueSize > 0 {
+		defer d.startOutputQueue()()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.ctx = ctx
+
+	// The input stream is read in a separate goroutine, in this way the context
+	// is cancelled as soon as the client disconnects (or sends a QUIT), even if
+	// the implementation is still busy serving a previous command.
+	type command struct {
+		cmd  string
+		args string
+	}
+	commands := make(chan *command)
+	var readErr error
+	go func() {
+		defer close(commands)
+		defer cancel()
+		reader := bufio.NewReader(in)
+		for {
+			fullCmd, err := reader.ReadString('\n')
+			if err != nil {
+				readErr = err
+				return
+			}
+			cmd, args := parseCommand(fullCmd)
+			telemetry.count(&telemetry.serverCommands)
+			if d.interceptListCommand(cmd) {
+				continue
+			}
+			commands <- &command{cmd: cmd, args: args}
+			if cmd == CommandQuit {
+				return
+			}
+		}
+	}()
+
+	for c := range commands {
+		cmd := c.cmd
 
-		if !d.initialized && cmd != "HELLO" && cmd != "QUIT" {
-			d.send(messageError("command_error", fmt.Sprintf("First command must be HELLO, but got '%s'", cmd)))
+		if d.state == StateUninitialized && cmd != CommandHello && cmd != CommandQuit {
+			d.send(messageError(EventTypeCommandError, fmt.Sprintf("First command must be HELLO, but got '%s'", cmd)))
 			continue
 		}
 
 		switch cmd {
-		case "HELLO":
-			if len(fullCmd) < 7 {
-				d.hello("")
-			} else {
-				d.hello(fullCmd[6:])
-			}
-		case "START":
-			d.start()
-		case "LIST":
+		case CommandHello:
+			d.hello(c.args)
+		case CommandStart:
+			d.start(c.args)
+		case CommandList:
 			d.list()
-		case "START_SYNC":
-			d.startSync()
-		case "STOP":
+		case CommandStartSync:
+			d.startSync(c.args)
+		case CommandStop:
 			d.stop()
-		case "QUIT":
-			d.impl.Quit()
-			d.send(messageOk("quit"))
+		case CommandDescribe:
+			d.describe()
+		case CommandConfigure:
+			d.configure(c.args)
+		case CommandPing:
+			d.ping()
+		case CommandStopList:
+			// Received when no LIST is in progress: since STOP_LIST has no
+			// response of its own, it's ignored.
+			if d.protocolVersion.Load() < 2 {
+				d.send(messageError(EventTypeCommandError, fmt.Sprintf("Command %s not supported", cmd)))
+			}
+		case CommandQuit:
+			d.stopHeartbeat()
+			d.stopSession()
+			_ = d.protect("Quit", func() error {
+				d.impl.Quit()
+				return nil
+			})
+			d.state = StateQuit
+			d.send(messageOk(EventTypeQuit))
 			return nil
 		default:
-			d.send(messageError("command_error", fmt.Sprintf("Command %s not supported", cmd)))
+			d.send(messageError(EventTypeCommandError, fmt.Sprintf("Command %s not supported", cmd)))
+		}
+	}
+
+	d.stopHeartbeat()
+	d.stopSession()
+	d.send(messageError(EventTypeCommandError, readErr.Error()))
+	return readErr
+}
+
+// parseCommand splits a command line received from the client in the
+// command name (converted to uppercase) and its arguments.
+func parseCommand(line string) (cmd string, args string) {
+	line = strings.TrimSpace(line)
+	cmd, args, _ = strings.Cut(line, " ")
+	return strings.ToUpper(cmd), strings.TrimSpace(args)
+}
+
+var helloArgsRegexp = regexp.MustCompile(`^(\d+) "([^"]+)"(?: fds=(\S+))?(?: format=(\S+))?(?: compression=(\S+))?$`)
+
+var helloFileRegexp = regexp.MustCompile(`^([A-Za-z0-9_.-]+):(\d+)$`)
+
+var helloFileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// helloArgs are the arguments of the HELLO command.
+type helloArgs struct {
+	// protocolVersion is the protocol version requested by the client
+	protocolVersion int
+	userAgent       string
+	// fds are the file descriptors announced by the client, indexed by name
+	fds map[string]uintptr
+	// format is the output format requested by the client, if any
+	format string
+	// compression is the compression requested by the client, if any
+	compression string
+}
+
+// parseHelloArgs parses the arguments of the HELLO command.
+func parseHelloArgs(args string) (*helloArgs, error) {
+	matches := helloArgsRegexp.FindStringSubmatch(args)
+	if len(matches) != 6 {
+		return nil, errors.New("Invalid HELLO command")
+	}
+	v, err := strconv.ParseInt(matches[1], 10, 32)
+	if err != nil {
+		return nil, errors.New("Invalid protocol version: " + matches[1])
+	}
+	res := &helloArgs{protocolVersion: int(v), userAgent: matches[2], format: matches[4], compression: matches[5]}
+	if res.format != "" && res.format != OutputFormatIndented && res.format != OutputFormatCompact {
+		return nil, errors.New("Invalid output format: " + res.format)
+	}
+	if res.compression != "" && !isSupportedCompression(res.compression) {
+		return nil, errors.New("Unsupported compression: " + res.compression)
+	}
+	if matches[3] == "" {
+		return res, nil
+	}
+	res.fds = map[string]uintptr{}
+	for _, file := range strings.Split(matches[3], ",") {
+		fileMatches := helloFileRegexp.FindStringSubmatch(file)
+		if fileMatches == nil {
+			return nil, errors.New("Invalid file descriptor: " + file)
+		}
+		fd, err := strconv.ParseUint(fileMatches[2], 10, 31)
+		if err != nil || fd < 3 {
+			return nil, errors.New("Invalid file descriptor: " + file)
 		}
+		res.fds[fileMatches[1]] = uintptr(fd)
 	}
+	return res, nil
 }
 
-func (d *Server) hello(cmd string) {
-	if d.initialized {
-		d.send(messageError("hello", "HELLO already called"))
+// transition checks that the command is allowed in the current state and
+// returns the state reached after the command. The commands not allowed are
+// reported to the conformance checks, if enabled.
+func (d *Server) transition(cmd string) (State, bool) {
+	next, err := NextState(d.state, cmd)
+	if err != nil {
+		d.conformance.reportCommand(err)
+		return d.state, false
+	}
+	return next, true
+}
+
+func (d *Server) hello(args string) {
+	if d.repeatedCommand(CommandHello, args) {
 		return
 	}
-	re := regexp.MustCompile(`^(\d+) "([^"]+)"$`)
-	matches := re.FindStringSubmatch(cmd)
-	if len(matches) != 3 {
-		d.send(messageError("hello", "Invalid HELLO command"))
+	next, ok := d.transition(CommandHello)
+	if !ok {
+		d.send(messageError(EventTypeHello, "HELLO already called"))
 		return
 	}
-	d.userAgent = matches[2]
-	v, err := strconv.ParseInt(matches[1], 10, 64)
+	hello, err := parseHelloArgs(args)
 	if err != nil {
-		d.send(messageError("hello", "Invalid protocol version: "+matches[2]))
+		d.send(messageError(EventTypeHello, err.Error()))
 		return
 	}
-	d.reqProtocolVersion = int(v)
-	if err := d.impl.Hello(d.userAgent, 1); err != nil {
-		d.send(messageError("hello", err.Error()))
+	if receiver, ok := d.impl.(FileReceiver); ok && len(hello.fds) > 0 {
+		files := map[string]*os.File{}
+		for name, fd := range hello.fds {
+			files[name] = os.NewFile(fd, name)
+		}
+		if err := d.protect("ReceiveFiles", func() error { return receiver.ReceiveFiles(files) }); err != nil {
+			d.send(messageError(EventTypeHello, err.Error()))
+			return
+		}
+	}
+	if extension, ok := d.impl.(VendorExtension); ok {
+		extension.SetVendorEventCallback(d.SendVendorEvent)
+	}
+	if emitter, ok := d.impl.(WarningEmitter); ok {
+		emitter.SetWarningCallback(d.SendWarning)
+	}
+	d.userAgent = hello.userAgent
+	d.reqProtocolVersion = hello.protocolVersion
+	protocolVersion := min(max(d.reqProtocolVersion, 1), maxProtocolVersion)
+	if err := d.protect("Hello", func() error { return d.impl.Hello(d.userAgent, protocolVersion) }); err != nil {
+		d.send(messageError(EventTypeHello, err.Error()))
 		return
 	}
-	d.send(&message{
-		EventType:       "hello",
-		ProtocolVersion: 1, // Protocol version 1 is the only supported for now...
+	d.protocolVersion.Store(int32(protocolVersion))
+	d.helloArgs = args
+	if hello.format != "" {
+		// The response to the HELLO is already sent in the requested format
+		d.compactOutput.Store(hello.format == OutputFormatCompact)
+	}
+	d.listMutex.Lock()
+	d.stopListSupported = protocolVersion >= 2
+	d.listMutex.Unlock()
+	response := d.marshal(&message{
+		EventType:       EventTypeHello,
+		ProtocolVersion: protocolVersion,
 		Message:         "OK",
 	})
-	d.initialized = true
+	if hello.compression != "" {
+		// The response to the HELLO is not compressed
+		d.compression.enableAfter(response, hello.compression)
+	}
+	d.write(response, false)
+	d.state = next
+}
+
+func (d *Server) describe() {
+	if d.protocolVersion.Load() < 2 {
+		d.send(messageError(EventTypeDescribe, "DESCRIBE requires protocol version 2"))
+		return
+	}
+	describer, ok := d.impl.(Describer)
+	if !ok {
+		d.send(messageError(EventTypeDescribe, "DESCRIBE not supported by the discovery"))
+		return
+	}
+	msg := messageOk(EventTypeDescribe)
+	if err := d.protect("Describe", func() error {
+		msg.Description = describer.Describe()
+		return nil
+	}); err != nil {
+		d.send(messageError(EventTypeDescribe, err.Error()))
+		return
+	}
+	if msg.Description == nil {
+		msg.Description = &Description{}
+	}
+	if _, ok := d.impl.(Configurer); ok && !slices.Contains(msg.Description.Capabilities, CommandConfigure) {
+		desc := *msg.Description
+		desc.Capabilities = append(slices.Clone(desc.Capabilities), CommandConfigure)
+		msg.Description = &desc
+	}
+	if !slices.Contains(msg.Description.Capabilities, CommandPing) {
+		desc := *msg.Description
+		desc.Capabilities = append(slices.Clone(desc.Capabilities), CommandPing)
+		msg.Description = &desc
+	}
+	d.send(msg)
+}
+
+func (d *Server) configure(args string) {
+	if d.protocolVersion.Load() < 2 {
+		d.send(messageError(EventTypeConfigure, "CONFIGURE requires protocol version 2"))
+		return
+	}
+	configurer, ok := d.impl.(Configurer)
+	if !ok {
+		d.send(messageError(EventTypeConfigure, "CONFIGURE not supported by the discovery"))
+		return
+	}
+	key, value, _ := strings.Cut(args, " ")
+	if key == "" {
+		d.send(messageError(EventTypeConfigure, "Invalid CONFIGURE command"))
+		return
+	}
+	if err := d.protect("Configure", func() error { return configurer.Configure(key, strings.TrimSpace(value)) }); err != nil {
+		d.send(messageError(EventTypeConfigure, "Cannot CONFIGURE: "+err.Error()))
+		return
+	}
+	d.send(messageOk(EventTypeConfigure))
+}
+
+// ping answers the PING command, without involving the implementation.
+func (d *Server) ping() {
+	if d.protocolVersion.Load() < 2 {
+		d.send(messageError(EventTypeCommandError, fmt.Sprintf("Command %s not supported", CommandPing)))
+		return
+	}
+	d.send(messageOk(EventTypePong))
 }
 
-func (d *Server) start() {
-	if d.started {
-		d.send(messageError("start", "Discovery already STARTed"))
+func (d *Server) start(args string) {
+	if d.repeatedCommand(CommandStart, "") {
 		return
 	}
-	if d.syncStarted {
-		d.send(messageError("start", "Discovery already START_SYNCed, cannot START"))
+	next, ok := d.transition(CommandStart)
+	if !ok && d.state == StateSyncing {
+		d.send(messageError(EventTypeStart, "Discovery already START_SYNCed, cannot START"))
+		return
+	}
+	if !ok {
+		d.send(messageError(EventTypeStart, "Discovery already STARTed"))
+		return
+	}
+	if err := d.startWithParams(args); err != nil {
+		d.send(messageError(EventTypeStart, "Cannot START: "+err.Error()))
 		return
 	}
 	d.cachedPorts = map[string]*Port{}
 	d.cachedErr = ""
-	if err := d.impl.StartSync(d.eventCallback, d.errorCallback); err != nil {
-		d.send(messageError("start", "Cannot START: "+err.Error()))
-		return
+	ctx := d.startSession()
+	// In START mode the events are not sent to the client, so they're
+	// allowed even before the acknowledgement.
+	d.conformance.begin(true)
+	if _, ok := d.impl.(PortLister); !ok {
+		if err := d.startImplSync(ctx, d.eventCallback, d.errorCallback); err != nil {
+			d.stopSession()
+			d.stopAfterPanic(err)
+			d.send(messageError(EventTypeStart, "Cannot START: "+err.Error()))
+			return
+		}
 	}
-	d.started = true
-	d.send(messageOk("start"))
+	d.state = next
+	d.send(messageOk(EventTypeStart))
 }
 
+// eventCallback and errorCallback are called through the session guard
+// that holds the callbacksMutex, so the access to the cache is serialized.
 func (d *Server) eventCallback(event string, port *Port) {
+	if port == nil {
+		return
+	}
 	id := port.Address + "|" + port.Protocol
-	if event == "add" {
+	if event == EventTypeAdd {
 		d.cachedPorts[id] = port
 	}
-	if event == "remove" {
+	if event == EventTypeRemove {
 		delete(d.cachedPorts, id)
 	}
 }
@@ -208,84 +589,373 @@ func (d *Server) errorCallback(msg string) {
 }
 
 func (d *Server) list() {
-	if !d.started {
-		d.send(messageError("list", "Discovery not STARTed"))
-		return
-	}
-	if d.syncStarted {
-		d.send(messageError("list", "discovery already START_SYNCed, LIST not allowed"))
+	d.listMutex.Lock()
+	stop := d.listStop
+	d.listMutex.Unlock()
+	defer d.endList(stop)
+	if _, ok := d.transition(CommandList); !ok {
+		if d.state == StateSyncing {
+			d.send(messageError(EventTypeList, "discovery already START_SYNCed, LIST not allowed"))
+		} else {
+			d.send(messageError(EventTypeList, "Discovery not STARTed"))
+		}
 		return
 	}
-	if d.cachedErr != "" {
-		d.send(messageError("list", d.cachedErr))
-		return
+	ctx, stopped, release := d.listContext(stop)
+	defer release()
+	var ports []*Port
+	if lister, ok := d.impl.(PortLister); ok {
+		var l []*Port
+		err := d.protect("List", func() error {
+			var err error
+			l, err = lister.List(ctx)
+			return err
+		})
+		if isPanicError(err) {
+			d.recoverToIdle()
+			d.send(messageError(EventTypeList, err.Error()))
+			return
+		}
+		if stopped() {
+			d.send(messageError(EventTypeList, listCancelledMessage))
+			return
+		}
+		if err != nil {
+			d.send(messageError(EventTypeList, err.Error()))
+			return
+		}
+		ports = l
+	} else {
+		d.callbacksMutex.Lock()
+		cachedErr := d.cachedErr
+		for _, port := range d.cachedPorts {
+			ports = append(ports, port)
+		}
+		d.callbacksMutex.Unlock()
+		if cachedErr != "" {
+			d.send(messageError(EventTypeList, cachedErr))
+			return
+		}
 	}
-	ports := []*Port{}
-	for _, port := range d.cachedPorts {
-		ports = append(ports, port)
+	if ports == nil {
+		ports = []*Port{}
 	}
+	ports = d.transformPorts(ports)
 	d.send(&message{
-		EventType: "list",
+		EventType: EventTypeList,
 		Ports:     &ports,
 	})
 }
 
-func (d *Server) startSync() {
-	if d.syncStarted {
-		d.send(messageError("start_sync", "Discovery already START_SYNCed"))
+// interceptListCommand is called by the goroutine reading the commands, it
+// arms the cancellation of a LIST before it's served and handles the
+// STOP_LIST commands that cancel it. Returns true if the command has been
+// consumed.
+func (d *Server) interceptListCommand(cmd string) bool {
+	d.listMutex.Lock()
+	defer d.listMutex.Unlock()
+	if !d.stopListSupported {
+		return false
+	}
+	switch cmd {
+	case CommandList:
+		// Each LIST has its own cancellation, armed until it's completed
+		d.listStop = make(chan struct{})
+	case CommandStopList:
+		if d.listStop != nil {
+			select {
+			case <-d.listStop:
+				// Already cancelled
+			default:
+				close(d.listStop)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// listContext returns the context for the implementation of the LIST, that
+// is cancelled when the stop channel of the LIST is closed by a STOP_LIST, a
+// function reporting if it has been cancelled and a function to call when the
+// LIST is completed. Like the session context, the context is anyway cancelled
+// by the STOP.
+func (d *Server) listContext(stop chan struct{}) (context.Context, func() bool, func()) {
+	if stop == nil {
+		return d.sessionCtx, func() bool { return false }, func() {}
+	}
+	ctx, cancel := context.WithCancel(d.sessionCtx)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-done:
+		}
+	}()
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	}
+	return ctx, stopped, func() { close(done) }
+}
+
+// endList disarms the cancellation of the LIST with the given stop channel, a
+// following STOP_LIST is ignored. The cancellation of a following LIST, already
+// received, is left armed.
+func (d *Server) endList(stop chan struct{}) {
+	d.listMutex.Lock()
+	defer d.listMutex.Unlock()
+	if d.listStop == stop {
+		d.listStop = nil
+	}
+}
+
+func (d *Server) startSync(args string) {
+	next, ok := d.transition(CommandStartSync)
+	if !ok && d.state == StateStarted {
+		d.send(messageError(EventTypeStartSync, "Discovery already STARTed, cannot START_SYNC"))
 		return
 	}
-	if d.started {
-		d.send(messageError("start_sync", "Discovery already STARTed, cannot START_SYNC"))
+	if !ok {
+		d.send(messageError(EventTypeStartSync, "Discovery already START_SYNCed"))
 		return
 	}
-	if err := d.impl.StartSync(d.syncEvent, d.errorEvent); err != nil {
-		d.send(messageError("start_sync", "Cannot START_SYNC: "+err.Error()))
+	if err := d.startWithParams(args); err != nil {
+		d.send(messageError(EventTypeStartSync, "Cannot START_SYNC: "+err.Error()))
 		return
 	}
-	d.syncStarted = true
-	d.send(messageOk("start_sync"))
+	ctx := d.startSession()
+	d.conformance.begin(false)
+	if err := d.startImplSync(ctx, d.syncEvent, d.errorEvent); err != nil {
+		d.stopSession()
+		d.stopAfterPanic(err)
+		d.send(messageError(EventTypeStartSync, "Cannot START_SYNC: "+err.Error()))
+		return
+	}
+	d.state = next
+	// The acknowledgement is sent holding the callbacksMutex, so the events
+	// are ordered after it.
+	d.callbacksMutex.Lock()
+	d.send(messageOk(EventTypeStartSync))
+	d.conformance.ack()
+	d.callbacksMutex.Unlock()
+	d.startHeartbeat()
 }
 
 func (d *Server) stop() {
-	if !d.syncStarted && !d.started {
-		d.send(messageError("stop", "Discovery already STOPped"))
+	if d.repeatedCommand(CommandStop, "") {
 		return
 	}
-	if err := d.impl.Stop(); err != nil {
-		d.send(messageError("stop", "Cannot STOP: "+err.Error()))
+	next, ok := d.transition(CommandStop)
+	if !ok {
+		d.send(messageError(EventTypeStop, "Discovery already STOPped"))
 		return
 	}
-	d.started = false
-	if d.syncStarted {
-		d.syncStarted = false
+	d.stopHeartbeat()
+	d.stopSession()
+	if err := d.protect("Stop", d.impl.Stop); err != nil {
+		if isPanicError(err) {
+			// The session is already stopped
+			d.state = next
+		}
+		d.send(messageError(EventTypeStop, "Cannot STOP: "+err.Error()))
+		return
 	}
-	d.send(messageOk("stop"))
+	d.state = next
+	d.send(messageOk(EventTypeStop))
+}
+
+// startWithParams passes the parameters of the START or START_SYNC command to
+// the implementation, if it's a ParamsStarter.
+func (d *Server) startWithParams(args string) error {
+	if args != "" && d.protocolVersion.Load() < 2 {
+		return errors.New("parameters require protocol version 2")
+	}
+	starter, ok := d.impl.(ParamsStarter)
+	if !ok {
+		return nil
+	}
+	params, err := parseStartParams(args)
+	if err != nil {
+		return err
+	}
+	return d.protect("StartWithParams", func() error { return starter.StartWithParams(params) })
+}
+
+// startSession creates the context that is passed to the implementation
+// until the next STOP or QUIT command.
+func (d *Server) startSession() context.Context {
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.sessionCtx = ctx
+	d.sessionCancel = cancel
+	return ctx
+}
+
+func (d *Server) stopSession() {
+	if d.sessionCancel == nil {
+		return
+	}
+	// Wait for the callbacks in progress to complete, after the context
+	// cancellation the callbacks of the session are ignored.
+	d.callbacksMutex.Lock()
+	d.sessionCancel()
+	d.callbacksMutex.Unlock()
+	d.sessionCancel = nil
+}
+
+// startImplSync calls the StartSync of the implementation. The callbacks
+// passed to the implementation are safe to be called from multiple goroutines
+// and they are ignored after the end of the session.
+func (d *Server) startImplSync(ctx context.Context, eventCB EventCallback, errorCB ErrorCallback) error {
+	guardedEventCB := func(event string, port *Port) {
+		d.callbacksMutex.Lock()
+		defer d.callbacksMutex.Unlock()
+		if ctx.Err() == nil {
+			d.conformance.checkEvent(event, port)
+			eventCB(event, port)
+		}
+	}
+	guardedErrorCB := func(err string) {
+		d.callbacksMutex.Lock()
+		defer d.callbacksMutex.Unlock()
+		if ctx.Err() == nil {
+			errorCB(err)
+		}
+	}
+	if impl, ok := d.impl.(DiscoveryWithContext); ok {
+		return d.protect("StartSyncWithContext", func() error {
+			return impl.StartSyncWithContext(ctx, guardedEventCB, guardedErrorCB)
+		})
+	}
+	return d.protect("StartSync", func() error {
+		return d.impl.StartSync(guardedEventCB, guardedErrorCB)
+	})
+}
+
+func (d *Server) startHeartbeat() {
+	if d.heartbeatInterval <= 0 || d.protocolVersion.Load() < 2 {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	d.heartbeatStop = stop
+	d.heartbeatDone = done
+	interval := d.heartbeatInterval
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				d.send(&message{EventType: EventTypeHeartbeat})
+			}
+		}
+	}()
+}
+
+func (d *Server) stopHeartbeat() {
+	if d.heartbeatStop == nil {
+		return
+	}
+	close(d.heartbeatStop)
+	<-d.heartbeatDone
+	d.heartbeatStop = nil
+	d.heartbeatDone = nil
 }
 
 func (d *Server) syncEvent(event string, port *Port) {
-	d.send(&message{
+	if port == nil {
+		return
+	}
+	telemetry.count(&telemetry.serverEvents)
+	port = d.transformPort(port)
+	msg := &message{
 		EventType: event,
 		Port:      port,
-	})
+	}
+	if d.protocolVersion.Load() >= 2 {
+		msg.Payload = encodePayload(port)
+	}
+	d.write(d.marshal(msg), d.eventPolicy == EventBackpressureDrop)
 }
 
 func (d *Server) errorEvent(msg string) {
-	d.send(messageError("start_sync", msg))
+	d.send(messageError(EventTypeStartSync, msg))
 }
 
 func (d *Server) send(msg *message) {
-	data, err := json.MarshalIndent(msg, "", "  ")
+	d.write(d.marshal(msg), false)
+}
+
+func (d *Server) marshal(msg *message) []byte {
+	encode := func(v any) ([]byte, error) { return json.MarshalIndent(v, "", "  ") }
+	if d.compactOutput.Load() {
+		encode = json.Marshal
+	}
+	data, err := encode(msg)
 	if err != nil {
 		// We are certain that this will be marshalled correctly
 		// so we don't handle the error
-		data, _ = json.MarshalIndent(messageError("command_error", err.Error()), "", "  ")
+		data, _ = encode(messageError(EventTypeCommandError, err.Error()))
 	}
-	data = append(data, '\n')
+	return append(data, '\n')
+}
 
+// write sends data to the output stream, directly or through the output
+// queue if enabled. If drop is true and the output queue is full, the data
+// is discarded.
+func (d *Server) write(data []byte, drop bool) {
 	d.outputMutex.Lock()
 	defer d.outputMutex.Unlock()
-	n, err := d.output.Write(data)
+	if d.outputQueue == nil {
+		writeOutput(d.output, data)
+		return
+	}
+	if !drop {
+		d.outputQueue <- data
+		return
+	}
+	select {
+	case d.outputQueue <- data:
+	default:
+		d.droppedEvents++
+	}
+}
+
+// startOutputQueue starts the goroutine that writes the queued messages to
+// the output stream and returns a function that flushes the queue and
+// waits for the goroutine to terminate.
+func (d *Server) startOutputQueue() func() {
+	queue := make(chan []byte, d.outputQueueSize)
+	done := make(chan struct{})
+	d.outputMutex.Lock()
+	d.outputQueue = queue
+	d.outputMutex.Unlock()
+	go func() {
+		defer close(done)
+		for data := range queue {
+			writeOutput(d.output, data)
+		}
+	}()
+	return func() {
+		d.outputMutex.Lock()
+		d.outputQueue = nil
+		close(queue)
+		d.outputMutex.Unlock()
+		<-done
+	}
+}
+
+func writeOutput(out io.Writer, data []byte) {
+	n, err := out.Write(data)
 	if n != len(data) || err != nil {
 		panic("ERROR")
 	}
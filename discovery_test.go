@@ -18,9 +18,19 @@
 package discovery
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/arduino/go-paths-helper"
+	properties "github.com/arduino/go-properties-orderedmap"
 	"github.com/stretchr/testify/require"
 )
 
@@ -67,3 +77,636 @@ func TestDisc(t *testing.T) {
 		require.Equal(t, "{\n  \"eventType\": \"quit\",\n  \"message\": \"OK\"\n}\n", string(output[:outN]))
 	}
 }
+
+type nullDiscovery struct{}
+
+func (d *nullDiscovery) Hello(userAgent string, protocol int) error   { return nil }
+func (d *nullDiscovery) StartSync(EventCallback, ErrorCallback) error { return nil }
+func (d *nullDiscovery) Stop() error                                  { return nil }
+func (d *nullDiscovery) Quit()                                        {}
+
+type testServerConn struct {
+	t       *testing.T
+	in      *io.PipeWriter
+	decoder *json.Decoder
+}
+
+func runTestServer(t *testing.T, server *Server) *testServerConn {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go server.Run(inR, outW)
+	return &testServerConn{t: t, in: inW, decoder: json.NewDecoder(outR)}
+}
+
+func (c *testServerConn) send(cmd string) {
+	_, err := c.in.Write([]byte(cmd + "\n"))
+	require.NoError(c.t, err)
+}
+
+func (c *testServerConn) recv() *message {
+	var msg message
+	require.NoError(c.t, c.decoder.Decode(&msg))
+	return &msg
+}
+
+func TestServerHeartbeat(t *testing.T) {
+	t.Run("WithProtocolVersion2", func(t *testing.T) {
+		server := NewServer(&nullDiscovery{})
+		server.SetHeartbeatInterval(10 * time.Millisecond)
+		conn := runTestServer(t, server)
+
+		conn.send(`HELLO 2 "test"`)
+		msg := conn.recv()
+		require.Equal(t, "hello", msg.EventType)
+		require.Equal(t, 2, msg.ProtocolVersion)
+
+		conn.send("START_SYNC")
+		require.Equal(t, "start_sync", conn.recv().EventType)
+		require.Equal(t, "heartbeat", conn.recv().EventType)
+		require.Equal(t, "heartbeat", conn.recv().EventType)
+
+		conn.send("STOP")
+		for msg := conn.recv(); msg.EventType != "stop"; msg = conn.recv() {
+			require.Equal(t, "heartbeat", msg.EventType)
+		}
+		conn.send("QUIT")
+		require.Equal(t, "quit", conn.recv().EventType)
+	})
+
+	t.Run("WithProtocolVersion1", func(t *testing.T) {
+		server := NewServer(&nullDiscovery{})
+		server.SetHeartbeatInterval(10 * time.Millisecond)
+		conn := runTestServer(t, server)
+
+		conn.send(`HELLO 1 "test"`)
+		msg := conn.recv()
+		require.Equal(t, "hello", msg.EventType)
+		require.Equal(t, 1, msg.ProtocolVersion)
+
+		conn.send("START_SYNC")
+		require.Equal(t, "start_sync", conn.recv().EventType)
+		time.Sleep(50 * time.Millisecond)
+		conn.send("STOP")
+		require.Equal(t, "stop", conn.recv().EventType)
+		conn.send("QUIT")
+		require.Equal(t, "quit", conn.recv().EventType)
+	})
+}
+
+type contextDiscovery struct {
+	nullDiscovery
+	syncCtx chan context.Context
+	listCtx chan context.Context
+}
+
+func (d *contextDiscovery) StartSyncWithContext(ctx context.Context, eventCB EventCallback, errorCB ErrorCallback) error {
+	d.syncCtx <- ctx
+	return nil
+}
+
+func (d *contextDiscovery) List(ctx context.Context) ([]*Port, error) {
+	d.listCtx <- ctx
+	return []*Port{{Address: "1", Protocol: "test"}}, nil
+}
+
+func TestServerContext(t *testing.T) {
+	impl := &contextDiscovery{
+		syncCtx: make(chan context.Context, 1),
+		listCtx: make(chan context.Context, 1),
+	}
+	conn := runTestServer(t, NewServer(impl))
+	conn.send(`HELLO 2 "test"`)
+	require.Equal(t, "hello", conn.recv().EventType)
+
+	// START + LIST uses the PortLister and the context is cancelled on STOP
+	conn.send("START")
+	require.Equal(t, "start", conn.recv().EventType)
+	conn.send("LIST")
+	msg := conn.recv()
+	require.Equal(t, "list", msg.EventType)
+	require.Len(t, *msg.Ports, 1)
+	listCtx := <-impl.listCtx
+	require.NoError(t, listCtx.Err())
+	conn.send("STOP")
+	require.Equal(t, "stop", conn.recv().EventType)
+	require.Error(t, listCtx.Err())
+
+	// START_SYNC context is cancelled on STOP
+	conn.send("START_SYNC")
+	require.Equal(t, "start_sync", conn.recv().EventType)
+	syncCtx := <-impl.syncCtx
+	require.NoError(t, syncCtx.Err())
+	conn.send("STOP")
+	require.Equal(t, "stop", conn.recv().EventType)
+	require.Error(t, syncCtx.Err())
+
+	// START_SYNC context is cancelled when the client disconnects
+	conn.send("START_SYNC")
+	require.Equal(t, "start_sync", conn.recv().EventType)
+	syncCtx = <-impl.syncCtx
+	require.NoError(t, syncCtx.Err())
+	require.NoError(t, conn.in.Close())
+	require.Equal(t, "command_error", conn.recv().EventType)
+	require.Error(t, syncCtx.Err())
+}
+
+type concurrentDiscovery struct {
+	nullDiscovery
+	done chan bool
+}
+
+func (d *concurrentDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				eventCB("add", &Port{Address: fmt.Sprintf("%d-%d", i, j), Protocol: "test"})
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		d.done <- true
+	}()
+	return nil
+}
+
+func TestServerConcurrentEvents(t *testing.T) {
+	t.Run("WithStart", func(t *testing.T) {
+		impl := &concurrentDiscovery{done: make(chan bool, 1)}
+		conn := runTestServer(t, NewServer(impl))
+		conn.send(`HELLO 1 "test"`)
+		require.Equal(t, "hello", conn.recv().EventType)
+		conn.send("START")
+		require.Equal(t, "start", conn.recv().EventType)
+		<-impl.done
+		conn.send("LIST")
+		msg := conn.recv()
+		require.Equal(t, "list", msg.EventType)
+		require.Len(t, *msg.Ports, 200)
+		conn.send("QUIT")
+		require.Equal(t, "quit", conn.recv().EventType)
+	})
+
+	t.Run("WithStartSyncAndDropPolicy", func(t *testing.T) {
+		impl := &concurrentDiscovery{done: make(chan bool, 1)}
+		server := NewServer(impl)
+		server.SetEventBackpressurePolicy(EventBackpressureDrop, 10)
+		conn := runTestServer(t, server)
+		conn.send(`HELLO 1 "test"`)
+		require.Equal(t, "hello", conn.recv().EventType)
+		conn.send("START_SYNC")
+		<-impl.done
+		require.Greater(t, server.DroppedEvents(), uint64(0))
+
+		conn.send("STOP")
+		added := 0
+		for msg := conn.recv(); msg.EventType != "stop"; msg = conn.recv() {
+			if msg.EventType == "add" {
+				added++
+			}
+		}
+		require.Equal(t, uint64(200), uint64(added)+server.DroppedEvents())
+		conn.send("QUIT")
+		require.Equal(t, "quit", conn.recv().EventType)
+	})
+}
+
+type callbackDiscovery struct {
+	nullDiscovery
+	started chan EventCallback
+}
+
+func (d *callbackDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	d.started <- eventCB
+	return nil
+}
+
+func FuzzParseCommand(f *testing.F) {
+	f.Add("HELLO 1 \"arduino-cli\"")
+	f.Add("hello")
+	f.Add("HELLO 99999999999999999999 \"x\"")
+	f.Add("  start_sync  ")
+	f.Add("LIST extra args")
+	f.Add("HELLO 2 \"arduino-cli\" fds=usb:3,sock:4")
+	f.Fuzz(func(t *testing.T, line string) {
+		cmd, args := parseCommand(line)
+		require.NotContains(t, cmd, " ")
+		if cmd == CommandHello {
+			if hello, err := parseHelloArgs(args); err == nil {
+				require.GreaterOrEqual(t, hello.protocolVersion, 0)
+				require.NotEmpty(t, hello.userAgent)
+			}
+		}
+	})
+}
+
+func FuzzServer(f *testing.F) {
+	f.Add("HELLO 2 \"test\"\nSTART\nLIST\nSTOP\nSTART_SYNC\nDESCRIBE\nSTOP\nQUIT\n")
+	f.Add("START\nhello 1 \"a\"\nstart_sync\nstart\nlist\n")
+	f.Fuzz(func(t *testing.T, input string) {
+		server := NewServer(&nullDiscovery{})
+		_ = server.Run(strings.NewReader(input), io.Discard)
+	})
+}
+
+type configurableDiscovery struct {
+	nullDiscovery
+	settings map[string]string
+}
+
+func (d *configurableDiscovery) Configure(key, value string) error {
+	if key == "fail" {
+		return errors.New("invalid setting")
+	}
+	d.settings[key] = value
+	return nil
+}
+
+func (d *configurableDiscovery) Describe() *Description {
+	return &Description{Protocols: []string{"test"}}
+}
+
+func TestServerConfigure(t *testing.T) {
+	impl := &configurableDiscovery{settings: map[string]string{}}
+	conn := runTestServer(t, NewServer(impl))
+	conn.send(`HELLO 2 "test"`)
+	require.Equal(t, 2, conn.recv().ProtocolVersion)
+
+	conn.send("DESCRIBE")
+	msg := conn.recv()
+	require.Equal(t, []string{CommandConfigure, CommandPing}, msg.Description.Capabilities)
+
+	conn.send("CONFIGURE interfaces eth0, wlan0")
+	msg = conn.recv()
+	require.Equal(t, EventTypeConfigure, msg.EventType)
+	require.False(t, msg.Error)
+	require.Equal(t, "eth0, wlan0", impl.settings["interfaces"])
+
+	conn.send("CONFIGURE fail 1")
+	msg = conn.recv()
+	require.True(t, msg.Error)
+	require.Equal(t, "Cannot CONFIGURE: invalid setting", msg.Message)
+
+	conn.send("CONFIGURE")
+	require.True(t, conn.recv().Error)
+
+	// Not available in protocol version 1 or if the discovery doesn't support it
+	conn = runTestServer(t, NewServer(impl))
+	conn.send(`HELLO 1 "test"`)
+	conn.recv()
+	conn.send("CONFIGURE key value")
+	require.Equal(t, "CONFIGURE requires protocol version 2", conn.recv().Message)
+
+	conn = runTestServer(t, NewServer(&nullDiscovery{}))
+	conn.send(`HELLO 2 "test"`)
+	conn.recv()
+	conn.send("CONFIGURE key value")
+	require.Equal(t, "CONFIGURE not supported by the discovery", conn.recv().Message)
+}
+
+func TestServerStopList(t *testing.T) {
+	t.Run("WithProtocolVersion1", func(t *testing.T) {
+		conn := runTestServer(t, NewServer(&nullDiscovery{}))
+		conn.send(`HELLO 1 "test"`)
+		require.Equal(t, "hello", conn.recv().EventType)
+		conn.send("STOP_LIST")
+		msg := conn.recv()
+		require.Equal(t, "command_error", msg.EventType)
+		require.Equal(t, "Command STOP_LIST not supported", msg.Message)
+	})
+	t.Run("WithProtocolVersion2", func(t *testing.T) {
+		conn := runTestServer(t, NewServer(&nullDiscovery{}))
+		conn.send(`HELLO 2 "test"`)
+		require.Equal(t, "hello", conn.recv().EventType)
+		conn.send("START")
+		require.Equal(t, "start", conn.recv().EventType)
+		// Without a LIST in progress STOP_LIST has no response
+		conn.send("STOP_LIST")
+		conn.send("LIST")
+		msg := conn.recv()
+		require.Equal(t, "list", msg.EventType)
+		require.False(t, msg.Error)
+	})
+	t.Run("RightAfterList", func(t *testing.T) {
+		conn := runTestServer(t, NewServer(&blockingListDiscovery{}))
+		conn.send(`HELLO 2 "test"`)
+		require.Equal(t, "hello", conn.recv().EventType)
+		conn.send("START")
+		require.Equal(t, "start", conn.recv().EventType)
+		for i := 0; i < 20; i++ {
+			// The STOP_LIST may be received before the LIST is served
+			conn.send("LIST\nSTOP_LIST")
+			msg := conn.recv()
+			require.Equal(t, "list", msg.EventType)
+			require.True(t, msg.Error)
+			require.Equal(t, listCancelledMessage, msg.Message)
+		}
+	})
+}
+
+// blockingListDiscovery answers the LIST only after a while, unless cancelled.
+type blockingListDiscovery struct {
+	nullDiscovery
+}
+
+func (d *blockingListDiscovery) List(ctx context.Context) ([]*Port, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(time.Second):
+		return []*Port{}, nil
+	}
+}
+
+// panickingDiscovery panics in the methods listed in panics.
+type panickingDiscovery struct {
+	nullDiscovery
+	panics map[string]bool
+	stops  int
+}
+
+func (d *panickingDiscovery) StartSync(EventCallback, ErrorCallback) error {
+	if d.panics["StartSync"] {
+		panic("StartSync failure")
+	}
+	return nil
+}
+
+func (d *panickingDiscovery) List(ctx context.Context) ([]*Port, error) {
+	if d.panics["List"] {
+		panic("List failure")
+	}
+	return []*Port{}, nil
+}
+
+func (d *panickingDiscovery) Stop() error {
+	d.stops++
+	return nil
+}
+
+func TestServerRecoverPanics(t *testing.T) {
+	impl := &panickingDiscovery{panics: map[string]bool{"StartSync": true, "List": true}}
+	server := NewServer(impl)
+	conn := runTestServer(t, server)
+	conn.send(`HELLO 2 "test"`)
+	require.Equal(t, "hello", conn.recv().EventType)
+
+	// The panic is reported as an error with the stack trace
+	conn.send("START_SYNC")
+	msg := conn.recv()
+	require.Equal(t, "start_sync", msg.EventType)
+	require.True(t, msg.Error)
+	require.Contains(t, msg.Message, "panic in StartSync: StartSync failure")
+	require.Contains(t, msg.Message, "goroutine")
+	require.Equal(t, 1, impl.stops)
+
+	// The server is back in Idle state
+	conn.send("START")
+	require.Equal(t, "start", conn.recv().EventType)
+	conn.send("LIST")
+	msg = conn.recv()
+	require.Equal(t, "list", msg.EventType)
+	require.True(t, msg.Error)
+	require.Contains(t, msg.Message, "panic in List: List failure")
+	require.Equal(t, 2, impl.stops)
+	require.Equal(t, uint64(2), server.RecoveredPanics())
+
+	conn.send("LIST")
+	msg = conn.recv()
+	require.True(t, msg.Error)
+	require.Equal(t, "Discovery not STARTed", msg.Message)
+	impl.panics["List"] = false
+	conn.send("START")
+	require.False(t, conn.recv().Error)
+	conn.send("LIST")
+	require.False(t, conn.recv().Error)
+	conn.send("QUIT")
+	require.Equal(t, "quit", conn.recv().EventType)
+}
+
+func TestServerPing(t *testing.T) {
+	conn := runTestServer(t, NewServer(&nullDiscovery{}))
+	conn.send("PING")
+	require.True(t, conn.recv().Error)
+	conn.send(`HELLO 2 "test"`)
+	require.Equal(t, "hello", conn.recv().EventType)
+	for _, cmd := range []string{"PING", "START_SYNC", "PING"} {
+		conn.send(cmd)
+		msg := conn.recv()
+		require.False(t, msg.Error, cmd)
+		if cmd == "PING" {
+			require.Equal(t, "pong", msg.EventType)
+			require.Equal(t, "OK", msg.Message)
+		}
+	}
+
+	conn = runTestServer(t, NewServer(&nullDiscovery{}))
+	conn.send(`HELLO 1 "test"`)
+	require.Equal(t, "hello", conn.recv().EventType)
+	conn.send("PING")
+	msg := conn.recv()
+	require.Equal(t, "command_error", msg.EventType)
+	require.Equal(t, "Command PING not supported", msg.Message)
+}
+
+func TestServerTransformers(t *testing.T) {
+	impl := &callbackDiscovery{started: make(chan EventCallback, 2)}
+	server := NewServer(impl)
+	server.AddTransformer(NormalizeMACAddress("mac"))
+	server.AddTransformer(RedactProperties("token"))
+	server.AddTransformer(func(port *Port) { port.AddressLabel = "Board on " + port.Address })
+	conn := runTestServer(t, server)
+	conn.send(`HELLO 2 "test"`)
+	require.Equal(t, "hello", conn.recv().EventType)
+
+	newPort := func() *Port {
+		return &Port{Address: "1", Protocol: "test", Properties: properties.NewFromHashmap(map[string]string{
+			"mac":   "AA-BB-CC-DD-EE-FF",
+			"token": "secret",
+			"vid":   "0x2341",
+		})}
+	}
+	requireTransformed := func(port *Port) {
+		require.Equal(t, "Board on 1", port.AddressLabel)
+		require.Equal(t, "aa:bb:cc:dd:ee:ff", port.Properties.Get("mac"))
+		require.False(t, port.Properties.ContainsKey("token"))
+		require.Equal(t, "0x2341", port.Properties.Get("vid"))
+	}
+
+	conn.send("START")
+	require.Equal(t, "start", conn.recv().EventType)
+	port := newPort()
+	(<-impl.started)("add", port)
+	conn.send("LIST")
+	msg := conn.recv()
+	require.Len(t, *msg.Ports, 1)
+	requireTransformed((*msg.Ports)[0])
+	// The port of the implementation is not changed
+	require.Equal(t, "AA-BB-CC-DD-EE-FF", port.Properties.Get("mac"))
+	require.Equal(t, "secret", port.Properties.Get("token"))
+
+	conn.send("STOP")
+	require.Equal(t, "stop", conn.recv().EventType)
+	conn.send("START_SYNC")
+	require.Equal(t, "start_sync", conn.recv().EventType)
+	// The output pipe is synchronous, the event is sent while receiving it
+	go (<-impl.started)("add", newPort())
+	msg = conn.recv()
+	require.Equal(t, "add", msg.EventType)
+	requireTransformed(msg.Port)
+
+	// Invalid MAC addresses are left unchanged
+	port = &Port{Properties: properties.NewFromHashmap(map[string]string{"mac": "73622384782"})}
+	NormalizeMACAddress("mac", "missing")(port)
+	require.Equal(t, "73622384782", port.Properties.Get("mac"))
+}
+
+func TestServerOutputFormat(t *testing.T) {
+	run := func(server *Server) (func(cmd string), func() string) {
+		inR, inW := io.Pipe()
+		outR, outW := io.Pipe()
+		go server.Run(inR, outW)
+		reader := bufio.NewReader(outR)
+		send := func(cmd string) {
+			_, err := inW.Write([]byte(cmd + "\n"))
+			require.NoError(t, err)
+		}
+		recvLine := func() string {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			return line
+		}
+		return send, recvLine
+	}
+
+	// Indented by default
+	send, recvLine := run(NewServer(&nullDiscovery{}))
+	send(`HELLO 2 "test"`)
+	require.Equal(t, "{\n", recvLine())
+
+	// Compact selected by the implementation
+	server := NewServer(&nullDiscovery{})
+	require.NoError(t, server.SetOutputFormat(OutputFormatCompact))
+	require.Error(t, server.SetOutputFormat("xml"))
+	send, recvLine = run(server)
+	send(`HELLO 2 "test"`)
+	require.Equal(t, `{"eventType":"hello","message":"OK","protocolVersion":2}`+"\n", recvLine())
+
+	// Compact requested by the client
+	send, recvLine = run(NewServer(&nullDiscovery{}))
+	send(`HELLO 2 "test" format=compact`)
+	require.Equal(t, `{"eventType":"hello","message":"OK","protocolVersion":2}`+"\n", recvLine())
+	send("START_SYNC")
+	require.Equal(t, `{"eventType":"start_sync","message":"OK"}`+"\n", recvLine())
+
+	// Indented requested by the client, overriding the implementation
+	server = NewServer(&nullDiscovery{})
+	require.NoError(t, server.SetOutputFormat(OutputFormatCompact))
+	send, recvLine = run(server)
+	send(`HELLO 2 "test" format=indented`)
+	require.Equal(t, "{\n", recvLine())
+}
+
+func TestServerIdempotentCommands(t *testing.T) {
+	// The repeated commands are errors by default
+	conn := runTestServer(t, NewServer(&nullDiscovery{}))
+	conn.send(`HELLO 2 "test"`)
+	require.False(t, conn.recv().Error)
+	conn.send(`HELLO 2 "test"`)
+	require.True(t, conn.recv().Error)
+	conn.send("STOP")
+	require.True(t, conn.recv().Error)
+
+	server := NewServer(&nullDiscovery{})
+	server.SetIdempotentCommands(true)
+	conn = runTestServer(t, server)
+	conn.send(`HELLO 2 "test"`)
+	msg := conn.recv()
+	require.False(t, msg.Error)
+	require.Empty(t, msg.Note)
+
+	// The same HELLO gets the same acknowledgement
+	conn.send(`HELLO 2 "test"`)
+	msg = conn.recv()
+	require.Equal(t, "hello", msg.EventType)
+	require.False(t, msg.Error)
+	require.Equal(t, 2, msg.ProtocolVersion)
+	require.Equal(t, "OK", msg.Message)
+	require.Equal(t, "HELLO already called", msg.Note)
+	conn.send(`HELLO 1 "other"`)
+	require.True(t, conn.recv().Error)
+
+	for _, cmd := range []string{"STOP", "START", "START", "STOP", "STOP"} {
+		conn.send(cmd)
+		msg := conn.recv()
+		require.False(t, msg.Error, cmd)
+		require.Equal(t, "OK", msg.Message, cmd)
+	}
+	conn.send("START")
+	require.Empty(t, conn.recv().Note)
+	conn.send("START")
+	require.Equal(t, "Discovery already STARTed", conn.recv().Note)
+
+	// Only the repetitions are tolerated
+	conn.send("STOP")
+	require.False(t, conn.recv().Error)
+	conn.send("START_SYNC")
+	require.False(t, conn.recv().Error)
+	conn.send("START")
+	require.True(t, conn.recv().Error)
+}
+
+type paramsDiscovery struct {
+	nullDiscovery
+	params []map[string]string
+}
+
+func (d *paramsDiscovery) StartWithParams(params map[string]string) error {
+	if params["fail"] != "" {
+		return errors.New(params["fail"])
+	}
+	d.params = append(d.params, params)
+	return nil
+}
+
+func TestServerStartParams(t *testing.T) {
+	impl := &paramsDiscovery{}
+	conn := runTestServer(t, NewServer(impl))
+	conn.send(`HELLO 2 "test"`)
+	require.Equal(t, "hello", conn.recv().EventType)
+	conn.send(strings.TrimSuffix(BuildStart(CommandStart, (&HostHints{Interfaces: []string{"eth0", "wlan0"}}).Params()), "\n"))
+	require.False(t, conn.recv().Error)
+	conn.send("STOP")
+	require.False(t, conn.recv().Error)
+	conn.send("START_SYNC")
+	require.False(t, conn.recv().Error)
+	conn.send("STOP")
+	require.False(t, conn.recv().Error)
+	require.Equal(t, []map[string]string{{"interfaces": "eth0,wlan0"}, {}}, impl.params)
+
+	// The errors abort the command
+	conn.send("START_SYNC fail=boom")
+	msg := conn.recv()
+	require.True(t, msg.Error)
+	require.Equal(t, "Cannot START_SYNC: boom", msg.Message)
+	conn.send("START a=1&a=2")
+	require.Equal(t, "Cannot START: Invalid parameters: repeated key a", conn.recv().Message)
+	conn.send("START")
+	require.False(t, conn.recv().Error)
+
+	// The parameters require protocol version 2, and are ignored by the
+	// discoveries not implementing ParamsStarter
+	conn = runTestServer(t, NewServer(&paramsDiscovery{}))
+	conn.send(`HELLO 1 "test"`)
+	require.Equal(t, "hello", conn.recv().EventType)
+	conn.send("START interfaces=eth0")
+	require.Equal(t, "Cannot START: parameters require protocol version 2", conn.recv().Message)
+	conn = runTestServer(t, NewServer(&nullDiscovery{}))
+	conn.send(`HELLO 2 "test"`)
+	require.Equal(t, "hello", conn.recv().EventType)
+	conn.send("START interfaces=eth0")
+	require.False(t, conn.recv().Error)
+}
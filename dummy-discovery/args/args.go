@@ -20,6 +20,7 @@ package args
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -29,9 +30,21 @@ var Tag = "snapshot"
 // Timestamp is the current timestamp
 var Timestamp = "unknown"
 
+// Emulate is the name of the real discovery whose port properties are
+// emulated by the dummy ports: "serial", "mdns" or empty for the default
+// dummy properties.
+var Emulate = ""
+
+// LatencyProbe makes the dummy answer to LIST with a single port carrying
+// the time the command has been received, to measure the latency of the
+// whole client/transport stack.
+var LatencyProbe = false
+
 // Parse arguments passed by the user
 func Parse() {
-	for _, arg := range os.Args[1:] {
+	osArgs := os.Args[1:]
+	for i := 0; i < len(osArgs); i++ {
+		arg := osArgs[i]
 		if arg == "" {
 			continue
 		}
@@ -47,6 +60,26 @@ func Parse() {
 			}()
 			continue
 		}
+		if arg == "--latency-probe" {
+			LatencyProbe = true
+			continue
+		}
+		if arg == "--emulate" || strings.HasPrefix(arg, "--emulate=") {
+			// Emulate the port properties of a real discovery
+			if value, ok := strings.CutPrefix(arg, "--emulate="); ok {
+				Emulate = value
+			} else if i+1 < len(osArgs) {
+				i++
+				Emulate = osArgs[i]
+			} else {
+				Emulate = ""
+			}
+			if Emulate != "serial" && Emulate != "mdns" {
+				fmt.Fprintf(os.Stderr, "invalid argument: %s: expected 'serial' or 'mdns'\n", arg)
+				os.Exit(1)
+			}
+			continue
+		}
 		fmt.Fprintf(os.Stderr, "invalid argument: %s\n", arg)
 		os.Exit(1)
 	}
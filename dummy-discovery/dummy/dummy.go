@@ -0,0 +1,407 @@
+//
+// This file is part of dummy-discovery.
+//
+// Copyright 2021 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package dummy is the Discovery implementation of the dummy-discovery. It
+// can be embedded in the test binaries of the clients, to run a configurable
+// fake discovery without building and spawning the dummy-discovery process,
+// for example registering it for the in-process clients:
+//
+//	discovery.Register("dummy", func() discovery.Discovery {
+//		return dummy.NewDiscovery(&dummy.Options{EventsInterval: 10 * time.Millisecond})
+//	})
+package dummy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arduino/go-properties-orderedmap"
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// Options are the options of the dummy discovery, the zero value is the
+// default behaviour of the dummy-discovery tool.
+type Options struct {
+	// EventsInterval is the time between two generated events, 2s if zero.
+	// It can be changed at runtime with the "interval" setting.
+	EventsInterval time.Duration
+	// ResetDelay is the time a port stays disconnected after a reset, 1s if
+	// zero. It can be changed at runtime with the "resetDelay" setting.
+	ResetDelay time.Duration
+	// Emulate is the name of the real discovery whose port properties are
+	// emulated by the dummy ports: "serial", "mdns" or empty for the default
+	// dummy properties.
+	Emulate string
+	// LatencyProbe makes the dummy answer to LIST with a single port carrying
+	// the time the command has been received, to measure the latency of the
+	// whole client/transport stack.
+	LatencyProbe bool
+}
+
+// NewDiscovery returns a new dummy discovery with the given options, nil
+// options are the default ones.
+func NewDiscovery(opts *Options) discovery.Discovery {
+	if opts == nil {
+		opts = &Options{}
+	}
+	d := &dummyDiscovery{
+		eventsInterval: opts.EventsInterval,
+		resetDelay:     opts.ResetDelay,
+		emulate:        opts.Emulate,
+	}
+	if d.eventsInterval <= 0 {
+		d.eventsInterval = 2 * time.Second
+	}
+	if d.resetDelay <= 0 {
+		d.resetDelay = time.Second
+	}
+	if opts.LatencyProbe {
+		return &latencyProbeDiscovery{dummyDiscovery: d}
+	}
+	return d
+}
+
+// dummyDiscovery is an example implementation of a Discovery.
+// It simulates a real implementation of a Discovery by generating
+// connected ports deterministically, it can also be used for testing
+// purposes.
+type dummyDiscovery struct {
+	startSyncCount int
+	eventsInterval time.Duration
+	resetDelay     time.Duration
+	emulate        string
+
+	// The following fields are guarded by mutex, they are shared between
+	// the goroutine generating the events and the commands.
+	mutex   sync.Mutex
+	ports   map[string]*discovery.Port
+	eventCB discovery.EventCallback
+	ctx     context.Context
+	hints   *discovery.HostHints
+}
+
+// Hello does nothing.
+// In a real implementation it could setup background processes
+// or other kind of resources necessary to discover Ports.
+func (d *dummyDiscovery) Hello(userAgent string, protocol int) error {
+	return nil
+}
+
+// Describe returns the description of the dummy discovery capabilities.
+func (d *dummyDiscovery) Describe() *discovery.Description {
+	switch d.emulate {
+	case "serial":
+		return &discovery.Description{
+			Protocols:    []string{"serial"},
+			PropertyKeys: []string{"vid", "pid", "serialNumber"},
+		}
+	case "mdns":
+		return &discovery.Description{
+			Protocols:    []string{"network"},
+			PropertyKeys: []string{"hostname", "port", "ttl", "board"},
+		}
+	}
+	return &discovery.Description{
+		Protocols:    []string{"dummy"},
+		PropertyKeys: []string{"vid", "pid", "mac"},
+	}
+}
+
+// Configure sets the runtime settings of the discovery: "interval", the time
+// between two generated events, and "resetDelay", the time a port stays
+// disconnected after a reset. The "reset" key is an action, it resets the
+// board connected to the port with the given address, see reset.
+func (d *dummyDiscovery) Configure(key, value string) error {
+	if key == "reset" {
+		d.reset(value)
+		return nil
+	}
+	if key != "interval" && key != "resetDelay" {
+		return fmt.Errorf("unknown setting: %s", key)
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return fmt.Errorf("%s must be positive", key)
+	}
+	if key == "resetDelay" {
+		d.resetDelay = duration
+	} else {
+		d.eventsInterval = duration
+	}
+	return nil
+}
+
+// reset emulates the reset of the board connected to the port with the given
+// address, like the 1200-bps touch performed before an upload: the port is
+// removed and, after the reset delay, it's added again with a new address.
+// The addresses of the ports not connected are ignored, like a touch of a
+// port already gone.
+func (d *dummyDiscovery) reset(address string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	port, ok := d.ports[address]
+	if !ok {
+		return
+	}
+	delete(d.ports, address)
+	ctx, eventCB, delay := d.ctx, d.eventCB, d.resetDelay
+	go func() {
+		eventCB(discovery.EventTypeRemove, &discovery.Port{
+			Address:  port.Address,
+			Protocol: port.Protocol,
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		// The board is the same, only the address changes
+		reconnected := port.Clone()
+		fresh := d.createDummyPort()
+		reconnected.Address = fresh.Address
+		reconnected.AddressLabel = fresh.AddressLabel
+		d.addPort(ctx, reconnected)
+	}()
+}
+
+// StartWithParams receives the hints of the host before each START or
+// START_SYNC: the ports excluded by the host are not reported.
+// In a real implementation the hints could restrict the network interfaces
+// or the serial ports scanned.
+func (d *dummyDiscovery) StartWithParams(params map[string]string) error {
+	hints, err := discovery.ParseHostHints(params)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	d.hints = hints
+	d.mutex.Unlock()
+	return nil
+}
+
+// addPort records the port as connected and sends the "add" event, unless
+// the sync session has ended or the port is excluded by the host.
+func (d *dummyDiscovery) addPort(ctx context.Context, port *discovery.Port) {
+	d.mutex.Lock()
+	if d.ctx != ctx || (d.hints != nil && d.hints.PortExcluded(port.Address)) {
+		d.mutex.Unlock()
+		return
+	}
+	d.ports[port.Address] = port
+	eventCB := d.eventCB
+	d.mutex.Unlock()
+	eventCB(discovery.EventTypeAdd, port)
+}
+
+// removePort sends the "remove" event of the port, if still connected.
+func (d *dummyDiscovery) removePort(ctx context.Context, port *discovery.Port) {
+	d.mutex.Lock()
+	_, connected := d.ports[port.Address]
+	if d.ctx != ctx || !connected {
+		d.mutex.Unlock()
+		return
+	}
+	delete(d.ports, port.Address)
+	eventCB := d.eventCB
+	d.mutex.Unlock()
+	eventCB(discovery.EventTypeRemove, &discovery.Port{
+		Address:  port.Address,
+		Protocol: port.Protocol,
+	})
+}
+
+// ReceiveFiles writes a greeting to each file passed by the client and closes it.
+// In a real implementation the files could be devices or sockets opened by
+// a privileged parent process.
+func (d *dummyDiscovery) ReceiveFiles(files map[string]*os.File) error {
+	for name, file := range files {
+		_, err := fmt.Fprintf(file, "Hello %s from dummy-discovery\n", name)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("writing to %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Quit does nothing.
+// In a real implementation it can be used to tear down resources
+// used to discovery Ports.
+func (d *dummyDiscovery) Quit() {}
+
+// Stop does nothing.
+// The goroutine started by StartSyncWithContext is terminated by the
+// cancellation of the context, that happens automatically when the
+// discovery receives a STOP or QUIT command.
+func (d *dummyDiscovery) Stop() error {
+	return nil
+}
+
+// StartSync is required to implement the Discovery interface, the
+// server will always call StartSyncWithContext in its place.
+func (d *dummyDiscovery) StartSync(eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	return d.StartSyncWithContext(context.Background(), eventCB, errorCB)
+}
+
+// StartSyncWithContext starts the goroutine that generates fake Ports.
+func (d *dummyDiscovery) StartSyncWithContext(ctx context.Context, eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	d.startSyncCount++
+	if d.startSyncCount%5 == 0 {
+		return errors.New("could not start_sync every 5 times")
+	}
+
+	d.mutex.Lock()
+	d.ports = map[string]*discovery.Port{}
+	d.eventCB = eventCB
+	d.ctx = ctx
+	d.mutex.Unlock()
+
+	// Run synchronous event emitter
+	interval := d.eventsInterval
+	go func() {
+		// Output initial port state
+		d.addPort(ctx, d.createDummyPort())
+		d.addPort(ctx, d.createDummyPort())
+
+		// Start sending events
+		count := 0
+		for count < 2 {
+			count++
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+
+			port := d.createDummyPort()
+			d.addPort(ctx, port)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+
+			d.removePort(ctx, port)
+		}
+
+		errorCB("unrecoverable error, cannot send more events")
+	}()
+
+	return nil
+}
+
+var dummyCounter = 0
+var dummyCounterMutex sync.Mutex
+
+// createDummyPort creates a Port with fake data
+func (d *dummyDiscovery) createDummyPort() *discovery.Port {
+	dummyCounterMutex.Lock()
+	defer dummyCounterMutex.Unlock()
+	dummyCounter++
+	switch d.emulate {
+	case "serial":
+		return createSerialPort()
+	case "mdns":
+		return createMDNSPort()
+	}
+	mac := fmt.Sprintf("%d", dummyCounter*384782)
+	return &discovery.Port{
+		Address:       fmt.Sprintf("%d", dummyCounter),
+		AddressLabel:  "Dummy upload port",
+		Protocol:      discovery.ProtocolDummy,
+		ProtocolLabel: "Dummy protocol",
+		HardwareID:    mac,
+		Properties: properties.NewFromHashmap(map[string]string{
+			"vid": "0x2341",
+			"pid": "0x0041",
+			"mac": mac,
+		}),
+	}
+}
+
+// createSerialPort creates a Port with the same properties reported
+// by the serial-discovery for an Arduino board.
+func createSerialPort() *discovery.Port {
+	serialNumber := fmt.Sprintf("%020X", dummyCounter*384782)
+	return &discovery.Port{
+		Address:       fmt.Sprintf("/dev/ttyACM%d", dummyCounter),
+		AddressLabel:  fmt.Sprintf("/dev/ttyACM%d", dummyCounter),
+		Protocol:      discovery.ProtocolSerial,
+		ProtocolLabel: "Serial Port (USB)",
+		HardwareID:    serialNumber,
+		Properties: properties.NewFromHashmap(map[string]string{
+			"vid":          "0x2341",
+			"pid":          "0x0043",
+			"serialNumber": serialNumber,
+		}),
+	}
+}
+
+// createMDNSPort creates a Port with the same properties reported
+// by the mdns-discovery for an Arduino board.
+func createMDNSPort() *discovery.Port {
+	address := fmt.Sprintf("192.168.1.%d", dummyCounter%254+1)
+	hostname := fmt.Sprintf("arduino-%d.local.", dummyCounter)
+	return &discovery.Port{
+		Address:       address,
+		AddressLabel:  fmt.Sprintf("%s at %s", hostname, address),
+		Protocol:      discovery.ProtocolNetwork,
+		ProtocolLabel: "Network Port",
+		Properties: properties.NewFromHashmap(map[string]string{
+			"hostname": hostname,
+			"port":     "65280",
+			"ttl":      "120",
+			"board":    "uno-r4-wifi",
+		}),
+	}
+}
+
+// latencyProbeDiscovery is the dummy discovery in latency probe mode: the
+// response to LIST is a single port whose properties carry the time the
+// command has been received, in nanoseconds since the Unix epoch, and the
+// progressive number of the probe.
+type latencyProbeDiscovery struct {
+	*dummyDiscovery
+	probes atomic.Int64
+}
+
+// List returns the latency probe port.
+func (d *latencyProbeDiscovery) List(ctx context.Context) ([]*discovery.Port, error) {
+	receivedAt := time.Now()
+	probe := d.probes.Add(1)
+	return []*discovery.Port{{
+		Address:       "latency-probe",
+		AddressLabel:  "Latency probe",
+		Protocol:      discovery.ProtocolDummy,
+		ProtocolLabel: "Dummy protocol",
+		Properties: properties.NewFromHashmap(map[string]string{
+			"receivedAt": strconv.FormatInt(receivedAt.UnixNano(), 10),
+			"probe":      strconv.FormatInt(probe, 10),
+		}),
+	}}, nil
+}
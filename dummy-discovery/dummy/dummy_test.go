@@ -0,0 +1,69 @@
+//
+// This file is part of dummy-discovery.
+//
+// Copyright 2021 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package dummy
+
+import (
+	"testing"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	discovery.Register("dummy", func() discovery.Discovery {
+		return NewDiscovery(&Options{EventsInterval: 10 * time.Millisecond, Emulate: "serial"})
+	})
+	discovery.Register("dummy-latency-probe", func() discovery.Discovery {
+		return NewDiscovery(&Options{LatencyProbe: true})
+	})
+}
+
+func TestInProcessDiscovery(t *testing.T) {
+	disc := discovery.NewInProcessClient("dummy", "dummy")
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	desc, err := disc.Describe()
+	require.NoError(t, err)
+	require.Equal(t, []string{"serial"}, desc.Protocols)
+
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+	received := []string{}
+	for len(received) < 4 {
+		select {
+		case ev := <-events:
+			require.Equal(t, "serial", ev.Port.Protocol)
+			received = append(received, ev.Type)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "events not received", "%v", received)
+		}
+	}
+	require.Equal(t, []string{"add", "add", "add", "remove"}, received)
+	require.NoError(t, disc.Stop())
+
+	probe := discovery.NewInProcessClient("probe", "dummy-latency-probe")
+	require.NoError(t, probe.Run())
+	defer probe.Quit()
+	require.NoError(t, probe.Start())
+	ports, err := probe.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+	require.Equal(t, "latency-probe", ports[0].Address)
+	require.Equal(t, "1", ports[0].Properties.Get("probe"))
+}
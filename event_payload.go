@@ -0,0 +1,68 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ErrNoPayload is returned by PayloadAs when the event has no payload.
+var ErrNoPayload = errors.New("event without payload")
+
+// WithPayload returns a copy of the port carrying the given payload, to be
+// passed to the EventCallback to attach structured data to the event (for
+// example the signal strength of a wireless board). The payload is encoded as
+// JSON in the "payload" field of the event, it's sent only if the client
+// negotiated protocol version 2 or later. The payload is not part of the port:
+// it's not reported by LIST.
+func WithPayload(port *Port, payload interface{}) *Port {
+	if port == nil {
+		return nil
+	}
+	res := *port
+	res.payload = payload
+	return &res
+}
+
+// PayloadAs decodes the payload attached to the event by the discovery (see
+// WithPayload) into a value of type T.
+func PayloadAs[T any](ev *Event) (T, error) {
+	var res T
+	if ev == nil || len(ev.Payload) == 0 {
+		return res, ErrNoPayload
+	}
+	err := json.Unmarshal(ev.Payload, &res)
+	return res, err
+}
+
+// encodePayload returns the JSON encoding of the payload of the port, or nil
+// if the port has no payload or it can't be encoded.
+func encodePayload(port *Port) json.RawMessage {
+	if port.payload == nil {
+		return nil
+	}
+	if raw, ok := port.payload.(json.RawMessage); ok {
+		return raw
+	}
+	data, err := json.Marshal(port.payload)
+	if err != nil {
+		return nil
+	}
+	return data
+}
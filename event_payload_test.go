@@ -0,0 +1,81 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type signal struct {
+	RSSI int    `json:"rssi"`
+	Band string `json:"band"`
+}
+
+type payloadDiscovery struct {
+	nullDiscovery
+}
+
+func (d *payloadDiscovery) StartSync(eventCB EventCallback, _ ErrorCallback) error {
+	eventCB(EventTypeAdd, WithPayload(&Port{Address: "1", Protocol: "ble"}, &signal{RSSI: -42, Band: "2.4GHz"}))
+	eventCB(EventTypeAdd, &Port{Address: "2", Protocol: "ble"})
+	eventCB(EventTypeAdd, WithPayload(&Port{Address: "3", Protocol: "ble"}, func() {}))
+	return nil
+}
+
+func init() {
+	Register("test-payload", func() Discovery { return &payloadDiscovery{} })
+}
+
+func TestEventPayload(t *testing.T) {
+	disc := NewInProcessClient("payload", "test-payload")
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+
+	ev := <-events
+	require.JSONEq(t, `{"rssi":-42,"band":"2.4GHz"}`, string(ev.Payload))
+	s, err := PayloadAs[signal](ev)
+	require.NoError(t, err)
+	require.Equal(t, signal{RSSI: -42, Band: "2.4GHz"}, s)
+	m, err := PayloadAs[map[string]interface{}](ev)
+	require.NoError(t, err)
+	require.Equal(t, "2.4GHz", m["band"])
+	_, err = PayloadAs[int](ev)
+	require.Error(t, err)
+
+	// The events without payload, or with a payload that can't be encoded
+	ev = <-events
+	_, err = PayloadAs[signal](ev)
+	require.ErrorIs(t, err, ErrNoPayload)
+	ev = <-events
+	require.Equal(t, "3", ev.Port.Address)
+	require.Nil(t, ev.Payload)
+
+	// The payload is sent only with protocol version 2
+	conn := runTestServer(t, NewServer(&payloadDiscovery{}))
+	conn.send(`HELLO 1 "test"`)
+	require.Equal(t, "hello", conn.recv().EventType)
+	conn.send("START_SYNC")
+	for i := 0; i < 4; i++ {
+		msg := conn.recv()
+		require.Nil(t, msg.Payload, msg.EventType)
+	}
+}
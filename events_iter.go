@@ -0,0 +1,151 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build go1.23
+
+package discovery
+
+import (
+	"context"
+	"iter"
+	"sync"
+)
+
+// eventsIteratorBufferSize is the size of the event channels used by the iterators.
+const eventsIteratorBufferSize = 16
+
+// Events returns an iterator over the events of the discovery: the sync mode is
+// started (see StartSync) when the iteration begins and it's stopped (see Stop)
+// when the iteration ends, because the loop is terminated or the context is done.
+// The iteration ends also if the discovery terminates. If the sync mode can not
+// be started the error is logged and the iterator yields no events.
+func (disc *Client) Events(ctx context.Context) iter.Seq[*Event] {
+	return func(yield func(*Event) bool) {
+		events, err := disc.StartSync(eventsIteratorBufferSize)
+		if err != nil {
+			disc.logger.Errorf("Starting sync of discovery %s: %v", disc, err)
+			return
+		}
+		defer func() {
+			if err := disc.Stop(); err != nil {
+				disc.logger.Errorf("Stopping sync of discovery %s: %v", disc, err)
+			}
+		}()
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok || !yield(ev) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Events returns an iterator over the events of all the discoveries: the
+// discoveries that are not running are started, and the sync mode is started on
+// all of them when the iteration begins. The sync mode is stopped when the
+// iteration ends, because the loop is terminated or the context is done.
+// The discoveries that fail to start are skipped, their status can be checked
+// with Health. The iteration ends when all the discoveries are terminated.
+// The events are recorded by the Manager, see Snapshot. The iteration begins
+// with an "add" event for each static port, see AddStaticPort. The events of
+// the ports not selected by the protocol filter are dropped, see SetProtocolFilter.
+func (m *Manager) Events(ctx context.Context) iter.Seq[*Event] {
+	return func(yield func(*Event) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		syncedMutex := sync.Mutex{}
+		synced := []*Client{}
+		merged := make(chan *Event)
+		var wg sync.WaitGroup
+		m.forEachDiscovery(func(disc *Client) error {
+			if !disc.Alive() {
+				if err := disc.Run(); err != nil {
+					return err
+				}
+			}
+			events, err := disc.StartSync(eventsIteratorBufferSize)
+			if err != nil {
+				return err
+			}
+			syncedMutex.Lock()
+			synced = append(synced, disc)
+			syncedMutex.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ev := range events {
+					select {
+					case merged <- ev:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return nil
+		})
+		go func() {
+			wg.Wait()
+			close(merged)
+		}()
+
+		defer func() {
+			cancel()
+			var stopWg sync.WaitGroup
+			for _, disc := range synced {
+				stopWg.Add(1)
+				go func(disc *Client) {
+					defer stopWg.Done()
+					if disc.Alive() {
+						_ = disc.Stop()
+					}
+				}(disc)
+			}
+			stopWg.Wait()
+			wg.Wait()
+		}()
+
+		filter := m.getProtocolFilter()
+		for _, port := range filterPorts(m.staticPortsList(), filter) {
+			if !yield(&Event{Type: EventTypeAdd, Port: port, DiscoveryID: StaticDiscoveryID}) {
+				return
+			}
+		}
+		for {
+			select {
+			case ev, ok := <-merged:
+				if !ok {
+					return
+				}
+				for _, ev := range m.recordEvent(ev) {
+					if !filter.matchEvent(ev) {
+						continue
+					}
+					if !yield(ev) {
+						return
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build go1.23
+
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventsIterator(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("Client", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+
+		adds := 0
+		for ev := range cl.Events(ctx) {
+			require.Equal(t, EventTypeAdd, ev.Type)
+			if adds++; adds == 2 {
+				break
+			}
+		}
+		require.Equal(t, 2, adds)
+
+		// The sync mode has been stopped at the end of the loop
+		require.NoError(t, cl.Drain(ctx))
+		ch, err := cl.StartSync(10)
+		require.NoError(t, err)
+		require.NotNil(t, ch)
+		require.NoError(t, cl.Stop())
+	})
+
+	t.Run("Manager", func(t *testing.T) {
+		m := NewManager()
+		a := NewClient("a", "dummy-discovery/dummy-discovery")
+		b := NewClient("b", "dummy-discovery/dummy-discovery")
+		require.NoError(t, m.Add(a))
+		require.NoError(t, m.Add(b))
+		require.NoError(t, m.Add(NewClient("missing", "dummy-discovery/not-existent-discovery")))
+		defer m.QuitAll(context.Background())
+
+		adds := map[string]int{}
+		for ev := range m.Events(ctx) {
+			require.Equal(t, EventTypeAdd, ev.Type)
+			adds[ev.DiscoveryID]++
+			if adds["a"] >= 2 && adds["b"] >= 2 {
+				break
+			}
+		}
+		require.Equal(t, map[string]int{"a": 2, "b": 2}, adds)
+		require.NoError(t, a.Drain(ctx))
+		require.NoError(t, b.Drain(ctx))
+	})
+}
@@ -0,0 +1,564 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arduino/go-properties-orderedmap"
+)
+
+// The kinds of the findings of the FuzzProxy.
+const (
+	// FuzzFindingCrash is reported when a side closes the connection
+	// without a QUIT.
+	FuzzFindingCrash = "crash"
+	// FuzzFindingDesync is reported when a side doesn't follow the protocol:
+	// the discovery sends an invalid message or a response not matching the
+	// command received, the client sends a command not allowed in the state
+	// it has been led to.
+	FuzzFindingDesync = "desync"
+)
+
+// The sides of the communication observed by the FuzzProxy.
+const (
+	FuzzSideClient    = "client"
+	FuzzSideDiscovery = "discovery"
+)
+
+// FuzzProxyConfig is the configuration of a FuzzProxy.
+type FuzzProxyConfig struct {
+	// Seed initializes the random generator of the mutations.
+	Seed int64
+	// MutationProbability is the probability, between 0 and 1, that each
+	// command and each message is mutated.
+	MutationProbability float64
+	// TraceSize is the number of the last commands and messages recorded in
+	// each finding, 20 if zero.
+	TraceSize int
+	// Report, if not nil, is called with each finding as soon as it's
+	// detected.
+	Report func(finding *FuzzFinding)
+}
+
+// FuzzFinding is a crash or a desync detected by the FuzzProxy.
+type FuzzFinding struct {
+	Time        time.Time `json:"time"`
+	Seed        int64     `json:"seed"`
+	Side        string    `json:"side"`
+	Kind        string    `json:"kind"`
+	Description string    `json:"description"`
+	// Trace are the last commands (prefixed by ">") and messages (prefixed
+	// by "<") forwarded before the finding, with the mutations applied.
+	Trace []string `json:"trace"`
+}
+
+func (f *FuzzFinding) String() string {
+	return fmt.Sprintf("%s %s: %s", f.Side, f.Kind, f.Description)
+}
+
+// FuzzProxy sits between a client and a discovery, mutating the commands and
+// the messages exchanged, and records the crashes and the desyncs of both the
+// sides: it's a testing tool to harden the clients and the discoveries. The
+// mutations stay within the constraints of the protocol: the commands are
+// single lines, the messages are JSON objects with the fields of the
+// specification. The fuzzing is guided by the protocol coverage: the distinct
+// behaviours observed (the response of the discovery to each command in each
+// state, the command sent by the client after each mutated message) are
+// recorded, and the mutations that lead to new behaviours are chosen more
+// often. Note that this is the coverage of the protocol, not of the code.
+type FuzzProxy struct {
+	config FuzzProxyConfig
+
+	mutex           sync.Mutex
+	rand            *rand.Rand
+	energy          map[string]int
+	coverage        map[string]bool
+	findings        []*FuzzFinding
+	trace           []string
+	pending         []*fuzzCommand
+	discoveryState  State
+	clientState     State
+	protocolVersion int
+	lastMutation    string
+	quitSent        bool
+}
+
+// fuzzCommand is a command forwarded to the discovery, waiting for its
+// response.
+type fuzzCommand struct {
+	// name is the command received by the discovery, after the mutations.
+	name string
+	// clientCommand is the command sent by the client, it's empty for the
+	// commands injected by the proxy: their responses are not forwarded.
+	clientCommand string
+	mutation      string
+}
+
+// NewFuzzProxy creates a FuzzProxy with the given configuration.
+func NewFuzzProxy(config *FuzzProxyConfig) *FuzzProxy {
+	p := &FuzzProxy{
+		config:          *config,
+		rand:            rand.New(rand.NewSource(config.Seed)),
+		energy:          map[string]int{},
+		coverage:        map[string]bool{},
+		discoveryState:  StateUninitialized,
+		clientState:     StateUninitialized,
+		protocolVersion: 1,
+	}
+	if p.config.TraceSize <= 0 {
+		p.config.TraceSize = 20
+	}
+	return p
+}
+
+// Run forwards the commands read from client to toDiscovery, and the messages
+// read from fromDiscovery to toClient, until the discovery closes its output.
+// The writers are closed, if they are io.Closer, when the corresponding
+// reader is closed.
+func (p *FuzzProxy) Run(client io.Reader, toClient io.Writer, toDiscovery io.Writer, fromDiscovery io.Reader) error {
+	go p.forwardCommands(client, toDiscovery)
+	err := p.forwardMessages(fromDiscovery, toClient)
+	if closer, ok := toClient.(io.Closer); ok {
+		closer.Close()
+	}
+	return err
+}
+
+// Findings returns the findings recorded so far.
+func (p *FuzzProxy) Findings() []*FuzzFinding {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]*FuzzFinding(nil), p.findings...)
+}
+
+// Coverage returns the distinct protocol behaviours observed so far, sorted.
+func (p *FuzzProxy) Coverage() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	res := []string{}
+	for behaviour := range p.coverage {
+		res = append(res, behaviour)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (p *FuzzProxy) forwardCommands(client io.Reader, toDiscovery io.Writer) {
+	defer func() {
+		if closer, ok := toDiscovery.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+	reader := bufio.NewReader(client)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			p.mutex.Lock()
+			if !p.quitSent {
+				p.report(FuzzSideClient, FuzzFindingCrash, fmt.Sprintf("connection closed without QUIT: %v", err))
+			}
+			p.mutex.Unlock()
+			return
+		}
+		for _, cmd := range p.command(line) {
+			if _, err := io.WriteString(toDiscovery, cmd); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// command checks the command sent by the client and returns the commands to
+// send to the discovery.
+func (p *FuzzProxy) command(line string) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	name, _ := parseCommand(line)
+	if _, ok := responseEventTypes[name]; ok {
+		p.observe(fmt.Sprintf("client %s %s after %s", p.clientState, name, p.lastMutation), p.lastMutation)
+		// A command sent while waiting for the responses can not be checked
+		if _, err := NextState(p.clientState, name); err != nil && len(p.pending) == 0 {
+			p.report(FuzzSideClient, FuzzFindingDesync, fmt.Sprintf("%s sent in state %s", name, p.clientState))
+		}
+	}
+	if name == CommandQuit {
+		p.quitSent = true
+	}
+
+	mutation := ""
+	lines := []string{line}
+	if name != CommandQuit && p.mutate() {
+		mutation = p.pickMutation(commandMutatorNames, func(m string) bool { return true })
+		lines = commandMutators[mutation](p.rand, line)
+	}
+	for i, cmd := range lines {
+		sent, _ := parseCommand(cmd)
+		if sent == CommandStopList && p.protocolVersion >= 2 {
+			// STOP_LIST has no response
+			continue
+		}
+		entry := &fuzzCommand{name: sent, mutation: mutation}
+		if i == 0 {
+			entry.clientCommand = name
+		}
+		p.pending = append(p.pending, entry)
+	}
+	for _, cmd := range lines {
+		p.record(">", strings.TrimSpace(cmd), mutation)
+	}
+	return lines
+}
+
+func (p *FuzzProxy) forwardMessages(fromDiscovery io.Reader, toClient io.Writer) error {
+	decoder := json.NewDecoder(fromDiscovery)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			p.mutex.Lock()
+			if !p.quitSent || p.discoveryState != StateQuit {
+				p.report(FuzzSideDiscovery, FuzzFindingCrash, fmt.Sprintf("output closed without QUIT: %v", err))
+			}
+			p.mutex.Unlock()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		for _, data := range p.message(raw) {
+			if _, err := toClient.Write(append(data, '\n')); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// message checks the message sent by the discovery and returns the messages
+// to send to the client.
+func (p *FuzzProxy) message(raw json.RawMessage) [][]byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	msg := &message{}
+	if err := json.Unmarshal(raw, msg); err != nil {
+		p.report(FuzzSideDiscovery, FuzzFindingDesync, fmt.Sprintf("invalid message: %v", err))
+		p.record("<", string(raw), "")
+		return [][]byte{raw}
+	}
+	var cmd *fuzzCommand
+	if isResponseEventType(msg.EventType) {
+		cmd = p.response(msg)
+		if cmd != nil && cmd.clientCommand == "" {
+			// Response to a command injected by the proxy
+			p.record("<", string(raw), "")
+			return nil
+		}
+	}
+
+	p.lastMutation = ""
+	msgs := []*message{msg}
+	if msg.EventType != EventTypeQuit && p.mutate() {
+		p.lastMutation = p.pickMutation(messageMutatorNames, func(m string) bool {
+			return messageMutators[m].applies(msg)
+		})
+		if p.lastMutation != "" {
+			msgs = messageMutators[p.lastMutation].mutate(p.rand, msg)
+		}
+	}
+	res := [][]byte{}
+	for _, m := range msgs {
+		data := []byte(raw)
+		if p.lastMutation != "" {
+			data, _ = json.Marshal(m)
+		}
+		p.record("<", string(data), p.lastMutation)
+		res = append(res, data)
+	}
+
+	// Update the state of the client with the response it receives
+	if cmd != nil && len(msgs) > 0 && !msgs[0].Error && msgs[0].EventType == responseEventTypes[cmd.clientCommand] {
+		if next, err := NextState(p.clientState, cmd.clientCommand); err == nil {
+			p.clientState = next
+		}
+	}
+	return res
+}
+
+// response matches the response with the pending command, and updates the
+// state of the discovery.
+func (p *FuzzProxy) response(msg *message) *fuzzCommand {
+	if len(p.pending) == 0 {
+		p.report(FuzzSideDiscovery, FuzzFindingDesync, fmt.Sprintf("unsolicited %q response", msg.EventType))
+		return nil
+	}
+	cmd := p.pending[0]
+	p.pending = p.pending[1:]
+	expected := EventTypeCommandError
+	if t, ok := responseEventTypes[cmd.name]; ok && (p.discoveryState != StateUninitialized || cmd.name == CommandHello || cmd.name == CommandQuit) {
+		expected = t
+	}
+	if cmd.name == CommandPing && p.protocolVersion < 2 {
+		// PING is an unknown command in protocol version 1
+		expected = EventTypeCommandError
+	}
+	p.observe(fmt.Sprintf("discovery %s %s -> %s error=%t", p.discoveryState, cmd.name, msg.EventType, msg.Error), cmd.mutation)
+	if msg.EventType != expected {
+		p.report(FuzzSideDiscovery, FuzzFindingDesync, fmt.Sprintf("%q response to %s, expected %q", msg.EventType, cmd.name, expected))
+		return cmd
+	}
+	if msg.Error {
+		return cmd
+	}
+	if next, err := NextState(p.discoveryState, cmd.name); err == nil {
+		p.discoveryState = next
+	}
+	if cmd.name == CommandHello && msg.ProtocolVersion > 0 {
+		p.protocolVersion = msg.ProtocolVersion
+	}
+	return cmd
+}
+
+// mutate returns true if the next command or message must be mutated.
+func (p *FuzzProxy) mutate() bool {
+	return p.config.MutationProbability > 0 && p.rand.Float64() < p.config.MutationProbability
+}
+
+// pickMutation chooses one of the applicable mutations, with a probability
+// proportional to its energy. The names of the mutations must be sorted, so
+// the same seed always produces the same choices.
+func (p *FuzzProxy) pickMutation(names []string, applies func(name string) bool) string {
+	total := 0
+	candidates := []string{}
+	for _, name := range names {
+		if applies(name) {
+			candidates = append(candidates, name)
+			total += 1 + p.energy[name]
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	n := p.rand.Intn(total)
+	for _, name := range candidates {
+		n -= 1 + p.energy[name]
+		if n < 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// observe records a protocol behaviour, giving more energy to the mutation
+// that led to it if it's new.
+func (p *FuzzProxy) observe(behaviour, mutation string) {
+	if p.coverage[behaviour] {
+		return
+	}
+	p.coverage[behaviour] = true
+	if mutation != "" {
+		p.energy[mutation]++
+	}
+}
+
+func (p *FuzzProxy) record(direction, data, mutation string) {
+	compact := &bytes.Buffer{}
+	if direction == "<" && json.Compact(compact, []byte(data)) == nil {
+		data = compact.String()
+	}
+	if mutation != "" {
+		data += " (" + mutation + ")"
+	}
+	p.trace = append(p.trace, direction+" "+data)
+	if len(p.trace) > p.config.TraceSize {
+		p.trace = p.trace[len(p.trace)-p.config.TraceSize:]
+	}
+}
+
+// report records a finding, the mutex must be held.
+func (p *FuzzProxy) report(side, kind, description string) {
+	finding := &FuzzFinding{
+		Time:        time.Now(),
+		Seed:        p.config.Seed,
+		Side:        side,
+		Kind:        kind,
+		Description: description,
+		Trace:       append([]string(nil), p.trace...),
+	}
+	p.findings = append(p.findings, finding)
+	if p.config.Report != nil {
+		p.config.Report(finding)
+	}
+}
+
+// isResponseEventType returns true if the event type is the one of a response
+// to a command.
+func isResponseEventType(eventType string) bool {
+	if eventType == EventTypeCommandError {
+		return true
+	}
+	for _, t := range responseEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// fuzzStrings are the values used by the mutations of the strings.
+var fuzzStrings = []string{
+	"",
+	" ",
+	"\x00",
+	"ünïcödé ✓",
+	"../../etc/passwd",
+	"COM1\nCOM2",
+	`"quoted"`,
+	"{}",
+	"-1",
+	strings.Repeat("A", 4096),
+}
+
+// commandMutator returns the commands to send in place of the given one.
+type commandMutator func(rnd *rand.Rand, line string) []string
+
+var commandMutators = map[string]commandMutator{
+	"command-case": func(rnd *rand.Rand, line string) []string {
+		return []string{strings.ToLower(line)}
+	},
+	"command-duplicate": func(rnd *rand.Rand, line string) []string {
+		return []string{line, line}
+	},
+	"command-whitespace": func(rnd *rand.Rand, line string) []string {
+		return []string{strings.ReplaceAll(" \t"+line, " ", "  \t")}
+	},
+	"command-swap": func(rnd *rand.Rand, line string) []string {
+		commands := []string{CommandHello, CommandStart, CommandStop, CommandList, CommandStartSync, CommandDescribe, CommandPing}
+		return []string{commands[rnd.Intn(len(commands))] + "\n"}
+	},
+	"command-arguments": func(rnd *rand.Rand, line string) []string {
+		name, _ := parseCommand(line)
+		return []string{name + " " + strings.ReplaceAll(fuzzStrings[rnd.Intn(len(fuzzStrings))], "\n", " ") + "\n"}
+	},
+	"command-hello-version": func(rnd *rand.Rand, line string) []string {
+		versions := []string{"0", "-1", "99999", "1.5", "2147483648"}
+		return []string{fmt.Sprintf("HELLO %s \"fuzz\"\n", versions[rnd.Intn(len(versions))])}
+	},
+}
+
+var commandMutatorNames = sortedMutatorNames(commandMutators)
+
+// messageMutator changes the messages sent to the client.
+type messageMutator struct {
+	applies func(msg *message) bool
+	mutate  func(rnd *rand.Rand, msg *message) []*message
+}
+
+func hasPorts(msg *message) bool {
+	return msg.Port != nil || (msg.Ports != nil && len(*msg.Ports) > 0)
+}
+
+// randomPort returns one of the ports of the message.
+func randomPort(rnd *rand.Rand, msg *message) *Port {
+	if msg.Port != nil {
+		return msg.Port
+	}
+	ports := *msg.Ports
+	return ports[rnd.Intn(len(ports))]
+}
+
+var messageMutators = map[string]*messageMutator{
+	"message-drop": {
+		applies: func(msg *message) bool { return true },
+		mutate:  func(rnd *rand.Rand, msg *message) []*message { return nil },
+	},
+	"message-duplicate": {
+		applies: func(msg *message) bool { return true },
+		mutate:  func(rnd *rand.Rand, msg *message) []*message { return []*message{msg, msg} },
+	},
+	"message-error": {
+		applies: func(msg *message) bool { return isResponseEventType(msg.EventType) },
+		mutate: func(rnd *rand.Rand, msg *message) []*message {
+			msg.Error = !msg.Error
+			msg.Message = fuzzStrings[rnd.Intn(len(fuzzStrings))]
+			return []*message{msg}
+		},
+	},
+	"message-add-remove": {
+		applies: func(msg *message) bool { return msg.EventType == EventTypeAdd || msg.EventType == EventTypeRemove },
+		mutate: func(rnd *rand.Rand, msg *message) []*message {
+			if msg.EventType == EventTypeAdd {
+				msg.EventType = EventTypeRemove
+			} else {
+				msg.EventType = EventTypeAdd
+			}
+			return []*message{msg}
+		},
+	},
+	"message-protocol-version": {
+		applies: func(msg *message) bool { return msg.EventType == EventTypeHello },
+		mutate: func(rnd *rand.Rand, msg *message) []*message {
+			msg.ProtocolVersion = rnd.Intn(5)
+			return []*message{msg}
+		},
+	},
+	"port-address": {
+		applies: hasPorts,
+		mutate: func(rnd *rand.Rand, msg *message) []*message {
+			randomPort(rnd, msg).Address = fuzzStrings[rnd.Intn(len(fuzzStrings))]
+			return []*message{msg}
+		},
+	},
+	"port-protocol": {
+		applies: hasPorts,
+		mutate: func(rnd *rand.Rand, msg *message) []*message {
+			randomPort(rnd, msg).Protocol = fuzzStrings[rnd.Intn(len(fuzzStrings))]
+			return []*message{msg}
+		},
+	},
+	"port-properties": {
+		applies: hasPorts,
+		mutate: func(rnd *rand.Rand, msg *message) []*message {
+			port := randomPort(rnd, msg)
+			if port.Properties == nil {
+				port.Properties = properties.NewMap()
+			}
+			keys := append(port.Properties.Keys(), fuzzStrings...)
+			port.Properties.Set(keys[rnd.Intn(len(keys))], fuzzStrings[rnd.Intn(len(fuzzStrings))])
+			return []*message{msg}
+		},
+	},
+}
+
+var messageMutatorNames = sortedMutatorNames(messageMutators)
+
+func sortedMutatorNames[T any](mutators map[string]T) []string {
+	res := []string{}
+	for name := range mutators {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,197 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fuzzTestDiscovery struct {
+	nullDiscovery
+}
+
+func (d *fuzzTestDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		eventCB(EventTypeAdd, &Port{Address: "1", Protocol: "fuzz"})
+	}()
+	return nil
+}
+
+type fuzzProxyConn struct {
+	proxy   *FuzzProxy
+	client  *io.PipeWriter
+	decoder *json.Decoder
+	done    chan error
+	drained sync.Once
+}
+
+// runFuzzProxy runs the proxy between the test, acting as the client, and
+// the given discovery streams.
+func runFuzzProxy(config *FuzzProxyConfig, toDiscovery io.WriteCloser, fromDiscovery io.Reader) *fuzzProxyConn {
+	clientR, clientW := io.Pipe()
+	messagesR, messagesW := io.Pipe()
+	conn := &fuzzProxyConn{
+		proxy:   NewFuzzProxy(config),
+		client:  clientW,
+		decoder: json.NewDecoder(messagesR),
+		done:    make(chan error, 1),
+	}
+	go func() {
+		conn.done <- conn.proxy.Run(clientR, messagesW, toDiscovery, fromDiscovery)
+	}()
+	return conn
+}
+
+// runFuzzProxyServer runs the proxy in front of a Server.
+func runFuzzProxyServer(config *FuzzProxyConfig) *fuzzProxyConn {
+	commandsR, commandsW := io.Pipe()
+	messagesR, messagesW := io.Pipe()
+	go func() {
+		_ = NewServer(&fuzzTestDiscovery{}).Run(commandsR, disconnectedWriter{messagesW})
+		messagesW.Close()
+	}()
+	return runFuzzProxy(config, commandsW, messagesR)
+}
+
+func (c *fuzzProxyConn) exchange(t *testing.T, command string) *message {
+	_, err := io.WriteString(c.client, command+"\n")
+	require.NoError(t, err)
+	msg := &message{}
+	require.NoError(t, c.decoder.Decode(msg))
+	return msg
+}
+
+// drain discards the messages sent to the client from now on.
+func (c *fuzzProxyConn) drain() {
+	c.drained.Do(func() {
+		go func() {
+			for c.decoder.Decode(&message{}) == nil {
+			}
+		}()
+	})
+}
+
+// wait waits for the termination of the proxy.
+func (c *fuzzProxyConn) wait(t *testing.T) {
+	c.drain()
+	select {
+	case err := <-c.done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "proxy not terminated")
+	}
+}
+
+func TestFuzzProxy(t *testing.T) {
+	t.Run("Passthrough", func(t *testing.T) {
+		conn := runFuzzProxyServer(&FuzzProxyConfig{Seed: 1})
+		require.Equal(t, EventTypeHello, conn.exchange(t, `HELLO 1 "test"`).EventType)
+		require.Equal(t, EventTypeStartSync, conn.exchange(t, CommandStartSync).EventType)
+		msg := &message{}
+		require.NoError(t, conn.decoder.Decode(msg))
+		require.Equal(t, EventTypeAdd, msg.EventType)
+		require.Equal(t, "1", msg.Port.Address)
+		require.Equal(t, EventTypeStop, conn.exchange(t, CommandStop).EventType)
+		require.Equal(t, EventTypeQuit, conn.exchange(t, CommandQuit).EventType)
+		conn.client.Close()
+		conn.wait(t)
+		require.Empty(t, conn.proxy.Findings())
+		require.Contains(t, conn.proxy.Coverage(), "discovery syncing STOP -> stop error=false")
+	})
+
+	t.Run("ClientDesync", func(t *testing.T) {
+		conn := runFuzzProxyServer(&FuzzProxyConfig{Seed: 1})
+		require.Equal(t, EventTypeCommandError, conn.exchange(t, CommandStartSync).EventType)
+		require.Equal(t, EventTypeQuit, conn.exchange(t, CommandQuit).EventType)
+		conn.client.Close()
+		conn.wait(t)
+		findings := conn.proxy.Findings()
+		require.Len(t, findings, 1)
+		require.Equal(t, FuzzSideClient, findings[0].Side)
+		require.Equal(t, FuzzFindingDesync, findings[0].Kind)
+	})
+
+	t.Run("ClientCrash", func(t *testing.T) {
+		conn := runFuzzProxyServer(&FuzzProxyConfig{Seed: 1})
+		require.Equal(t, EventTypeHello, conn.exchange(t, `HELLO 1 "test"`).EventType)
+		conn.client.Close()
+		conn.wait(t)
+		findings := conn.proxy.Findings()
+		require.NotEmpty(t, findings)
+		require.Equal(t, FuzzSideClient, findings[0].Side)
+		require.Equal(t, FuzzFindingCrash, findings[0].Kind)
+		require.Equal(t, []string{`> HELLO 1 "test"`, `< {"eventType":"hello","message":"OK","protocolVersion":1}`}, findings[0].Trace)
+	})
+
+	t.Run("DiscoveryDesyncAndCrash", func(t *testing.T) {
+		reported := []*FuzzFinding{}
+		commandsR, commandsW := io.Pipe()
+		messagesR, messagesW := io.Pipe()
+		conn := runFuzzProxy(&FuzzProxyConfig{Seed: 1, Report: func(finding *FuzzFinding) {
+			reported = append(reported, finding)
+		}}, commandsW, messagesR)
+		commands := bufio.NewReader(commandsR)
+		_, err := io.WriteString(conn.client, "HELLO 1 \"test\"\n")
+		require.NoError(t, err)
+		_, err = commands.ReadString('\n')
+		require.NoError(t, err)
+		go func() {
+			_, _ = io.WriteString(messagesW, `{"eventType":"start","message":"OK"}`)
+			_, _ = io.WriteString(messagesW, `{"eventType":"start","message":"OK"}`)
+			messagesW.Close()
+		}()
+		for i := 0; i < 2; i++ {
+			require.NoError(t, conn.decoder.Decode(&message{}))
+		}
+		conn.wait(t)
+		require.Equal(t, conn.proxy.Findings(), reported)
+		require.Len(t, reported, 3)
+		require.Equal(t, `discovery desync: "start" response to HELLO, expected "hello"`, reported[0].String())
+		require.Equal(t, `discovery desync: unsolicited "start" response`, reported[1].String())
+		require.Equal(t, FuzzSideDiscovery, reported[2].Side)
+		require.Equal(t, FuzzFindingCrash, reported[2].Kind)
+	})
+
+	t.Run("Mutations", func(t *testing.T) {
+		// The Server must survive the mutated commands without desyncs
+		conn := runFuzzProxyServer(&FuzzProxyConfig{Seed: 42, MutationProbability: 1})
+		conn.drain()
+		commands := []string{`HELLO 1 "test"`, CommandStart, CommandList, CommandStop, CommandStartSync, CommandStop}
+		for i := 0; i < 10; i++ {
+			for _, command := range commands {
+				_, err := io.WriteString(conn.client, command+"\n")
+				require.NoError(t, err)
+			}
+		}
+		_, err := io.WriteString(conn.client, CommandQuit+"\n")
+		require.NoError(t, err)
+		conn.wait(t)
+		for _, finding := range conn.proxy.Findings() {
+			require.Equal(t, FuzzSideClient, finding.Side, finding.String())
+		}
+		require.Greater(t, len(conn.proxy.Coverage()), 10)
+	})
+}
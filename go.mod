@@ -7,12 +7,16 @@ toolchain go1.21.1
 require (
 	github.com/arduino/go-paths-helper v1.10.0
 	github.com/arduino/go-properties-orderedmap v1.8.0
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/klauspost/compress v1.17.9
 	github.com/stretchr/testify v1.8.4
+	pgregory.net/rapid v1.1.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
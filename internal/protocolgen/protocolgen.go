@@ -0,0 +1,339 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package protocolgen generates the Go definitions of the pluggable discovery
+// protocol from its machine-readable specification, protocol_spec.json: the
+// constants of the commands and of the event types, the struct of the
+// messages, the tables used to validate the messages and the transitions of
+// the protocol state machine.
+package protocolgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"strings"
+)
+
+// licenseHeader is the header of the generated files.
+const licenseHeader = `//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+`
+
+// Spec is the machine-readable specification of the protocol.
+type Spec struct {
+	Title            string       `json:"title"`
+	ProtocolVersions []int        `json:"protocolVersions"`
+	Commands         []*Command   `json:"commands"`
+	EventTypes       []*EventType `json:"eventTypes"`
+	States           []*State     `json:"states"`
+	// Message is the JSON schema of the messages sent by the discovery.
+	Message json.RawMessage `json:"message"`
+}
+
+// Command is a command that a client may send to a discovery.
+type Command struct {
+	Name string `json:"name"`
+	// Response is the event type of the response, empty if the command has
+	// no response of its own.
+	Response string `json:"response"`
+	// OKMessage is true if the successful response carries the "OK" message.
+	OKMessage          bool   `json:"okMessage"`
+	MinProtocolVersion int    `json:"minProtocolVersion"`
+	Description        string `json:"description"`
+}
+
+// EventType is a type of the messages that a discovery may send.
+type EventType struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// State is a state of the protocol state machine.
+type State struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Transitions []*Transition `json:"transitions"`
+}
+
+// Transition is the state reached after a command.
+type Transition struct {
+	Command string `json:"command"`
+	To      string `json:"to"`
+}
+
+// messageSchema is the part of the JSON schema of the messages used by the
+// generator.
+type messageSchema struct {
+	Required   []string                   `json:"required"`
+	Properties map[string]*messageField   `json:"properties"`
+	Defs       map[string]json.RawMessage `json:"$defs"`
+}
+
+type messageField struct {
+	Type       string   `json:"type"`
+	GoName     string   `json:"x-go-name"`
+	GoType     string   `json:"x-go-type"`
+	EventTypes []string `json:"x-event-types"`
+}
+
+// Parse parses the specification and checks its consistency.
+func Parse(data []byte) (*Spec, error) {
+	var spec Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid protocol specification: %w", err)
+	}
+	eventTypes := map[string]bool{}
+	for _, eventType := range spec.EventTypes {
+		eventTypes[eventType.Name] = true
+	}
+	commands := map[string]bool{}
+	for _, command := range spec.Commands {
+		commands[command.Name] = true
+		if command.Response != "" && !eventTypes[command.Response] {
+			return nil, fmt.Errorf("unknown response %s of command %s", command.Response, command.Name)
+		}
+	}
+	states := map[string]bool{}
+	for _, state := range spec.States {
+		states[state.Name] = true
+	}
+	for _, state := range spec.States {
+		for _, transition := range state.Transitions {
+			if !commands[transition.Command] {
+				return nil, fmt.Errorf("unknown command %s in the transitions of state %s", transition.Command, state.Name)
+			}
+			if !states[transition.To] {
+				return nil, fmt.Errorf("unknown state %s in the transitions of state %s", transition.To, state.Name)
+			}
+		}
+	}
+	return &spec, nil
+}
+
+// Generate returns the Go source of the definitions of the protocol, in the
+// given package, from the specification.
+func Generate(data []byte, pkg string) ([]byte, error) {
+	spec, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	var schema messageSchema
+	if err := json.Unmarshal(spec.Message, &schema); err != nil {
+		return nil, fmt.Errorf("invalid message schema: %w", err)
+	}
+	// The fields are generated in the order of the schema
+	fieldNames, err := objectKeys(spec.Message, "properties")
+	if err != nil {
+		return nil, fmt.Errorf("invalid message schema: %w", err)
+	}
+
+	var out bytes.Buffer
+	p := func(format string, args ...any) { fmt.Fprintf(&out, format+"\n", args...) }
+	out.WriteString(licenseHeader)
+	p("")
+	p("// Code generated by protocolgen from protocol_spec.json. DO NOT EDIT.")
+	p("")
+	p("package %s", pkg)
+	p("")
+	for _, name := range fieldNames {
+		if strings.HasPrefix(schema.Properties[name].GoType, "json.") {
+			p(`import "encoding/json"`)
+			p("")
+			break
+		}
+	}
+
+	p("// The commands that a client may send to a pluggable discovery.")
+	p("const (")
+	for _, command := range spec.Commands {
+		p("%s = %q", commandConst(command.Name), command.Name)
+	}
+	p(")")
+	p("")
+	p("// The event types of the messages that a pluggable discovery may send.")
+	p("const (")
+	for _, eventType := range spec.EventTypes {
+		p("%s = %q", eventTypeConst(eventType.Name), eventType.Name)
+	}
+	p(")")
+	p("")
+
+	p("// responseEventTypes are the event types of the responses to the commands.")
+	p("var responseEventTypes = map[string]string{")
+	for _, command := range spec.Commands {
+		if command.Response != "" {
+			p("%s: %s,", commandConst(command.Name), eventTypeConst(command.Response))
+		}
+	}
+	p("}")
+	p("")
+	p(`// okEventTypes are the event types of the responses that carry an "OK"`)
+	p("// message when successful.")
+	p("var okEventTypes = []string{")
+	for _, command := range spec.Commands {
+		if command.OKMessage {
+			p("%s,", eventTypeConst(command.Response))
+		}
+	}
+	p("}")
+	p("")
+
+	p("// transitions is the table of the state transitions: for each state, the")
+	p("// commands allowed and the state reached after the command. It's shared by")
+	p("// the Client and the Server.")
+	p("var transitions = map[State]map[string]State{")
+	for _, state := range spec.States {
+		if len(state.Transitions) == 0 {
+			continue
+		}
+		p("%s: {", stateConst(state.Name))
+		for _, transition := range state.Transitions {
+			p("%s: %s,", commandConst(transition.Command), stateConst(transition.To))
+		}
+		p("},")
+	}
+	p("}")
+	p("")
+
+	p("// messageFields are the fields allowed in the messages, each with the event")
+	p("// types where it's expected (nil if expected in any message).")
+	p("var messageFields = map[string][]string{")
+	for _, name := range fieldNames {
+		eventTypes := schema.Properties[name].EventTypes
+		if len(eventTypes) == 0 {
+			p("%q: nil,", name)
+			continue
+		}
+		consts := []string{}
+		for _, eventType := range eventTypes {
+			consts = append(consts, eventTypeConst(eventType))
+		}
+		p("%q: {%s},", name, strings.Join(consts, ", "))
+	}
+	p("}")
+	p("")
+
+	p("// message is a message sent by the discovery.")
+	p("type message struct {")
+	for _, name := range fieldNames {
+		field := schema.Properties[name]
+		goName, goType := field.GoName, field.GoType
+		if goName == "" {
+			goName = strings.ToUpper(name[:1]) + name[1:]
+		}
+		if goType == "" {
+			switch field.Type {
+			case "string":
+				goType = "string"
+			case "boolean":
+				goType = "bool"
+			case "integer":
+				goType = "int"
+			default:
+				return nil, fmt.Errorf("field %s: missing x-go-type for type %q", name, field.Type)
+			}
+		}
+		tag := name
+		if !contains(schema.Required, name) {
+			tag += ",omitempty"
+		}
+		p("%s %s `json:%q`", goName, goType, tag)
+	}
+	p("}")
+
+	return format.Source(out.Bytes())
+}
+
+// objectKeys returns the keys of the object in the given field of the JSON
+// object data, in the order they appear.
+func objectKeys(data []byte, field string) ([]string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(fields[field]))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("%s is not an object", field)
+	}
+	keys := []string{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, token.(string))
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// commandConst returns the name of the constant of a command, for example
+// CommandStartSync for START_SYNC.
+func commandConst(name string) string {
+	return "Command" + camelCase(name)
+}
+
+// eventTypeConst returns the name of the constant of an event type, for
+// example EventTypeStartSync for start_sync.
+func eventTypeConst(name string) string {
+	return "EventType" + camelCase(name)
+}
+
+// stateConst returns the name of the constant of a state, for example
+// StateIdle for idle.
+func stateConst(name string) string {
+	return "State" + camelCase(name)
+}
+
+func camelCase(name string) string {
+	res := ""
+	for _, word := range strings.Split(strings.ToLower(name), "_") {
+		if word != "" {
+			res += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return res
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,444 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Manager handles a set of pluggable discoveries identified by their ID.
+type Manager struct {
+	discoveriesMutex sync.Mutex
+	discoveries      map[string]*Client
+	heartbeatTimeout time.Duration
+	quitTimeout      time.Duration
+	pingInterval     time.Duration
+	// pingStop stops the goroutine pinging the discoveries, see
+	// SetPingInterval.
+	pingStop        chan struct{}
+	clock           Clock
+	restartPolicy   *RestartPolicy
+	restartPolicies map[string]*RestartPolicy
+	supervisors     map[string]*supervisor
+	healthCallback  func(ev *HealthEvent)
+	journal         *eventJournal
+	syncs           map[string]chan struct{}
+	staticPorts     map[string]*Port
+	protocolFilter  *ProtocolFilter
+	dedup           *portDeduplicator
+	warmup          *warmup
+	readyCallback   func(id string, err error)
+	hooks           eventHooks
+	merger          eventMerger
+	reservations    uploadReservations
+	// enumerations are the first enumerations of the discoveries in sync
+	// mode, see FirstEnumerationDone.
+	enumerations      map[string]*enumeration
+	enumerationPolicy *EnumerationPolicy
+	startups          map[string]*DiscoveryStartup
+	syncPolicies      map[string]SyncPolicy
+	// subscribers is the number of the active subscriptions, see
+	// SyncPolicyOnDemand.
+	subscribers       int
+	syncPoliciesMutex sync.Mutex
+	// mode is the state the discoveries added at runtime are brought to:
+	// StateStarted after Start, StateSyncing after StartSync.
+	mode State
+	// imported is the health of the discoveries of the state loaded with
+	// ImportState.
+	imported []*DiscoveryHealth
+}
+
+// DiscoveryHealth is a snapshot of the health status of a discovery
+// handled by a Manager.
+type DiscoveryHealth struct {
+	ID            string    `json:"id"`
+	Alive         bool      `json:"alive"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+	// Stale is true if the discovery sent heartbeats during the current sync
+	// session, or answered the pings (see SetPingInterval), but stopped doing
+	// it for longer than the heartbeat timeout.
+	Stale bool `json:"stale"`
+	// Quarantined is true if the discovery has been detected in a crash-loop,
+	// see RestartPolicy.
+	Quarantined bool `json:"quarantined"`
+}
+
+// ManagerStatus is a snapshot of the status of the discoveries handled by a
+// Manager, see Manager.Status.
+type ManagerStatus struct {
+	Health []*DiscoveryHealth `json:"health"`
+	// Warnings are the warnings sent by the discoveries, sorted by discovery
+	// ID, see Client.Warnings.
+	Warnings []*Warning `json:"warnings"`
+}
+
+// NewManager creates a new empty discovery Manager
+func NewManager() *Manager {
+	return &Manager{
+		discoveries:       map[string]*Client{},
+		supervisors:       map[string]*supervisor{},
+		restartPolicies:   map[string]*RestartPolicy{},
+		heartbeatTimeout:  30 * time.Second,
+		quitTimeout:       5 * time.Second,
+		clock:             systemClock{},
+		journal:           newEventJournal(),
+		syncs:             map[string]chan struct{}{},
+		staticPorts:       map[string]*Port{},
+		dedup:             newPortDeduplicator(),
+		enumerations:      map[string]*enumeration{},
+		enumerationPolicy: DefaultEnumerationPolicy(),
+		startups:          map[string]*DiscoveryStartup{},
+		syncPolicies:      map[string]SyncPolicy{},
+	}
+}
+
+// SetClock sets the clock used by the Manager, by default the
+// system clock is used.
+func (m *Manager) SetClock(clock Clock) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	m.clock = clock
+}
+
+// SetHeartbeatTimeout sets the maximum time allowed between two heartbeats
+// before a discovery is reported as stale in the Health snapshot.
+// A timeout of 0 disables staleness detection.
+func (m *Manager) SetHeartbeatTimeout(timeout time.Duration) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	m.heartbeatTimeout = timeout
+}
+
+// SetQuitTimeout sets the maximum time allowed to each discovery to terminate
+// after the QUIT command in QuitAll, before being killed.
+func (m *Manager) SetQuitTimeout(timeout time.Duration) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	m.quitTimeout = timeout
+}
+
+// Add adds a discovery to the Manager. An error is returned if a discovery
+// with the same ID is already present, or if the ID is StaticDiscoveryID.
+// The discovery may be added while the Manager is running: after Start it's
+// started, after StartSync it's put in sync mode and its events are recorded
+// as the events of the other discoveries. If the discovery fails to start, or
+// one of its dependencies is not running (see DiscoveryStartup), it's added
+// anyway and the error is returned.
+func (m *Manager) Add(disc *Client) error {
+	m.discoveriesMutex.Lock()
+	id := disc.GetID()
+	if id == StaticDiscoveryID {
+		m.discoveriesMutex.Unlock()
+		return fmt.Errorf("reserved discovery ID: %s", id)
+	}
+	if _, has := m.discoveries[id]; has {
+		m.discoveriesMutex.Unlock()
+		return fmt.Errorf("pluggable discovery already added: %s", id)
+	}
+	m.discoveries[id] = disc
+	mode := m.mode
+	m.discoveriesMutex.Unlock()
+
+	if mode == StateUninitialized {
+		return nil
+	}
+	if err := m.checkDependencies(id); err != nil {
+		return err
+	}
+	if mode == StateSyncing {
+		return m.startSyncPolicy(disc)
+	}
+	return m.startDiscovery(disc)
+}
+
+// Remove removes a discovery from the Manager, while the Manager is running
+// too: the discovery is quit, as in QuitAll, and its automatic restart is
+// stopped. If the discovery is in sync mode, a "remove" event is recorded for
+// each port it reported before its final "stop" event, so the subscribers are
+// notified that the ports are gone. The returned error is not nil if the
+// discovery is not present or if it has been killed.
+func (m *Manager) Remove(id string) error {
+	m.discoveriesMutex.Lock()
+	disc, ok := m.discoveries[id]
+	if !ok {
+		m.discoveriesMutex.Unlock()
+		return fmt.Errorf("pluggable discovery not found: %s", id)
+	}
+	delete(m.discoveries, id)
+	if sup, ok := m.supervisors[id]; ok {
+		close(sup.stop)
+		delete(m.supervisors, id)
+	}
+	done := m.syncs[id]
+	delete(m.syncs, id)
+	if e, ok := m.enumerations[id]; ok {
+		e.complete()
+		delete(m.enumerations, id)
+	}
+	timeout := m.quitTimeout
+	clock := m.clock
+	m.discoveriesMutex.Unlock()
+
+	var err error
+	if disc.Alive() {
+		err = quitDiscovery(context.Background(), disc, timeout, clock)
+	}
+	if done != nil {
+		<-done
+	}
+	return err
+}
+
+// IDs returns the list of the IDs of the discoveries handled by the Manager,
+// sorted alphabetically.
+func (m *Manager) IDs() []string {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	res := []string{}
+	for id := range m.discoveries {
+		res = append(res, id)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Start runs all the discoveries that are not already running and sends
+// them the START command, the discoveries are started in parallel. The returned
+// map contains the errors of the discoveries that failed to start, indexed by
+// discovery ID. If a RestartPolicy is set, the discoveries successfully started
+// are automatically restarted if they terminate unexpectedly. The discoveries
+// already started are left untouched. The order of the startup may be
+// configured with SetDiscoveryStartup.
+func (m *Manager) Start() map[string]error {
+	m.discoveriesMutex.Lock()
+	if m.mode != StateSyncing {
+		m.mode = StateStarted
+	}
+	m.discoveriesMutex.Unlock()
+	m.startPinging()
+	return m.forEachDiscoveryInOrder(m.startDiscovery)
+}
+
+func (m *Manager) startDiscovery(disc *Client) error {
+	if !disc.Alive() {
+		if err := disc.Run(); err != nil {
+			return fmt.Errorf("running discovery %s: %w", disc, err)
+		}
+	}
+	if disc.State() != StateStarted {
+		if err := disc.Start(); err != nil {
+			return fmt.Errorf("starting discovery %s: %w", disc, err)
+		}
+	}
+	m.supervise(disc)
+	return nil
+}
+
+// ListAll sends the LIST command to all the discoveries in parallel and returns
+// the ports detected by all of them, followed by the static ports (see
+// AddStaticPort). If a warm-up is in progress it waits for its completion,
+// see WarmUp. The duplicated ports are removed according to the policy set
+// with SetDedupPolicy. A failing discovery doesn't prevent the
+// other discoveries from being listed: the returned map contains the errors of
+// the discoveries that failed, indexed by discovery ID. The ports not selected
+// by the protocol filter are dropped, see SetProtocolFilter.
+func (m *Manager) ListAll() ([]*Port, map[string]error) {
+	return m.View(m.getProtocolFilter()).ListAll()
+}
+
+func (m *Manager) listAll() ([]*Port, map[string]error) {
+	// The first list after a warm-up waits for the discoveries to be ready
+	_, _ = m.WaitReady(context.Background())
+	portsMutex := sync.Mutex{}
+	ports := map[string][]*Port{}
+	errs := m.forEachDiscovery(func(disc *Client) error {
+		if !disc.Alive() {
+			return fmt.Errorf("discovery %s is not running", disc)
+		}
+		l, err := disc.List()
+		if err != nil {
+			return fmt.Errorf("listing ports from discovery %s: %w", disc, err)
+		}
+		portsMutex.Lock()
+		ports[disc.GetID()] = l
+		portsMutex.Unlock()
+		return nil
+	})
+
+	res := m.dedup.dedupList(ports, m.IDs())
+	res = append(res, m.staticPortsList()...)
+	return res, errs
+}
+
+// DescribeAll sends the DESCRIBE command to all the discoveries in parallel and
+// returns the descriptions indexed by discovery ID. The returned error map
+// contains the errors of the discoveries that failed, including the discoveries
+// that do not support the DESCRIBE command.
+func (m *Manager) DescribeAll() (map[string]*Description, map[string]error) {
+	descriptionsMutex := sync.Mutex{}
+	descriptions := map[string]*Description{}
+	errs := m.forEachDiscovery(func(disc *Client) error {
+		if !disc.Alive() {
+			return fmt.Errorf("discovery %s is not running", disc)
+		}
+		desc, err := disc.Describe()
+		if err != nil {
+			return fmt.Errorf("describing discovery %s: %w", disc, err)
+		}
+		descriptionsMutex.Lock()
+		descriptions[disc.GetID()] = desc
+		descriptionsMutex.Unlock()
+		return nil
+	})
+	return descriptions, errs
+}
+
+// QuitAll sends the QUIT command to all the running discoveries in parallel and
+// stops their automatic restart. The discoveries that do not terminate within
+// the quit timeout (see SetQuitTimeout), or before the context is done, are
+// killed: in this way the shutdown latency is bounded regardless of the number
+// of discoveries. The returned error joins the errors of all the discoveries
+// that have been killed, or nil if all the discoveries terminated gracefully.
+func (m *Manager) QuitAll(ctx context.Context) error {
+	m.stopSupervisors()
+	m.stopPinging()
+	m.discoveriesMutex.Lock()
+	timeout := m.quitTimeout
+	clock := m.clock
+	m.mode = StateUninitialized
+	m.discoveriesMutex.Unlock()
+
+	errs := m.forEachDiscovery(func(disc *Client) error {
+		if !disc.Alive() {
+			return nil
+		}
+		return quitDiscovery(ctx, disc, timeout, clock)
+	})
+
+	res := []error{}
+	for _, id := range m.IDs() {
+		if err, ok := errs[id]; ok {
+			res = append(res, err)
+		}
+	}
+	return errors.Join(res...)
+}
+
+// quitDiscovery sends the QUIT command to the discovery and kills it if it
+// doesn't terminate within the timeout, or before the context is done.
+func quitDiscovery(ctx context.Context, disc *Client, timeout time.Duration, clock Clock) error {
+	done := make(chan struct{})
+	go func() {
+		disc.Quit()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+		return nil
+	case <-clock.After(timeout):
+		err = fmt.Errorf("discovery %s did not quit within %s, killed", disc, timeout)
+	case <-ctx.Done():
+		err = fmt.Errorf("discovery %s killed while quitting: %w", disc, ctx.Err())
+	}
+	disc.kill()
+	<-done
+	return err
+}
+
+// forEachDiscovery runs the given function on all the discoveries in parallel
+// and returns the errors indexed by discovery ID.
+func (m *Manager) forEachDiscovery(f func(disc *Client) error) map[string]error {
+	m.discoveriesMutex.Lock()
+	discoveries := []*Client{}
+	for _, disc := range m.discoveries {
+		discoveries = append(discoveries, disc)
+	}
+	m.discoveriesMutex.Unlock()
+	return forEachClient(discoveries, f)
+}
+
+// forEachClient runs the given function on the discoveries in parallel and
+// returns the errors indexed by discovery ID.
+func forEachClient(discoveries []*Client, f func(disc *Client) error) map[string]error {
+	var wg sync.WaitGroup
+	errsMutex := sync.Mutex{}
+	errs := map[string]error{}
+	for _, disc := range discoveries {
+		wg.Add(1)
+		go func(disc *Client) {
+			defer wg.Done()
+			if err := f(disc); err != nil {
+				errsMutex.Lock()
+				errs[disc.GetID()] = err
+				errsMutex.Unlock()
+			}
+		}(disc)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Health returns a snapshot of the health status of all the discoveries
+// handled by the Manager, and of the discoveries of the state loaded with
+// ImportState, sorted by discovery ID.
+func (m *Manager) Health() []*DiscoveryHealth {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	now := m.clock.Now()
+	res := []*DiscoveryHealth{}
+	for id, disc := range m.discoveries {
+		lastHeartbeat := disc.LastHeartbeat()
+		res = append(res, &DiscoveryHealth{
+			ID:            id,
+			Alive:         disc.Alive(),
+			LastHeartbeat: lastHeartbeat,
+			Stale: m.heartbeatTimeout > 0 &&
+				!lastHeartbeat.IsZero() &&
+				now.Sub(lastHeartbeat) > m.heartbeatTimeout,
+			Quarantined: m.supervisors[id] != nil && m.supervisors[id].quarantined,
+		})
+	}
+	res = append(res, m.importedHealth()...)
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Status returns a snapshot of the status of the discoveries handled by the
+// Manager: their health (see Health) and the warnings they sent, explaining
+// for example why some ports may be missing.
+func (m *Manager) Status() *ManagerStatus {
+	status := &ManagerStatus{Health: m.Health(), Warnings: []*Warning{}}
+	m.discoveriesMutex.Lock()
+	discoveries := []*Client{}
+	for _, disc := range m.discoveries {
+		discoveries = append(discoveries, disc)
+	}
+	m.discoveriesMutex.Unlock()
+	sort.Slice(discoveries, func(i, j int) bool { return discoveries[i].GetID() < discoveries[j].GetID() })
+	for _, disc := range discoveries {
+		status.Warnings = append(status.Warnings, disc.Warnings()...)
+	}
+	return status
+}
@@ -0,0 +1,356 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// ManagerConfig is a declarative description of the discoveries handled by a
+// Manager, see Manager.LoadConfig. The struct can be decoded from the JSON
+// configuration of the host application. The durations are expressed as
+// strings in the format accepted by time.ParseDuration (for example "500ms").
+type ManagerConfig struct {
+	Discoveries []*DiscoveryConfig `json:"discoveries"`
+	// Protocols is the filter of the ports reported by the Manager, see
+	// Manager.SetProtocolFilter.
+	Protocols *ProtocolFilter `json:"protocols,omitempty"`
+	// StartParams are the parameters of the START and START_SYNC commands of
+	// all the discoveries, for example the HostHints of the host.
+	StartParams map[string]string `json:"startParams,omitempty"`
+	// Dedup is the de-duplication policy of the ports reported by more than
+	// one discovery, see Manager.SetDedupPolicy.
+	Dedup *DedupPolicy `json:"dedup,omitempty"`
+}
+
+// DiscoveryConfig is the configuration of a single discovery.
+type DiscoveryConfig struct {
+	// ID is the unique identifier of the discovery.
+	ID string `json:"id"`
+	// Command is the path of the discovery executable.
+	Command string `json:"command,omitempty"`
+	// InProcess is the name of a registered Discovery to run in-process, in
+	// place of Command (see Register).
+	InProcess string `json:"inProcess,omitempty"`
+	// SHA256 is the expected checksum of the discovery executable, in
+	// hexadecimal, see WithChecksum.
+	SHA256 string `json:"sha256,omitempty"`
+	// ProcessGroup kills all the processes spawned by the discovery when it's
+	// terminated, see WithProcessGroup.
+	ProcessGroup bool `json:"processGroup,omitempty"`
+	// CompactOutput requests the discovery to send the messages in the compact
+	// JSON format, see WithCompactOutput.
+	CompactOutput bool `json:"compactOutput,omitempty"`
+	// Compression requests the discovery to compress the messages it sends,
+	// see WithCompression.
+	Compression string `json:"compression,omitempty"`
+	// IdempotentCommands makes the commands of the discovery idempotent, see
+	// WithIdempotentCommands.
+	IdempotentCommands bool `json:"idempotentCommands,omitempty"`
+	// MaxPorts is the maximum number of ports accepted from the discovery,
+	// see WithMaxPorts.
+	MaxPorts int `json:"maxPorts,omitempty"`
+	// NormalizeProtocols normalizes the protocol of the ports reported by the
+	// discovery, see WithProtocolNormalization.
+	NormalizeProtocols bool `json:"normalizeProtocols,omitempty"`
+	// AdaptiveTimeouts adapts the timeouts of the commands to the latencies
+	// of the responses observed, with the default policy, see
+	// WithAdaptiveTimeouts.
+	AdaptiveTimeouts bool `json:"adaptiveTimeouts,omitempty"`
+	// Decode sets the strictness of the parser of the messages sent by the
+	// discovery, see WithDecodeOptions.
+	Decode *DecodeOptions `json:"decode,omitempty"`
+	// DeviceWatchFallback runs a DeviceWatchDiscovery of the default devices
+	// if the discovery executable is not installed, see
+	// WithDeviceWatchFallback.
+	DeviceWatchFallback bool `json:"deviceWatchFallback,omitempty"`
+	// RedactedProperties are the property keys masked in the logs and in the
+	// diagnostic reports, see WithRedactedProperties.
+	RedactedProperties []string `json:"redactedProperties,omitempty"`
+	// Args are the command line arguments of the discovery.
+	Args []string `json:"args,omitempty"`
+	// StartParams are the parameters of the START and START_SYNC commands,
+	// added to the StartParams of the ManagerConfig, see WithStartParams.
+	StartParams map[string]string `json:"startParams,omitempty"`
+	// Env are additional environment variables, in the form "KEY=VALUE".
+	Env []string `json:"env,omitempty"`
+	// Workspace is the base directory of the working and temp directories
+	// of the discovery, see Client.SetWorkspace.
+	Workspace string `json:"workspace,omitempty"`
+	// Restart is the restart policy of the discovery, if not set the policy
+	// of the Manager is used.
+	Restart *RestartPolicyConfig `json:"restart,omitempty"`
+	// Priority is the startup priority of the discovery, the discoveries
+	// with a lower priority are started first, see DiscoveryStartup.
+	Priority int `json:"priority,omitempty"`
+	// DependsOn are the IDs of the discoveries that must be started before
+	// this discovery, see DiscoveryStartup.
+	DependsOn []string `json:"dependsOn,omitempty"`
+	// SyncOnDemand puts the discovery in sync mode only while the Manager has
+	// subscribers, see SyncPolicyOnDemand.
+	SyncOnDemand bool `json:"syncOnDemand,omitempty"`
+	// Debounce is the delay applied to the "remove" events, see Client.SetDebounce.
+	Debounce string `json:"debounce,omitempty"`
+	// LabelTemplate computes the labels of the ports reported by the
+	// discovery, see ParseLabelTemplate.
+	LabelTemplate string `json:"labelTemplate,omitempty"`
+	// Filters select the ports reported by the discovery: a port is reported
+	// if it matches at least one filter. If empty all the ports are reported.
+	Filters []*PortFilterConfig `json:"filters,omitempty"`
+}
+
+// RestartPolicyConfig is the declarative form of a RestartPolicy, the fields
+// not set take the value of the DefaultRestartPolicy. A Jitter greater than 0
+// randomizes the exponential backoff, see JitteredBackoff.
+type RestartPolicyConfig struct {
+	MaxCrashes     int     `json:"maxCrashes,omitempty"`
+	CrashWindow    string  `json:"crashWindow,omitempty"`
+	InitialBackoff string  `json:"initialBackoff,omitempty"`
+	MaxBackoff     string  `json:"maxBackoff,omitempty"`
+	Jitter         float64 `json:"jitter,omitempty"`
+}
+
+// PortFilterConfig matches the ports having one of the given protocols (if
+// any) and all the given property values.
+type PortFilterConfig struct {
+	Protocols  []string          `json:"protocols,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// LoadConfig creates and adds to the Manager the discoveries described in the
+// given configuration, and sets its protocol filter if present. The whole configuration is validated before adding any
+// discovery: if an error is returned the Manager is not modified.
+func (m *Manager) LoadConfig(cfg *ManagerConfig) error {
+	ids := map[string]bool{}
+	for _, id := range m.IDs() {
+		ids[id] = true
+	}
+	type loadedDiscovery struct {
+		client        *Client
+		restartPolicy *RestartPolicy
+		startup       *DiscoveryStartup
+		onDemand      bool
+	}
+	loaded := []*loadedDiscovery{}
+	errs := []error{}
+	for _, discCfg := range cfg.Discoveries {
+		if discCfg == nil {
+			continue
+		}
+		disc, policy, err := discCfg.newClient(cfg.StartParams)
+		if err == nil && ids[discCfg.ID] {
+			err = errors.New("duplicate discovery ID")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("discovery '%s': %w", discCfg.ID, err))
+			continue
+		}
+		ids[discCfg.ID] = true
+		l := &loadedDiscovery{client: disc, restartPolicy: policy, onDemand: discCfg.SyncOnDemand}
+		if discCfg.Priority != 0 || len(discCfg.DependsOn) > 0 {
+			l.startup = &DiscoveryStartup{Priority: discCfg.Priority, DependsOn: discCfg.DependsOn}
+		}
+		loaded = append(loaded, l)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, l := range loaded {
+		if err := m.Add(l.client); err != nil {
+			return err
+		}
+		if l.restartPolicy != nil {
+			m.SetDiscoveryRestartPolicy(l.client.GetID(), l.restartPolicy)
+		}
+		if l.startup != nil {
+			m.SetDiscoveryStartup(l.client.GetID(), l.startup)
+		}
+		if l.onDemand {
+			m.SetSyncPolicy(l.client.GetID(), SyncPolicyOnDemand)
+		}
+	}
+	if cfg.Protocols != nil {
+		m.SetProtocolFilter(cfg.Protocols)
+	}
+	if cfg.Dedup != nil {
+		m.SetDedupPolicy(cfg.Dedup)
+	}
+	return nil
+}
+
+// newClient creates the discovery Client described by the configuration.
+// The startParams of the ManagerConfig are overridden by the ones of the
+// discovery.
+func (cfg *DiscoveryConfig) newClient(startParams map[string]string) (*Client, *RestartPolicy, error) {
+	if cfg.ID == "" {
+		return nil, nil, errors.New("missing discovery ID")
+	}
+	if cfg.ID == StaticDiscoveryID {
+		return nil, nil, fmt.Errorf("reserved discovery ID: %s", cfg.ID)
+	}
+	var disc *Client
+	switch {
+	case cfg.Command != "" && cfg.InProcess != "":
+		return nil, nil, errors.New("both command and inProcess specified")
+	case cfg.InProcess != "":
+		if _, err := registeredFactory(cfg.InProcess); err != nil {
+			return nil, nil, err
+		}
+		disc = NewInProcessClient(cfg.ID, cfg.InProcess)
+	case cfg.Command != "":
+		disc = NewClient(cfg.ID, append([]string{cfg.Command}, cfg.Args...)...)
+	default:
+		return nil, nil, errors.New("missing command")
+	}
+	if len(cfg.Env) > 0 {
+		WithEnv(cfg.Env...)(disc)
+	}
+	if cfg.SHA256 != "" {
+		if cfg.InProcess != "" {
+			return nil, nil, errors.New("sha256 not supported for inProcess discoveries")
+		}
+		WithChecksum(cfg.SHA256)(disc)
+	}
+	if len(cfg.RedactedProperties) > 0 {
+		WithRedactedProperties(cfg.RedactedProperties...)(disc)
+	}
+	if cfg.ProcessGroup {
+		WithProcessGroup(true)(disc)
+	}
+	if cfg.CompactOutput {
+		WithCompactOutput(true)(disc)
+	}
+	if cfg.IdempotentCommands {
+		WithIdempotentCommands(true)(disc)
+	}
+	if cfg.Compression != "" {
+		WithCompression(cfg.Compression)(disc)
+	}
+	if cfg.MaxPorts != 0 {
+		WithMaxPorts(cfg.MaxPorts)(disc)
+	}
+	if cfg.NormalizeProtocols {
+		WithProtocolNormalization(true)(disc)
+	}
+	if cfg.DeviceWatchFallback {
+		WithDeviceWatchFallback("")(disc)
+	}
+	if cfg.AdaptiveTimeouts {
+		WithAdaptiveTimeouts(&AdaptiveTimeouts{})(disc)
+	}
+	if cfg.Decode != nil {
+		WithDecodeOptions(*cfg.Decode)(disc)
+	}
+	if len(startParams) > 0 || len(cfg.StartParams) > 0 {
+		params := maps.Clone(startParams)
+		if params == nil {
+			params = map[string]string{}
+		}
+		maps.Copy(params, cfg.StartParams)
+		WithStartParams(params)(disc)
+	}
+	WithWorkspace(cfg.Workspace)(disc)
+	if cfg.Debounce != "" {
+		debounce, err := time.ParseDuration(cfg.Debounce)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid debounce: %w", err)
+		}
+		WithDebounce(debounce)(disc)
+	}
+	if cfg.LabelTemplate != "" {
+		tmpl, err := ParseLabelTemplate(cfg.LabelTemplate)
+		if err != nil {
+			return nil, nil, err
+		}
+		WithLabelTemplate(tmpl)(disc)
+	}
+	if len(cfg.Filters) > 0 {
+		filters := cfg.Filters
+		WithPortFilter(func(port *Port) bool {
+			for _, filter := range filters {
+				if filter != nil && filter.match(port) {
+					return true
+				}
+			}
+			return false
+		})(disc)
+	}
+	var policy *RestartPolicy
+	if cfg.Restart != nil {
+		p, err := cfg.Restart.restartPolicy()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid restart policy: %w", err)
+		}
+		policy = p
+	}
+	return disc, policy, nil
+}
+
+func (cfg *RestartPolicyConfig) restartPolicy() (*RestartPolicy, error) {
+	policy := DefaultRestartPolicy()
+	if cfg.MaxCrashes > 0 {
+		policy.MaxCrashes = cfg.MaxCrashes
+	}
+	for _, field := range []struct {
+		value  string
+		target *time.Duration
+	}{
+		{cfg.CrashWindow, &policy.CrashWindow},
+		{cfg.InitialBackoff, &policy.InitialBackoff},
+		{cfg.MaxBackoff, &policy.MaxBackoff},
+	} {
+		if field.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field.value)
+		if err != nil {
+			return nil, err
+		}
+		*field.target = d
+	}
+	if cfg.Jitter < 0 || cfg.Jitter > 1 {
+		return nil, fmt.Errorf("invalid jitter %v: must be between 0 and 1", cfg.Jitter)
+	}
+	if cfg.Jitter > 0 {
+		policy.Backoff = &JitteredBackoff{
+			Strategy: &ExponentialBackoff{Initial: policy.InitialBackoff, Max: policy.MaxBackoff},
+			Jitter:   cfg.Jitter,
+		}
+	}
+	return policy, nil
+}
+
+func (filter *PortFilterConfig) match(port *Port) bool {
+	if len(filter.Protocols) > 0 && !slices.Contains(filter.Protocols, port.Protocol) {
+		return false
+	}
+	for key, value := range filter.Properties {
+		if port.Properties == nil {
+			return false
+		}
+		if v, ok := port.Properties.GetOk(key); !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
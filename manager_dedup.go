@@ -0,0 +1,245 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"slices"
+	"sort"
+	"sync"
+)
+
+// DedupPolicy enables the de-duplication of the ports reported by more than
+// one discovery with the same protocol and address, see Manager.SetDedupPolicy.
+// The port is owned by the reporting discovery that comes first in Priority,
+// the discoveries not listed in Priority come after all the listed ones and,
+// between them, the discovery reporting the port first wins. An empty Priority
+// means that the first discovery reporting a port always wins.
+type DedupPolicy struct {
+	Priority []string `json:"priority,omitempty"`
+}
+
+// rank returns the position of the discovery in the priority list.
+func (p *DedupPolicy) rank(id string) int {
+	if i := slices.Index(p.Priority, id); i >= 0 {
+		return i
+	}
+	return len(p.Priority)
+}
+
+// SetDedupPolicy enables the de-duplication of the ports reported by several
+// discoveries (for example the same serial port reported by a generic and by a
+// vendor discovery) in ListAll, Snapshot, Subscribe and Events: only the owner
+// of the port, selected by the policy, reports it and the events of the other
+// discoveries are suppressed. When the owner removes the port, the ownership
+// passes to the next discovery still reporting it, that is announced with an
+// "add" event. The static ports are not de-duplicated. A nil policy (the
+// default) disables the de-duplication. It must be called before StartSync.
+func (m *Manager) SetDedupPolicy(policy *DedupPolicy) {
+	m.dedup.setPolicy(policy)
+}
+
+// SuppressedDuplicates returns the number of events suppressed by the
+// de-duplication of the ports, see SetDedupPolicy.
+func (m *Manager) SuppressedDuplicates() uint64 {
+	m.dedup.mutex.Lock()
+	defer m.dedup.mutex.Unlock()
+	return m.dedup.suppressed
+}
+
+// recordEvent records an event received from a discovery in the journal,
+// after the upload reservations (see ReserveForUpload) and the
+// de-duplication, calls the event hooks and returns the events actually
+// recorded.
+func (m *Manager) recordEvent(ev *Event) []*Event {
+	m.dedup.mutex.Lock()
+	events := []*Event{}
+	for _, ev := range m.reservations.process(ev) {
+		events = append(events, m.dedup.process(ev)...)
+	}
+	for _, ev := range events {
+		m.journal.record(ev)
+	}
+	m.dedup.mutex.Unlock()
+	for _, ev := range events {
+		m.hooks.call(ev)
+	}
+	return events
+}
+
+// portReport is a port reported by a discovery.
+type portReport struct {
+	id   string
+	port *Port
+}
+
+// portDeduplicator tracks the discoveries reporting each port to select
+// the owner of the port.
+type portDeduplicator struct {
+	mutex  sync.Mutex
+	policy *DedupPolicy
+	// reports are the reports of each port, in order of arrival, indexed
+	// by protocol and address
+	reports    map[string][]*portReport
+	suppressed uint64
+}
+
+func newPortDeduplicator() *portDeduplicator {
+	return &portDeduplicator{reports: map[string][]*portReport{}}
+}
+
+func (d *portDeduplicator) setPolicy(policy *DedupPolicy) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.policy = policy
+}
+
+// owner returns the report of the owner of the port, or nil if the port is
+// not reported. The caller must hold the mutex.
+func (d *portDeduplicator) owner(reports []*portReport) *portReport {
+	var owner *portReport
+	for _, report := range reports {
+		if owner == nil || d.policy.rank(report.id) < d.policy.rank(owner.id) {
+			owner = report
+		}
+	}
+	return owner
+}
+
+// process applies the de-duplication to an event and returns the resulting
+// events. The caller must hold the mutex.
+func (d *portDeduplicator) process(ev *Event) []*Event {
+	if d.policy == nil || ev.DiscoveryID == StaticDiscoveryID {
+		return []*Event{ev}
+	}
+	switch ev.Type {
+	case EventTypeAdd:
+		key := ev.Port.Protocol + "|" + ev.Port.Address
+		previous := d.owner(d.reports[key])
+		if i := slices.IndexFunc(d.reports[key], func(r *portReport) bool { return r.id == ev.DiscoveryID }); i >= 0 {
+			d.reports[key][i].port = ev.Port
+		} else {
+			d.reports[key] = append(d.reports[key], &portReport{id: ev.DiscoveryID, port: ev.Port})
+		}
+		if owner := d.owner(d.reports[key]); owner.id != ev.DiscoveryID {
+			d.suppressed++
+			return nil
+		}
+		if previous != nil && previous.id != ev.DiscoveryID {
+			// The port passes to a discovery with higher priority
+			return []*Event{removeEvent(previous), ev}
+		}
+		return []*Event{ev}
+	case EventTypeRemove:
+		key := ev.Port.Protocol + "|" + ev.Port.Address
+		previous := d.owner(d.reports[key])
+		if !d.removeReport(key, ev.DiscoveryID) {
+			return []*Event{ev}
+		}
+		if previous.id != ev.DiscoveryID {
+			d.suppressed++
+			return nil
+		}
+		return d.transfer(key, []*Event{ev})
+	case EventTypeStop:
+		res := []*Event{ev}
+		keys := []string{}
+		for key := range d.reports {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			previous := d.owner(d.reports[key])
+			if d.removeReport(key, ev.DiscoveryID) && previous.id == ev.DiscoveryID {
+				res = d.transfer(key, res)
+			}
+		}
+		return res
+	}
+	return []*Event{ev}
+}
+
+// removeReport removes the report of the port from the given discovery,
+// returns false if the discovery was not reporting the port.
+func (d *portDeduplicator) removeReport(key, id string) bool {
+	reports := d.reports[key]
+	i := slices.IndexFunc(reports, func(r *portReport) bool { return r.id == id })
+	if i < 0 {
+		return false
+	}
+	reports = slices.Delete(reports, i, i+1)
+	if len(reports) == 0 {
+		delete(d.reports, key)
+	} else {
+		d.reports[key] = reports
+	}
+	return true
+}
+
+// transfer appends to the events the "add" of the port by its new owner, if any.
+func (d *portDeduplicator) transfer(key string, events []*Event) []*Event {
+	if owner := d.owner(d.reports[key]); owner != nil {
+		events = append(events, &Event{Type: EventTypeAdd, Port: owner.port.Clone(), DiscoveryID: owner.id})
+	}
+	return events
+}
+
+func removeEvent(report *portReport) *Event {
+	return &Event{
+		Type:        EventTypeRemove,
+		Port:        &Port{Address: report.port.Address, Protocol: report.port.Protocol},
+		DiscoveryID: report.id,
+	}
+}
+
+// dedupList removes the duplicated ports from the lists of the discoveries,
+// indexed by discovery ID. The owner of each port is selected with the policy,
+// between the discoveries with the same priority the owner tracked from the
+// events is preferred, then the discoveries are taken in the order of ids.
+func (d *portDeduplicator) dedupList(ports map[string][]*Port, ids []string) []*Port {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	res := []*Port{}
+	if d.policy == nil {
+		for _, id := range ids {
+			res = append(res, ports[id]...)
+		}
+		return res
+	}
+	owners := map[string]string{}
+	for _, id := range ids {
+		for _, port := range ports[id] {
+			key := port.Protocol + "|" + port.Address
+			current, ok := owners[key]
+			if !ok || d.policy.rank(id) < d.policy.rank(current) {
+				owners[key] = id
+			} else if d.policy.rank(id) == d.policy.rank(current) {
+				if owner := d.owner(d.reports[key]); owner != nil && owner.id == id {
+					owners[key] = id
+				}
+			}
+		}
+	}
+	for _, id := range ids {
+		for _, port := range ports[id] {
+			if owners[port.Protocol+"|"+port.Address] == id {
+				res = append(res, port)
+			}
+		}
+	}
+	return res
+}
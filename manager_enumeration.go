@@ -0,0 +1,162 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EnumerationPolicy bounds the time waited for the first enumeration of the
+// ports of each discovery synced by the Manager, that is the burst of "add"
+// events sent by a discovery after it's put in sync mode, see
+// Manager.FirstEnumerationDone. The first enumeration is done when the
+// discovery doesn't send events for QuietPeriod after the first one, when
+// Timeout is elapsed since the start of the discovery, or when the sync
+// session of the discovery ends, whichever comes first. The ports detected
+// later are reported as usual.
+type EnumerationPolicy struct {
+	// Timeout is the maximum time waited for the first enumeration, 0 for no
+	// limit.
+	Timeout time.Duration
+	// QuietPeriod is the time without events, after the first one, after
+	// which the first enumeration is considered complete, 0 to wait always
+	// for the Timeout. A discovery that reports no ports is waited until the
+	// Timeout.
+	QuietPeriod time.Duration
+}
+
+// DefaultEnumerationPolicy returns the default EnumerationPolicy of the
+// Manager: the first enumeration takes at most 2 seconds, or ends after 250ms
+// without events.
+func DefaultEnumerationPolicy() *EnumerationPolicy {
+	return &EnumerationPolicy{
+		Timeout:     2 * time.Second,
+		QuietPeriod: 250 * time.Millisecond,
+	}
+}
+
+// enumeration tracks the first enumeration of a discovery.
+type enumeration struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func (e *enumeration) complete() {
+	e.once.Do(func() { close(e.done) })
+}
+
+func (e *enumeration) isDone() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetEnumerationPolicy sets the policy bounding the time waited for the first
+// enumeration of the discoveries, see EnumerationPolicy. It must be called
+// before StartSync.
+func (m *Manager) SetEnumerationPolicy(policy *EnumerationPolicy) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	m.enumerationPolicy = policy
+}
+
+// FirstEnumerationDone returns a channel that is closed when the first
+// enumeration of the ports of the given discovery is done, after it has been
+// put in sync mode by StartSync (see EnumerationPolicy), or when it fails to
+// start or is removed from the Manager. The ports detected so far are then
+// available with Snapshot: in this way a CLI may print promptly a list of the
+// boards, without waiting for the slow discoveries. The channel may be
+// requested before StartSync.
+func (m *Manager) FirstEnumerationDone(id string) (<-chan struct{}, error) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	if _, ok := m.discoveries[id]; !ok {
+		return nil, fmt.Errorf("pluggable discovery not found: %s", id)
+	}
+	return m.enumerationOf(id).done, nil
+}
+
+// WaitFirstEnumeration waits until the first enumeration of all the
+// discoveries is done, see FirstEnumerationDone, or the context is done.
+func (m *Manager) WaitFirstEnumeration(ctx context.Context) error {
+	m.discoveriesMutex.Lock()
+	pending := []*enumeration{}
+	for id := range m.discoveries {
+		pending = append(pending, m.enumerationOf(id))
+	}
+	m.discoveriesMutex.Unlock()
+	for _, e := range pending {
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return errors.Join(errors.New("waiting for the first enumeration"), ctx.Err())
+		}
+	}
+	return nil
+}
+
+// enumerationOf returns the first enumeration of the discovery with the given
+// ID, creating it if needed. The caller must hold the discoveriesMutex.
+func (m *Manager) enumerationOf(id string) *enumeration {
+	e, ok := m.enumerations[id]
+	if !ok {
+		e = &enumeration{done: make(chan struct{})}
+		m.enumerations[id] = e
+	}
+	return e
+}
+
+// watchEnumeration completes the first enumeration according to the policy: a
+// value is received from activity for each event of the discovery, and ended
+// is closed at the end of the sync session. The quiet period starts with the
+// first event, until then only the Timeout ends the wait. The watch ends
+// without waiting if the enumeration is completed elsewhere.
+func watchEnumeration(e *enumeration, policy *EnumerationPolicy, clock Clock, activity <-chan struct{}, ended <-chan struct{}) {
+	defer e.complete()
+	var timeout <-chan time.Time
+	if policy.Timeout > 0 {
+		timeout = clock.After(policy.Timeout)
+	}
+	started := false
+	for {
+		var quiet <-chan time.Time
+		if started && policy.QuietPeriod > 0 {
+			quiet = clock.After(policy.QuietPeriod)
+		}
+		select {
+		case <-activity:
+			// The quiet period starts again
+			started = true
+		case <-quiet:
+			return
+		case <-timeout:
+			return
+		case <-ended:
+			return
+		case <-e.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,406 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// defaultEventHistorySize is the default number of events kept by the Manager.
+const defaultEventHistorySize = 256
+
+// managerSyncBufferSize is the size of the event channels of the discoveries
+// synced by the Manager.
+const managerSyncBufferSize = 16
+
+// ErrHistoryTruncated is returned by Manager.Subscribe when some of the events
+// following the requested sequence number have been already discarded from the
+// history: the subscriber must take a new Snapshot to recover the port state.
+var ErrHistoryTruncated = errors.New("event history truncated")
+
+// SequencedEvent is an event received by the Manager, numbered with a sequence
+// number that increases by one for each event.
+type SequencedEvent struct {
+	Seq   uint64
+	Event *Event
+}
+
+// ManagerSnapshot is the state of the ports detected by the discoveries synced
+// by the Manager, see Manager.Snapshot.
+type ManagerSnapshot struct {
+	// Seq is the sequence number of the last event received, the state of the
+	// ports includes all the events up to Seq.
+	Seq uint64
+	// Ports are the ports currently detected, sorted by discovery ID, protocol
+	// and address.
+	Ports []*Port
+	// Events are the last events received, oldest first.
+	Events []*SequencedEvent
+}
+
+// SetEventHistorySize sets the number of events kept by the Manager to be
+// replayed to the subscribers (see Subscribe), 256 by default.
+func (m *Manager) SetEventHistorySize(size int) {
+	m.journal.setSize(size)
+}
+
+// StartSync runs all the discoveries that are not already running and puts them
+// in sync mode, see Client.StartSync, the discoveries already in sync mode are
+// left untouched, the discoveries started with Start or WarmUp are stopped and
+// put in sync mode. The events are recorded by the Manager to
+// keep the state of the ports detected, available with Snapshot, and they are
+// delivered to the subscribers, see Subscribe. If a RestartPolicy is set, a
+// discovery terminated unexpectedly is restarted in sync mode: a "remove" event
+// is recorded for each of its ports, followed by the new initial "add" events,
+// so the subscriptions go on across the restarts. The discoveries with
+// SyncPolicyOnDemand are only started until the first subscriber appears, see
+// SetSyncPolicy. The returned map contains the errors of the discoveries that
+// failed to start, indexed by discovery ID.
+func (m *Manager) StartSync() map[string]error {
+	m.discoveriesMutex.Lock()
+	m.mode = StateSyncing
+	m.discoveriesMutex.Unlock()
+	m.startPinging()
+	return m.forEachDiscoveryInOrder(m.startSyncPolicy)
+}
+
+func (m *Manager) startSyncDiscovery(disc *Client) error {
+	m.discoveriesMutex.Lock()
+	enum := m.enumerationOf(disc.GetID())
+	policy := m.enumerationPolicy
+	clock := m.clock
+	m.discoveriesMutex.Unlock()
+	// The first enumeration is watched before starting the discovery, so the
+	// Timeout of the policy bounds the start of the discovery too
+	done := make(chan struct{})
+	var activity chan struct{}
+	if !enum.isDone() {
+		activity = make(chan struct{}, 1)
+		go watchEnumeration(enum, policy, clock, activity, done)
+	}
+	events, err := m.runSyncDiscovery(disc)
+	if err != nil {
+		// There are no ports to wait for
+		enum.complete()
+		return err
+	}
+	if events == nil {
+		// Already in sync mode
+		return nil
+	}
+
+	// The events of the previous sync session of the discovery are
+	// recorded before the events of the new one
+	m.discoveriesMutex.Lock()
+	previous := m.syncs[disc.GetID()]
+	m.syncs[disc.GetID()] = done
+	m.discoveriesMutex.Unlock()
+	go func() {
+		defer close(done)
+		if previous != nil {
+			<-previous
+		}
+		stopped := false
+		for ev := range events {
+			stopped = ev.Type == EventTypeStop
+			if stopped && ev.Err != nil && m.restarting(disc) {
+				// The session goes on after the restart of the discovery:
+				// its ports are gone and will be added again by the new
+				// initial burst of "add" events
+				m.removeDiscoveryPorts(disc)
+				continue
+			}
+			if stopped {
+				m.removeOrphanPorts(disc)
+			}
+			m.mergeEvent(ev)
+			if activity != nil {
+				select {
+				case activity <- struct{}{}:
+				default:
+				}
+			}
+		}
+		// The final "stop" event may be dropped if the channel is full
+		if !stopped {
+			if disc.terminationError() != nil && !disc.isQuitRequested() && m.restarting(disc) {
+				m.removeDiscoveryPorts(disc)
+				return
+			}
+			m.removeOrphanPorts(disc)
+			m.mergeEvent(&Event{Type: EventTypeStop, DiscoveryID: disc.GetID()})
+		}
+	}()
+	m.supervise(disc)
+	return nil
+}
+
+// runSyncDiscovery runs the discovery, if needed, and puts it in sync mode. A
+// nil channel is returned if the discovery is already in sync mode.
+func (m *Manager) runSyncDiscovery(disc *Client) (<-chan *Event, error) {
+	if !disc.Alive() {
+		if err := disc.Run(); err != nil {
+			return nil, fmt.Errorf("running discovery %s: %w", disc, err)
+		}
+	}
+	if disc.State() == StateSyncing {
+		return nil, nil
+	}
+	if disc.State() == StateStarted {
+		// Started by Start or WarmUp
+		if err := disc.Stop(); err != nil {
+			return nil, fmt.Errorf("stopping discovery %s: %w", disc, err)
+		}
+	}
+	events, err := disc.StartSync(managerSyncBufferSize)
+	if err != nil {
+		return nil, fmt.Errorf("starting sync of discovery %s: %w", disc, err)
+	}
+	return events, nil
+}
+
+// restarting returns true if the discovery, terminated unexpectedly, is going
+// to be restarted by its supervisor, see RestartPolicy.
+func (m *Manager) restarting(disc *Client) bool {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	return m.discoveries[disc.GetID()] == disc && m.supervisors[disc.GetID()] != nil
+}
+
+// removeDiscoveryPorts records a "remove" event for each port reported by
+// the discovery.
+func (m *Manager) removeDiscoveryPorts(disc *Client) {
+	// The ports added in the current merge window must be removed too
+	m.flushEvents(0)
+	for _, port := range m.journal.discoveryPorts(disc.GetID()) {
+		m.mergeEvent(&Event{Type: EventTypeRemove, Port: port, DiscoveryID: disc.GetID()})
+	}
+}
+
+// removeOrphanPorts records a "remove" event for each port reported by the
+// discovery, if it has been removed from the Manager (see Remove).
+func (m *Manager) removeOrphanPorts(disc *Client) {
+	m.discoveriesMutex.Lock()
+	removed := m.discoveries[disc.GetID()] != disc
+	m.discoveriesMutex.Unlock()
+	if removed {
+		m.removeDiscoveryPorts(disc)
+	}
+}
+
+// Snapshot returns the ports currently detected by the discoveries synced by
+// the Manager (see StartSync) and the recent history of the events. A frontend
+// reconnecting to the Manager can restore its state from the snapshot and then
+// follow the changes by subscribing from the sequence number of the snapshot.
+// The ports not selected by the protocol filter are dropped, see SetProtocolFilter.
+func (m *Manager) Snapshot() *ManagerSnapshot {
+	return m.View(m.getProtocolFilter()).Snapshot()
+}
+
+// Subscribe returns a channel receiving the events with a sequence number
+// greater than fromSeq: first the events still in the history and then the
+// new events, without gaps. Use 0 to receive all the events in the history.
+// ErrHistoryTruncated is returned if some of the requested events have been
+// already discarded. A subscriber not consuming the channel doesn't block the
+// discoveries, but if it falls behind the history the channel is closed. The
+// channel is closed also when the context is done. The events of the ports not
+// selected by the protocol filter are dropped, see SetProtocolFilter. The
+// discoveries with SyncPolicyOnDemand are in sync mode while there are
+// subscribers, their events follow the subscription.
+func (m *Manager) Subscribe(ctx context.Context, fromSeq uint64) (<-chan *SequencedEvent, error) {
+	return m.View(m.getProtocolFilter()).Subscribe(ctx, fromSeq)
+}
+
+// subscribe delivers the events selected by the filter, see Manager.Subscribe.
+// The release function is called when the subscription ends.
+func (j *eventJournal) subscribe(ctx context.Context, fromSeq uint64, filter *ProtocolFilter, release func()) (<-chan *SequencedEvent, error) {
+	if _, _, err := j.since(fromSeq); err != nil {
+		release()
+		return nil, err
+	}
+	out := make(chan *SequencedEvent)
+	go func() {
+		defer release()
+		defer close(out)
+		cursor := fromSeq
+		for {
+			events, updated, err := j.since(cursor)
+			if err != nil {
+				return
+			}
+			for _, ev := range events {
+				if !filter.matchEvent(ev.Event) {
+					cursor = ev.Seq
+					continue
+				}
+				select {
+				case out <- ev:
+					cursor = ev.Seq
+				case <-ctx.Done():
+					return
+				}
+			}
+			if len(events) > 0 {
+				continue
+			}
+			select {
+			case <-updated:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// eventJournal keeps the history of the events received by the Manager and
+// the state of the ports resulting from them.
+type eventJournal struct {
+	mutex   sync.Mutex
+	size    int
+	events  []*SequencedEvent
+	lastSeq uint64
+	ports   map[string]map[string]*Port
+	// updated is closed, and replaced, each time an event is recorded
+	updated chan struct{}
+}
+
+func newEventJournal() *eventJournal {
+	return &eventJournal{
+		size:    defaultEventHistorySize,
+		ports:   map[string]map[string]*Port{},
+		updated: make(chan struct{}),
+	}
+}
+
+func (j *eventJournal) setSize(size int) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.size = max(size, 1)
+	j.trim()
+}
+
+func (j *eventJournal) trim() {
+	if excess := len(j.events) - j.size; excess > 0 {
+		j.events = append([]*SequencedEvent(nil), j.events[excess:]...)
+	}
+}
+
+func (j *eventJournal) record(ev *Event) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.lastSeq++
+	ev.ManagerSeq = j.lastSeq
+	j.events = append(j.events, &SequencedEvent{Seq: j.lastSeq, Event: ev})
+	j.trim()
+
+	switch ev.Type {
+	case EventTypeAdd:
+		if j.ports[ev.DiscoveryID] == nil {
+			j.ports[ev.DiscoveryID] = map[string]*Port{}
+		}
+		j.ports[ev.DiscoveryID][ev.Port.Protocol+"|"+ev.Port.Address] = ev.Port
+	case EventTypeRemove:
+		delete(j.ports[ev.DiscoveryID], ev.Port.Protocol+"|"+ev.Port.Address)
+	case EventTypeStop:
+		delete(j.ports, ev.DiscoveryID)
+	}
+
+	close(j.updated)
+	j.updated = make(chan struct{})
+}
+
+// discoveryPorts returns the ports currently reported by the discovery,
+// sorted by protocol and address.
+func (j *eventJournal) discoveryPorts(id string) []*Port {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	keys := []string{}
+	for key := range j.ports[id] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	res := []*Port{}
+	for _, key := range keys {
+		res = append(res, j.ports[id][key])
+	}
+	return res
+}
+
+// findPort returns the port with the given protocol and address currently
+// reported by a discovery, or nil if not found.
+func (j *eventJournal) findPort(protocol, address string) *Port {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for _, ports := range j.ports {
+		if port, ok := ports[protocol+"|"+address]; ok {
+			return port.Clone()
+		}
+	}
+	return nil
+}
+
+// since returns the events with a sequence number greater than seq and a
+// channel closed when a new event is recorded.
+func (j *eventJournal) since(seq uint64) ([]*SequencedEvent, <-chan struct{}, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if seq > j.lastSeq {
+		return nil, nil, fmt.Errorf("sequence number %d not yet reached", seq)
+	}
+	if seq == j.lastSeq {
+		return nil, j.updated, nil
+	}
+	// The events kept are consecutive, the oldest is the one following
+	// seq only if no event after seq has been discarded
+	first := j.events[0].Seq
+	if seq+1 < first {
+		return nil, nil, fmt.Errorf("%w: the oldest event available is %d", ErrHistoryTruncated, first)
+	}
+	return append([]*SequencedEvent(nil), j.events[seq+1-first:]...), j.updated, nil
+}
+
+func (j *eventJournal) snapshot() *ManagerSnapshot {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	snapshot := &ManagerSnapshot{
+		Seq:    j.lastSeq,
+		Ports:  []*Port{},
+		Events: append([]*SequencedEvent{}, j.events...),
+	}
+	ids := []string{}
+	for id := range j.ports {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		keys := []string{}
+		for key := range j.ports[id] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			snapshot.Ports = append(snapshot.Ports, j.ports[id][key].Clone())
+		}
+	}
+	return snapshot
+}
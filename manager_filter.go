@@ -0,0 +1,117 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"slices"
+)
+
+// ProtocolFilter selects the ports by protocol: a port is selected if its
+// protocol is in Allow (or Allow is empty) and it's not in Deny.
+type ProtocolFilter struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Match returns true if the given protocol is selected by the filter. A nil
+// filter selects all the protocols.
+func (f *ProtocolFilter) Match(protocol string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Allow) > 0 && !slices.Contains(f.Allow, protocol) {
+		return false
+	}
+	return !slices.Contains(f.Deny, protocol)
+}
+
+// matchEvent returns true if the event is selected by the filter, the events
+// without a port are always selected.
+func (f *ProtocolFilter) matchEvent(ev *Event) bool {
+	return ev.Port == nil || f.Match(ev.Port.Protocol)
+}
+
+// SetProtocolFilter sets the filter applied to the ports reported by the
+// Manager, in ListAll, Snapshot, Subscribe and Events: the ports, and the
+// events of the ports, not selected by the filter are dropped. Use View to
+// apply a different filter for a single consumer. A nil filter (the default)
+// selects all the ports.
+func (m *Manager) SetProtocolFilter(filter *ProtocolFilter) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	m.protocolFilter = filter
+}
+
+func (m *Manager) getProtocolFilter() *ProtocolFilter {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	return m.protocolFilter
+}
+
+// ManagerView is a view of the ports reported by a Manager with its own
+// ProtocolFilter, see Manager.View.
+type ManagerView struct {
+	m      *Manager
+	filter *ProtocolFilter
+}
+
+// View returns a view of the ports reported by the Manager applying the given
+// filter in place of the filter of the Manager (see SetProtocolFilter), for the
+// consumers interested in a different set of protocols. A nil filter selects
+// all the ports.
+func (m *Manager) View(filter *ProtocolFilter) *ManagerView {
+	return &ManagerView{m: m, filter: filter}
+}
+
+// ListAll is the same as Manager.ListAll, applying the filter of the view.
+func (v *ManagerView) ListAll() ([]*Port, map[string]error) {
+	ports, errs := v.m.listAll()
+	return filterPorts(ports, v.filter), errs
+}
+
+// Snapshot is the same as Manager.Snapshot, applying the filter of the view.
+// The sequence numbers of the events dropped by the filter are skipped.
+func (v *ManagerView) Snapshot() *ManagerSnapshot {
+	snapshot := v.m.journal.snapshot()
+	snapshot.Ports = filterPorts(snapshot.Ports, v.filter)
+	events := []*SequencedEvent{}
+	for _, ev := range snapshot.Events {
+		if v.filter.matchEvent(ev.Event) {
+			events = append(events, ev)
+		}
+	}
+	snapshot.Events = events
+	return snapshot
+}
+
+// Subscribe is the same as Manager.Subscribe, applying the filter of the view.
+// The sequence numbers of the events dropped by the filter are skipped.
+func (v *ManagerView) Subscribe(ctx context.Context, fromSeq uint64) (<-chan *SequencedEvent, error) {
+	return v.m.journal.subscribe(ctx, fromSeq, v.filter, v.m.addSubscriber())
+}
+
+func filterPorts(ports []*Port, filter *ProtocolFilter) []*Port {
+	res := []*Port{}
+	for _, port := range ports {
+		if filter.Match(port.Protocol) {
+			res = append(res, port)
+		}
+	}
+	return res
+}
@@ -0,0 +1,69 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// eventHooks are the hooks called for each event recorded by the Manager.
+type eventHooks struct {
+	mutex  sync.RWMutex
+	hooks  []func(*Event)
+	panics atomic.Uint64
+}
+
+// OnEvent adds a hook called synchronously for every event recorded by the
+// Manager (after the de-duplication, see SetDedupPolicy), whether there are
+// subscribers or not. The hooks are meant for audit logging and analytics:
+// they are called in the order they have been added, from the goroutines
+// receiving the events of the discoveries, so they must be fast and safe for
+// concurrent use, and must not modify the event. A panic in a hook is
+// recovered and counted (see HookPanics), so it doesn't affect the delivery
+// of the events.
+func (m *Manager) OnEvent(hook func(*Event)) {
+	m.hooks.mutex.Lock()
+	defer m.hooks.mutex.Unlock()
+	m.hooks.hooks = append(m.hooks.hooks, hook)
+}
+
+// HookPanics returns the number of panics recovered from the event hooks,
+// see OnEvent.
+func (m *Manager) HookPanics() uint64 {
+	return m.hooks.panics.Load()
+}
+
+// call calls all the hooks with the given event.
+func (h *eventHooks) call(ev *Event) {
+	h.mutex.RLock()
+	hooks := h.hooks
+	h.mutex.RUnlock()
+	for _, hook := range hooks {
+		h.callHook(hook, ev)
+	}
+}
+
+func (h *eventHooks) callHook(hook func(*Event), ev *Event) {
+	defer func() {
+		if recover() != nil {
+			h.panics.Add(1)
+		}
+	}()
+	hook(ev)
+}
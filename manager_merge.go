@@ -0,0 +1,128 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventOrdering is the strategy used by the Manager to merge the events of
+// the discoveries in a single sequence, see Manager.SetEventOrdering. With all
+// the strategies the events of each discovery keep the order they have been
+// sent by the discovery.
+type EventOrdering int
+
+const (
+	// EventOrderArrival numbers the events in the order they are received by
+	// the Manager: the relative order of the events of different discoveries
+	// received at the same time depends on the scheduling of the goroutines.
+	EventOrderArrival EventOrdering = iota
+	// EventOrderDeterministic collects the events received in a merge window,
+	// started by the first event received, and numbers them sorted by
+	// discovery ID, keeping the order of the events of each discovery: the
+	// bursts of events sent at the same time by different discoveries (for
+	// example the initial "add" events) always get the same order. The events
+	// are delayed by up to the merge window.
+	EventOrderDeterministic
+)
+
+// defaultMergeWindow is the merge window of EventOrderDeterministic, if not
+// specified.
+const defaultMergeWindow = 10 * time.Millisecond
+
+// SetEventOrdering sets the strategy used to merge the events of the
+// discoveries, EventOrderArrival by default. The window is the merge window of
+// EventOrderDeterministic, 10ms if zero. It must be called before StartSync.
+func (m *Manager) SetEventOrdering(ordering EventOrdering, window time.Duration) {
+	if window <= 0 {
+		window = defaultMergeWindow
+	}
+	m.merger.mutex.Lock()
+	defer m.merger.mutex.Unlock()
+	m.merger.ordering = ordering
+	m.merger.window = window
+}
+
+// eventMerger collects the events of the discoveries in the merge windows of
+// EventOrderDeterministic.
+type eventMerger struct {
+	mutex    sync.Mutex
+	ordering EventOrdering
+	window   time.Duration
+	pending  []*Event
+	// current is the number of the current merge window, a timer flushes
+	// the events only if its window is still open
+	current uint64
+	// recordMutex is held while the events of a window are recorded, it's
+	// acquired before releasing mutex so the windows are recorded in order
+	recordMutex sync.Mutex
+}
+
+// mergeEvent records the event received from a discovery, following the
+// event ordering strategy of the Manager.
+func (m *Manager) mergeEvent(ev *Event) {
+	m.discoveriesMutex.Lock()
+	clock := m.clock
+	m.discoveriesMutex.Unlock()
+
+	merger := &m.merger
+	merger.mutex.Lock()
+	if merger.ordering != EventOrderDeterministic {
+		merger.mutex.Unlock()
+		m.recordEvent(ev)
+		return
+	}
+	merger.pending = append(merger.pending, ev)
+	if len(merger.pending) == 1 {
+		merger.current++
+		window := merger.current
+		timeout := clock.After(merger.window)
+		go func() {
+			<-timeout
+			m.flushEvents(window)
+		}()
+	}
+	merger.mutex.Unlock()
+}
+
+// flushEvents records the events of the given merge window, if it's still
+// open, or of the current one if window is 0.
+func (m *Manager) flushEvents(window uint64) {
+	merger := &m.merger
+	merger.mutex.Lock()
+	if window != 0 && window != merger.current {
+		merger.mutex.Unlock()
+		return
+	}
+	events := merger.pending
+	merger.pending = nil
+	// The next event opens a new window
+	merger.current++
+	merger.recordMutex.Lock()
+	merger.mutex.Unlock()
+	defer merger.recordMutex.Unlock()
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].DiscoveryID < events[j].DiscoveryID
+	})
+	for _, ev := range events {
+		m.recordEvent(ev)
+	}
+}
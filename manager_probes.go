@@ -0,0 +1,64 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+)
+
+// Readiness returns the discoveries that are not ready, indexed by discovery
+// ID: a discovery is ready once it's running and it has answered the HELLO
+// command. The Manager is ready if the returned map is empty.
+func (m *Manager) Readiness() map[string]error {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	res := map[string]error{}
+	for id, disc := range m.discoveries {
+		if !disc.Alive() {
+			res[id] = errors.New("not running")
+		} else if disc.State() == StateUninitialized {
+			res[id] = errors.New("waiting for HELLO")
+		}
+	}
+	return res
+}
+
+// Liveness returns the discoveries that are not live, indexed by discovery ID:
+// a discovery is not live if it has been quarantined after a crash-loop (see
+// RestartPolicy), or if its process terminated unexpectedly and it's not going
+// to be restarted. The discoveries never run or quit on request are live. The
+// Manager is live if the returned map is empty.
+func (m *Manager) Liveness() map[string]error {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	res := map[string]error{}
+	for id, disc := range m.discoveries {
+		sup := m.supervisors[id]
+		if sup != nil && sup.quarantined {
+			res[id] = errors.New("quarantined after a crash-loop")
+			continue
+		}
+		if sup == nil && disc.processTerminated() != nil && !disc.Alive() && !disc.isQuitRequested() {
+			res[id] = errors.New("terminated unexpectedly")
+			if err := disc.terminationError(); err != nil {
+				res[id] = errors.New("terminated unexpectedly: " + err.Error())
+			}
+		}
+	}
+	return res
+}
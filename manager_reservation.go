@@ -0,0 +1,243 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrReservationExpired is returned by UploadReservation.Wait when the reserved
+// port has been removed and it has not reappeared before the reservation
+// expired.
+var ErrReservationExpired = errors.New("upload reservation expired")
+
+// ErrReservationReleased is returned by UploadReservation.Wait when the
+// reservation has been released while the reserved port was removed.
+var ErrReservationReleased = errors.New("upload reservation released")
+
+// UploadReservation marks a port as used by a critical operation, typically an
+// upload, see Manager.ReserveForUpload.
+type UploadReservation struct {
+	m        *Manager
+	port     *Port
+	stableID string
+	done     chan struct{}
+	// The following fields are guarded by the mutex of the reservations
+	// removed is true if the reserved port has been removed, its "remove"
+	// events are held in removals until the port reappears or its address
+	// is taken by another port.
+	removed  bool
+	taken    bool
+	removals []*Event
+	resolved *Port
+	err      error
+}
+
+// uploadReservations are the active UploadReservations of a Manager.
+type uploadReservations struct {
+	mutex  sync.Mutex
+	active []*UploadReservation
+}
+
+// ReserveForUpload reserves the given port, currently reported by a discovery
+// synced by the Manager, for an upload until the reservation is released or
+// the ttl expires. The boards reset during the upload (for example with the
+// 1200bps touch) disappear and reappear, often at a different address: while
+// the port is reserved its "remove" event is held back and, when the port
+// reappears, the reservation resolves to the new port, see
+// UploadReservation.Wait. The port reappeared is identified by its HardwareID,
+// or by its "serialNumber" property, if the reserved port has any, otherwise
+// it must reappear at the same address. If it reappears at the same address
+// the flapping is hidden to the subscribers, otherwise the held "remove" event
+// is delivered just before the "add" event of the new port. If another port
+// appears at the address of the reserved port, the held "remove" event is
+// delivered just before its "add" event. If the port doesn't reappear before
+// the ttl expires, the held "remove" event is delivered.
+func (m *Manager) ReserveForUpload(port *Port, ttl time.Duration) (*UploadReservation, error) {
+	current := m.journal.findPort(port.Protocol, port.Address)
+	if current == nil {
+		return nil, fmt.Errorf("port %s (protocol %s) not found", port.Address, port.Protocol)
+	}
+	r := &UploadReservation{
+		m:        m,
+		port:     current,
+		stableID: stablePortID(current),
+		done:     make(chan struct{}),
+	}
+	reservations := &m.reservations
+	reservations.mutex.Lock()
+	for _, other := range reservations.active {
+		if other.port.Protocol == current.Protocol && other.port.Address == current.Address {
+			reservations.mutex.Unlock()
+			return nil, fmt.Errorf("port %s (protocol %s) already reserved", port.Address, port.Protocol)
+		}
+	}
+	reservations.active = append(reservations.active, r)
+	reservations.mutex.Unlock()
+
+	m.discoveriesMutex.Lock()
+	expired := m.clock.After(ttl)
+	m.discoveriesMutex.Unlock()
+	go func() {
+		select {
+		case <-expired:
+			m.finishReservation(r, ErrReservationExpired)
+		case <-r.done:
+		}
+	}()
+	return r, nil
+}
+
+// Port returns the reserved port.
+func (r *UploadReservation) Port() *Port {
+	return r.port.Clone()
+}
+
+// Wait waits for the end of the reservation and returns the reserved port as
+// it reappeared, possibly with a different address. If the port has not been
+// removed during the reservation the reserved port is returned when the
+// reservation expires or it's released. If the port has been removed and it
+// doesn't reappear, ErrReservationExpired or ErrReservationReleased is
+// returned. The context error is returned if the context is done before.
+func (r *UploadReservation) Wait(ctx context.Context) (*Port, error) {
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	r.m.reservations.mutex.Lock()
+	defer r.m.reservations.mutex.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.resolved.Clone(), nil
+}
+
+// Release ends the reservation: if the port has been removed, and it has not
+// reappeared yet, the held "remove" event is delivered.
+func (r *UploadReservation) Release() {
+	r.m.finishReservation(r, ErrReservationReleased)
+}
+
+// finishReservation ends the reservation, if still active, and records the
+// "remove" events held. If the reserved port has been removed the reservation
+// fails with the given error, otherwise it resolves to the reserved port.
+func (m *Manager) finishReservation(r *UploadReservation, err error) {
+	m.reservations.mutex.Lock()
+	var removals []*Event
+	if !r.removed {
+		removals = m.reservations.finish(r, r.port, nil)
+	} else {
+		removals = m.reservations.finish(r, nil, err)
+	}
+	m.reservations.mutex.Unlock()
+	for _, ev := range removals {
+		m.mergeEvent(ev)
+	}
+}
+
+// finish ends the reservation, resolved to the given port or failed with the
+// given error, and returns the "remove" events held, if the reservation is
+// still active. The caller must hold the mutex.
+func (rs *uploadReservations) finish(r *UploadReservation, port *Port, err error) []*Event {
+	i := slices.Index(rs.active, r)
+	if i < 0 {
+		return nil
+	}
+	rs.active = slices.Delete(rs.active, i, i+1)
+	r.resolved = port
+	r.err = err
+	close(r.done)
+	return r.removals
+}
+
+// process applies the reservations to an event received from a discovery and
+// returns the resulting events.
+func (rs *uploadReservations) process(ev *Event) []*Event {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if ev.Port == nil || len(rs.active) == 0 {
+		return []*Event{ev}
+	}
+	for _, r := range rs.active {
+		sameAddress := ev.Port.Protocol == r.port.Protocol && ev.Port.Address == r.port.Address
+		switch ev.Type {
+		case EventTypeRemove:
+			if sameAddress && !r.taken {
+				r.removed = true
+				r.removals = append(r.removals, ev)
+				return nil
+			}
+		case EventTypeAdd:
+			if !r.matches(ev.Port) {
+				if sameAddress && r.removed && !r.taken {
+					// Another port takes the address of the reserved port,
+					// that is removed before its addition
+					r.taken = true
+					removals := r.removals
+					r.removals = nil
+					return append(removals, ev)
+				}
+				continue
+			}
+			if sameAddress && !r.removed {
+				// An update of the reserved port
+				continue
+			}
+			removals := rs.finish(r, ev.Port, nil)
+			if !sameAddress || r.taken {
+				return append(removals, ev)
+			}
+			if ev.Port.Equals(r.port) {
+				// The port is back as it was, the flapping is hidden
+				return nil
+			}
+			return []*Event{ev}
+		}
+	}
+	return []*Event{ev}
+}
+
+// matches returns true if the port is the reserved port, identified by its
+// stable identifier if any or by its address otherwise.
+func (r *UploadReservation) matches(port *Port) bool {
+	if port.Protocol != r.port.Protocol {
+		return false
+	}
+	if r.stableID != "" {
+		return stablePortID(port) == r.stableID
+	}
+	return port.Address == r.port.Address
+}
+
+// stablePortID returns the identifier of the port that doesn't change across
+// the resets of the board, or an empty string if unknown.
+func stablePortID(port *Port) string {
+	if port.HardwareID != "" {
+		return port.HardwareID
+	}
+	if port.Properties != nil {
+		return port.Properties.Get("serialNumber")
+	}
+	return ""
+}
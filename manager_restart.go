@@ -0,0 +1,290 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RestartPolicy configures the automatic restart of the discoveries that
+// terminate unexpectedly. If a discovery crashes MaxCrashes times within
+// CrashWindow it's considered in a crash-loop and it's quarantined: the
+// restarts are then retried with an exponential backoff, starting from
+// InitialBackoff and capped at MaxBackoff, until the discovery runs again
+// or it's re-enabled with Manager.Reenable. The exponential backoff may be
+// replaced by any other BackoffStrategy with the Backoff field.
+type RestartPolicy struct {
+	MaxCrashes     int
+	CrashWindow    time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Backoff        BackoffStrategy
+}
+
+// backoff returns the BackoffStrategy of the quarantined restarts.
+func (p *RestartPolicy) backoff() BackoffStrategy {
+	if p.Backoff != nil {
+		return p.Backoff
+	}
+	return &ExponentialBackoff{Initial: p.InitialBackoff, Max: p.MaxBackoff}
+}
+
+// DefaultRestartPolicy returns the default RestartPolicy.
+func DefaultRestartPolicy() *RestartPolicy {
+	return &RestartPolicy{
+		MaxCrashes:     3,
+		CrashWindow:    time.Minute,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+	}
+}
+
+// The types of HealthEvent
+const (
+	HealthEventCrashed     = "crashed"
+	HealthEventRestarted   = "restarted"
+	HealthEventQuarantined = "quarantined"
+	HealthEventReenabled   = "reenabled"
+	// HealthEventUnresponsive is emitted when a discovery fails to answer
+	// a ping, see SetPingInterval.
+	HealthEventUnresponsive = "unresponsive"
+)
+
+// HealthEvent is emitted by the Manager when the health status of a discovery changes.
+type HealthEvent struct {
+	Type        string
+	DiscoveryID string
+	Time        time.Time
+	// Err is the cause of the crash, of the failed restart or of the failed
+	// ping, if any.
+	Err error
+}
+
+// supervisor holds the restart status of a discovery, it's guarded
+// by the Manager discoveriesMutex.
+type supervisor struct {
+	crashes     []time.Time
+	quarantined bool
+	reenable    chan struct{}
+	stop        chan struct{}
+}
+
+// SetRestartPolicy enables the automatic restart of the discoveries that
+// terminate unexpectedly, using the given policy. A nil policy (the default)
+// disables the automatic restart. It must be called before Start.
+func (m *Manager) SetRestartPolicy(policy *RestartPolicy) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	m.restartPolicy = policy
+}
+
+// SetDiscoveryRestartPolicy sets the restart policy of the discovery with the
+// given ID, overriding the policy set with SetRestartPolicy. A nil policy removes
+// the override. It must be called before Start.
+func (m *Manager) SetDiscoveryRestartPolicy(id string, policy *RestartPolicy) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	if policy == nil {
+		delete(m.restartPolicies, id)
+		return
+	}
+	m.restartPolicies[id] = policy
+}
+
+// OnHealthEvent sets a callback that is called each time the health status of
+// a discovery changes. The callback is called from the goroutines supervising
+// the discoveries, so it must be safe for concurrent use and it should not block.
+func (m *Manager) OnHealthEvent(callback func(ev *HealthEvent)) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	m.healthCallback = callback
+}
+
+// Reenable removes a discovery from the quarantine and restarts it immediately.
+func (m *Manager) Reenable(id string) error {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	sup, ok := m.supervisors[id]
+	if !ok || !sup.quarantined {
+		return fmt.Errorf("discovery %s is not quarantined", id)
+	}
+	sup.quarantined = false
+	sup.crashes = nil
+	select {
+	case sup.reenable <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// supervise starts a goroutine that restarts the given discovery each time
+// its process terminates unexpectedly, according to its restart policy.
+// Does nothing if the restart policy is not set or the discovery is already
+// supervised.
+func (m *Manager) supervise(disc *Client) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	policy := m.restartPolicy
+	if override, ok := m.restartPolicies[disc.GetID()]; ok {
+		policy = override
+	}
+	if policy == nil {
+		return
+	}
+	if _, ok := m.supervisors[disc.GetID()]; ok {
+		return
+	}
+	sup := &supervisor{
+		reenable: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	m.supervisors[disc.GetID()] = sup
+	go m.superviseLoop(disc, sup, *policy)
+}
+
+// stopSupervisors stops all the goroutines supervising the discoveries.
+func (m *Manager) stopSupervisors() {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	for id, sup := range m.supervisors {
+		close(sup.stop)
+		delete(m.supervisors, id)
+	}
+}
+
+func (m *Manager) superviseLoop(disc *Client, sup *supervisor, policy RestartPolicy) {
+	for {
+		select {
+		case <-disc.processTerminated():
+		case <-sup.stop:
+			return
+		}
+		if disc.isQuitRequested() {
+			m.discoveriesMutex.Lock()
+			if m.supervisors[disc.GetID()] == sup {
+				delete(m.supervisors, disc.GetID())
+			}
+			m.discoveriesMutex.Unlock()
+			return
+		}
+
+		err := disc.terminationError()
+		backoff := policy.backoff()
+		retry := 0
+		for {
+			m.recordCrash(disc, sup, policy, err)
+
+			m.discoveriesMutex.Lock()
+			quarantined := sup.quarantined
+			m.discoveriesMutex.Unlock()
+			if quarantined {
+				select {
+				case <-m.clock.After(backoff.Delay(retry)):
+					retry++
+				case <-sup.reenable:
+					retry = 0
+					m.emitHealthEvent(HealthEventReenabled, disc, nil)
+				case <-sup.stop:
+					return
+				}
+			}
+
+			if err = m.restart(disc); err == nil {
+				break
+			}
+		}
+
+		m.discoveriesMutex.Lock()
+		sup.quarantined = false
+		m.discoveriesMutex.Unlock()
+		telemetry.count(&telemetry.restarts)
+		m.emitHealthEvent(HealthEventRestarted, disc, nil)
+	}
+}
+
+// recordCrash records a crash of the discovery and quarantines it if a
+// crash-loop is detected.
+func (m *Manager) recordCrash(disc *Client, sup *supervisor, policy RestartPolicy, err error) {
+	m.emitHealthEvent(HealthEventCrashed, disc, err)
+
+	m.discoveriesMutex.Lock()
+	now := m.clock.Now()
+	crashes := []time.Time{now}
+	for _, t := range sup.crashes {
+		if now.Sub(t) < policy.CrashWindow {
+			crashes = append(crashes, t)
+		}
+	}
+	sup.crashes = crashes
+	quarantine := !sup.quarantined && len(crashes) >= policy.MaxCrashes
+	if quarantine {
+		sup.quarantined = true
+	}
+	m.discoveriesMutex.Unlock()
+
+	if quarantine {
+		m.emitHealthEvent(HealthEventQuarantined, disc, err)
+	}
+}
+
+// restart runs the discovery again and brings it back to the mode of the
+// Manager: after StartSync the discovery is put in sync mode and its events
+// follow the ones of the crashed session, see StartSync.
+func (m *Manager) restart(disc *Client) error {
+	m.discoveriesMutex.Lock()
+	mode := m.mode
+	m.discoveriesMutex.Unlock()
+	if mode == StateSyncing {
+		if err := m.startSyncPolicy(disc); err != nil {
+			if disc.Alive() {
+				disc.Quit()
+			}
+			return err
+		}
+		return nil
+	}
+	if err := disc.Run(); err != nil {
+		return err
+	}
+	if err := disc.Start(); err != nil {
+		disc.Quit()
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) emitHealthEvent(eventType string, disc *Client, err error) {
+	m.discoveriesMutex.Lock()
+	callback := m.healthCallback
+	now := m.clock.Now()
+	m.discoveriesMutex.Unlock()
+	if callback == nil {
+		return
+	}
+	if err == nil && eventType == HealthEventCrashed {
+		err = errors.New("discovery process terminated")
+	}
+	callback(&HealthEvent{
+		Type:        eventType,
+		DiscoveryID: disc.GetID(),
+		Time:        now,
+		Err:         err,
+	})
+}
@@ -0,0 +1,160 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrDependencyNotStarted is returned, wrapped, for the discoveries that are
+// not started because one of their dependencies is missing or failed to
+// start, see DiscoveryStartup.
+var ErrDependencyNotStarted = errors.New("dependency not started")
+
+// DiscoveryStartup configures the startup of a discovery handled by a Manager,
+// for the discoveries that conflict if they are started at the same time (for
+// example two vendor discoveries scanning the USB bus). The discoveries are
+// started by Start, StartSync and WarmUp in ascending Priority: the discoveries
+// with the same priority are started in parallel, after all the discoveries
+// with a lower priority. A discovery is started only after all the discoveries
+// listed in DependsOn have been started successfully.
+type DiscoveryStartup struct {
+	Priority  int
+	DependsOn []string
+}
+
+// SetDiscoveryStartup sets the startup ordering of the discovery with the given
+// ID, see DiscoveryStartup. A nil startup removes the ordering: the discovery
+// is started with priority 0 and without dependencies. It must be called before
+// Start.
+func (m *Manager) SetDiscoveryStartup(id string, startup *DiscoveryStartup) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	if startup == nil {
+		delete(m.startups, id)
+		return
+	}
+	m.startups[id] = &DiscoveryStartup{
+		Priority:  startup.Priority,
+		DependsOn: append([]string(nil), startup.DependsOn...),
+	}
+}
+
+// startupOf returns the startup ordering of the discovery, the
+// discoveriesMutex must be held.
+func (m *Manager) startupOf(id string) *DiscoveryStartup {
+	if startup, ok := m.startups[id]; ok {
+		return startup
+	}
+	return &DiscoveryStartup{}
+}
+
+// checkDependencies returns an error if a dependency of the discovery is not
+// running, it's used to start the discoveries added at runtime.
+func (m *Manager) checkDependencies(id string) error {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	for _, dep := range m.startupOf(id).DependsOn {
+		if disc, ok := m.discoveries[dep]; !ok || !disc.Alive() {
+			return fmt.Errorf("starting discovery %s: %w: %s", id, ErrDependencyNotStarted, dep)
+		}
+	}
+	return nil
+}
+
+// forEachDiscoveryInOrder runs the given function on all the discoveries in
+// the startup order (see DiscoveryStartup) and returns the errors indexed by
+// discovery ID. The discoveries are run in rounds: each round runs in parallel
+// the discoveries with the lowest priority among the ones still pending, whose
+// dependencies have been already run. The function is not run on a discovery
+// if one of its dependencies failed.
+func (m *Manager) forEachDiscoveryInOrder(f func(disc *Client) error) map[string]error {
+	m.discoveriesMutex.Lock()
+	pending := []*Client{}
+	startups := map[string]*DiscoveryStartup{}
+	for id, disc := range m.discoveries {
+		pending = append(pending, disc)
+		startups[id] = m.startupOf(id)
+	}
+	m.discoveriesMutex.Unlock()
+	sort.Slice(pending, func(i, j int) bool {
+		return startups[pending[i].GetID()].Priority < startups[pending[j].GetID()].Priority
+	})
+
+	errs := map[string]error{}
+	completed := map[string]bool{}
+	for len(pending) > 0 {
+		priority := startups[pending[0].GetID()].Priority
+		round := []*Client{}
+		waiting := []*Client{}
+		for _, disc := range pending {
+			id := disc.GetID()
+			if startups[id].Priority != priority {
+				waiting = append(waiting, disc)
+				continue
+			}
+			blocked := false
+			for _, dep := range startups[id].DependsOn {
+				if _, ok := startups[dep]; !ok {
+					errs[id] = fmt.Errorf("starting discovery %s: %w: %s not found", id, ErrDependencyNotStarted, dep)
+					break
+				}
+				if errs[dep] != nil {
+					errs[id] = fmt.Errorf("starting discovery %s: %w: %s", id, ErrDependencyNotStarted, dep)
+					break
+				}
+				blocked = blocked || !completed[dep]
+			}
+			switch {
+			case errs[id] != nil:
+				completed[id] = true
+			case !blocked:
+				round = append(round, disc)
+			default:
+				waiting = append(waiting, disc)
+			}
+		}
+		if len(round) == 0 && len(waiting) == len(pending) {
+			// The discoveries with the lowest priority depend on each
+			// other, or on discoveries with a higher priority
+			for _, disc := range waiting {
+				if startups[disc.GetID()].Priority == priority {
+					errs[disc.GetID()] = fmt.Errorf("starting discovery %s: %w: dependency cycle", disc, ErrDependencyNotStarted)
+					completed[disc.GetID()] = true
+				}
+			}
+		}
+
+		roundErrs := forEachClient(round, f)
+		for _, disc := range round {
+			if err, ok := roundErrs[disc.GetID()]; ok {
+				errs[disc.GetID()] = err
+			}
+			completed[disc.GetID()] = true
+		}
+		pending = pending[:0]
+		for _, disc := range waiting {
+			if !completed[disc.GetID()] {
+				pending = append(pending, disc)
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,194 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// managerStateVersion is the version of the format of the state documents
+// written by Manager.ExportState.
+const managerStateVersion = 1
+
+// ManagerState is the state of a Manager as serialized by ExportState: the
+// ports detected, the health of the discoveries and the recent history of the
+// events.
+type ManagerState struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// Seq is the sequence number of the last event received by the Manager.
+	Seq         uint64             `json:"seq"`
+	Discoveries []*DiscoveryHealth `json:"discoveries"`
+	// Ports are the ports currently detected, indexed by discovery ID. The
+	// static ports have discovery ID StaticDiscoveryID.
+	Ports  map[string][]*Port `json:"ports"`
+	Events []*StateEvent      `json:"events"`
+}
+
+// StateEvent is an event of the history of a Manager, see ManagerState.
+type StateEvent struct {
+	Seq         uint64          `json:"seq"`
+	Type        string          `json:"type"`
+	DiscoveryID string          `json:"discoveryId"`
+	Port        *Port           `json:"port,omitempty"`
+	Message     string          `json:"message,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+// ExportState writes to w the state of the Manager as a JSON document: the
+// ports currently detected, the health of the discoveries and the recent
+// history of the events. The document can be loaded in another Manager with
+// ImportState to reproduce the state offline, for example from a "discovery
+// state dump" collected from a user.
+func (m *Manager) ExportState(w io.Writer) error {
+	m.discoveriesMutex.Lock()
+	now := m.clock.Now()
+	m.discoveriesMutex.Unlock()
+
+	state := &ManagerState{
+		Version:     managerStateVersion,
+		Time:        now,
+		Discoveries: m.Health(),
+	}
+	state.Seq, state.Ports, state.Events = m.journal.dump()
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(state); err != nil {
+		return fmt.Errorf("writing manager state: %w", err)
+	}
+	return nil
+}
+
+// ImportState replaces the ports and the history of the events of the Manager
+// with the ones of a document written by ExportState: they are available with
+// Snapshot and Subscribe, and the static ports are restored too. The health of
+// the exported discoveries is reported by Health for the IDs not handled by the
+// Manager. The Manager must not be running, see Start and StartSync.
+func (m *Manager) ImportState(r io.Reader) error {
+	state := &ManagerState{}
+	if err := json.NewDecoder(r).Decode(state); err != nil {
+		return fmt.Errorf("reading manager state: %w", err)
+	}
+	if state.Version != managerStateVersion {
+		return fmt.Errorf("unsupported manager state version: %d", state.Version)
+	}
+	// The history must be made of consecutive events up to the last one
+	last := uint64(0)
+	for i, ev := range state.Events {
+		if i > 0 && ev.Seq != last+1 {
+			return fmt.Errorf("invalid manager state: event %d follows event %d", ev.Seq, last)
+		}
+		last = ev.Seq
+	}
+	if last != state.Seq {
+		return fmt.Errorf("invalid manager state: the last event is %d instead of %d", last, state.Seq)
+	}
+
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	if m.mode != StateUninitialized {
+		return errors.New("can not import the state of a running manager")
+	}
+	m.staticPorts = map[string]*Port{}
+	for _, port := range state.Ports[StaticDiscoveryID] {
+		m.staticPorts[port.Protocol+"|"+port.Address] = port.Clone()
+	}
+	m.imported = state.Discoveries
+	m.journal.restore(state.Seq, state.Ports, state.Events)
+	return nil
+}
+
+// importedHealth returns the health of the imported discoveries not handled
+// by the Manager, see ImportState. The discoveriesMutex must be held.
+func (m *Manager) importedHealth() []*DiscoveryHealth {
+	res := []*DiscoveryHealth{}
+	for _, health := range m.imported {
+		if _, ok := m.discoveries[health.ID]; !ok {
+			h := *health
+			res = append(res, &h)
+		}
+	}
+	return res
+}
+
+// dump returns the last sequence number, the ports indexed by discovery ID and
+// the history of the events.
+func (j *eventJournal) dump() (uint64, map[string][]*Port, []*StateEvent) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	ports := map[string][]*Port{}
+	for id, discoveryPorts := range j.ports {
+		keys := []string{}
+		for key := range discoveryPorts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ports[id] = append(ports[id], discoveryPorts[key].Clone())
+		}
+	}
+	events := []*StateEvent{}
+	for _, ev := range j.events {
+		events = append(events, &StateEvent{
+			Seq:         ev.Seq,
+			Type:        ev.Event.Type,
+			DiscoveryID: ev.Event.DiscoveryID,
+			Port:        ev.Event.Port.Clone(),
+			Message:     ev.Event.Message,
+			Payload:     ev.Event.Payload,
+		})
+	}
+	return j.lastSeq, ports, events
+}
+
+// restore replaces the state of the journal, see dump.
+func (j *eventJournal) restore(seq uint64, ports map[string][]*Port, events []*StateEvent) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.lastSeq = seq
+	j.ports = map[string]map[string]*Port{}
+	for id, discoveryPorts := range ports {
+		j.ports[id] = map[string]*Port{}
+		for _, port := range discoveryPorts {
+			j.ports[id][port.Protocol+"|"+port.Address] = port.Clone()
+		}
+	}
+	j.events = []*SequencedEvent{}
+	for _, ev := range events {
+		j.events = append(j.events, &SequencedEvent{
+			Seq: ev.Seq,
+			Event: &Event{
+				Type:        ev.Type,
+				Port:        ev.Port,
+				DiscoveryID: ev.DiscoveryID,
+				Message:     ev.Message,
+				ManagerSeq:  ev.Seq,
+				Payload:     ev.Payload,
+			},
+		})
+	}
+	j.trim()
+
+	close(j.updated)
+	j.updated = make(chan struct{})
+}
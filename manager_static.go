@@ -0,0 +1,80 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// StaticDiscoveryID is the reserved discovery ID of the ports added to the
+// Manager with AddStaticPort, it can not be used by a discovery.
+const StaticDiscoveryID = "static"
+
+// AddStaticPort adds a manually configured port (for example a fixed network
+// address from the user settings) to the ports reported by the Manager: the port
+// is returned by ListAll and it's delivered as an "add" event, with discovery ID
+// StaticDiscoveryID, to the subscribers (see Subscribe). Adding a port with the
+// same address and protocol of a static port replaces it.
+func (m *Manager) AddStaticPort(port *Port) error {
+	if port == nil || port.Address == "" || port.Protocol == "" {
+		return errors.New("static port must have an address and a protocol")
+	}
+	port = port.Clone()
+	m.discoveriesMutex.Lock()
+	m.staticPorts[port.Protocol+"|"+port.Address] = port
+	m.discoveriesMutex.Unlock()
+	m.journal.record(&Event{Type: EventTypeAdd, Port: port, DiscoveryID: StaticDiscoveryID})
+	return nil
+}
+
+// RemoveStaticPort removes the static port with the given address and protocol,
+// see AddStaticPort. A "remove" event is delivered to the subscribers.
+func (m *Manager) RemoveStaticPort(address, protocol string) error {
+	key := protocol + "|" + address
+	m.discoveriesMutex.Lock()
+	_, ok := m.staticPorts[key]
+	delete(m.staticPorts, key)
+	m.discoveriesMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("static port %s (%s) not found", address, protocol)
+	}
+	m.journal.record(&Event{
+		Type:        EventTypeRemove,
+		Port:        &Port{Address: address, Protocol: protocol},
+		DiscoveryID: StaticDiscoveryID,
+	})
+	return nil
+}
+
+// staticPortsList returns a copy of the static ports, sorted by protocol and address.
+func (m *Manager) staticPortsList() []*Port {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	keys := []string{}
+	for key := range m.staticPorts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	res := []*Port{}
+	for _, key := range keys {
+		res = append(res, m.staticPorts[key].Clone())
+	}
+	return res
+}
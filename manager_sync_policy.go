@@ -0,0 +1,130 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+// SyncPolicy declares when a discovery handled by a Manager is put in sync
+// mode, see Manager.SetSyncPolicy.
+type SyncPolicy int
+
+const (
+	// SyncPolicyAuto puts the discovery in sync mode as soon as the Manager
+	// is synced, see StartSync.
+	SyncPolicyAuto SyncPolicy = iota
+	// SyncPolicyOnDemand only starts the discovery when the Manager is
+	// synced, so its ports are available to ListAll, and puts it in sync mode
+	// when the first subscriber appears (see Subscribe): it's stopped again
+	// when the last subscriber is gone. It's meant for the discoveries
+	// expensive to keep in sync mode, like the network scanners, reducing the
+	// idle CPU usage when nobody is watching the ports.
+	SyncPolicyOnDemand
+)
+
+// SetSyncPolicy sets the sync policy of the discovery with the given ID,
+// SyncPolicyAuto by default. It must be called before StartSync.
+func (m *Manager) SetSyncPolicy(id string, policy SyncPolicy) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	if policy == SyncPolicyAuto {
+		delete(m.syncPolicies, id)
+		return
+	}
+	m.syncPolicies[id] = policy
+}
+
+// syncOnDemand returns true if the discovery must be kept only started while
+// the Manager is synced, because its sync policy is SyncPolicyOnDemand and
+// there are no subscribers. The discoveriesMutex must be held.
+func (m *Manager) syncOnDemand(id string) bool {
+	return m.syncPolicies[id] == SyncPolicyOnDemand && m.subscribers == 0
+}
+
+// startSyncPolicy brings the discovery to the mode required by its sync policy
+// while the Manager is synced: in sync mode, or only started.
+func (m *Manager) startSyncPolicy(disc *Client) error {
+	m.discoveriesMutex.Lock()
+	onDemand := m.syncOnDemand(disc.GetID())
+	m.discoveriesMutex.Unlock()
+	if !onDemand {
+		return m.startSyncDiscovery(disc)
+	}
+	if disc.State() == StateSyncing {
+		if err := disc.Stop(); err != nil {
+			return err
+		}
+		m.discoveriesMutex.Lock()
+		done := m.syncs[disc.GetID()]
+		m.discoveriesMutex.Unlock()
+		if done != nil {
+			// The final "stop" event is recorded before the discovery leaves
+			// the sync mode
+			<-done
+		}
+	}
+	return m.startDiscovery(disc)
+}
+
+// addSubscriber records a new subscriber of the Manager, until the returned
+// function is called: the discoveries with SyncPolicyOnDemand are put in sync
+// mode while there are subscribers.
+func (m *Manager) addSubscriber() func() {
+	m.discoveriesMutex.Lock()
+	m.subscribers++
+	first := m.subscribers == 1
+	m.discoveriesMutex.Unlock()
+	if first {
+		go m.applySyncPolicies()
+	}
+	return func() {
+		m.discoveriesMutex.Lock()
+		m.subscribers--
+		last := m.subscribers == 0
+		m.discoveriesMutex.Unlock()
+		if last {
+			go m.applySyncPolicies()
+		}
+	}
+}
+
+// applySyncPolicies brings the discoveries with SyncPolicyOnDemand to the mode
+// required by the current subscribers, if the Manager is synced. The
+// transitions are serialized, so the discoveries end in the mode required by
+// the last change of the subscribers.
+func (m *Manager) applySyncPolicies() {
+	m.syncPoliciesMutex.Lock()
+	defer m.syncPoliciesMutex.Unlock()
+	m.discoveriesMutex.Lock()
+	if m.mode != StateSyncing {
+		m.discoveriesMutex.Unlock()
+		return
+	}
+	onDemand := []*Client{}
+	for id, policy := range m.syncPolicies {
+		if disc, ok := m.discoveries[id]; ok && policy == SyncPolicyOnDemand {
+			onDemand = append(onDemand, disc)
+		}
+	}
+	m.discoveriesMutex.Unlock()
+	forEachClient(onDemand, func(disc *Client) error {
+		if !disc.Alive() {
+			// Failed to start, or restarting: the supervisor brings it to the
+			// required mode
+			return nil
+		}
+		return m.startSyncPolicy(disc)
+	})
+}
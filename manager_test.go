@@ -0,0 +1,990 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/arduino/go-properties-orderedmap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagerHealth(t *testing.T) {
+	m := NewManager()
+	require.NoError(t, m.Add(NewClient("b")))
+	require.NoError(t, m.Add(NewClient("a")))
+	require.Error(t, m.Add(NewClient("a")))
+	require.Equal(t, []string{"a", "b"}, m.IDs())
+
+	m.discoveries["a"].lastHeartbeat = time.Now().Add(-time.Minute)
+	m.discoveries["b"].lastHeartbeat = time.Now()
+	m.SetHeartbeatTimeout(10 * time.Second)
+
+	health := m.Health()
+	require.Len(t, health, 2)
+	require.Equal(t, "a", health[0].ID)
+	require.False(t, health[0].Alive)
+	require.True(t, health[0].Stale)
+	require.Equal(t, "b", health[1].ID)
+	require.False(t, health[1].Stale)
+
+	m.SetHeartbeatTimeout(0)
+	require.False(t, m.Health()[0].Stale)
+}
+
+func TestManagerListAll(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	dummy := NewClient("dummy", "dummy-discovery/dummy-discovery")
+	missing := NewClient("missing", "dummy-discovery/not-existent-discovery")
+	m := NewManager()
+	require.NoError(t, m.Add(dummy))
+	require.NoError(t, m.Add(missing))
+	defer dummy.Quit()
+
+	errs := m.Start()
+	require.Len(t, errs, 1)
+	require.Error(t, errs["missing"])
+
+	time.Sleep(100 * time.Millisecond)
+	ports, errs := m.ListAll()
+	require.Len(t, errs, 1)
+	require.Error(t, errs["missing"])
+	require.Len(t, ports, 2)
+	for _, port := range ports {
+		require.Equal(t, "dummy", port.Protocol)
+	}
+}
+
+func TestManagerRestartPolicy(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	clock := NewManualClock(time.Now())
+	crashing := NewClient("crashing", "dummy-discovery/dummy-discovery", "-k")
+	m := NewManager()
+	m.SetClock(clock)
+	m.SetRestartPolicy(&RestartPolicy{
+		MaxCrashes:     2,
+		CrashWindow:    time.Minute,
+		InitialBackoff: time.Hour,
+		MaxBackoff:     time.Hour,
+	})
+	events := make(chan *HealthEvent, 100)
+	m.OnHealthEvent(func(ev *HealthEvent) { events <- ev })
+	require.NoError(t, m.Add(crashing))
+	defer func() {
+		m.stopSupervisors()
+		crashing.Quit()
+	}()
+	require.Empty(t, m.Start())
+
+	waitEvent := func(eventType string) *HealthEvent {
+		for {
+			select {
+			case ev := <-events:
+				require.Equal(t, "crashing", ev.DiscoveryID)
+				if ev.Type == eventType {
+					return ev
+				}
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "health event not received", eventType)
+			}
+		}
+	}
+
+	// First crash: restarted immediately
+	require.Error(t, waitEvent(HealthEventCrashed).Err)
+	waitEvent(HealthEventRestarted)
+
+	// Second crash: quarantined, the restart waits for the backoff
+	waitEvent(HealthEventQuarantined)
+	require.True(t, m.Health()[0].Quarantined)
+	require.Error(t, m.Reenable("missing"))
+
+	require.NoError(t, m.Reenable("crashing"))
+	waitEvent(HealthEventReenabled)
+	waitEvent(HealthEventRestarted)
+	require.False(t, m.Health()[0].Quarantined)
+	require.Error(t, m.Reenable("crashing"))
+}
+
+func TestManagerQuitAll(t *testing.T) {
+	for _, dir := range []string{"dummy-discovery", "testdata/netcat"} {
+		builder, err := paths.NewProcess(nil, "go", "build")
+		require.NoError(t, err)
+		builder.SetDir(dir)
+		require.NoError(t, builder.Run())
+	}
+
+	// netcat never answers to the QUIT command
+	listener, err := net.ListenTCP("tcp", nil)
+	require.NoError(t, err)
+	stuck := NewClient("stuck", "testdata/netcat/netcat", listener.Addr().String())
+	require.NoError(t, stuck.runProcess())
+	listener.SetDeadline(time.Now().Add(time.Second))
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	dummy := NewClient("dummy", "dummy-discovery/dummy-discovery")
+	m := NewManager()
+	m.SetQuitTimeout(200 * time.Millisecond)
+	require.NoError(t, m.Add(dummy))
+	require.NoError(t, m.Add(stuck))
+	require.NoError(t, m.Add(NewClient("idle", "dummy-discovery/dummy-discovery")))
+	require.NoError(t, dummy.Run())
+
+	start := time.Now()
+	err = m.QuitAll(context.Background())
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "discovery stuck did not quit")
+	require.NotContains(t, err.Error(), "dummy")
+	require.False(t, dummy.Alive())
+	require.False(t, stuck.Alive())
+}
+
+func TestManagerLoadConfig(t *testing.T) {
+	var cfg ManagerConfig
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"discoveries": [
+			{
+				"id": "serial",
+				"command": "serial-discovery",
+				"args": ["-v"],
+				"env": ["DEBUG=1"],
+				"restart": { "maxCrashes": 5, "maxBackoff": "10s" },
+				"debounce": "500ms",
+				"filters": [
+					{ "protocols": ["serial"], "properties": { "vid": "0x2341" } }
+				],
+				"startParams": { "excludePorts": "/dev/ttyS*" }
+			},
+			{ "id": "mdns", "command": "mdns-discovery", "priority": 1, "dependsOn": ["serial"] }
+		],
+		"startParams": { "interfaces": "eth0", "excludePorts": "none" }
+	}`), &cfg))
+
+	m := NewManager()
+	require.NoError(t, m.LoadConfig(&cfg))
+	require.Equal(t, []string{"mdns", "serial"}, m.IDs())
+
+	serial := m.discoveries["serial"]
+	require.Equal(t, []string{"serial-discovery", "-v"}, serial.processArgs)
+	require.Equal(t, []string{"DEBUG=1"}, serial.env)
+	require.Equal(t, 500*time.Millisecond, serial.debounce)
+	require.True(t, serial.portFilter(&Port{Protocol: "serial", Properties: properties.NewFromHashmap(map[string]string{"vid": "0x2341"})}))
+	require.False(t, serial.portFilter(&Port{Protocol: "serial", Properties: properties.NewFromHashmap(map[string]string{"vid": "0x1234"})}))
+	require.False(t, serial.portFilter(&Port{Protocol: "network"}))
+	policy := m.restartPolicies["serial"]
+	require.Equal(t, 5, policy.MaxCrashes)
+	require.Equal(t, 10*time.Second, policy.MaxBackoff)
+	require.Equal(t, time.Second, policy.InitialBackoff)
+	require.Nil(t, m.discoveries["mdns"].portFilter)
+	require.Equal(t, map[string]string{"interfaces": "eth0", "excludePorts": "/dev/ttyS*"}, serial.startParams)
+	require.Equal(t, map[string]string{"interfaces": "eth0", "excludePorts": "none"}, m.discoveries["mdns"].startParams)
+	require.Equal(t, &DiscoveryStartup{Priority: 1, DependsOn: []string{"serial"}}, m.startups["mdns"])
+	require.NotContains(t, m.startups, "serial")
+
+	// Invalid configurations don't modify the Manager
+	err := m.LoadConfig(&ManagerConfig{Discoveries: []*DiscoveryConfig{
+		{ID: "new", Command: "new-discovery"},
+		{ID: "serial", Command: "serial-discovery"},
+		{ID: "bad", Command: "bad-discovery", Debounce: "forever"},
+		{ID: "", Command: "missing-id"},
+	}})
+	require.ErrorContains(t, err, "discovery 'serial': duplicate discovery ID")
+	require.ErrorContains(t, err, "discovery 'bad': invalid debounce")
+	require.ErrorContains(t, err, "discovery '': missing discovery ID")
+	require.Equal(t, []string{"mdns", "serial"}, m.IDs())
+}
+
+func TestManagerSnapshotAndSubscribe(t *testing.T) {
+	m := NewManager()
+	m.SetEventHistorySize(2)
+	require.NoError(t, m.Add(NewInProcessClient("inprocess", "test-inprocess")))
+	defer m.QuitAll(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live, err := m.Subscribe(ctx, 0)
+	require.NoError(t, err)
+	_, err = m.Subscribe(ctx, 1)
+	require.Error(t, err)
+
+	recv := func(events <-chan *SequencedEvent) *SequencedEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			require.FailNow(t, "event not received")
+			return nil
+		}
+	}
+
+	require.Empty(t, m.StartSync())
+	ev := recv(live)
+	require.Equal(t, uint64(1), ev.Seq)
+	require.Equal(t, EventTypeAdd, ev.Event.Type)
+	require.Equal(t, "inprocess", ev.Event.DiscoveryID)
+	require.Equal(t, uint64(1), ev.Event.ManagerSeq)
+	require.Equal(t, uint64(1), ev.Event.Seq)
+	snapshot := m.Snapshot()
+	require.Equal(t, uint64(1), snapshot.Seq)
+	require.Len(t, snapshot.Ports, 1)
+
+	// A new sync session follows the previous one, the events are kept in order
+	require.Empty(t, m.StartSync())
+	require.Len(t, m.Snapshot().Ports, 1)
+	disc := m.discoveries["inprocess"]
+	require.NoError(t, disc.Stop())
+	require.Empty(t, m.StartSync())
+	require.Equal(t, EventTypeStop, recv(live).Event.Type)
+	ev = recv(live)
+	require.Equal(t, uint64(3), ev.Seq)
+	require.Equal(t, EventTypeAdd, ev.Event.Type)
+
+	snapshot = m.Snapshot()
+	require.Equal(t, uint64(3), snapshot.Seq)
+	require.Len(t, snapshot.Ports, 1)
+	require.Len(t, snapshot.Events, 2)
+	require.Equal(t, uint64(2), snapshot.Events[0].Seq)
+
+	// A reconnecting subscriber resumes the stream from the history
+	_, err = m.Subscribe(ctx, 0)
+	require.ErrorIs(t, err, ErrHistoryTruncated)
+	resumed, err := m.Subscribe(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), recv(resumed).Seq)
+	require.Equal(t, uint64(3), recv(resumed).Seq)
+
+	cancel()
+	for range live {
+	}
+}
+
+func TestManagerStaticPorts(t *testing.T) {
+	m := NewManager()
+	require.Error(t, m.Add(NewClient(StaticDiscoveryID)))
+	require.NoError(t, m.Add(NewInProcessClient("inprocess", "test-inprocess")))
+	defer m.QuitAll(context.Background())
+	require.Empty(t, m.Start())
+
+	require.Error(t, m.AddStaticPort(&Port{Address: "192.168.1.10"}))
+	static := &Port{Address: "192.168.1.10", Protocol: "network", AddressLabel: "My board"}
+	require.NoError(t, m.AddStaticPort(static))
+	static.AddressLabel = "changed"
+
+	ports, errs := m.ListAll()
+	require.Empty(t, errs)
+	require.Len(t, ports, 2)
+	require.Equal(t, "inprocess", ports[0].Protocol)
+	require.Equal(t, "My board", ports[1].AddressLabel)
+
+	// The static ports are delivered in the event stream of the Manager
+	snapshot := m.Snapshot()
+	require.Len(t, snapshot.Ports, 1)
+	require.Equal(t, StaticDiscoveryID, snapshot.Events[0].Event.DiscoveryID)
+	events, err := m.Subscribe(context.Background(), snapshot.Seq)
+	require.NoError(t, err)
+	require.NoError(t, m.RemoveStaticPort("192.168.1.10", "network"))
+	ev := <-events
+	require.Equal(t, EventTypeRemove, ev.Event.Type)
+	require.Equal(t, StaticDiscoveryID, ev.Event.DiscoveryID)
+	require.Error(t, m.RemoveStaticPort("192.168.1.10", "network"))
+	require.Empty(t, m.Snapshot().Ports)
+
+	ports, _ = m.ListAll()
+	require.Len(t, ports, 1)
+}
+
+func TestManagerProtocolFilter(t *testing.T) {
+	filter := &ProtocolFilter{Allow: []string{"serial", "network"}, Deny: []string{"network"}}
+	require.True(t, filter.Match("serial"))
+	require.False(t, filter.Match("network"))
+	require.False(t, filter.Match("dfu"))
+	require.True(t, (*ProtocolFilter)(nil).Match("dfu"))
+
+	m := NewManager()
+	require.NoError(t, m.LoadConfig(&ManagerConfig{
+		Discoveries: []*DiscoveryConfig{{ID: "inprocess", InProcess: "test-inprocess"}},
+		Protocols:   &ProtocolFilter{Deny: []string{"inprocess"}},
+	}))
+	defer m.QuitAll(context.Background())
+	require.NoError(t, m.AddStaticPort(&Port{Address: "1", Protocol: "network"}))
+	require.Empty(t, m.StartSync())
+
+	// Each consumer may see a different set of protocols
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all, err := m.View(nil).Subscribe(ctx, 0)
+	require.NoError(t, err)
+	filtered, err := m.Subscribe(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, "network", (<-filtered).Event.Port.Protocol)
+	require.Equal(t, "network", (<-all).Event.Port.Protocol)
+	require.Equal(t, "inprocess", (<-all).Event.Port.Protocol)
+
+	require.Len(t, m.Snapshot().Ports, 1)
+	require.Len(t, m.View(nil).Snapshot().Ports, 2)
+	require.Len(t, m.View(&ProtocolFilter{Allow: []string{"inprocess"}}).Snapshot().Ports, 1)
+
+	m.SetProtocolFilter(nil)
+	require.Len(t, m.Snapshot().Ports, 2)
+}
+
+func TestManagerDedup(t *testing.T) {
+	m := NewManager()
+	m.SetDedupPolicy(&DedupPolicy{Priority: []string{"vendor"}})
+	serial := func(id, label string) *Event {
+		return &Event{Type: EventTypeAdd, Port: &Port{Address: "/dev/ttyACM0", Protocol: "serial", AddressLabel: label}, DiscoveryID: id}
+	}
+	remove := func(id string) *Event {
+		return &Event{Type: EventTypeRemove, Port: &Port{Address: "/dev/ttyACM0", Protocol: "serial"}, DiscoveryID: id}
+	}
+	types := func(events []*Event) []string {
+		res := []string{}
+		for _, ev := range events {
+			res = append(res, ev.Type+" "+ev.DiscoveryID)
+		}
+		return res
+	}
+
+	// The first discovery reporting the port owns it
+	require.Equal(t, []string{"add generic"}, types(m.recordEvent(serial("generic", "generic"))))
+	require.Equal(t, []string{"add other"}, types(m.recordEvent(&Event{Type: EventTypeAdd, Port: &Port{Address: "1", Protocol: "network"}, DiscoveryID: "other"})))
+	require.Empty(t, m.recordEvent(serial("other", "other")))
+	// The discovery with priority takes the port over
+	require.Equal(t, []string{"remove generic", "add vendor"}, types(m.recordEvent(serial("vendor", "vendor"))))
+	require.Empty(t, m.recordEvent(remove("generic")))
+	require.Equal(t, uint64(2), m.SuppressedDuplicates())
+	snapshot := m.Snapshot()
+	require.Len(t, snapshot.Ports, 2)
+	require.Equal(t, "vendor", snapshot.Ports[1].AddressLabel)
+
+	// When the owner stops, the port passes to the next discovery
+	events := m.recordEvent(&Event{Type: EventTypeStop, DiscoveryID: "vendor"})
+	require.Equal(t, []string{"stop vendor", "add other"}, types(events))
+	require.Equal(t, "other", events[1].Port.AddressLabel)
+	require.Equal(t, []string{"remove other"}, types(m.recordEvent(remove("other"))))
+	require.Len(t, m.Snapshot().Ports, 1)
+
+	// The duplicated ports are removed from ListAll
+	m = NewManager()
+	require.NoError(t, m.LoadConfig(&ManagerConfig{
+		Discoveries: []*DiscoveryConfig{
+			{ID: "a", InProcess: "test-inprocess"},
+			{ID: "b", InProcess: "test-inprocess"},
+		},
+		Dedup: &DedupPolicy{Priority: []string{"b"}},
+	}))
+	defer m.QuitAll(context.Background())
+	require.Empty(t, m.Start())
+	ports, errs := m.ListAll()
+	require.Empty(t, errs)
+	require.Len(t, ports, 1)
+	m.SetDedupPolicy(nil)
+	ports, _ = m.ListAll()
+	require.Len(t, ports, 2)
+}
+
+func TestManagerWarmUp(t *testing.T) {
+	m := NewManager()
+	require.NoError(t, m.LoadConfig(&ManagerConfig{Discoveries: []*DiscoveryConfig{
+		{ID: "a", InProcess: "test-inprocess"},
+		{ID: "b", InProcess: "test-inprocess"},
+		{ID: "missing", Command: "not-existent-discovery"},
+	}}))
+	defer m.QuitAll(context.Background())
+
+	// Without a warm-up WaitReady returns immediately
+	errs, err := m.WaitReady(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, errs)
+
+	ready := make(chan string, 3)
+	m.OnReady(func(id string, err error) {
+		if err != nil {
+			id += " failed"
+		}
+		ready <- id
+	})
+	m.WarmUp()
+	errs, err = m.WaitReady(context.Background())
+	require.NoError(t, err)
+	require.Len(t, errs, 1)
+	require.Error(t, errs["missing"])
+	close(ready)
+	ids := []string{}
+	for id := range ready {
+		ids = append(ids, id)
+	}
+	require.ElementsMatch(t, []string{"a", "b", "missing failed"}, ids)
+	require.Equal(t, StateStarted, m.discoveries["a"].State())
+
+	ports, errs := m.ListAll()
+	require.Len(t, errs, 1)
+	require.Len(t, ports, 2)
+
+	// Start leaves the warmed-up discoveries untouched
+	require.Len(t, m.Start(), 1)
+
+	// The warmed-up discoveries can be put in sync mode
+	errs = m.StartSync()
+	require.Len(t, errs, 1)
+	require.Equal(t, StateSyncing, m.discoveries["b"].State())
+}
+
+func TestManagerEventHooks(t *testing.T) {
+	m := NewManager()
+	m.SetDedupPolicy(&DedupPolicy{})
+	events := []string{}
+	m.OnEvent(func(ev *Event) { panic("bad hook") })
+	m.OnEvent(func(ev *Event) { events = append(events, ev.Type+" "+ev.DiscoveryID) })
+
+	// The hooks are called for the events recorded, even without subscribers
+	add := func(id string) *Event {
+		return &Event{Type: EventTypeAdd, Port: &Port{Address: "1", Protocol: "serial"}, DiscoveryID: id}
+	}
+	m.recordEvent(add("a"))
+	m.recordEvent(add("b"))
+	m.recordEvent(&Event{Type: EventTypeStop, DiscoveryID: "a"})
+	require.Equal(t, []string{"add a", "stop a", "add b"}, events)
+	require.Equal(t, uint64(3), m.HookPanics())
+	require.Equal(t, uint64(3), m.Snapshot().Seq)
+
+	// The events of the synced discoveries reach the hooks
+	m = NewManager()
+	received := make(chan *Event, 10)
+	m.OnEvent(func(ev *Event) { received <- ev })
+	require.NoError(t, m.Add(NewInProcessClient("inprocess", "test-inprocess")))
+	defer m.QuitAll(context.Background())
+	require.Empty(t, m.StartSync())
+	ev := <-received
+	require.Equal(t, EventTypeAdd, ev.Type)
+	require.Equal(t, "inprocess", ev.DiscoveryID)
+	require.Equal(t, uint64(1), ev.ManagerSeq)
+}
+
+func TestManagerProbes(t *testing.T) {
+	m := NewManager()
+	require.NoError(t, m.Add(NewInProcessClient("inprocess", "test-inprocess")))
+	defer m.QuitAll(context.Background())
+
+	// The discoveries never run are live but not ready
+	require.Equal(t, map[string]error{"inprocess": errors.New("not running")}, m.Readiness())
+	require.Empty(t, m.Liveness())
+
+	require.Empty(t, m.Start())
+	require.Empty(t, m.Readiness())
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// A discovery terminated unexpectedly is not live
+	legacy := NewClient("legacy", "sh", "-c", legacyDiscoveryScript)
+	require.NoError(t, m.Add(legacy))
+	require.NoError(t, legacy.Run())
+	require.Empty(t, m.Readiness())
+	legacy.statusMutex.Lock()
+	require.NoError(t, legacy.process.Process.Kill())
+	legacy.statusMutex.Unlock()
+	<-legacy.processTerminated()
+	require.Contains(t, m.Liveness(), "legacy")
+	require.ErrorContains(t, m.Liveness()["legacy"], "terminated unexpectedly")
+
+	// A discovery quit on request is live
+	require.NoError(t, legacy.Run())
+	legacy.Quit()
+	require.Empty(t, m.Liveness())
+}
+
+func TestManagerAddRemoveAtRuntime(t *testing.T) {
+	m := NewManager()
+	require.NoError(t, m.Add(NewInProcessClient("inprocess", "test-inprocess")))
+	defer m.QuitAll(context.Background())
+	require.Empty(t, m.StartSync())
+	require.Eventually(t, func() bool { return len(m.Snapshot().Ports) == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live, err := m.Subscribe(ctx, m.Snapshot().Seq)
+	require.NoError(t, err)
+	recv := func() *Event {
+		select {
+		case ev := <-live:
+			return ev.Event
+		case <-time.After(time.Second):
+			require.FailNow(t, "event not received")
+			return nil
+		}
+	}
+
+	// The discovery added while syncing is put in sync mode
+	require.NoError(t, m.Add(NewInProcessClient("payload", "test-payload")))
+	for _, address := range []string{"1", "2", "3"} {
+		ev := recv()
+		require.Equal(t, EventTypeAdd, ev.Type)
+		require.Equal(t, "payload", ev.DiscoveryID)
+		require.Equal(t, address, ev.Port.Address)
+	}
+	require.Equal(t, []string{"inprocess", "payload"}, m.IDs())
+
+	// The ports of the removed discovery are removed before the stop
+	require.NoError(t, m.Remove("payload"))
+	for _, address := range []string{"1", "2", "3"} {
+		ev := recv()
+		require.Equal(t, EventTypeRemove, ev.Type)
+		require.Equal(t, address, ev.Port.Address)
+	}
+	require.Equal(t, EventTypeStop, recv().Type)
+	require.Equal(t, []string{"inprocess"}, m.IDs())
+	require.Len(t, m.Snapshot().Ports, 1)
+	require.Error(t, m.Remove("payload"))
+
+	// A discovery removed while not syncing is just quit
+	disc := NewInProcessClient("other", "test-inprocess")
+	require.NoError(t, m.Add(disc))
+	require.NoError(t, m.QuitAll(context.Background()))
+	require.NoError(t, m.Add(NewInProcessClient("idle", "test-inprocess")))
+	require.False(t, m.discoveries["idle"].Alive())
+	require.NoError(t, m.Remove("idle"))
+}
+
+func TestManagerFirstEnumeration(t *testing.T) {
+	isClosed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// The first enumeration ends after the quiet period
+	m := NewManager()
+	m.SetEnumerationPolicy(&EnumerationPolicy{QuietPeriod: 50 * time.Millisecond})
+	require.NoError(t, m.Add(NewInProcessClient("payload", "test-payload")))
+	require.NoError(t, m.Add(NewClient("missing", "non-existent-discovery")))
+	defer m.QuitAll(context.Background())
+	_, err := m.FirstEnumerationDone("unknown")
+	require.Error(t, err)
+	done, err := m.FirstEnumerationDone("payload")
+	require.NoError(t, err)
+	require.False(t, isClosed(done))
+	require.Len(t, m.StartSync(), 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, m.WaitFirstEnumeration(ctx))
+	require.Len(t, m.Snapshot().Ports, 3)
+	require.True(t, isClosed(done))
+
+	// The first enumeration is bounded by the timeout
+	clock := NewManualClock(time.Now())
+	m = NewManager()
+	m.SetClock(clock)
+	m.SetEnumerationPolicy(&EnumerationPolicy{Timeout: 2 * time.Second})
+	require.NoError(t, m.Add(NewInProcessClient("inprocess", "test-inprocess")))
+	defer m.QuitAll(context.Background())
+	done, err = m.FirstEnumerationDone("inprocess")
+	require.NoError(t, err)
+	require.Empty(t, m.StartSync())
+	require.Eventually(t, func() bool { return len(m.Snapshot().Ports) == 1 }, time.Second, time.Millisecond)
+	require.False(t, isClosed(done))
+	require.Eventually(t, func() bool {
+		clock.Advance(time.Second)
+		return isClosed(done)
+	}, time.Second, 10*time.Millisecond)
+
+	// The quiet period starts with the first event: a discovery without ports
+	// is waited until the timeout
+	clock = NewManualClock(time.Now())
+	quiet := NewManager()
+	quiet.SetClock(clock)
+	quiet.SetEnumerationPolicy(&EnumerationPolicy{Timeout: 2 * time.Second, QuietPeriod: 100 * time.Millisecond})
+	require.NoError(t, quiet.Add(NewInProcessClient("burst", "test-burst")))
+	defer quiet.QuitAll(context.Background())
+	done, err = quiet.FirstEnumerationDone("burst")
+	require.NoError(t, err)
+	require.Empty(t, quiet.StartSync())
+	require.Eventually(t, func() bool { return clock.PendingTimers() > 0 }, time.Second, time.Millisecond)
+	clock.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	require.False(t, isClosed(done))
+	clock.Advance(time.Second)
+	require.Eventually(t, func() bool { return isClosed(done) }, time.Second, time.Millisecond)
+
+	// The first enumeration of a removed discovery is done
+	require.NoError(t, m.Remove("inprocess"))
+	m.SetEnumerationPolicy(&EnumerationPolicy{})
+	require.NoError(t, m.Add(NewInProcessClient("other", "test-inprocess")))
+	done, err = m.FirstEnumerationDone("other")
+	require.NoError(t, err)
+	require.False(t, isClosed(done))
+	require.NoError(t, m.Remove("other"))
+	require.True(t, isClosed(done))
+}
+
+func TestManagerExportImportState(t *testing.T) {
+	m := NewManager()
+	require.NoError(t, m.Add(NewInProcessClient("inprocess", "test-inprocess")))
+	require.NoError(t, m.AddStaticPort(&Port{Address: "192.168.1.10", Protocol: "network"}))
+	require.Empty(t, m.StartSync())
+	require.Eventually(t, func() bool { return m.Snapshot().Seq == 2 }, time.Second, 10*time.Millisecond)
+
+	var dump bytes.Buffer
+	require.NoError(t, m.ExportState(&dump))
+	require.Error(t, m.ImportState(bytes.NewReader(dump.Bytes())))
+	require.NoError(t, m.QuitAll(context.Background()))
+
+	imported := NewManager()
+	require.NoError(t, imported.ImportState(bytes.NewReader(dump.Bytes())))
+	snapshot := imported.Snapshot()
+	require.Equal(t, uint64(2), snapshot.Seq)
+	require.Len(t, snapshot.Ports, 2)
+	require.Len(t, snapshot.Events, 2)
+	require.Equal(t, StaticDiscoveryID, snapshot.Events[0].Event.DiscoveryID)
+	require.Equal(t, "inprocess", snapshot.Events[1].Event.DiscoveryID)
+	health := imported.Health()
+	require.Len(t, health, 1)
+	require.Equal(t, "inprocess", health[0].ID)
+	require.True(t, health[0].Alive)
+	ports, errs := imported.ListAll()
+	require.Empty(t, errs)
+	require.Len(t, ports, 1)
+	require.Equal(t, "192.168.1.10", ports[0].Address)
+
+	// The subscribers resume the stream from the imported history
+	events, err := imported.Subscribe(context.Background(), 1)
+	require.NoError(t, err)
+	require.NoError(t, imported.RemoveStaticPort("192.168.1.10", "network"))
+	require.Equal(t, uint64(2), (<-events).Seq)
+	require.Equal(t, uint64(3), (<-events).Seq)
+
+	require.Error(t, NewManager().ImportState(strings.NewReader(`{"version":1,"seq":3,"events":[{"seq":1}]}`)))
+	require.Error(t, NewManager().ImportState(strings.NewReader(`{"version":2}`)))
+}
+
+func TestManagerSyncRestart(t *testing.T) {
+	m := NewManager()
+	m.SetRestartPolicy(DefaultRestartPolicy())
+	restarted := make(chan struct{}, 10)
+	m.OnHealthEvent(func(ev *HealthEvent) {
+		if ev.Type == HealthEventRestarted {
+			restarted <- struct{}{}
+		}
+	})
+	require.NoError(t, m.Add(NewInProcessClient("inprocess", "test-inprocess")))
+	defer m.QuitAll(context.Background())
+
+	sub, err := m.Watch(0)
+	require.NoError(t, err)
+	defer sub.Close()
+	recv := func() *Event {
+		select {
+		case ev := <-sub.Events():
+			return ev
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "event not received")
+			return nil
+		}
+	}
+
+	require.Empty(t, m.StartSync())
+	require.Equal(t, EventTypeAdd, recv().Type)
+
+	// The crash of the discovery doesn't interrupt the stream: the ports are
+	// removed and added again after the restart
+	disc := m.discoveries["inprocess"]
+	disc.statusMutex.Lock()
+	disc.inProcess.messages.Close()
+	disc.statusMutex.Unlock()
+	ev := recv()
+	require.Equal(t, EventTypeRemove, ev.Type)
+	require.Equal(t, uint64(2), ev.ManagerSeq)
+	ev = recv()
+	require.Equal(t, EventTypeAdd, ev.Type)
+	require.Equal(t, uint64(3), ev.ManagerSeq)
+	<-restarted
+	require.Equal(t, StateSyncing, disc.State())
+	require.Len(t, m.Snapshot().Ports, 1)
+	require.Nil(t, sub.Err())
+}
+
+func TestManagerStartupOrder(t *testing.T) {
+	m := NewManager()
+	for _, id := range []string{"serial", "vendor1", "vendor2", "network", "cloud", "broken", "cycle1", "cycle2"} {
+		require.NoError(t, m.Add(NewClient(id)))
+	}
+	m.SetDiscoveryStartup("network", &DiscoveryStartup{Priority: 1})
+	m.SetDiscoveryStartup("cloud", &DiscoveryStartup{Priority: 1, DependsOn: []string{"network"}})
+	m.SetDiscoveryStartup("vendor2", &DiscoveryStartup{DependsOn: []string{"vendor1"}})
+	m.SetDiscoveryStartup("broken", &DiscoveryStartup{DependsOn: []string{"missing"}})
+	m.SetDiscoveryStartup("cycle1", &DiscoveryStartup{Priority: 2, DependsOn: []string{"cycle2"}})
+	m.SetDiscoveryStartup("cycle2", &DiscoveryStartup{Priority: 2, DependsOn: []string{"cycle1"}})
+
+	// The discoveries completed before the start of each discovery
+	completedBefore := map[string][]string{}
+	completed := []string{}
+	mutex := sync.Mutex{}
+	errs := m.forEachDiscoveryInOrder(func(disc *Client) error {
+		mutex.Lock()
+		completedBefore[disc.GetID()] = append([]string{}, completed...)
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		completed = append(completed, disc.GetID())
+		mutex.Unlock()
+		return nil
+	})
+	require.Len(t, errs, 3)
+	require.ErrorIs(t, errs["broken"], ErrDependencyNotStarted)
+	require.ErrorContains(t, errs["broken"], "missing not found")
+	require.ErrorContains(t, errs["cycle1"], "dependency cycle")
+	require.ErrorContains(t, errs["cycle2"], "dependency cycle")
+	require.Len(t, completed, 5)
+	require.NotContains(t, completedBefore["serial"], "vendor1")
+	require.NotContains(t, completedBefore["vendor1"], "serial")
+	require.ElementsMatch(t, []string{"serial", "vendor1"}, completedBefore["vendor2"])
+	require.ElementsMatch(t, []string{"serial", "vendor1", "vendor2"}, completedBefore["network"])
+	require.Contains(t, completedBefore["cloud"], "network")
+
+	// A failed dependency prevents the start of the dependents
+	m.SetDiscoveryStartup("broken", nil)
+	errs = m.forEachDiscoveryInOrder(func(disc *Client) error {
+		if disc.GetID() == "network" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	require.Len(t, errs, 4)
+	require.ErrorIs(t, errs["cloud"], ErrDependencyNotStarted)
+}
+
+func TestManagerEventOrdering(t *testing.T) {
+	event := func(eventType, id, address string) *Event {
+		return &Event{Type: eventType, Port: &Port{Address: address, Protocol: id}, DiscoveryID: id}
+	}
+	recorded := func(m *Manager) []string {
+		res := []string{}
+		for _, ev := range m.Snapshot().Events {
+			res = append(res, ev.Event.Type+" "+ev.Event.DiscoveryID+ev.Event.Port.Address)
+		}
+		return res
+	}
+
+	clock := NewManualClock(time.Now())
+	for run := 0; run < 10; run++ {
+		m := NewManager()
+		m.SetClock(clock)
+		m.SetEventOrdering(EventOrderDeterministic, time.Second)
+
+		// The bursts of events of the discoveries are merged in the same
+		// order, whatever the order they are received
+		var wg sync.WaitGroup
+		for _, id := range []string{"c", "a", "b"} {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				for _, address := range []string{"1", "2", "3"} {
+					m.mergeEvent(event(EventTypeAdd, id, address))
+				}
+			}(id)
+		}
+		wg.Wait()
+		require.Empty(t, recorded(m))
+		clock.Advance(time.Second)
+		require.Eventually(t, func() bool { return m.Snapshot().Seq == 9 }, time.Second, time.Millisecond)
+		require.Equal(t, []string{
+			"add a1", "add a2", "add a3",
+			"add b1", "add b2", "add b3",
+			"add c1", "add c2", "add c3",
+		}, recorded(m))
+
+		// The events of the next window follow
+		m.mergeEvent(event(EventTypeRemove, "b", "1"))
+		m.mergeEvent(event(EventTypeRemove, "a", "2"))
+		clock.Advance(time.Second)
+		require.Eventually(t, func() bool { return m.Snapshot().Seq == 11 }, time.Second, time.Millisecond)
+		require.Equal(t, []string{"remove a2", "remove b1"}, recorded(m)[9:])
+
+		// The removal of the ports of a discovery closes the window
+		m.mergeEvent(event(EventTypeAdd, "c", "4"))
+		m.removeDiscoveryPorts(NewClient("c"))
+		clock.Advance(time.Second)
+		require.Eventually(t, func() bool { return m.Snapshot().Seq == 16 }, time.Second, time.Millisecond)
+		require.Equal(t, []string{"add c4", "remove c1", "remove c2", "remove c3", "remove c4"}, recorded(m)[11:])
+		require.Len(t, m.Snapshot().Ports, 4)
+	}
+
+	// By default the events are recorded as they are received
+	m := NewManager()
+	m.mergeEvent(event(EventTypeAdd, "b", "1"))
+	m.mergeEvent(event(EventTypeAdd, "a", "1"))
+	require.Equal(t, []string{"add b1", "add a1"}, recorded(m))
+}
+
+func TestManagerSyncPolicy(t *testing.T) {
+	m := NewManager()
+	require.NoError(t, m.Add(NewInProcessClient("inprocess", "test-inprocess")))
+	require.NoError(t, m.Add(NewInProcessClient("payload", "test-payload")))
+	m.SetSyncPolicy("payload", SyncPolicyOnDemand)
+	defer m.QuitAll(context.Background())
+
+	// The discovery on demand is only started while nobody is watching
+	require.Empty(t, m.StartSync())
+	require.Eventually(t, func() bool { return len(m.Snapshot().Ports) == 1 }, time.Second, time.Millisecond)
+	onDemand := m.discoveries["payload"]
+	require.Equal(t, StateStarted, onDemand.State())
+	ports, err := onDemand.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 3)
+
+	// The first subscriber puts it in sync mode
+	ctx, cancel := context.WithCancel(context.Background())
+	live, err := m.Subscribe(ctx, m.Snapshot().Seq)
+	require.NoError(t, err)
+	for _, address := range []string{"1", "2", "3"} {
+		select {
+		case ev := <-live:
+			require.Equal(t, EventTypeAdd, ev.Event.Type)
+			require.Equal(t, "payload", ev.Event.DiscoveryID)
+			require.Equal(t, address, ev.Event.Port.Address)
+		case <-time.After(time.Second):
+			require.FailNow(t, "event not received")
+		}
+	}
+	require.Equal(t, StateSyncing, onDemand.State())
+
+	// The last subscriber gone, it's stopped again
+	cancel()
+	for range live {
+	}
+	require.Eventually(t, func() bool { return onDemand.State() == StateStarted }, time.Second, time.Millisecond)
+	require.Len(t, m.Snapshot().Ports, 1)
+	require.Equal(t, StateSyncing, m.discoveries["inprocess"].State())
+}
+
+func TestManagerReserveForUpload(t *testing.T) {
+	m := NewManager()
+	clock := NewManualClock(time.Now())
+	m.SetClock(clock)
+	board := func(address, pid string) *Port {
+		props := properties.NewMap()
+		props.Set("pid", pid)
+		props.Set("serialNumber", "ABC123")
+		return &Port{Address: address, Protocol: "serial", Properties: props}
+	}
+	event := func(eventType string, port *Port) *Event {
+		return &Event{Type: eventType, Port: port, DiscoveryID: "serial"}
+	}
+	types := func(events []*Event) []string {
+		res := []string{}
+		for _, ev := range events {
+			res = append(res, ev.Type+" "+ev.Port.Address)
+		}
+		return res
+	}
+	m.recordEvent(event(EventTypeAdd, board("/dev/ttyACM0", "0x8036")))
+	_, err := m.ReserveForUpload(&Port{Address: "/dev/ttyACM9", Protocol: "serial"}, time.Minute)
+	require.Error(t, err)
+
+	// The board reappears at the same address: the flapping is hidden
+	r, err := m.ReserveForUpload(&Port{Address: "/dev/ttyACM0", Protocol: "serial"}, time.Minute)
+	require.NoError(t, err)
+	_, err = m.ReserveForUpload(&Port{Address: "/dev/ttyACM0", Protocol: "serial"}, time.Minute)
+	require.Error(t, err)
+	require.Empty(t, m.recordEvent(event(EventTypeRemove, board("/dev/ttyACM0", "0x8036"))))
+	require.Len(t, m.Snapshot().Ports, 1)
+	require.Empty(t, m.recordEvent(event(EventTypeAdd, board("/dev/ttyACM0", "0x8036"))))
+	port, err := r.Wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "/dev/ttyACM0", port.Address)
+
+	// The bootloader appears at another address
+	r, err = m.ReserveForUpload(board("/dev/ttyACM0", "0x8036"), time.Minute)
+	require.NoError(t, err)
+	require.Empty(t, m.recordEvent(event(EventTypeRemove, board("/dev/ttyACM0", "0x8036"))))
+	require.Equal(t, []string{"add /dev/ttyACM5"}, types(m.recordEvent(event(EventTypeAdd, &Port{Address: "/dev/ttyACM5", Protocol: "serial"}))))
+	require.Equal(t, []string{"remove /dev/ttyACM0", "add /dev/ttyACM1"}, types(m.recordEvent(event(EventTypeAdd, board("/dev/ttyACM1", "0x0036")))))
+	port, err = r.Wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "/dev/ttyACM1", port.Address)
+	require.Equal(t, "0x0036", port.Properties.Get("pid"))
+
+	// The board doesn't come back: the removal is delivered on expiry
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live, err := m.Subscribe(ctx, m.Snapshot().Seq)
+	require.NoError(t, err)
+	r, err = m.ReserveForUpload(board("/dev/ttyACM1", "0x0036"), time.Minute)
+	require.NoError(t, err)
+	require.Empty(t, m.recordEvent(event(EventTypeRemove, board("/dev/ttyACM1", "0x0036"))))
+	clock.Advance(time.Minute)
+	_, err = r.Wait(context.Background())
+	require.ErrorIs(t, err, ErrReservationExpired)
+	select {
+	case ev := <-live:
+		require.Equal(t, EventTypeRemove, ev.Event.Type)
+		require.Equal(t, "/dev/ttyACM1", ev.Event.Port.Address)
+	case <-time.After(time.Second):
+		require.FailNow(t, "remove event not received")
+	}
+
+	// Another device takes the address of the reserved port: the held removal
+	// is delivered before its addition, the following events pass through
+	m.recordEvent(event(EventTypeAdd, board("/dev/ttyACM1", "0x0036")))
+	r, err = m.ReserveForUpload(board("/dev/ttyACM1", "0x0036"), time.Minute)
+	require.NoError(t, err)
+	require.Empty(t, m.recordEvent(event(EventTypeRemove, board("/dev/ttyACM1", "0x0036"))))
+	other := &Port{Address: "/dev/ttyACM1", Protocol: "serial", Properties: properties.NewMap()}
+	other.Properties.Set("serialNumber", "XYZ789")
+	require.Equal(t, []string{"remove /dev/ttyACM1", "add /dev/ttyACM1"}, types(m.recordEvent(event(EventTypeAdd, other))))
+	require.Equal(t, []string{"remove /dev/ttyACM1"}, types(m.recordEvent(event(EventTypeRemove, other))))
+	require.Equal(t, []string{"add /dev/ttyACM1"}, types(m.recordEvent(event(EventTypeAdd, other))))
+	clock.Advance(time.Minute)
+	_, err = r.Wait(context.Background())
+	require.ErrorIs(t, err, ErrReservationExpired)
+	ports := m.Snapshot().Ports
+	require.Len(t, ports, 2)
+	require.Equal(t, "XYZ789", ports[0].Properties.Get("serialNumber"))
+
+	// A port not reset during the upload is resolved to itself
+	r, err = m.ReserveForUpload(&Port{Address: "/dev/ttyACM5", Protocol: "serial"}, time.Minute)
+	require.NoError(t, err)
+	r.Release()
+	port, err = r.Wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "/dev/ttyACM5", port.Address)
+}
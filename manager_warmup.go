@@ -0,0 +1,96 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+)
+
+// warmup is a warm-up of the discoveries in progress, see Manager.WarmUp.
+type warmup struct {
+	done chan struct{}
+	errs map[string]error
+}
+
+// OnReady sets a callback that is called by WarmUp each time a discovery is
+// ready, or failed to start with the given error. The callback is called from
+// the goroutines starting the discoveries, so it must be safe for concurrent
+// use. It must be called before WarmUp.
+func (m *Manager) OnReady(callback func(id string, err error)) {
+	m.discoveriesMutex.Lock()
+	defer m.discoveriesMutex.Unlock()
+	m.readyCallback = callback
+}
+
+// WarmUp starts all the discoveries in background, like Start, and returns
+// immediately: the discoveries are spawned, and the HELLO and START commands
+// are sent, in the startup order (see SetDiscoveryStartup), while the
+// application completes its own startup. Use WaitReady to wait until all the
+// discoveries are ready, ListAll waits for it automatically. WarmUp does
+// nothing if a warm-up is already in progress.
+func (m *Manager) WarmUp() {
+	m.discoveriesMutex.Lock()
+	if m.warmup != nil && !m.warmup.isDone() {
+		m.discoveriesMutex.Unlock()
+		return
+	}
+	w := &warmup{done: make(chan struct{})}
+	m.warmup = w
+	callback := m.readyCallback
+	m.discoveriesMutex.Unlock()
+
+	go func() {
+		w.errs = m.forEachDiscoveryInOrder(func(disc *Client) error {
+			err := m.startDiscovery(disc)
+			if callback != nil {
+				callback(disc.GetID(), err)
+			}
+			return err
+		})
+		close(w.done)
+	}()
+}
+
+// WaitReady waits until the warm-up started with WarmUp is completed, or the
+// context is done, and returns the errors of the discoveries that failed to
+// start, indexed by discovery ID. If no warm-up has been started it returns
+// immediately.
+func (m *Manager) WaitReady(ctx context.Context) (map[string]error, error) {
+	m.discoveriesMutex.Lock()
+	w := m.warmup
+	m.discoveriesMutex.Unlock()
+	if w == nil {
+		return map[string]error{}, nil
+	}
+	select {
+	case <-w.done:
+		return w.errs, nil
+	case <-ctx.Done():
+		return nil, errors.Join(errors.New("waiting for the discoveries warm-up"), ctx.Err())
+	}
+}
+
+func (w *warmup) isDone() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
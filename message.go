@@ -17,19 +17,18 @@
 
 package discovery
 
-type message struct {
-	EventType       string   `json:"eventType"`
-	Message         string   `json:"message,omitempty"`
-	Error           bool     `json:"error,omitempty"`
-	ProtocolVersion int      `json:"protocolVersion,omitempty"`
-	Port            *Port    `json:"port,omitempty"`
-	Ports           *[]*Port `json:"ports,omitempty"`
+func messageOk(event string) *message {
+	return &message{
+		EventType: event,
+		Message:   "OK",
+	}
 }
 
-func messageOk(event string) *message {
+func messageOkWithNote(event, note string) *message {
 	return &message{
 		EventType: event,
 		Message:   "OK",
+		Note:      note,
 	}
 }
 
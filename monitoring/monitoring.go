@@ -0,0 +1,122 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package monitoring exposes over HTTP, and with expvar, the telemetry
+// counters of the discovery package (see discovery.EnableTelemetry) and the
+// readiness and liveness probes of a discovery.Manager. It's a separate
+// package so the applications not exposing them don't depend on net/http and
+// expvar, that registers its handler on http.DefaultServeMux when imported.
+package monitoring
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// TelemetryVarName is the name of the expvar variable publishing the
+// telemetry counters, see PublishTelemetry.
+const TelemetryVarName = "discovery"
+
+// TelemetryHandlerPath is the path of the HTTP handler registered by
+// RegisterTelemetryHandler.
+const TelemetryHandlerPath = "/debug/discovery"
+
+// The paths of the HTTP handlers registered by RegisterProbeHandlers.
+const (
+	ReadinessHandlerPath = "/readyz"
+	LivenessHandlerPath  = "/livez"
+)
+
+var publishTelemetry sync.Once
+
+// PublishTelemetry enables the telemetry and publishes the counters with
+// expvar, under the name TelemetryVarName.
+func PublishTelemetry() {
+	discovery.EnableTelemetry()
+	publishTelemetry.Do(func() {
+		expvar.Publish(TelemetryVarName, expvar.Func(func() any { return discovery.Telemetry() }))
+	})
+}
+
+// TelemetryHandler returns an HTTP handler serving the telemetry counters
+// in JSON format.
+func TelemetryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(discovery.Telemetry())
+	})
+}
+
+// RegisterTelemetryHandler enables the telemetry and registers the
+// TelemetryHandler on the given mux at TelemetryHandlerPath.
+func RegisterTelemetryHandler(mux *http.ServeMux) {
+	discovery.EnableTelemetry()
+	mux.Handle(TelemetryHandlerPath, TelemetryHandler())
+}
+
+// ProbeReport is the JSON body of the responses of the readiness and liveness
+// HTTP handlers.
+type ProbeReport struct {
+	// OK is true if all the discoveries passed the check.
+	OK bool `json:"ok"`
+	// Failures are the reasons of the failed checks, indexed by discovery ID.
+	Failures map[string]string `json:"failures,omitempty"`
+}
+
+// ReadinessHandler returns an HTTP handler reporting the Readiness of the
+// Manager: the status is 200 if the Manager is ready, 503 otherwise, the body
+// is a ProbeReport in JSON format.
+func ReadinessHandler(m *discovery.Manager) http.Handler {
+	return probeHandler(m.Readiness)
+}
+
+// LivenessHandler returns an HTTP handler reporting the Liveness of the
+// Manager: the status is 200 if the Manager is live, 503 otherwise, the body
+// is a ProbeReport in JSON format.
+func LivenessHandler(m *discovery.Manager) http.Handler {
+	return probeHandler(m.Liveness)
+}
+
+// RegisterProbeHandlers registers the ReadinessHandler and the LivenessHandler
+// of the Manager on the given mux at ReadinessHandlerPath and
+// LivenessHandlerPath.
+func RegisterProbeHandlers(mux *http.ServeMux, m *discovery.Manager) {
+	mux.Handle(ReadinessHandlerPath, ReadinessHandler(m))
+	mux.Handle(LivenessHandlerPath, LivenessHandler(m))
+}
+
+func probeHandler(check func() map[string]error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errs := check()
+		report := &ProbeReport{OK: len(errs) == 0}
+		if len(errs) > 0 {
+			report.Failures = map[string]string{}
+			for id, err := range errs {
+				report.Failures[id] = err.Error()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+	})
+}
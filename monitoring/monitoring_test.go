@@ -0,0 +1,90 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package monitoring
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type testDiscovery struct{}
+
+func (d *testDiscovery) Hello(userAgent string, protocolVersion int) error { return nil }
+func (d *testDiscovery) Stop() error                                       { return nil }
+func (d *testDiscovery) Quit()                                             {}
+func (d *testDiscovery) StartSync(eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	return nil
+}
+
+func init() {
+	discovery.Register("monitoring-test", func() discovery.Discovery { return &testDiscovery{} })
+}
+
+func TestTelemetry(t *testing.T) {
+	defer discovery.DisableTelemetry()
+	PublishTelemetry()
+	require.NotNil(t, expvar.Get(TelemetryVarName))
+
+	mux := http.NewServeMux()
+	RegisterTelemetryHandler(mux)
+	cl := discovery.NewInProcessClient("1", "monitoring-test")
+	require.NoError(t, cl.Run())
+	cl.Quit()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, TelemetryHandlerPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var counters discovery.TelemetryCounters
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &counters))
+	// HELLO and QUIT
+	require.GreaterOrEqual(t, counters.ClientCommands, uint64(2))
+}
+
+func TestProbeHandlers(t *testing.T) {
+	m := discovery.NewManager()
+	require.NoError(t, m.Add(discovery.NewInProcessClient("inprocess", "monitoring-test")))
+	defer m.QuitAll(context.Background())
+	mux := http.NewServeMux()
+	RegisterProbeHandlers(mux, m)
+	probe := func(path string) (int, *ProbeReport) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var report ProbeReport
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		return rec.Code, &report
+	}
+
+	// The discoveries never run are live but not ready
+	code, report := probe(ReadinessHandlerPath)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, &ProbeReport{Failures: map[string]string{"inprocess": "not running"}}, report)
+	code, report = probe(LivenessHandlerPath)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, &ProbeReport{OK: true}, report)
+
+	require.Empty(t, m.Start())
+	code, report = probe(ReadinessHandlerPath)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, &ProbeReport{OK: true}, report)
+}
@@ -0,0 +1,280 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package mqttbridge publishes the events of the ports detected by a discovery
+// Manager to an MQTT broker, so the dashboards monitoring a fleet of machines
+// (for example the machines of a test lab) can track the boards connected to
+// each of them without custom agents.
+//
+// The messages are published with the Eclipse Paho MQTT client (see Dial), or
+// through a Publisher adapting the MQTT client of the host application. The
+// package is a separate module, so the discovery package doesn't depend on
+// the MQTT client.
+package mqttbridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// DefaultTopic is the template of the topics of the messages, if not
+// configured, see Config.
+const DefaultTopic = "arduino/boards/{{.Host}}/{{.Protocol}}/{{.Address}}"
+
+// Publisher publishes the messages to an MQTT broker, it's implemented by
+// Client.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error
+}
+
+// Config is the configuration of a Bridge.
+type Config struct {
+	// Topic is the template of the topic of the message of each event, in
+	// the text/template syntax, DefaultTopic by default. The fields
+	// available are Host, DiscoveryID, Protocol, Address and HardwareID:
+	// the characters reserved by MQTT in their values ('/', '+' and '#')
+	// are replaced by '_', and the leading '/' of the addresses is dropped.
+	Topic string
+	// QoS is the quality of service of the messages, from 0 to 2.
+	QoS byte
+	// Retain publishes the messages as retained, so the dashboards
+	// connecting to the broker receive the boards currently connected: the
+	// removal of a port is published as an empty message, that deletes the
+	// retained message of the port.
+	Retain bool
+	// Host is the name of the machine in the messages, the host name by
+	// default.
+	Host string
+}
+
+// Message is the JSON payload of the message of an event.
+type Message struct {
+	// Type is the type of the event, "add" or "remove".
+	Type        string          `json:"type"`
+	Host        string          `json:"host"`
+	DiscoveryID string          `json:"discoveryId,omitempty"`
+	Seq         uint64          `json:"seq,omitempty"`
+	Time        time.Time       `json:"time"`
+	Port        *discovery.Port `json:"port"`
+}
+
+// topicFields are the fields of the template of the topics.
+type topicFields struct {
+	Host        string
+	DiscoveryID string
+	Protocol    string
+	Address     string
+	HardwareID  string
+}
+
+// Bridge publishes the "add" and "remove" events of the ports reported by a
+// Manager, aggregating all its discoveries, to an MQTT broker.
+type Bridge struct {
+	m         *discovery.Manager
+	publisher Publisher
+	config    Config
+	topic     *template.Template
+	published atomic.Uint64
+	// ports are the ports published, indexed by protocol and address
+	ports map[string]*publishedPort
+}
+
+// publishedPort is a port published, with the topic of its messages and the
+// discovery reporting it, empty if unknown.
+type publishedPort struct {
+	port        *discovery.Port
+	topic       string
+	discoveryID string
+}
+
+// New creates a Bridge publishing the events of the Manager through the
+// publisher.
+func New(m *discovery.Manager, publisher Publisher, config *Config) (*Bridge, error) {
+	b := &Bridge{m: m, publisher: publisher, ports: map[string]*publishedPort{}}
+	if config != nil {
+		b.config = *config
+	}
+	if b.config.Topic == "" {
+		b.config.Topic = DefaultTopic
+	}
+	if b.config.QoS > 2 {
+		return nil, fmt.Errorf("invalid QoS %d", b.config.QoS)
+	}
+	if b.config.Host == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("getting host name: %w", err)
+		}
+		b.config.Host = host
+	}
+	topic, err := template.New("topic").Option("missingkey=error").Parse(b.config.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic template: %w", err)
+	}
+	b.topic = topic
+	return b, nil
+}
+
+// Published returns the number of messages published.
+func (b *Bridge) Published() uint64 {
+	return b.published.Load()
+}
+
+// Run publishes the ports currently reported by the Manager, and then the
+// following events, until the context is done or a message can not be
+// published: the error is returned. The ports of a discovery stopped are
+// published as removed. Run may be called again, for example after
+// reconnecting to the broker, to publish the current ports again.
+func (b *Bridge) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	b.ports = map[string]*publishedPort{}
+	events, err := b.m.Subscribe(ctx, 0)
+	if errors.Is(err, discovery.ErrHistoryTruncated) {
+		// The discoveries of the ports already reported are unknown
+		snapshot := b.m.Snapshot()
+		for _, port := range snapshot.Ports {
+			if err := b.publish(ctx, &discovery.Event{Type: discovery.EventTypeAdd, Port: port}); err != nil {
+				return err
+			}
+		}
+		events, err = b.m.Subscribe(ctx, snapshot.Seq)
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return errors.New("subscription to the Manager events closed")
+			}
+			if err := b.process(ctx, ev.Event); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// process publishes the messages of an event.
+func (b *Bridge) process(ctx context.Context, ev *discovery.Event) error {
+	switch ev.Type {
+	case discovery.EventTypeAdd, discovery.EventTypeRemove:
+		return b.publish(ctx, ev)
+	case discovery.EventTypeStop:
+		// The discovery of the ports published from the snapshot is
+		// unknown, they are removed if no more reported by the Manager
+		current := map[string]bool{}
+		for _, port := range b.m.Snapshot().Ports {
+			current[port.Protocol+"|"+port.Address] = true
+		}
+		keys := []string{}
+		for key, published := range b.ports {
+			if published.discoveryID == ev.DiscoveryID || (published.discoveryID == "" && !current[key]) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			remove := &discovery.Event{Type: discovery.EventTypeRemove, Port: b.ports[key].port, DiscoveryID: ev.DiscoveryID}
+			if err := b.publish(ctx, remove); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// publish publishes the message of an "add" or "remove" event.
+func (b *Bridge) publish(ctx context.Context, ev *discovery.Event) error {
+	key := ev.Port.Protocol + "|" + ev.Port.Address
+	var topic string
+	if published, ok := b.ports[key]; ok && ev.Type == discovery.EventTypeRemove {
+		// The port of the "remove" events carries only the address and
+		// the protocol, the topic is the one of the "add"
+		topic = published.topic
+		delete(b.ports, key)
+	} else {
+		var err error
+		if topic, err = b.buildTopic(ev); err != nil {
+			return err
+		}
+		if ev.Type == discovery.EventTypeAdd {
+			b.ports[key] = &publishedPort{port: ev.Port, topic: topic, discoveryID: ev.DiscoveryID}
+		}
+	}
+
+	var payload []byte
+	if ev.Type == discovery.EventTypeAdd || !b.config.Retain {
+		var err error
+		payload, err = json.Marshal(&Message{
+			Type:        ev.Type,
+			Host:        b.config.Host,
+			DiscoveryID: ev.DiscoveryID,
+			Seq:         ev.ManagerSeq,
+			Time:        time.Now(),
+			Port:        ev.Port,
+		})
+		if err != nil {
+			return fmt.Errorf("encoding message: %w", err)
+		}
+	}
+	if err := b.publisher.Publish(ctx, topic, b.config.QoS, b.config.Retain, payload); err != nil {
+		return fmt.Errorf("publishing to %s: %w", topic, err)
+	}
+	b.published.Add(1)
+	return nil
+}
+
+// buildTopic returns the topic of the message of the event.
+func (b *Bridge) buildTopic(ev *discovery.Event) (string, error) {
+	var buf strings.Builder
+	err := b.topic.Execute(&buf, &topicFields{
+		Host:        topicLevel(b.config.Host),
+		DiscoveryID: topicLevel(ev.DiscoveryID),
+		Protocol:    topicLevel(ev.Port.Protocol),
+		Address:     topicLevel(strings.TrimPrefix(ev.Port.Address, "/")),
+		HardwareID:  topicLevel(ev.Port.HardwareID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("building topic: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// topicLevelReplacer replaces the characters reserved by MQTT.
+var topicLevelReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// topicLevel replaces the characters reserved by MQTT in a topic level.
+func topicLevel(s string) string {
+	return topicLevelReplacer.Replace(s)
+}
@@ -0,0 +1,117 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package mqttbridge
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBridge(t *testing.T) {
+	broker := runTestBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := Dial(ctx, &Options{Broker: "tcp://" + broker.address, ClientID: "lab-01"})
+	require.NoError(t, err)
+
+	m := discovery.NewManager()
+	require.NoError(t, m.AddStaticPort(&discovery.Port{Address: "/dev/ttyACM0", Protocol: "serial"}))
+	bridge, err := New(m, client, &Config{QoS: 2, Retain: true, Host: "lab-01"})
+	require.NoError(t, err)
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- bridge.Run(runCtx) }()
+
+	// The ports already reported are published
+	p := broker.recv(t)
+	require.Equal(t, "arduino/boards/lab-01/serial/dev_ttyACM0", p.topic)
+	require.Equal(t, byte(2), p.qos)
+	require.True(t, p.retain)
+	var msg Message
+	require.NoError(t, json.Unmarshal(p.payload, &msg))
+	require.Equal(t, discovery.EventTypeAdd, msg.Type)
+	require.Equal(t, "lab-01", msg.Host)
+	require.Equal(t, discovery.StaticDiscoveryID, msg.DiscoveryID)
+	require.Equal(t, "/dev/ttyACM0", msg.Port.Address)
+
+	// The removal deletes the retained message
+	require.NoError(t, m.AddStaticPort(&discovery.Port{Address: "10.0.0.5#8266", Protocol: "network"}))
+	require.Equal(t, "arduino/boards/lab-01/network/10.0.0.5_8266", broker.recv(t).topic)
+	require.NoError(t, m.RemoveStaticPort("/dev/ttyACM0", "serial"))
+	p = broker.recv(t)
+	require.Equal(t, "arduino/boards/lab-01/serial/dev_ttyACM0", p.topic)
+	require.Empty(t, p.payload)
+	require.Eventually(t, func() bool { return bridge.Published() == 3 }, time.Second, time.Millisecond)
+
+	stop()
+	require.ErrorIs(t, <-done, context.Canceled)
+	require.NoError(t, client.Close())
+}
+
+// publisherFunc adapts a function to the Publisher interface.
+type publisherFunc func(topic string, payload []byte)
+
+func (f publisherFunc) Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	f(topic, payload)
+	return nil
+}
+
+func TestBridgeHistoryTruncated(t *testing.T) {
+	// The ports are published from the snapshot, their discovery is unknown
+	m := discovery.NewManager()
+	m.SetEventHistorySize(1)
+	require.NoError(t, m.AddStaticPort(&discovery.Port{Address: "/dev/ttyACM0", Protocol: "serial"}))
+	require.NoError(t, m.AddStaticPort(&discovery.Port{Address: "/dev/ttyACM1", Protocol: "serial"}))
+	publications := make(chan *publication, 10)
+	publisher := publisherFunc(func(topic string, payload []byte) {
+		publications <- &publication{topic: topic, payload: payload}
+	})
+	bridge, err := New(m, publisher, &Config{Topic: "boards/{{.DiscoveryID}}/{{.Address}}", Retain: true, Host: "lab-01"})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bridge.Run(ctx)
+	require.Equal(t, "boards//dev_ttyACM0", (<-publications).topic)
+	require.Equal(t, "boards//dev_ttyACM1", (<-publications).topic)
+
+	// The removal deletes the retained message of the snapshot
+	require.NoError(t, m.RemoveStaticPort("/dev/ttyACM0", "serial"))
+	p := <-publications
+	require.Equal(t, "boards//dev_ttyACM0", p.topic)
+	require.Empty(t, p.payload)
+}
+
+func TestBridgeConfig(t *testing.T) {
+	m := discovery.NewManager()
+	_, err := New(m, nil, &Config{QoS: 3})
+	require.Error(t, err)
+	_, err = New(m, nil, &Config{QoS: 2, Host: "lab-01"})
+	require.NoError(t, err)
+	_, err = New(m, nil, &Config{Topic: "boards/{{.Host"})
+	require.Error(t, err)
+	bridge, err := New(m, nil, &Config{Topic: "{{.Host}}/{{.DiscoveryID}}/{{.HardwareID}}", Host: "lab/01"})
+	require.NoError(t, err)
+	topic, err := bridge.buildTopic(&discovery.Event{DiscoveryID: "serial", Port: &discovery.Port{HardwareID: "ABC+1"}})
+	require.NoError(t, err)
+	require.Equal(t, "lab_01/serial/ABC_1", topic)
+}
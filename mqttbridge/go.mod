@@ -0,0 +1,27 @@
+module github.com/arduino/pluggable-discovery-protocol-handler/v2/mqttbridge
+
+go 1.21
+
+require (
+	github.com/arduino/pluggable-discovery-protocol-handler/v2 v2.0.0-00010101000000-000000000000
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/stretchr/testify v1.9.0
+)
+
+require (
+	github.com/arduino/go-paths-helper v1.10.0 // indirect
+	github.com/arduino/go-properties-orderedmap v1.8.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/fsnotify/fsnotify v1.7.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+	pgregory.net/rapid v1.1.0 // indirect
+)
+
+replace github.com/arduino/pluggable-discovery-protocol-handler/v2 => ../
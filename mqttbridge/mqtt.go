@@ -0,0 +1,169 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package mqttbridge
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ErrClientClosed is returned by Client.Publish after the client has been
+// closed.
+var ErrClientClosed = errors.New("mqtt client closed")
+
+// Options are the options of the connection to the MQTT broker, see Dial.
+type Options struct {
+	// Broker is the URL of the broker, for example tcp://broker.lab:1883:
+	// the schemes tcp and mqtt connect in clear text (default port 1883),
+	// the schemes ssl, tls and mqtts connect through TLS (default port 8883).
+	Broker string
+	// ClientID identifies the client to the broker, it must be unique
+	// among the clients of the broker: the broker keeps the session of the
+	// client across the reconnections.
+	ClientID string
+	// Username and Password authenticate the client, the Password requires
+	// the Username.
+	Username string
+	Password string
+	// KeepAlive is the interval of the pings sent to the broker, 30s by
+	// default: the connection is considered lost if the broker doesn't
+	// answer.
+	KeepAlive time.Duration
+	// MaxReconnectInterval is the maximum interval between the attempts to
+	// reconnect to the broker after the connection has been lost, 1m by
+	// default.
+	MaxReconnectInterval time.Duration
+	// TLS is the configuration of the TLS connections, if nil the default
+	// configuration is used.
+	TLS *tls.Config
+}
+
+// Client publishes the messages to an MQTT broker through the Eclipse Paho
+// MQTT client. When the connection is lost the client reconnects to the
+// broker, resuming its session: the messages published with QoS 1 and 2 and
+// not yet acknowledged are sent again, the messages published in the
+// meantime are sent once reconnected. It's safe for concurrent use.
+type Client struct {
+	client    mqtt.Client
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial connects to the MQTT broker.
+func Dial(ctx context.Context, opts *Options) (*Client, error) {
+	broker, err := brokerURL(opts.Broker)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ClientID == "" {
+		return nil, errors.New("missing client ID")
+	}
+	if opts.Password != "" && opts.Username == "" {
+		return nil, errors.New("password without username")
+	}
+	keepAlive := opts.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = 30 * time.Second
+	}
+	clientOpts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetKeepAlive(keepAlive).
+		SetCleanSession(false).
+		SetAutoReconnect(true)
+	if opts.MaxReconnectInterval > 0 {
+		clientOpts.SetMaxReconnectInterval(opts.MaxReconnectInterval)
+	}
+	if opts.TLS != nil {
+		clientOpts.SetTLSConfig(opts.TLS)
+	}
+	c := &Client{client: mqtt.NewClient(clientOpts), closed: make(chan struct{})}
+	token := c.client.Connect()
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return nil, fmt.Errorf("connecting to broker %s: %w", opts.Broker, err)
+		}
+	case <-ctx.Done():
+		c.client.Disconnect(0)
+		return nil, fmt.Errorf("connecting to broker %s: %w", opts.Broker, ctx.Err())
+	}
+	return c, nil
+}
+
+// brokerURL returns the URL of the broker with the default port of its
+// scheme, if missing.
+func brokerURL(broker string) (string, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", fmt.Errorf("invalid broker URL: %w", err)
+	}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		port = "8883"
+	default:
+		return "", fmt.Errorf("invalid broker URL %s: unsupported scheme %s", broker, u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u.String(), nil
+}
+
+// Publish publishes a message, waiting for its acknowledgement if the QoS is
+// greater than 0. While the client is reconnecting the message is queued:
+// if the context is done before the acknowledgement the message may still
+// be delivered.
+func (c *Client) Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	select {
+	case <-c.closed:
+		return ErrClientClosed
+	default:
+	}
+	token := c.client.Publish(topic, qos, retain, payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closed:
+		return ErrClientClosed
+	}
+}
+
+// Close disconnects from the broker, waiting at most one second for the
+// messages being published.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.client.Disconnect(1000)
+	})
+	return nil
+}
@@ -0,0 +1,216 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package mqttbridge
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The types of the MQTT control packets handled by the test broker.
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetPubrec     = 5
+	packetPubrel     = 6
+	packetPubcomp    = 7
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+)
+
+type publication struct {
+	topic   string
+	qos     byte
+	retain  bool
+	dup     bool
+	payload []byte
+}
+
+// testBroker is a minimal MQTT broker, acknowledging the messages published
+// with any QoS.
+type testBroker struct {
+	address      string
+	publications chan *publication
+	connections  atomic.Int32
+	// dropNext makes the broker close the connection when the next message
+	// is received, without acknowledging it.
+	dropNext atomic.Bool
+}
+
+// runTestBroker starts a testBroker, accepting any number of connections.
+func runTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	b := &testBroker{address: listener.Addr().String(), publications: make(chan *publication, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	header, body, err := readPacket(conn)
+	if err != nil || header>>4 != packetConnect || len(body) < 6 || string(body[2:6]) != "MQTT" {
+		return
+	}
+	b.connections.Add(1)
+	if _, err := conn.Write([]byte{packetConnack << 4, 2, 0, 0}); err != nil {
+		return
+	}
+	for {
+		header, body, err := readPacket(conn)
+		if err != nil {
+			return
+		}
+		var response []byte
+		switch header >> 4 {
+		case packetPublish:
+			p := &publication{qos: header >> 1 & 0x03, retain: header&0x01 != 0, dup: header&0x08 != 0}
+			length := int(binary.BigEndian.Uint16(body))
+			p.topic = string(body[2 : 2+length])
+			body = body[2+length:]
+			if b.dropNext.CompareAndSwap(true, false) {
+				return
+			}
+			switch p.qos {
+			case 1:
+				response = []byte{packetPuback << 4, 2, body[0], body[1]}
+			case 2:
+				response = []byte{packetPubrec << 4, 2, body[0], body[1]}
+			}
+			if p.qos > 0 {
+				body = body[2:]
+			}
+			p.payload = body
+			b.publications <- p
+		case packetPubrel:
+			response = []byte{packetPubcomp << 4, 2, body[0], body[1]}
+		case packetPingreq:
+			response = []byte{packetPingresp << 4, 0}
+		default:
+			return
+		}
+		if response != nil {
+			if _, err := conn.Write(response); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// recv returns the next message published.
+func (b *testBroker) recv(t *testing.T) *publication {
+	select {
+	case p := <-b.publications:
+		return p
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "message not published")
+		return nil
+	}
+}
+
+// readPacket reads an MQTT packet, returning the first byte of its fixed
+// header and its body.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, nil, err
+	}
+	header := b[0]
+	length := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("invalid packet length")
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length |= int(b[0]&0x7f) << (7 * i)
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func TestClient(t *testing.T) {
+	broker := runTestBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := Dial(ctx, &Options{Broker: "tcp://" + broker.address, ClientID: "lab-01"})
+	require.NoError(t, err)
+
+	// QoS 2
+	require.NoError(t, client.Publish(ctx, "boards/1", 2, true, []byte("add")))
+	p := broker.recv(t)
+	require.Equal(t, "boards/1", p.topic)
+	require.Equal(t, byte(2), p.qos)
+	require.True(t, p.retain)
+	require.Equal(t, "add", string(p.payload))
+
+	// The message not acknowledged is sent again after reconnecting
+	broker.dropNext.Store(true)
+	require.NoError(t, client.Publish(ctx, "boards/2", 1, false, []byte("add")))
+	p = broker.recv(t)
+	require.Equal(t, "boards/2", p.topic)
+	require.True(t, p.dup)
+	require.Equal(t, int32(2), broker.connections.Load())
+
+	require.NoError(t, client.Close())
+	require.ErrorIs(t, client.Publish(ctx, "boards/3", 0, false, nil), ErrClientClosed)
+}
+
+func TestDialOptions(t *testing.T) {
+	ctx := context.Background()
+	_, err := Dial(ctx, &Options{Broker: "http://localhost", ClientID: "lab-01"})
+	require.EqualError(t, err, "invalid broker URL http://localhost: unsupported scheme http")
+	_, err = Dial(ctx, &Options{Broker: "tcp://localhost"})
+	require.EqualError(t, err, "missing client ID")
+	_, err = Dial(ctx, &Options{Broker: "tcp://localhost", ClientID: "lab-01", Password: "secret"})
+	require.EqualError(t, err, "password without username")
+
+	broker, err := brokerURL("mqtts://broker.lab")
+	require.NoError(t, err)
+	require.Equal(t, "mqtts://broker.lab:8883", broker)
+	broker, err = brokerURL("tcp://broker.lab:1884")
+	require.NoError(t, err)
+	require.Equal(t, "tcp://broker.lab:1884", broker)
+}
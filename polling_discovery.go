@@ -0,0 +1,136 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PollingDiscovery is a Discovery that finds the ports by calling a poll
+// function, it's meant to write simple discoveries without handling the
+// goroutines of the sync mode. In sync mode the function is called every
+// interval and the differences between two consecutive polls are sent as
+// "add" and "remove" events, the LIST command calls the function directly.
+// The function may be called concurrently by LIST and by the sync mode.
+type PollingDiscovery struct {
+	poll     func() ([]*Port, error)
+	interval time.Duration
+	jitter   float64
+	clock    Clock
+
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewPollingDiscovery creates a PollingDiscovery calling the poll function
+// every interval while in sync mode, an interval of 0 means one second.
+func NewPollingDiscovery(poll func() ([]*Port, error), interval time.Duration) *PollingDiscovery {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &PollingDiscovery{
+		poll:     poll,
+		interval: interval,
+		clock:    systemClock{},
+	}
+}
+
+// SetJitter randomizes the polling interval by up to the given fraction
+// (between 0 and 1) in both directions, to avoid many discoveries polling
+// the same bus at the same time. It must be called before StartSync.
+func (d *PollingDiscovery) SetJitter(jitter float64) {
+	d.jitter = jitter
+}
+
+// SetClock sets the Clock used to wait the polling interval. It must be
+// called before StartSync.
+func (d *PollingDiscovery) SetClock(clock Clock) {
+	d.clock = clock
+}
+
+// Hello does nothing.
+func (d *PollingDiscovery) Hello(userAgent string, protocolVersion int) error {
+	return nil
+}
+
+// List calls the poll function.
+func (d *PollingDiscovery) List(ctx context.Context) ([]*Port, error) {
+	return d.poll()
+}
+
+// StartSync starts polling in background: the first poll sends an "add" event
+// for each port found, after the START_SYNC response. If the first poll fails
+// the error is signalled with the errorCB and the polling ends, the following
+// failures are ignored and the ports are kept until the next successful poll.
+func (d *PollingDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	d.mutex.Lock()
+	d.cancel = cancel
+	d.done = done
+	d.mutex.Unlock()
+
+	delay := &JitteredBackoff{Strategy: FixedBackoff(d.interval), Jitter: d.jitter}
+	go func() {
+		defer close(done)
+		ports, err := d.poll()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			errorCB(fmt.Sprintf("polling ports: %v", err))
+			return
+		}
+		known := diffPorts(nil, ports, eventCB)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.clock.After(delay.Delay(0)):
+			}
+			ports, err := d.poll()
+			if err != nil || ctx.Err() != nil {
+				continue
+			}
+			known = diffPorts(known, ports, eventCB)
+		}
+	}()
+	return nil
+}
+
+// Stop stops the polling and waits for its termination.
+func (d *PollingDiscovery) Stop() error {
+	d.mutex.Lock()
+	cancel, done := d.cancel, d.done
+	d.cancel, d.done = nil, nil
+	d.mutex.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return nil
+}
+
+// Quit stops the polling.
+func (d *PollingDiscovery) Quit() {
+	_ = d.Stop()
+}
@@ -0,0 +1,112 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollingDiscovery(t *testing.T) {
+	var mutex sync.Mutex
+	var ports []*Port
+	var pollErr error
+	setPorts := func(err error, addresses ...string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		ports = nil
+		for _, address := range addresses {
+			ports = append(ports, &Port{Address: address, Protocol: "test"})
+		}
+		pollErr = err
+	}
+	poll := func() ([]*Port, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return ports, pollErr
+	}
+	events := make(chan string, 10)
+	eventCB := func(event string, port *Port) { events <- event + " " + port.Address }
+	clock := NewManualClock(time.Now())
+	d := NewPollingDiscovery(poll, time.Second)
+	d.SetClock(clock)
+	d.SetJitter(0.1)
+
+	// The first poll failure is signalled as an error, ending the polling
+	setPorts(errors.New("bus error"))
+	errs := make(chan string, 1)
+	require.NoError(t, d.StartSync(eventCB, func(err string) { errs <- err }))
+	require.Equal(t, "polling ports: bus error", <-errs)
+	require.NoError(t, d.Stop())
+
+	setPorts(nil, "1", "2")
+	require.NoError(t, d.StartSync(eventCB, func(string) {}))
+	require.Equal(t, "add 1", <-events)
+	require.Equal(t, "add 2", <-events)
+	listed, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+
+	advance := func() {
+		require.Eventually(t, func() bool { return clock.PendingTimers() == 1 }, 5*time.Second, time.Millisecond)
+		clock.Advance(2 * time.Second)
+	}
+	setPorts(nil, "2", "3")
+	advance()
+	require.Equal(t, "remove 1", <-events)
+	require.Equal(t, "add 3", <-events)
+
+	// The ports are kept when a poll fails
+	setPorts(errors.New("bus error"))
+	advance()
+	setPorts(nil, "2", "3")
+	advance()
+	advance()
+	require.NoError(t, d.Stop())
+	require.Empty(t, events)
+	require.NoError(t, d.Stop())
+}
+
+func init() {
+	Register("test-polling", func() Discovery {
+		return NewPollingDiscovery(func() ([]*Port, error) {
+			return []*Port{{Address: "1", Protocol: "polling"}}, nil
+		}, time.Hour)
+	})
+}
+
+func TestPollingDiscoveryInProcess(t *testing.T) {
+	disc := NewInProcessClient("polling", "test-polling")
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+	ev := <-events
+	require.Equal(t, EventTypeAdd, ev.Type)
+	require.Equal(t, "polling", ev.Port.Protocol)
+	require.NoError(t, disc.Stop())
+	require.NoError(t, disc.Start())
+	ports, err := disc.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+}
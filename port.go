@@ -17,7 +17,15 @@
 
 package discovery
 
-import "github.com/arduino/go-properties-orderedmap"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/arduino/go-properties-orderedmap"
+)
 
 // Port is a descriptor for a board port
 type Port struct {
@@ -27,6 +35,197 @@ type Port struct {
 	ProtocolLabel string          `json:"protocolLabel,omitempty"`
 	Properties    *properties.Map `json:"properties,omitempty"`
 	HardwareID    string          `json:"hardwareId,omitempty"`
+
+	// Extra contains the raw JSON fields of the port that are not known by
+	// this version of the protocol handler. They are preserved when the port
+	// is decoded and emitted again when the port is encoded, so the metadata
+	// added by newer discoveries is not lost when the port is forwarded.
+	Extra map[string]json.RawMessage `json:"-"`
+
+	// raw is the JSON the port has been decoded from, see Raw.
+	raw json.RawMessage
+	// payload is the payload of the event carrying the port, see WithPayload.
+	payload interface{}
+}
+
+// portKnownFields are the JSON fields of Port that are not stored in Port.Extra
+var portKnownFields = []string{"address", "label", "protocol", "protocolLabel", "properties", "hardwareId"}
+
+// portJSON is the JSON encoding of the known fields of Port, the properties
+// are kept raw to preserve their order (properties.Map does not).
+type portJSON struct {
+	Address       string          `json:"address"`
+	AddressLabel  string          `json:"label,omitempty"`
+	Protocol      string          `json:"protocol,omitempty"`
+	ProtocolLabel string          `json:"protocolLabel,omitempty"`
+	Properties    json.RawMessage `json:"properties,omitempty"`
+	HardwareID    string          `json:"hardwareId,omitempty"`
+}
+
+// UnmarshalJSON decodes the port, the unknown fields are stored in Port.Extra.
+// The order of the properties is preserved.
+func (p *Port) UnmarshalJSON(data []byte) error {
+	var res portJSON
+	if err := json.Unmarshal(data, &res); err != nil {
+		return err
+	}
+	props, err := unmarshalOrderedProperties(res.Properties)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for _, field := range portKnownFields {
+		delete(fields, field)
+	}
+	port := Port{
+		Address:       res.Address,
+		AddressLabel:  res.AddressLabel,
+		Protocol:      res.Protocol,
+		ProtocolLabel: res.ProtocolLabel,
+		Properties:    props,
+		HardwareID:    res.HardwareID,
+		raw:           append(json.RawMessage(nil), data...),
+	}
+	if len(fields) > 0 {
+		port.Extra = fields
+	}
+	*p = port
+	return nil
+}
+
+// MarshalJSON encodes the port, including the fields stored in Port.Extra.
+// The extra fields that conflict with the known fields of Port are ignored.
+// The properties are encoded in their order.
+func (p *Port) MarshalJSON() ([]byte, error) {
+	props, err := marshalOrderedProperties(p.Properties)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(&portJSON{
+		Address:       p.Address,
+		AddressLabel:  p.AddressLabel,
+		Protocol:      p.Protocol,
+		ProtocolLabel: p.ProtocolLabel,
+		Properties:    props,
+		HardwareID:    p.HardwareID,
+	})
+	if err != nil || len(p.Extra) == 0 {
+		return data, err
+	}
+
+	keys := []string{}
+	for key := range p.Extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-1]) // remove the closing brace
+	for _, key := range keys {
+		if isPortKnownField(key) {
+			continue
+		}
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value := p.Extra[key]
+		if value == nil {
+			value = json.RawMessage("null")
+		}
+		buf.WriteByte(',')
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		if err := json.Compact(&buf, value); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Raw returns the JSON the port has been decoded from, byte by byte, so the
+// consumers that persist the ports don't lose any data or formatting. If the
+// port has not been decoded from JSON, its encoding is returned. Changes made
+// to a decoded port are not reflected in Raw: use json.Marshal to encode the
+// current content of the port.
+func (p *Port) Raw() json.RawMessage {
+	if p.raw != nil {
+		return append(json.RawMessage(nil), p.raw...)
+	}
+	data, err := p.MarshalJSON()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// marshalOrderedProperties encodes the properties as a JSON object keeping
+// their order, a nil map is encoded as nil.
+func marshalOrderedProperties(props *properties.Map) (json.RawMessage, error) {
+	if props == nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range props.Keys() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		encodedValue, err := json.Marshal(props.Get(key))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		buf.Write(encodedValue)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// unmarshalOrderedProperties decodes a JSON object of strings keeping the
+// order of its keys, a missing or null object is decoded as nil.
+func unmarshalOrderedProperties(data json.RawMessage) (*properties.Map, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, errors.New("invalid properties: expected an object")
+	}
+	props := properties.NewMap()
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string)
+		var value string
+		if err := dec.Decode(&value); err != nil {
+			return nil, fmt.Errorf("invalid property %s: %w", key, err)
+		}
+		props.Set(key, value)
+	}
+	return props, nil
+}
+
+func isPortKnownField(field string) bool {
+	for _, known := range portKnownFields {
+		if field == known {
+			return true
+		}
+	}
+	return false
 }
 
 // Equals returns true if the given port has the same address and protocol
@@ -35,6 +234,25 @@ func (p *Port) Equals(o *Port) bool {
 	return p.Address == o.Address && p.Protocol == o.Protocol
 }
 
+// isIdentical returns true if the given port has the same fields of the
+// current port, including the properties.
+func (p *Port) isIdentical(o *Port) bool {
+	if !p.Equals(o) ||
+		p.AddressLabel != o.AddressLabel ||
+		p.ProtocolLabel != o.ProtocolLabel ||
+		p.HardwareID != o.HardwareID {
+		return false
+	}
+	props, otherProps := p.Properties, o.Properties
+	if props == nil {
+		props = properties.NewMap()
+	}
+	if otherProps == nil {
+		otherProps = properties.NewMap()
+	}
+	return props.Equals(otherProps)
+}
+
 func (p *Port) String() string {
 	if p == nil {
 		return "none"
@@ -51,5 +269,14 @@ func (p *Port) Clone() *Port {
 	if p.Properties != nil {
 		res.Properties = p.Properties.Clone()
 	}
+	if p.raw != nil {
+		res.raw = append(json.RawMessage(nil), p.raw...)
+	}
+	if p.Extra != nil {
+		res.Extra = map[string]json.RawMessage{}
+		for key, value := range p.Extra {
+			res.Extra[key] = append(json.RawMessage(nil), value...)
+		}
+	}
 	return &res
 }
@@ -0,0 +1,96 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// LabelTemplate computes the display label of the ports from their fields and
+// properties, see ParseLabelTemplate.
+type LabelTemplate struct {
+	tmpl *template.Template
+}
+
+// LabelData is the data passed to a LabelTemplate: the fields of the port as
+// reported by the discovery, and its properties as a map, so they can be
+// accessed by key (for example {{.Properties.board}}).
+type LabelData struct {
+	Address       string
+	AddressLabel  string
+	Protocol      string
+	ProtocolLabel string
+	HardwareID    string
+	Properties    map[string]string
+}
+
+// ParseLabelTemplate parses a text/template computing the labels of the ports,
+// for example "{{.Properties.board}} on {{.Address}}". The template is executed
+// with a LabelData, the missing properties are replaced by empty strings.
+func ParseLabelTemplate(text string) (*LabelTemplate, error) {
+	tmpl, err := template.New("label").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label template: %w", err)
+	}
+	return &LabelTemplate{tmpl: tmpl}, nil
+}
+
+// Label returns the label of the port computed by the template. If the
+// template fails, or its result is blank, the AddressLabel of the port is
+// returned.
+func (t *LabelTemplate) Label(port *Port) string {
+	data := &LabelData{
+		Address:       port.Address,
+		AddressLabel:  port.AddressLabel,
+		Protocol:      port.Protocol,
+		ProtocolLabel: port.ProtocolLabel,
+		HardwareID:    port.HardwareID,
+		Properties:    map[string]string{},
+	}
+	if port.Properties != nil {
+		data.Properties = port.Properties.AsMap()
+	}
+	var label strings.Builder
+	if err := t.tmpl.Execute(&label, data); err != nil {
+		return port.AddressLabel
+	}
+	if strings.TrimSpace(label.String()) == "" {
+		return port.AddressLabel
+	}
+	return label.String()
+}
+
+// WithLabelTemplate replaces the AddressLabel of the ports reported by the
+// discovery, in the events and in the LIST results, with the label computed
+// by the given template.
+func WithLabelTemplate(tmpl *LabelTemplate) ClientOption {
+	return func(disc *Client) {
+		disc.labelTemplate = tmpl
+	}
+}
+
+// applyLabelTemplate sets the label of the port computed by the label
+// template, if any.
+func (disc *Client) applyLabelTemplate(port *Port) {
+	if disc.labelTemplate == nil || port == nil {
+		return
+	}
+	port.AddressLabel = disc.labelTemplate.Label(port)
+}
@@ -0,0 +1,102 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The identifiers of the well-known protocols of the ports. The protocol
+// identifiers are lower case, the discoveries must report them exactly in
+// this form: the human readable name of the protocol is the ProtocolLabel.
+const (
+	// ProtocolSerial is the protocol of the serial ports, like the ports of
+	// the USB boards.
+	ProtocolSerial = "serial"
+	// ProtocolNetwork is the protocol of the boards reachable through the
+	// network, for example the boards announced with mDNS.
+	ProtocolNetwork = "network"
+	// ProtocolDFU is the protocol of the boards in USB DFU mode.
+	ProtocolDFU = "dfu"
+	// ProtocolDummy is the protocol of the fake ports of the dummy-discovery.
+	ProtocolDummy = "dummy"
+)
+
+// knownProtocols are the well-known protocol identifiers, sorted.
+var knownProtocols = []string{ProtocolDFU, ProtocolDummy, ProtocolNetwork, ProtocolSerial}
+
+// KnownProtocols returns the well-known protocol identifiers, sorted.
+func KnownProtocols() []string {
+	return append([]string{}, knownProtocols...)
+}
+
+// NormalizeProtocol returns the canonical form of a protocol identifier, with
+// the surrounding spaces removed and case folded, for example "Serial " is
+// normalized to ProtocolSerial.
+func NormalizeProtocol(protocol string) string {
+	return strings.ToLower(strings.TrimSpace(protocol))
+}
+
+// IsKnownProtocol returns true if the protocol, once normalized, is one of
+// the well-known protocol identifiers.
+func IsKnownProtocol(protocol string) bool {
+	protocol = NormalizeProtocol(protocol)
+	for _, known := range knownProtocols {
+		if protocol == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateProtocol returns an error if the protocol is not a valid protocol
+// identifier in its canonical form: a non-empty sequence of lower case
+// letters, digits, '-', '_' and '.'. Any protocol is accepted, not only the
+// well-known ones.
+func ValidateProtocol(protocol string) error {
+	if protocol == "" {
+		return fmt.Errorf("empty protocol")
+	}
+	if normalized := NormalizeProtocol(protocol); normalized != protocol {
+		return fmt.Errorf("protocol '%s' is not normalized, expected '%s'", protocol, normalized)
+	}
+	for _, c := range protocol {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+			return fmt.Errorf("invalid character '%c' in protocol '%s'", c, protocol)
+		}
+	}
+	return nil
+}
+
+// WithProtocolNormalization normalizes the protocol of the ports reported by
+// the discovery with NormalizeProtocol, so the ports of the discoveries
+// reporting, for example, "Serial" instead of "serial" are handled like the
+// others.
+func WithProtocolNormalization(enabled bool) ClientOption {
+	return func(disc *Client) {
+		disc.normalizeProtocols = enabled
+	}
+}
+
+// normalizePortProtocol normalizes the protocol of the port, if enabled.
+func (disc *Client) normalizePortProtocol(port *Port) {
+	if disc.normalizeProtocols && port != nil {
+		port.Protocol = NormalizeProtocol(port.Protocol)
+	}
+}
@@ -0,0 +1,140 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/arduino/go-properties-orderedmap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortUnknownFields(t *testing.T) {
+	data := []byte(`{"address":"1","protocol":"dummy","serialNumber":"A1B2","capabilities":{"upload": true}}`)
+	var port Port
+	require.NoError(t, json.Unmarshal(data, &port))
+	require.Equal(t, "1", port.Address)
+	require.Equal(t, "dummy", port.Protocol)
+	require.Len(t, port.Extra, 2)
+	require.JSONEq(t, `"A1B2"`, string(port.Extra["serialNumber"]))
+
+	// The unknown fields are emitted again when the port is forwarded
+	out, err := json.Marshal(port.Clone())
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"1","protocol":"dummy","capabilities":{"upload":true},"serialNumber":"A1B2"}`, string(out))
+
+	// Extra fields can't override the known fields
+	port.Extra["address"] = json.RawMessage(`"2"`)
+	out, err = json.Marshal(&port)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"address":"1","protocol":"dummy","capabilities":{"upload":true},"serialNumber":"A1B2"}`, string(out))
+
+	// Ports without unknown fields are unchanged
+	var plain Port
+	require.NoError(t, json.Unmarshal([]byte(`{"address":"1"}`), &plain))
+	require.Nil(t, plain.Extra)
+	out, err = json.Marshal(&plain)
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"1"}`, string(out))
+}
+
+func TestPortRawJSON(t *testing.T) {
+	data := []byte(`{"address":"1", "protocol":"dummy", "properties":{"vid":"0x2341","pid":"0x0043","serialNumber":"A1B2"}, "zeta":1, "alpha":[true]}`)
+	var port Port
+	require.NoError(t, json.Unmarshal(data, &port))
+	require.Equal(t, []string{"vid", "pid", "serialNumber"}, port.Properties.Keys())
+
+	// Raw returns the original JSON, even after a Clone
+	require.Equal(t, string(data), string(port.Raw()))
+	require.Equal(t, string(data), string(port.Clone().Raw()))
+
+	// The properties are encoded in their order
+	out, err := json.Marshal(&port)
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"1","protocol":"dummy","properties":{"vid":"0x2341","pid":"0x0043","serialNumber":"A1B2"},"alpha":[true],"zeta":1}`, string(out))
+	var decoded Port
+	require.NoError(t, json.Unmarshal(out, &decoded))
+	require.Equal(t, port.Properties.Keys(), decoded.Properties.Keys())
+	require.Len(t, decoded.Extra, 2)
+
+	// Ports not decoded from JSON return their encoding
+	require.Equal(t, `{"address":"2"}`, string((&Port{Address: "2"}).Raw()))
+
+	require.Error(t, json.Unmarshal([]byte(`{"address":"1","properties":["a"]}`), &port))
+	require.Error(t, json.Unmarshal([]byte(`{"address":"1","properties":{"a":1}}`), &port))
+}
+
+func TestPortLabelTemplate(t *testing.T) {
+	_, err := ParseLabelTemplate("{{.Address")
+	require.Error(t, err)
+
+	tmpl, err := ParseLabelTemplate("{{.Properties.board}} on {{.Address}}")
+	require.NoError(t, err)
+	props := properties.NewMap()
+	props.Set("board", "Arduino UNO")
+	require.Equal(t, "Arduino UNO on /dev/ttyACM0", tmpl.Label(&Port{Address: "/dev/ttyACM0", AddressLabel: "ttyACM0", Properties: props}))
+	require.Equal(t, " on /dev/ttyACM0", tmpl.Label(&Port{Address: "/dev/ttyACM0"}))
+
+	// A blank or failed label keeps the label of the discovery
+	tmpl, err = ParseLabelTemplate("{{.Properties.board}}")
+	require.NoError(t, err)
+	require.Equal(t, "ttyACM0", tmpl.Label(&Port{Address: "/dev/ttyACM0", AddressLabel: "ttyACM0"}))
+	tmpl, err = ParseLabelTemplate("{{index .Properties 1}}")
+	require.NoError(t, err)
+	require.Equal(t, "ttyACM0", tmpl.Label(&Port{Address: "/dev/ttyACM0", AddressLabel: "ttyACM0"}))
+
+	// The labels are applied to the events and to the LIST results
+	m := NewManager()
+	require.Error(t, m.LoadConfig(&ManagerConfig{Discoveries: []*DiscoveryConfig{
+		{ID: "inprocess", InProcess: "test-inprocess", LabelTemplate: "{{"},
+	}}))
+	require.NoError(t, m.LoadConfig(&ManagerConfig{Discoveries: []*DiscoveryConfig{
+		{ID: "inprocess", InProcess: "test-inprocess", LabelTemplate: "{{.Protocol}} port {{.Address}}"},
+	}}))
+	defer m.QuitAll(context.Background())
+	require.Empty(t, m.Start())
+	ports, errs := m.ListAll()
+	require.Empty(t, errs)
+	require.Equal(t, "inprocess port 1", ports[0].AddressLabel)
+	disc := m.discoveries["inprocess"]
+	require.NoError(t, disc.Stop())
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, "inprocess port 1", (<-events).Port.AddressLabel)
+}
+
+func TestProtocolIdentifiers(t *testing.T) {
+	require.Equal(t, []string{"dfu", "dummy", "network", "serial"}, KnownProtocols())
+	require.Equal(t, ProtocolSerial, NormalizeProtocol(" Serial "))
+	require.Equal(t, "teensy", NormalizeProtocol("Teensy"))
+	require.True(t, IsKnownProtocol("NETWORK"))
+	require.False(t, IsKnownProtocol("teensy"))
+
+	require.NoError(t, ValidateProtocol(ProtocolDFU))
+	require.NoError(t, ValidateProtocol("teensy-hid_1.0"))
+	require.EqualError(t, ValidateProtocol(""), "empty protocol")
+	require.EqualError(t, ValidateProtocol("Serial"), "protocol 'Serial' is not normalized, expected 'serial'")
+	require.EqualError(t, ValidateProtocol("usb/serial"), "invalid character '/' in protocol 'usb/serial'")
+
+	cl := NewClientWithOptions("1", "test", WithProtocolNormalization(true))
+	port := &Port{Address: "1", Protocol: "Serial"}
+	cl.normalizePortProtocol(port)
+	require.Equal(t, ProtocolSerial, port.Protocol)
+}
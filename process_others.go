@@ -0,0 +1,55 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !windows
+
+package discovery
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+func tellCommandNotToSpawnShell(_ *exec.Cmd) {
+	// noop
+}
+
+// setProcessGroup makes the command run in a new process group, whose id is
+// the pid of the process.
+func setProcessGroup(oscmd *exec.Cmd) {
+	if oscmd.SysProcAttr == nil {
+		oscmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	oscmd.SysProcAttr.Setpgid = true
+}
+
+// attachProcessGroup does nothing, the process group is created at the start
+// of the process, see setProcessGroup.
+func attachProcessGroup(_ *exec.Cmd) error {
+	return nil
+}
+
+// killProcessGroup kills all the processes of the process group of the
+// command, started with setProcessGroup. The group may be already empty.
+func killProcessGroup(oscmd *exec.Cmd) error {
+	err := syscall.Kill(-oscmd.Process.Pid, syscall.SIGKILL)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !windows
+
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// processAlive returns true if the process is running, the zombies are
+// considered terminated.
+func processAlive(pid int) bool {
+	if stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); err == nil {
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		return len(fields) > 0 && fields[0] != "Z"
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+func TestClientProcessGroup(t *testing.T) {
+	runWithHelper := func(t *testing.T, opts ...ClientOption) (*Client, int) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		script := "sleep 60 </dev/null >/dev/null 2>&1 & echo $! > " + pidFile + "\n" + legacyDiscoveryScript
+		disc := NewClientWithOptions("group", "sh", append(opts, WithArgs("-c", script))...)
+		require.NoError(t, disc.Run())
+		var pid int
+		require.Eventually(t, func() bool {
+			data, err := os.ReadFile(pidFile)
+			if err != nil {
+				return false
+			}
+			pid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		require.True(t, processAlive(pid))
+		return disc, pid
+	}
+
+	// Without the process group the helper survives the discovery
+	disc, pid := runWithHelper(t)
+	disc.Quit()
+	require.True(t, processAlive(pid))
+	require.NoError(t, syscall.Kill(pid, syscall.SIGKILL))
+
+	disc, pid = runWithHelper(t, WithProcessGroup(true))
+	disc.Quit()
+	require.Eventually(t, func() bool { return !processAlive(pid) }, 5*time.Second, 10*time.Millisecond)
+
+	disc, pid = runWithHelper(t, WithProcessGroup(true))
+	disc.kill()
+	require.Eventually(t, func() bool { return !processAlive(pid) }, 5*time.Second, 10*time.Millisecond)
+}
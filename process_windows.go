@@ -0,0 +1,132 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// tellCommandNotToSpawnShell avoids that the specified Cmd display a small
+// command prompt while running on Windows.
+func tellCommandNotToSpawnShell(oscmd *exec.Cmd) {
+	oscmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+}
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+)
+
+const (
+	processSetQuota                   = 0x0100
+	jobObjectExtendedLimitInformation = 9
+	jobObjectLimitKillOnJobClose      = 0x2000
+)
+
+// jobObjectExtendedLimitInfo is the JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+// structure of the Windows API.
+type jobObjectExtendedLimitInfo struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+	IoInfo                  [6]uint64
+	ProcessMemoryLimit      uintptr
+	JobMemoryLimit          uintptr
+	PeakProcessMemoryUsed   uintptr
+	PeakJobMemoryUsed       uintptr
+}
+
+// processJobs are the job objects of the processes started with
+// setProcessGroup, indexed by command.
+var (
+	processJobsMutex sync.Mutex
+	processJobs      = map[*exec.Cmd]syscall.Handle{}
+)
+
+// setProcessGroup makes the command run in a new process group, its
+// descendants are tracked by the job object created by attachProcessGroup.
+func setProcessGroup(oscmd *exec.Cmd) {
+	if oscmd.SysProcAttr == nil {
+		oscmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	oscmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// attachProcessGroup assigns the process of the started command to a new job
+// object, that kills all the processes of the job when closed: the
+// descendants spawned by the process are assigned to the job too, so they are
+// killed with it by killProcessGroup, or when the current process terminates.
+// The descendants spawned before the assignment, right after the start, are
+// not tracked.
+func attachProcessGroup(oscmd *exec.Cmd) error {
+	r, _, err := procCreateJobObjectW.Call(0, 0)
+	if r == 0 {
+		return err
+	}
+	job := syscall.Handle(r)
+	info := jobObjectExtendedLimitInfo{LimitFlags: jobObjectLimitKillOnJobClose}
+	if r, _, err := procSetInformationJobObject.Call(uintptr(job), jobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info)); r == 0 {
+		syscall.CloseHandle(job)
+		return err
+	}
+	process, err := syscall.OpenProcess(processSetQuota|syscall.PROCESS_TERMINATE, false, uint32(oscmd.Process.Pid))
+	if err != nil {
+		syscall.CloseHandle(job)
+		return err
+	}
+	defer syscall.CloseHandle(process)
+	if r, _, err := procAssignProcessToJobObject.Call(uintptr(job), uintptr(process)); r == 0 {
+		syscall.CloseHandle(job)
+		return err
+	}
+	processJobsMutex.Lock()
+	processJobs[oscmd] = job
+	processJobsMutex.Unlock()
+	return nil
+}
+
+// killProcessGroup kills the process of the command and all its descendants
+// through its job object, see attachProcessGroup. If the process has not been
+// assigned to a job only the process is killed.
+func killProcessGroup(oscmd *exec.Cmd) error {
+	processJobsMutex.Lock()
+	job, ok := processJobs[oscmd]
+	delete(processJobs, oscmd)
+	processJobsMutex.Unlock()
+	if !ok {
+		return oscmd.Process.Kill()
+	}
+	r, _, err := procTerminateJobObject.Call(uintptr(job), 1)
+	if closeErr := syscall.CloseHandle(job); r != 0 {
+		return closeErr
+	}
+	return errors.Join(err, oscmd.Process.Kill())
+}
@@ -0,0 +1,198 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VendorEventPrefix is the prefix of the event types reserved to the vendor
+// extensions of the protocol, in the form "x-<vendor>-<name>" (for example
+// "x-acme-scan-progress"). The vendor events may be sent by a discovery at
+// any time after the HELLO, with protocol version 2 or later, carrying their
+// data in the "payload" field: the clients not interested in them ignore them.
+const VendorEventPrefix = "x-"
+
+// IsVendorEventType returns true if the event type is reserved to the vendor
+// extensions, see VendorEventPrefix.
+func IsVendorEventType(eventType string) bool {
+	return strings.HasPrefix(eventType, VendorEventPrefix) && len(eventType) > len(VendorEventPrefix)
+}
+
+// The formats of the JSON messages sent by a discovery, see Server.SetOutputFormat.
+const (
+	// OutputFormatIndented formats each message on multiple indented lines,
+	// as in the examples of the specification. This is the default format.
+	OutputFormatIndented = "indented"
+	// OutputFormatCompact formats each message on a single line.
+	OutputFormatCompact = "compact"
+)
+
+// BuildHello returns the HELLO command, terminated by a newline, to request the
+// given protocol version with the given user agent.
+func BuildHello(protocolVersion int, userAgent string) string {
+	return fmt.Sprintf("%s %d \"%s\"\n", CommandHello, protocolVersion, userAgent)
+}
+
+// BuildHelloWithFiles returns the HELLO command, like BuildHello, extended to
+// announce the file descriptors passed to the discovery process: files maps
+// the name of each file to its descriptor number in the discovery process.
+func BuildHelloWithFiles(protocolVersion int, userAgent string, files map[string]int) string {
+	return BuildHelloWithOptions(protocolVersion, userAgent, files, "")
+}
+
+// BuildHelloWithOptions returns the HELLO command, like BuildHelloWithFiles,
+// extended to request the given output format to the discovery (see
+// OutputFormatCompact). If the format is empty the discovery uses its default
+// format and the command is understood also by the discoveries not supporting
+// the option.
+func BuildHelloWithOptions(protocolVersion int, userAgent string, files map[string]int, format string) string {
+	return BuildHelloWithCompression(protocolVersion, userAgent, files, format, "")
+}
+
+// BuildHelloWithCompression returns the HELLO command, like
+// BuildHelloWithOptions, extended to request the compression of the messages
+// sent by the discovery (see CompressionGzip and CompressionZstd). If the
+// compression is empty the command is understood also by the discoveries not
+// supporting the option.
+func BuildHelloWithCompression(protocolVersion int, userAgent string, files map[string]int, format, compression string) string {
+	cmd := fmt.Sprintf("%s %d \"%s\"", CommandHello, protocolVersion, userAgent)
+	if len(files) > 0 {
+		cmd += " fds=" + formatHelloFiles(files)
+	}
+	if format != "" {
+		cmd += " format=" + format
+	}
+	if compression != "" {
+		cmd += " compression=" + compression
+	}
+	return cmd + "\n"
+}
+
+func formatHelloFiles(files map[string]int) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return files[names[i]] < files[names[j]] })
+	fds := make([]string, len(names))
+	for i, name := range names {
+		fds[i] = fmt.Sprintf("%s:%d", name, files[name])
+	}
+	return strings.Join(fds, ",")
+}
+
+// BuildCommand returns the given command (that must not have arguments)
+// terminated by a newline.
+func BuildCommand(command string) string {
+	return command + "\n"
+}
+
+// BuildStart returns the given START or START_SYNC command, terminated by a
+// newline, with the given parameters (available since protocol version 2, see
+// ParamsStarter).
+func BuildStart(command string, params map[string]string) string {
+	if len(params) == 0 {
+		return BuildCommand(command)
+	}
+	return command + " " + encodeStartParams(params) + "\n"
+}
+
+// BuildConfigure returns the CONFIGURE command, terminated by a newline, to set
+// the given configuration key to the given value. The key must not contain spaces
+// and the value must not contain newlines.
+func BuildConfigure(key, value string) string {
+	return fmt.Sprintf("%s %s %s\n", CommandConfigure, key, value)
+}
+
+// ParseHelloResponse parses the response to the HELLO command and returns the
+// protocol version selected by the discovery.
+func ParseHelloResponse(data []byte) (int, error) {
+	var msg discoveryMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return 0, err
+	}
+	return helloResponse(&msg)
+}
+
+// ParseListResponse parses the response to the LIST command and returns
+// the list of ports.
+func ParseListResponse(data []byte) ([]*Port, error) {
+	var msg discoveryMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return listResponse(&msg)
+}
+
+// checkOkResponse checks that msg is a successful response of the given event type.
+func checkOkResponse(msg *discoveryMessage, eventType string) error {
+	if msg.EventType != eventType {
+		return fmt.Errorf("event out of sync, expected '%s', received '%s'", eventType, msg.EventType)
+	} else if msg.Error {
+		return fmt.Errorf("command failed: %s", msg.Message)
+	} else if strings.ToUpper(msg.Message) != "OK" {
+		return fmt.Errorf("communication out of sync, expected 'OK', received '%s'", msg.Message)
+	}
+	return nil
+}
+
+func helloResponse(msg *discoveryMessage) (int, error) {
+	if err := checkOkResponse(msg, EventTypeHello); err != nil {
+		return 0, err
+	}
+	if msg.ProtocolVersion > maxProtocolVersion {
+		return 0, fmt.Errorf("protocol version not supported: requested %d, got %d", maxProtocolVersion, msg.ProtocolVersion)
+	}
+	return max(msg.ProtocolVersion, 1), nil
+}
+
+// listCancelledMessage is the message of the error response to a LIST
+// cancelled by a STOP_LIST.
+const listCancelledMessage = "list cancelled"
+
+func listResponse(msg *discoveryMessage) ([]*Port, error) {
+	if msg.EventType != EventTypeList {
+		return nil, fmt.Errorf("event out of sync, expected '%s', received '%s'", EventTypeList, msg.EventType)
+	} else if msg.Error && msg.Message == listCancelledMessage {
+		return nil, ErrListCancelled
+	} else if msg.Error {
+		return nil, fmt.Errorf("command failed: %s", msg.Message)
+	}
+	for _, port := range msg.Ports {
+		if port == nil {
+			return nil, errors.New("invalid 'list' message: null port")
+		}
+	}
+	return msg.Ports, nil
+}
+
+func describeResponse(msg *discoveryMessage) (*Description, error) {
+	if msg.EventType != EventTypeDescribe {
+		return nil, fmt.Errorf("event out of sync, expected '%s', received '%s'", EventTypeDescribe, msg.EventType)
+	} else if msg.Error {
+		return nil, fmt.Errorf("command failed: %s", msg.Message)
+	} else if msg.Description == nil {
+		return nil, errors.New("invalid 'describe' message: missing description")
+	}
+	return msg.Description, nil
+}
@@ -0,0 +1,49 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import _ "embed" // required by go:embed
+
+//go:generate go run ./cmd/protocolgen -spec protocol_spec.json -out protocol_spec_gen.go
+
+// protocolSpec is the machine-readable specification of the protocol: the
+// constants of the commands and of the event types, the message struct, the
+// tables validating the messages and the transitions of the state machine are
+// generated from it (see protocol_spec_gen.go), run "go generate" after
+// changing it.
+//
+//go:embed protocol_spec.json
+var protocolSpec []byte
+
+// ProtocolSpec returns the machine-readable specification of the pluggable
+// discovery protocol, as JSON: the commands with their responses and the
+// minimum protocol version, the event types, the states with their
+// transitions, and the JSON schema of the messages sent by the discovery. It's
+// the source of the definitions of this package, it may be used to generate
+// the bindings of the protocol in other languages and its documentation.
+func ProtocolSpec() []byte {
+	return append([]byte{}, protocolSpec...)
+}
+
+// ResponseEventType returns the event type of the response to the given
+// command of the specification, ok is false if the command has no response,
+// like STOP_LIST, or if it's not a command of the specification.
+func ResponseEventType(command string) (eventType string, ok bool) {
+	eventType, ok = responseEventTypes[command]
+	return eventType, ok
+}
@@ -0,0 +1,52 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/arduino/pluggable-discovery-protocol-handler/v2/internal/protocolgen"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolSpec(t *testing.T) {
+	// The generated definitions are in sync with the specification
+	generated, err := protocolgen.Generate(ProtocolSpec(), "discovery")
+	require.NoError(t, err)
+	current, err := os.ReadFile("protocol_spec_gen.go")
+	require.NoError(t, err)
+	require.Equal(t, string(generated), string(current), "protocol_spec_gen.go is outdated, run go generate")
+
+	spec, err := protocolgen.Parse(ProtocolSpec())
+	require.NoError(t, err)
+	require.Equal(t, maxProtocolVersion, spec.ProtocolVersions[len(spec.ProtocolVersions)-1])
+	for i, state := range spec.States {
+		require.Equal(t, State(i).String(), state.Name)
+	}
+	var schema map[string]any
+	require.NoError(t, json.Unmarshal(spec.Message, &schema))
+	require.Equal(t, "object", schema["type"])
+
+	// The inconsistencies of the specification are detected
+	_, err = protocolgen.Parse([]byte(`{"commands":[{"name":"HELLO","response":"hi"}]}`))
+	require.EqualError(t, err, "unknown response hi of command HELLO")
+	_, err = protocolgen.Parse([]byte(`{"states":[{"name":"idle","transitions":[{"command":"START","to":"idle"}]}]}`))
+	require.EqualError(t, err, "unknown command START in the transitions of state idle")
+}
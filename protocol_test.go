@@ -0,0 +1,77 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolBuilders(t *testing.T) {
+	require.Equal(t, "HELLO 2 \"arduino-cli test\"\n", BuildHello(2, "arduino-cli test"))
+	require.Equal(t, "START_SYNC\n", BuildCommand(CommandStartSync))
+	require.Equal(t, "HELLO 2 \"test\" fds=usb:3,sock:4\n", BuildHelloWithFiles(2, "test", map[string]int{"sock": 4, "usb": 3}))
+	require.Equal(t, BuildHello(2, "test"), BuildHelloWithFiles(2, "test", nil))
+
+	require.Equal(t, "HELLO 2 \"test\" fds=usb:3 format=compact\n", BuildHelloWithOptions(2, "test", map[string]int{"usb": 3}, OutputFormatCompact))
+	require.Equal(t, "HELLO 2 \"test\" format=compact\n", BuildHelloWithOptions(2, "test", nil, OutputFormatCompact))
+	require.Equal(t, BuildHello(2, "test"), BuildHelloWithOptions(2, "test", nil, ""))
+
+	hello, err := parseHelloArgs(`2 "test" fds=usb:3,sock:4`)
+	require.NoError(t, err)
+	require.Equal(t, 2, hello.protocolVersion)
+	require.Equal(t, "test", hello.userAgent)
+	require.Equal(t, map[string]uintptr{"usb": 3, "sock": 4}, hello.fds)
+	require.Empty(t, hello.format)
+	_, err = parseHelloArgs(`2 "test" fds=stdout:1`)
+	require.EqualError(t, err, "Invalid file descriptor: stdout:1")
+	hello, err = parseHelloArgs(`2 "test" fds=usb:3 format=compact`)
+	require.NoError(t, err)
+	require.Equal(t, OutputFormatCompact, hello.format)
+	_, err = parseHelloArgs(`2 "test" format=xml`)
+	require.EqualError(t, err, "Invalid output format: xml")
+
+	require.Equal(t, "HELLO 2 \"test\" format=compact compression=gzip\n", BuildHelloWithCompression(2, "test", nil, OutputFormatCompact, CompressionGzip))
+	require.Equal(t, BuildHello(2, "test"), BuildHelloWithCompression(2, "test", nil, "", ""))
+	hello, err = parseHelloArgs(`2 "test" format=compact compression=gzip`)
+	require.NoError(t, err)
+	require.Equal(t, CompressionGzip, hello.compression)
+	hello, err = parseHelloArgs(`2 "test" compression=zstd`)
+	require.NoError(t, err)
+	require.Equal(t, CompressionZstd, hello.compression)
+	_, err = parseHelloArgs(`2 "test" compression=brotli`)
+	require.EqualError(t, err, "Unsupported compression: brotli")
+
+	v, err := ParseHelloResponse([]byte(`{"eventType":"hello","protocolVersion":1,"message":"OK"}`))
+	require.NoError(t, err)
+	require.Equal(t, 1, v)
+	_, err = ParseHelloResponse([]byte(`{"eventType":"hello","protocolVersion":3,"message":"OK"}`))
+	require.Error(t, err)
+	_, err = ParseHelloResponse([]byte(`{"eventType":"hello","error":true,"message":"Invalid HELLO command"}`))
+	require.EqualError(t, err, "command failed: Invalid HELLO command")
+
+	ports, err := ParseListResponse([]byte(`{"eventType":"list","ports":[{"address":"1","protocol":"dummy"}]}`))
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+	require.Equal(t, "1", ports[0].Address)
+	_, err = ParseListResponse([]byte(`{"eventType":"start","message":"OK"}`))
+	require.EqualError(t, err, "event out of sync, expected 'list', received 'start'")
+	_, err = ParseListResponse([]byte(`{"eventType":"list"`))
+	require.Error(t, err)
+}
@@ -0,0 +1,57 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY allocates a pseudo-terminal and returns its master and slave sides,
+// the ioctls are the ones used by grantpt, unlockpt and ptsname of the libc.
+func openPTY() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ptyIoctl(master, syscall.TIOCPTYGRANT, nil); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("granting pseudo-terminal: %w", err)
+	}
+	if err := ptyIoctl(master, syscall.TIOCPTYUNLK, nil); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlocking pseudo-terminal: %w", err)
+	}
+	name := make([]byte, 128)
+	if err := ptyIoctl(master, syscall.TIOCPTYGNAME, unsafe.Pointer(&name[0])); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("getting pseudo-terminal name: %w", err)
+	}
+	if i := bytes.IndexByte(name, 0); i != -1 {
+		name = name[:i]
+	}
+	slave, err := os.OpenFile(string(name), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
@@ -0,0 +1,47 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY allocates a pseudo-terminal and returns its master and slave sides:
+// on FreeBSD posix_openpt is a system call, and the pseudo-terminals don't
+// need to be granted and unlocked.
+func openPTY() (*os.File, *os.File, error) {
+	fd, _, errno := syscall.Syscall(syscall.SYS_POSIX_OPENPT, uintptr(syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC), 0, 0)
+	if errno != 0 {
+		return nil, nil, fmt.Errorf("opening pseudo-terminal: %w", errno)
+	}
+	master := os.NewFile(fd, "/dev/ptmx")
+	var number uint32
+	if err := ptyIoctl(master, syscall.TIOCGPTN, unsafe.Pointer(&number)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("getting pseudo-terminal number: %w", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
@@ -0,0 +1,139 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+var (
+	registryMutex sync.Mutex
+	registry      = map[string]func() Discovery{}
+)
+
+// Register makes a Discovery implementation compiled into the current binary
+// available with the given name, to be run in-process with NewInProcessClient
+// on the hosts that cannot spawn subprocesses (mobile, WASM, ...). The factory
+// is called to create a new Discovery each time the Client is started. Register
+// is usually called from an init function and panics if the name is empty or
+// already registered.
+func Register(name string, factory func() Discovery) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if name == "" {
+		panic("discovery: Register with empty name")
+	}
+	if factory == nil {
+		panic("discovery: Register factory is nil for " + name)
+	}
+	if _, exists := registry[name]; exists {
+		panic("discovery: Register called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+// Registered returns the sorted names of the registered Discovery implementations.
+func Registered() []string {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func registeredFactory(name string) (func() Discovery, error) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	factory, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("discovery %s not registered", name)
+	}
+	return factory, nil
+}
+
+// NewInProcessClient creates a new Client for the Discovery registered with
+// the given name (see Register). The Client is used exactly as the Client of
+// a discovery executable, but the Discovery runs in a Server inside the
+// current process and no subprocess is spawned. The settings of the process
+// (stderr, environment, extra files) are ignored and ProcessInfo returns nil.
+func NewInProcessClient(id, name string) *Client {
+	disc := NewClient(id)
+	disc.inProcessName = name
+	return disc
+}
+
+// inProcessServer is a Server running in-process, connected to the Client
+// through a pair of pipes.
+type inProcessServer struct {
+	commands *io.PipeWriter
+	messages *io.PipeReader
+	done     chan struct{}
+}
+
+// startInProcessServer runs a Server for the Discovery created by the factory
+// and returns the server and the stream of the messages sent by the Server.
+func (disc *Client) startInProcessServer(factory func() Discovery) (*inProcessServer, io.Reader) {
+	commandsReader, commandsWriter := io.Pipe()
+	messagesReader, messagesWriter := io.Pipe()
+	s := &inProcessServer{
+		commands: commandsWriter,
+		messages: messagesReader,
+		done:     make(chan struct{}),
+	}
+	server := NewServer(factory())
+	go func() {
+		defer close(s.done)
+		_ = server.Run(commandsReader, disconnectedWriter{messagesWriter})
+		// The client sees the termination of the Server as the
+		// termination of a discovery process
+		messagesWriter.Close()
+		commandsReader.Close()
+	}()
+	return s, messagesReader
+}
+
+// disconnectedWriter discards the data written after the reader of the pipe
+// has been closed, in place of failing, since the Server panics if it can't
+// write its output.
+type disconnectedWriter struct {
+	w *io.PipeWriter
+}
+
+func (w disconnectedWriter) Write(data []byte) (int, error) {
+	n, err := w.w.Write(data)
+	if errors.Is(err, io.ErrClosedPipe) {
+		return len(data), nil
+	}
+	return n, err
+}
+
+// kill disconnects the Server and waits for its termination. The Discovery is
+// expected to terminate its pending work when the context of the Server is
+// cancelled.
+func (s *inProcessServer) kill() {
+	s.commands.Close()
+	s.messages.Close()
+	<-s.done
+}
@@ -0,0 +1,90 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type registeredDiscovery struct {
+	nullDiscovery
+}
+
+func (d *registeredDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	eventCB(EventTypeAdd, &Port{Address: "1", Protocol: "inprocess"})
+	return nil
+}
+
+func init() {
+	Register("test-inprocess", func() Discovery { return &registeredDiscovery{} })
+}
+
+func TestInProcessClient(t *testing.T) {
+	require.Contains(t, Registered(), "test-inprocess")
+	require.Panics(t, func() { Register("test-inprocess", func() Discovery { return &nullDiscovery{} }) })
+
+	cl := NewInProcessClient("1", "test-inprocess")
+	require.NoError(t, cl.Run())
+	require.True(t, cl.Alive())
+	require.Nil(t, cl.ProcessInfo())
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	ev := <-events
+	require.Equal(t, EventTypeAdd, ev.Type)
+	require.Equal(t, "inprocess", ev.Port.Protocol)
+	require.Equal(t, uint64(1), ev.Seq)
+	require.NoError(t, cl.Stop())
+	ev = <-events
+	require.Equal(t, EventTypeStop, ev.Type)
+	require.Equal(t, uint64(2), ev.Seq)
+
+	// The sequence continues in the following sync sessions
+	events, err = cl.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), (<-events).Seq)
+	require.NoError(t, cl.Stop())
+	cl.Quit()
+	require.False(t, cl.Alive())
+
+	// The Client may be run again, with a new Discovery
+	require.NoError(t, cl.Run())
+	require.NoError(t, cl.Start())
+	ports, err := cl.List()
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+	cl.Quit()
+
+	require.EqualError(t, NewInProcessClient("1", "unknown").Run(), "discovery unknown not registered")
+
+	// The registered discoveries are available to the Manager
+	m := NewManager()
+	require.NoError(t, m.LoadConfig(&ManagerConfig{Discoveries: []*DiscoveryConfig{
+		{ID: "inprocess", InProcess: "test-inprocess"},
+	}}))
+	require.Error(t, m.LoadConfig(&ManagerConfig{Discoveries: []*DiscoveryConfig{
+		{ID: "unknown", InProcess: "unknown"},
+	}}))
+	require.Empty(t, m.Start())
+	ports, errs := m.ListAll()
+	require.Empty(t, errs)
+	require.Len(t, ports, 1)
+	require.NoError(t, m.QuitAll(context.Background()))
+}
@@ -0,0 +1,111 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// RemoteProxy forwards the communication between a discovery and a client
+// reached through a network link, compacting the events that the link can't
+// transmit as fast as the discovery produces them: the messages of the
+// discovery are queued, an "add" and a "remove" of a port never transmitted
+// cancel out, and the repeated events of the same port are collapsed to the
+// latest state. The other messages are forwarded unchanged, in their order
+// with respect to the events. When the queue is full of events of different
+// ports the output of the discovery is no longer read until the link catches
+// up. The messages must be plain JSON: the proxy can't be used with the
+// compression or the stdio encryption.
+type RemoteProxy struct {
+	queue *outputCompactor
+}
+
+// NewRemoteProxy creates a RemoteProxy queueing at most queueSize messages of
+// the discovery. A queueSize lower than 1 is raised to 1.
+func NewRemoteProxy(queueSize int) *RemoteProxy {
+	return &RemoteProxy{queue: newOutputCompactor(max(queueSize, 1))}
+}
+
+// Run forwards the commands read from client to toDiscovery, and the messages
+// read from fromDiscovery to toClient, until the discovery closes its output
+// and the queued messages have been written. The writers are closed, if they
+// are io.Closer, when the corresponding reader is closed. Run must be called
+// only once.
+func (p *RemoteProxy) Run(client io.Reader, toClient io.Writer, toDiscovery io.Writer, fromDiscovery io.Reader) error {
+	go func() {
+		_, _ = io.Copy(toDiscovery, client)
+		if closer, ok := toDiscovery.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+	written := make(chan error, 1)
+	go func() {
+		written <- p.writeMessages(toClient)
+	}()
+	err := p.readMessages(fromDiscovery)
+	p.queue.close()
+	if writeErr := <-written; err == nil {
+		err = writeErr
+	}
+	if closer, ok := toClient.(io.Closer); ok {
+		closer.Close()
+	}
+	return err
+}
+
+// CompactedEvents returns the number of events discarded so far, because
+// superseded by a following event of the same port.
+func (p *RemoteProxy) CompactedEvents() uint64 {
+	p.queue.mutex.Lock()
+	defer p.queue.mutex.Unlock()
+	return p.queue.compacted
+}
+
+func (p *RemoteProxy) readMessages(fromDiscovery io.Reader) error {
+	decoder := json.NewDecoder(fromDiscovery)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		data := append([]byte(raw), '\n')
+		msg := &message{}
+		if err := json.Unmarshal(raw, msg); err == nil && msg.Port != nil &&
+			(msg.EventType == EventTypeAdd || msg.EventType == EventTypeRemove) {
+			p.queue.pushEvent(msg.EventType, msg.Port, data)
+		} else {
+			p.queue.pushMessage(data)
+		}
+	}
+}
+
+// writeMessages writes the queued messages to toClient until the queue is
+// closed. After a write error the messages are discarded, so that the
+// discovery is never blocked, and the error is returned at the end.
+func (p *RemoteProxy) writeMessages(toClient io.Writer) error {
+	var err error
+	for data := p.queue.pop(); data != nil; data = p.queue.pop() {
+		if err == nil {
+			_, err = toClient.Write(data)
+		}
+	}
+	return err
+}
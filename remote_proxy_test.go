@@ -0,0 +1,88 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteProxyCompaction(t *testing.T) {
+	impl := &callbackDiscovery{started: make(chan EventCallback, 1)}
+	server := NewServer(impl)
+	proxy := NewRemoteProxy(10)
+	toDiscoveryR, toDiscoveryW := io.Pipe()
+	fromDiscoveryR, fromDiscoveryW := io.Pipe()
+	go func() {
+		server.Run(toDiscoveryR, fromDiscoveryW)
+		fromDiscoveryW.Close()
+	}()
+	clientInR, clientInW := io.Pipe()
+	clientOutR, clientOutW := io.Pipe()
+	proxyErr := make(chan error, 1)
+	go func() {
+		proxyErr <- proxy.Run(clientInR, clientOutW, toDiscoveryW, fromDiscoveryR)
+	}()
+	conn := &testServerConn{t: t, in: clientInW, decoder: json.NewDecoder(clientOutR)}
+	conn.send(`HELLO 1 "test"`)
+	require.Equal(t, "hello", conn.recv().EventType)
+	requireCompacted := func(expected uint64) {
+		require.Eventually(t, func() bool { return proxy.CompactedEvents() == expected }, time.Second, time.Millisecond)
+	}
+
+	// The output is not read, so the events are queued and compacted
+	conn.send("START_SYNC")
+	eventCB := <-impl.started
+	eventCB("add", &Port{Address: "1", Protocol: "test"})
+	eventCB("add", &Port{Address: "2", Protocol: "test"})
+	eventCB("remove", &Port{Address: "1", Protocol: "test"})
+	eventCB("add", &Port{Address: "2", Protocol: "test", AddressLabel: "updated"})
+	eventCB("add", &Port{Address: "3", Protocol: "test"})
+	requireCompacted(3)
+
+	require.Equal(t, "start_sync", conn.recv().EventType)
+	msg := conn.recv()
+	require.Equal(t, "add", msg.EventType)
+	require.Equal(t, "2", msg.Port.Address)
+	require.Equal(t, "updated", msg.Port.AddressLabel)
+	msg = conn.recv()
+	require.Equal(t, "add", msg.EventType)
+	require.Equal(t, "3", msg.Port.Address)
+
+	// A port already transmitted is removed, the add of the port 4 keeps
+	// the output busy while the following events are compacted
+	eventCB("add", &Port{Address: "4", Protocol: "test"})
+	eventCB("add", &Port{Address: "3", Protocol: "test", AddressLabel: "updated"})
+	eventCB("remove", &Port{Address: "3", Protocol: "test"})
+	requireCompacted(4)
+	require.Equal(t, "4", conn.recv().Port.Address)
+	msg = conn.recv()
+	require.Equal(t, "remove", msg.EventType)
+	require.Equal(t, "3", msg.Port.Address)
+
+	// The proxy terminates with the discovery
+	conn.send("QUIT")
+	require.Equal(t, "quit", conn.recv().EventType)
+	require.NoError(t, <-proxyErr)
+	_, err := conn.decoder.Token()
+	require.ErrorIs(t, err, io.EOF)
+}
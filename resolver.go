@@ -0,0 +1,133 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrDiscoveryNotFound is returned by the Resolver when the discovery
+// executable can not be found in any of the packages directories.
+var ErrDiscoveryNotFound = errors.New("discovery executable not found")
+
+// ErrVersionMismatch is returned by the Resolver when the version reported
+// by the discovery executable doesn't match the expected version.
+type ErrVersionMismatch struct {
+	Path     string
+	Expected string
+	Found    string
+}
+
+func (e *ErrVersionMismatch) Error() string {
+	return fmt.Sprintf("discovery %s version mismatch: expected %s, found %s", e.Path, e.Expected, e.Found)
+}
+
+// versionCheckTimeout is the maximum time allowed to the discovery to print its version.
+const versionCheckTimeout = 5 * time.Second
+
+// A Resolver locates the discovery executables installed in the packages
+// directories, with the same layout used by the Arduino CLI:
+//
+//	<packages dir>/<packager>/tools/<tool>/<version>/<tool>[.exe]
+//
+// and checks that the executables report the expected version when run
+// with the --version flag.
+type Resolver struct {
+	packagesDirs []string
+}
+
+// NewResolver creates a Resolver that looks for the discovery executables
+// in the given packages directories, in order.
+func NewResolver(packagesDirs ...string) *Resolver {
+	return &Resolver{packagesDirs: packagesDirs}
+}
+
+// Resolve returns the path of the executable of the given version of the
+// discovery tool. ErrDiscoveryNotFound is returned if the executable is not
+// installed, an ErrVersionMismatch if the executable reports a different version.
+func (r *Resolver) Resolve(packager, tool, version string) (string, error) {
+	return r.ResolveTool(&ToolDescriptor{Packager: packager, Name: tool, Version: version})
+}
+
+// ResolveTool returns the path of the executable of the discovery tool
+// described by the descriptor, see Resolve.
+func (r *Resolver) ResolveTool(desc *ToolDescriptor) (string, error) {
+	for _, dir := range r.packagesDirs {
+		path := filepath.Join(dir, desc.executablePath())
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		found, err := executableVersion(path, desc.versionFlag())
+		if err != nil {
+			return "", err
+		}
+		if normalizeVersion(found) != normalizeVersion(desc.Version) {
+			return "", &ErrVersionMismatch{Path: path, Expected: desc.Version, Found: found}
+		}
+		return path, nil
+	}
+	return "", fmt.Errorf("%w: %s:%s@%s", ErrDiscoveryNotFound, desc.Packager, desc.Name, desc.Version)
+}
+
+// NewClient resolves the given version of the discovery tool and returns
+// a Client to run it with the given arguments.
+func (r *Resolver) NewClient(id, packager, tool, version string, args ...string) (*Client, error) {
+	return r.NewToolClient(id, &ToolDescriptor{Packager: packager, Name: tool, Version: version, Args: args})
+}
+
+// NewToolClient resolves the discovery tool described by the descriptor and
+// returns a Client to run it with the arguments of the descriptor.
+func (r *Resolver) NewToolClient(id string, desc *ToolDescriptor) (*Client, error) {
+	path, err := r.ResolveTool(desc)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(id, append([]string{path}, desc.Args...)...), nil
+}
+
+// executableVersion runs the executable with the given version flag and
+// returns the version reported, the output is expected in the format:
+//
+//	<tool> <version> [other info]
+func executableVersion(path, versionFlag string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), versionCheckTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, versionFlag)
+	tellCommandNotToSpawnShell(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("getting version of discovery %s: %w", path, err)
+	}
+	firstLine, _, _ := strings.Cut(string(out), "\n")
+	fields := strings.Fields(firstLine)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("getting version of discovery %s: invalid output '%s'", path, firstLine)
+	}
+	return fields[1], nil
+}
+
+func normalizeVersion(version string) string {
+	return strings.TrimPrefix(version, "v")
+}
@@ -0,0 +1,93 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver(t *testing.T) {
+	packagesDir := t.TempDir()
+	executable := "dummy-discovery"
+	if runtime.GOOS == "windows" {
+		executable += ".exe"
+	}
+	toolPath := filepath.Join(packagesDir, "builtin", "tools", "dummy-discovery", "1.2.3", executable)
+	builder, err := paths.NewProcess(nil, "go", "build", "-o", toolPath,
+		"-ldflags", "-X github.com/arduino/pluggable-discovery-protocol-handler/v2/dummy-discovery/args.Tag=v1.2.3")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	resolver := NewResolver(filepath.Join(packagesDir, "missing"), packagesDir)
+	path, err := resolver.Resolve("builtin", "dummy-discovery", "1.2.3")
+	require.NoError(t, err)
+	require.Equal(t, toolPath, path)
+
+	disc, err := resolver.NewClient("dummy", "builtin", "dummy-discovery", "1.2.3")
+	require.NoError(t, err)
+	require.NoError(t, disc.Run())
+	disc.Quit()
+
+	_, err = resolver.Resolve("builtin", "dummy-discovery", "1.0.0")
+	require.ErrorIs(t, err, ErrDiscoveryNotFound)
+
+	// The executable installed in the wrong directory is refused
+	wrongPath := filepath.Join(packagesDir, "builtin", "tools", "dummy-discovery", "2.0.0", executable)
+	require.NoError(t, paths.New(wrongPath).Parent().MkdirAll())
+	require.NoError(t, paths.New(toolPath).CopyTo(paths.New(wrongPath)))
+	require.NoError(t, os.Chmod(wrongPath, 0755))
+	_, err = resolver.Resolve("builtin", "dummy-discovery", "2.0.0")
+	var mismatch *ErrVersionMismatch
+	require.ErrorAs(t, err, &mismatch)
+	require.Equal(t, wrongPath, mismatch.Path)
+	require.Equal(t, "2.0.0", mismatch.Expected)
+	require.Equal(t, "v1.2.3", mismatch.Found)
+
+	// A tool with a custom layout and version flag
+	desc := &ToolDescriptor{
+		Packager:    "vendor",
+		Name:        "dummy-discovery",
+		Version:     "1.2.3",
+		PathPattern: "{packager}/tools/{name}/{version}/bin/{name}-{version}",
+		VersionFlag: "-v",
+	}
+	customPath := filepath.Join(packagesDir, "vendor", "tools", "dummy-discovery", "1.2.3", "bin", "dummy-discovery-1.2.3")
+	if runtime.GOOS == "windows" {
+		customPath += ".exe"
+	}
+	require.NoError(t, paths.New(customPath).Parent().MkdirAll())
+	require.NoError(t, paths.New(toolPath).CopyTo(paths.New(customPath)))
+	require.NoError(t, os.Chmod(customPath, 0755))
+	path, err = resolver.ResolveTool(desc)
+	require.NoError(t, err)
+	require.Equal(t, customPath, path)
+
+	m := NewManager()
+	require.NoError(t, m.AddTool("custom", resolver, desc))
+	require.Equal(t, []string{customPath}, m.discoveries["custom"].processArgs)
+	desc.Version = "3.0.0"
+	require.ErrorIs(t, m.AddTool("missing", resolver, desc), ErrDiscoveryNotFound)
+	require.Equal(t, []string{"custom"}, m.IDs())
+}
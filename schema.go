@@ -0,0 +1,78 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// PortSchema describes the properties that the ports of a protocol are expected
+// to carry, see Client.SetPortSchema.
+type PortSchema struct {
+	// RequiredKeys are the property keys that must be present in each port.
+	RequiredKeys []string
+	// Values are the regular expressions that the value of the properties must
+	// match, indexed by property key. The properties not present in the port
+	// are not checked.
+	Values map[string]*regexp.Regexp
+}
+
+// Check returns the list of the violations of the schema by the given port.
+func (s *PortSchema) Check(port *Port) []error {
+	var res []error
+	for _, key := range s.RequiredKeys {
+		if port.Properties == nil || !port.Properties.ContainsKey(key) {
+			res = append(res, fmt.Errorf("port %s (protocol %s): missing required property %s", port, port.Protocol, key))
+		}
+	}
+	if port.Properties == nil {
+		return res
+	}
+	for _, key := range port.Properties.Keys() {
+		re, ok := s.Values[key]
+		if !ok {
+			continue
+		}
+		if value := port.Properties.Get(key); !re.MatchString(value) {
+			res = append(res, fmt.Errorf("port %s (protocol %s): invalid value '%s' for property %s, expected to match %s", port, port.Protocol, value, key, re))
+		}
+	}
+	return res
+}
+
+// SetPortSchema sets the schema that the ports of the given protocol, received
+// from the discovery, are checked against. In sync mode the violations are
+// reported with EventTypeWarning events, sent just before the offending port
+// event that is delivered anyway, otherwise they are logged. A nil schema
+// removes the checks for the protocol. It must be called before Run.
+//
+// Deprecated: use the WithPortSchema option of NewClientWithOptions.
+func (disc *Client) SetPortSchema(protocol string, schema *PortSchema) {
+	WithPortSchema(protocol, schema)(disc)
+}
+
+// checkPortSchema returns the violations of the schema of the port protocol,
+// if any.
+func (disc *Client) checkPortSchema(port *Port) []error {
+	schema, ok := disc.portSchemas[port.Protocol]
+	if !ok {
+		return nil
+	}
+	return schema.Check(port)
+}
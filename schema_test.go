@@ -0,0 +1,62 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/arduino/go-properties-orderedmap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortSchemaCheck(t *testing.T) {
+	schema := &PortSchema{
+		RequiredKeys: []string{"vid", "pid"},
+		Values: map[string]*regexp.Regexp{
+			"vid": regexp.MustCompile(`^0x[0-9a-fA-F]{4}$`),
+			"pid": regexp.MustCompile(`^0x[0-9a-fA-F]{4}$`),
+		},
+	}
+	port := &Port{
+		Address:    "/dev/ttyACM0",
+		Protocol:   "serial",
+		Properties: properties.NewFromHashmap(map[string]string{"vid": "0x2341", "pid": "0x0043"}),
+	}
+	require.Empty(t, schema.Check(port))
+
+	port.Properties.Set("pid", "43")
+	port.Properties.Remove("vid")
+	violations := schema.Check(port)
+	require.Len(t, violations, 2)
+	require.EqualError(t, violations[0], "port /dev/ttyACM0 (protocol serial): missing required property vid")
+	require.EqualError(t, violations[1], "port /dev/ttyACM0 (protocol serial): invalid value '43' for property pid, expected to match ^0x[0-9a-fA-F]{4}$")
+
+	port.Properties = nil
+	require.Len(t, schema.Check(port), 2)
+}
+
+func TestClientPortSchema(t *testing.T) {
+	disc := NewClient("test")
+	schema := &PortSchema{RequiredKeys: []string{"vid"}}
+	disc.SetPortSchema("serial", schema)
+	require.Len(t, disc.checkPortSchema(&Port{Address: "1", Protocol: "serial"}), 1)
+	require.Empty(t, disc.checkPortSchema(&Port{Address: "1", Protocol: "network"}))
+	disc.SetPortSchema("serial", nil)
+	require.Empty(t, disc.checkPortSchema(&Port{Address: "1", Protocol: "serial"}))
+}
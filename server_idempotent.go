@@ -0,0 +1,54 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+// SetIdempotentCommands makes the server tolerate the commands repeated by
+// the client, for example by the wrappers resending the commands after a
+// retry of the transport: a HELLO identical to the first one is answered with
+// the same acknowledgement, a START when the discovery is already started and a
+// STOP when it's already stopped are answered with "OK". The acknowledgements
+// of the repeated commands have a note explaining that the command has been
+// ignored. The option is disabled by default, as the specification requires an
+// error for the repeated commands. This method must be called before Run.
+func (d *Server) SetIdempotentCommands(enabled bool) {
+	d.idempotentCommands = enabled
+}
+
+// repeatedCommand answers the command, if it's a repetition tolerated by the
+// idempotent commands, and returns true. See SetIdempotentCommands.
+func (d *Server) repeatedCommand(cmd, args string) bool {
+	if !d.idempotentCommands {
+		return false
+	}
+	switch {
+	case cmd == CommandHello && d.state != StateUninitialized && d.state != StateQuit && args == d.helloArgs:
+		d.send(&message{
+			EventType:       EventTypeHello,
+			ProtocolVersion: int(d.protocolVersion.Load()),
+			Message:         "OK",
+			Note:            "HELLO already called",
+		})
+	case cmd == CommandStart && d.state == StateStarted:
+		d.send(messageOkWithNote(EventTypeStart, "Discovery already STARTed"))
+	case cmd == CommandStop && d.state == StateIdle:
+		d.send(messageOkWithNote(EventTypeStop, "Discovery already STOPped"))
+	default:
+		return false
+	}
+	return true
+}
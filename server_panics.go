@@ -0,0 +1,82 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is the error reported to the client when the Discovery
+// implementation panics while serving a command. The Server recovers the
+// panic and keeps serving the commands, see Server.RecoveredPanics.
+type PanicError struct {
+	// Method is the name of the method of the implementation that panicked.
+	Method string
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in %s: %v\n%s", e.Method, e.Value, e.Stack)
+}
+
+// RecoveredPanics returns the number of panics of the Discovery implementation
+// recovered by the Server. Only the panics raised while serving a command are
+// recovered: a panic in a goroutine started by the implementation still
+// terminates the process.
+func (d *Server) RecoveredPanics() uint64 {
+	return d.recoveredPanics.Load()
+}
+
+// protect calls the given method of the implementation, converting a panic
+// into a *PanicError.
+func (d *Server) protect(method string, call func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			d.recoveredPanics.Add(1)
+			err = &PanicError{Method: method, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return call()
+}
+
+// stopAfterPanic stops the implementation if the StartSync failed with a
+// panic, since it may have been left partially started.
+func (d *Server) stopAfterPanic(err error) {
+	if isPanicError(err) {
+		_ = d.protect("Stop", d.impl.Stop)
+	}
+}
+
+func isPanicError(err error) bool {
+	var panicErr *PanicError
+	return errors.As(err, &panicErr)
+}
+
+// recoverToIdle brings the Server back to the Idle state after a panic of
+// the implementation in START or sync mode, stopping the implementation.
+func (d *Server) recoverToIdle() {
+	d.stopHeartbeat()
+	d.stopSession()
+	_ = d.protect("Stop", d.impl.Stop)
+	d.state = StateIdle
+}
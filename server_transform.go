@@ -0,0 +1,96 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"net"
+)
+
+// PortTransformer changes a port sent by the Server, for example to normalize
+// or redact its properties. The transformer receives a copy of the port, so it
+// can change it freely without affecting the ports of the implementation.
+type PortTransformer func(port *Port)
+
+// AddTransformer adds a transformer applied to every port sent by the Server,
+// in the LIST responses and in the "add" and "remove" events, before the port
+// is serialized: in this way the discovery enforces a consistent output without
+// normalizing the ports in all its code paths. The transformers are applied in
+// the order they've been added. It must be called before Run.
+func (d *Server) AddTransformer(transformer PortTransformer) {
+	d.transformers = append(d.transformers, transformer)
+}
+
+// transformPort returns the port changed by the transformers, or the port
+// itself if there are no transformers.
+func (d *Server) transformPort(port *Port) *Port {
+	if len(d.transformers) == 0 || port == nil {
+		return port
+	}
+	res := port.Clone()
+	res.raw = nil
+	for _, transformer := range d.transformers {
+		transformer(res)
+	}
+	return res
+}
+
+// transformPorts returns the ports changed by the transformers.
+func (d *Server) transformPorts(ports []*Port) []*Port {
+	if len(d.transformers) == 0 {
+		return ports
+	}
+	res := make([]*Port, len(ports))
+	for i, port := range ports {
+		res[i] = d.transformPort(port)
+	}
+	return res
+}
+
+// NormalizeMACAddress returns a PortTransformer that formats the MAC addresses
+// in the given properties as lowercase, colon separated, hexadecimal digits
+// (for example "aa:bb:cc:dd:ee:ff"). The values that are not valid MAC
+// addresses are left unchanged.
+func NormalizeMACAddress(keys ...string) PortTransformer {
+	return func(port *Port) {
+		if port.Properties == nil {
+			return
+		}
+		for _, key := range keys {
+			value, ok := port.Properties.GetOk(key)
+			if !ok {
+				continue
+			}
+			if mac, err := net.ParseMAC(value); err == nil {
+				port.Properties.Set(key, mac.String())
+			}
+		}
+	}
+}
+
+// RedactProperties returns a PortTransformer that removes the given properties,
+// for example the authentication tokens, from the ports.
+func RedactProperties(keys ...string) PortTransformer {
+	return func(port *Port) {
+		if port.Properties == nil {
+			return
+		}
+		for _, key := range keys {
+			port.Properties.Remove(key)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package service generates and installs the user-level units running a
+// pluggable discovery as a daemon reachable through TCP, for example on the
+// CI lab machines exposing their boards to the remote developers: a systemd
+// socket with its service on Linux, a launchd agent on macOS.
+//
+// The units use the per-connection socket activation (the "inetd" style):
+// the service manager listens on the TCP port and, for each connection,
+// starts a new instance of the discovery with its stdin and stdout connected
+// to the socket, so any discovery can be served without changes. The clients
+// reach the discovery through a command bridging its stdio to the socket, for
+// example:
+//
+//	discovery.NewClient("lab", "nc", "lab-host", "9000")
+//
+// The protocol is not authenticated: the port must be exposed only on trusted
+// networks, or through a secure tunnel.
+package service
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// System is a service manager.
+type System string
+
+// The service managers supported.
+const (
+	// Systemd is the service manager of Linux, the units are a socket with
+	// Accept=yes and a template service.
+	Systemd System = "systemd"
+	// Launchd is the service manager of macOS, the unit is an agent in
+	// inetd compatibility mode.
+	Launchd System = "launchd"
+)
+
+// launchdLabelPrefix is the prefix of the labels of the launchd agents.
+const launchdLabelPrefix = "cc.arduino.pluggable-discovery."
+
+// Unit describes the daemon running a discovery.
+type Unit struct {
+	// Name is the name of the unit, made of letters, digits, '.', '_' and '-'.
+	Name string
+	// Command is the command line of the discovery, the executable must be
+	// an absolute path.
+	Command []string
+	// Listen is the TCP address the service manager listens on, in the form
+	// "host:port", or ":port" to listen on all the interfaces.
+	Listen string
+	// Env are the additional environment variables of the discovery, in the
+	// form KEY=VALUE.
+	Env []string
+}
+
+var unitNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func (u *Unit) validate() error {
+	if !unitNameRegexp.MatchString(u.Name) {
+		return fmt.Errorf("invalid unit name '%s'", u.Name)
+	}
+	if len(u.Command) == 0 {
+		return errors.New("missing discovery command")
+	}
+	if !filepath.IsAbs(u.Command[0]) {
+		return fmt.Errorf("the discovery executable %s must be an absolute path", u.Command[0])
+	}
+	if _, _, err := u.listenAddress(); err != nil {
+		return err
+	}
+	for _, env := range u.Env {
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("invalid environment variable '%s': expected KEY=VALUE", env)
+		}
+	}
+	return nil
+}
+
+// listenAddress returns the host and the port of the listening address.
+func (u *Unit) listenAddress() (host, port string, err error) {
+	host, port, err = net.SplitHostPort(u.Listen)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid listen address '%s': %w", u.Listen, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", "", fmt.Errorf("invalid listen address '%s': invalid port", u.Listen)
+	}
+	return host, port, nil
+}
+
+// SystemdSocket returns the systemd socket unit, <Name>.socket.
+func (u *Unit) SystemdSocket() (string, error) {
+	if err := u.validate(); err != nil {
+		return "", err
+	}
+	host, port, _ := u.listenAddress()
+	listen := port
+	if host != "" {
+		listen = net.JoinHostPort(host, port)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=Pluggable discovery %s (socket)\n", u.Name)
+	fmt.Fprintf(&b, "\n[Socket]\n")
+	fmt.Fprintf(&b, "ListenStream=%s\n", listen)
+	fmt.Fprintf(&b, "Accept=yes\n")
+	fmt.Fprintf(&b, "\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=sockets.target\n")
+	return b.String(), nil
+}
+
+// SystemdService returns the systemd template service unit started for each
+// connection, <Name>@.service.
+func (u *Unit) SystemdService() (string, error) {
+	if err := u.validate(); err != nil {
+		return "", err
+	}
+	args := []string{}
+	for _, arg := range u.Command {
+		// ExecStart= expands the variables, Environment= doesn't
+		args = append(args, systemdQuote(strings.ReplaceAll(arg, "$", "$$")))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=Pluggable discovery %s (connection %%i)\n", u.Name)
+	fmt.Fprintf(&b, "\n[Service]\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(args, " "))
+	for _, env := range u.Env {
+		fmt.Fprintf(&b, "Environment=%s\n", systemdQuote(env))
+	}
+	fmt.Fprintf(&b, "StandardInput=socket\n")
+	fmt.Fprintf(&b, "StandardOutput=socket\n")
+	fmt.Fprintf(&b, "StandardError=journal\n")
+	return b.String(), nil
+}
+
+// systemdQuote quotes a word of a systemd unit, escaping the specifiers.
+func systemdQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%").Replace(s)
+	return `"` + s + `"`
+}
+
+// LaunchdLabel returns the label of the launchd agent.
+func (u *Unit) LaunchdLabel() string {
+	return launchdLabelPrefix + u.Name
+}
+
+// LaunchdPlist returns the property list of the launchd agent.
+func (u *Unit) LaunchdPlist() (string, error) {
+	if err := u.validate(); err != nil {
+		return "", err
+	}
+	host, port, _ := u.listenAddress()
+	var b strings.Builder
+	line := func(indent int, format string, args ...any) {
+		b.WriteString(strings.Repeat("\t", indent))
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+	str := func(indent int, s string) { line(indent, "<string>%s</string>", xmlEscape(s)) }
+	line(0, `<?xml version="1.0" encoding="UTF-8"?>`)
+	line(0, `<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">`)
+	line(0, `<plist version="1.0">`)
+	line(0, "<dict>")
+	line(1, "<key>Label</key>")
+	str(1, u.LaunchdLabel())
+	line(1, "<key>ProgramArguments</key>")
+	line(1, "<array>")
+	for _, arg := range u.Command {
+		str(2, arg)
+	}
+	line(1, "</array>")
+	if len(u.Env) > 0 {
+		line(1, "<key>EnvironmentVariables</key>")
+		line(1, "<dict>")
+		for _, env := range u.Env {
+			key, value, _ := strings.Cut(env, "=")
+			line(2, "<key>%s</key>", xmlEscape(key))
+			str(2, value)
+		}
+		line(1, "</dict>")
+	}
+	line(1, "<key>inetdCompatibility</key>")
+	line(1, "<dict>")
+	line(2, "<key>Wait</key>")
+	line(2, "<false/>")
+	line(1, "</dict>")
+	line(1, "<key>Sockets</key>")
+	line(1, "<dict>")
+	line(2, "<key>Listeners</key>")
+	line(2, "<dict>")
+	if host != "" {
+		line(3, "<key>SockNodeName</key>")
+		str(3, host)
+	}
+	line(3, "<key>SockServiceName</key>")
+	str(3, port)
+	line(3, "<key>SockType</key>")
+	str(3, "stream")
+	line(2, "</dict>")
+	line(1, "</dict>")
+	line(0, "</dict>")
+	line(0, "</plist>")
+	return b.String(), nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// DefaultSystem returns the service manager of the current operating system.
+func DefaultSystem() (System, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return Systemd, nil
+	case "darwin":
+		return Launchd, nil
+	}
+	return "", fmt.Errorf("no service manager supported on %s", runtime.GOOS)
+}
+
+// UserUnitDir returns the directory of the user-level units of the service
+// manager: $XDG_CONFIG_HOME/systemd/user for systemd, ~/Library/LaunchAgents
+// for launchd.
+func UserUnitDir(system System) (string, error) {
+	switch system {
+	case Systemd:
+		config, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(config, "systemd", "user"), nil
+	case Launchd:
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, "Library", "LaunchAgents"), nil
+	}
+	return "", fmt.Errorf("unknown service manager '%s'", system)
+}
+
+// Installation is the result of Install.
+type Installation struct {
+	// Files are the unit files written.
+	Files []string
+	// Commands are the command lines enabling the units, run by Enable.
+	Commands [][]string
+}
+
+// Install writes the units of the given service manager in dir, usually
+// UserUnitDir. The units are not enabled, see Installation.Enable. The files
+// are readable only by the user, since the environment may contain secrets.
+func (u *Unit) Install(system System, dir string) (*Installation, error) {
+	type unitFile struct {
+		name     string
+		generate func() (string, error)
+	}
+	var files []unitFile
+	res := &Installation{}
+	switch system {
+	case Systemd:
+		files = []unitFile{
+			{u.Name + ".socket", u.SystemdSocket},
+			{u.Name + "@.service", u.SystemdService},
+		}
+		res.Commands = [][]string{
+			{"systemctl", "--user", "daemon-reload"},
+			{"systemctl", "--user", "enable", "--now", u.Name + ".socket"},
+		}
+	case Launchd:
+		plist := filepath.Join(dir, u.LaunchdLabel()+".plist")
+		files = []unitFile{{u.LaunchdLabel() + ".plist", u.LaunchdPlist}}
+		res.Commands = [][]string{
+			{"launchctl", "bootstrap", "gui/" + strconv.Itoa(os.Getuid()), plist},
+		}
+	default:
+		return nil, fmt.Errorf("unknown service manager '%s'", system)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		content, err := file.generate()
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			return nil, err
+		}
+		res.Files = append(res.Files, path)
+	}
+	return res, nil
+}
+
+// Enable runs the commands enabling the installed units, the listening socket
+// is opened right away. On systemd the user units run only while the user is
+// logged in, unless lingering is enabled with "loginctl enable-linger".
+func (i *Installation) Enable() error {
+	for _, command := range i.Commands {
+		if out, err := exec.Command(command[0], command[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("running %s: %w: %s", strings.Join(command, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
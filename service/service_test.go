@@ -0,0 +1,111 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnits(t *testing.T) {
+	unit := &Unit{
+		Name:    "serial-discovery",
+		Command: []string{"/opt/discoveries/serial-discovery", "--label", "100% \"lab\"", "--price", "$5"},
+		Listen:  "127.0.0.1:9000",
+		Env:     []string{"LOG=debug", "PS1=$ "},
+	}
+
+	socket, err := unit.SystemdSocket()
+	require.NoError(t, err)
+	require.Equal(t, `[Unit]
+Description=Pluggable discovery serial-discovery (socket)
+
+[Socket]
+ListenStream=127.0.0.1:9000
+Accept=yes
+
+[Install]
+WantedBy=sockets.target
+`, socket)
+
+	service, err := unit.SystemdService()
+	require.NoError(t, err)
+	require.Equal(t, `[Unit]
+Description=Pluggable discovery serial-discovery (connection %i)
+
+[Service]
+ExecStart="/opt/discoveries/serial-discovery" "--label" "100%% \"lab\"" "--price" "$$5"
+Environment="LOG=debug"
+Environment="PS1=$ "
+StandardInput=socket
+StandardOutput=socket
+StandardError=journal
+`, service)
+
+	plist, err := unit.LaunchdPlist()
+	require.NoError(t, err)
+	require.Contains(t, plist, "<string>cc.arduino.pluggable-discovery.serial-discovery</string>")
+	require.Contains(t, plist, "\t\t<string>100% &#34;lab&#34;</string>\n")
+	require.Contains(t, plist, "\t\t<key>LOG</key>\n\t\t<string>debug</string>\n")
+	require.Contains(t, plist, "\t\t\t<key>SockNodeName</key>\n\t\t\t<string>127.0.0.1</string>\n")
+	require.Contains(t, plist, "\t\t\t<key>SockServiceName</key>\n\t\t\t<string>9000</string>\n")
+
+	// Listening on all the interfaces
+	unit.Listen = ":9000"
+	socket, err = unit.SystemdSocket()
+	require.NoError(t, err)
+	require.Contains(t, socket, "ListenStream=9000\n")
+	plist, err = unit.LaunchdPlist()
+	require.NoError(t, err)
+	require.NotContains(t, plist, "SockNodeName")
+
+	for _, invalid := range []*Unit{
+		{Name: "bad/name", Command: []string{"/bin/true"}, Listen: ":9000"},
+		{Name: "relative", Command: []string{"serial-discovery"}, Listen: ":9000"},
+		{Name: "port", Command: []string{"/bin/true"}, Listen: ":http"},
+		{Name: "env", Command: []string{"/bin/true"}, Listen: ":9000", Env: []string{"LOG"}},
+	} {
+		_, err := invalid.SystemdService()
+		require.Error(t, err, invalid.Name)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	unit := &Unit{Name: "dummy", Command: []string{"/opt/dummy-discovery"}, Listen: ":9000"}
+	dir := t.TempDir()
+	installation, err := unit.Install(Systemd, dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "dummy.socket"), filepath.Join(dir, "dummy@.service")}, installation.Files)
+	require.Equal(t, []string{"systemctl", "--user", "enable", "--now", "dummy.socket"}, installation.Commands[1])
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(installation.Files[1])
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	installation, err = unit.Install(Launchd, dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "cc.arduino.pluggable-discovery.dummy.plist")}, installation.Files)
+
+	_, err = unit.Install("upstart", dir)
+	require.EqualError(t, err, "unknown service manager 'upstart'")
+}
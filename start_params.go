@@ -0,0 +1,142 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// The standard parameters of the START and START_SYNC commands, see
+// HostHints.
+const (
+	// StartParamInterfaces is the comma separated list of the network
+	// interfaces that the network discoveries should scan.
+	StartParamInterfaces = "interfaces"
+	// StartParamExcludePorts is the comma separated list of the glob patterns
+	// (see path.Match) of the port addresses that the discoveries should not
+	// scan.
+	StartParamExcludePorts = "excludePorts"
+)
+
+// ParamsStarter is an optional interface that a Discovery may implement to
+// receive the parameters of the START and START_SYNC commands (available
+// since protocol version 2), for example the HostHints of the host. The
+// parameters are hints: they are ignored by the discoveries not implementing
+// this interface. StartWithParams is called before StartSync (or before the
+// first ListPorts) with the parameters of the command, possibly empty, and an
+// error aborts the command.
+type ParamsStarter interface {
+	StartWithParams(params map[string]string) error
+}
+
+// HostHints are the hints of the host environment passed to the discoveries
+// as parameters of the START and START_SYNC commands, see WithStartParams and
+// ParamsStarter.
+type HostHints struct {
+	// Interfaces are the network interfaces preferred by the host: the network
+	// discoveries should not scan the other interfaces (for example the VPN
+	// interfaces). If empty all the interfaces are scanned.
+	Interfaces []string
+	// ExcludePorts are the glob patterns (see path.Match) of the addresses of
+	// the ports that should not be scanned, for example "/dev/ttyS*".
+	ExcludePorts []string
+}
+
+// Params returns the parameters of the START command carrying the hints.
+func (h *HostHints) Params() map[string]string {
+	params := map[string]string{}
+	if len(h.Interfaces) > 0 {
+		params[StartParamInterfaces] = strings.Join(h.Interfaces, ",")
+	}
+	if len(h.ExcludePorts) > 0 {
+		params[StartParamExcludePorts] = strings.Join(h.ExcludePorts, ",")
+	}
+	return params
+}
+
+// ParseHostHints returns the HostHints carried by the parameters received by
+// a ParamsStarter. An error is returned if a pattern is invalid.
+func ParseHostHints(params map[string]string) (*HostHints, error) {
+	hints := &HostHints{
+		Interfaces:   splitParamList(params[StartParamInterfaces]),
+		ExcludePorts: splitParamList(params[StartParamExcludePorts]),
+	}
+	for _, pattern := range hints.ExcludePorts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("invalid excludePorts pattern: " + pattern)
+		}
+	}
+	return hints, nil
+}
+
+// InterfaceAllowed returns true if the network interface with the given name
+// should be scanned.
+func (h *HostHints) InterfaceAllowed(name string) bool {
+	return len(h.Interfaces) == 0 || slices.Contains(h.Interfaces, name)
+}
+
+// PortExcluded returns true if the port with the given address should not be
+// scanned.
+func (h *HostHints) PortExcluded(address string) bool {
+	for _, pattern := range h.ExcludePorts {
+		if ok, _ := path.Match(pattern, address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func splitParamList(value string) []string {
+	res := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// encodeStartParams encodes the parameters of the START and START_SYNC
+// commands, sorted by key.
+func encodeStartParams(params map[string]string) string {
+	values := url.Values{}
+	for key, value := range params {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+// parseStartParams parses the parameters of the START and START_SYNC commands.
+func parseStartParams(args string) (map[string]string, error) {
+	values, err := url.ParseQuery(args)
+	if err != nil {
+		return nil, errors.New("Invalid parameters: " + err.Error())
+	}
+	params := map[string]string{}
+	for key, value := range values {
+		if len(value) != 1 {
+			return nil, errors.New("Invalid parameters: repeated key " + key)
+		}
+		params[key] = value[0]
+	}
+	return params, nil
+}
@@ -0,0 +1,52 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostHints(t *testing.T) {
+	hints := &HostHints{Interfaces: []string{"eth0", "wlan0"}, ExcludePorts: []string{"/dev/ttyS*"}}
+	params := hints.Params()
+	require.Equal(t, map[string]string{"interfaces": "eth0,wlan0", "excludePorts": "/dev/ttyS*"}, params)
+	require.Equal(t, "START_SYNC excludePorts=%2Fdev%2FttyS%2A&interfaces=eth0%2Cwlan0\n", BuildStart(CommandStartSync, params))
+	require.Equal(t, "START\n", BuildStart(CommandStart, nil))
+
+	parsed, err := parseStartParams("excludePorts=%2Fdev%2FttyS%2A&interfaces=eth0%2Cwlan0")
+	require.NoError(t, err)
+	require.Equal(t, params, parsed)
+	hints, err = ParseHostHints(parsed)
+	require.NoError(t, err)
+	require.True(t, hints.InterfaceAllowed("eth0"))
+	require.False(t, hints.InterfaceAllowed("tun0"))
+	require.True(t, hints.PortExcluded("/dev/ttyS0"))
+	require.False(t, hints.PortExcluded("/dev/ttyACM0"))
+
+	// No hints: everything is allowed
+	hints, err = ParseHostHints(map[string]string{})
+	require.NoError(t, err)
+	require.True(t, hints.InterfaceAllowed("tun0"))
+	require.False(t, hints.PortExcluded("/dev/ttyS0"))
+	require.Empty(t, hints.Params())
+
+	_, err = ParseHostHints(map[string]string{StartParamExcludePorts: "/dev/tty["})
+	require.EqualError(t, err, "invalid excludePorts pattern: /dev/tty[")
+}
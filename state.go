@@ -0,0 +1,81 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+)
+
+// State is a state of the pluggable discovery protocol state machine.
+type State int
+
+// The states of the pluggable discovery protocol.
+const (
+	// StateUninitialized is the state of a discovery before the HELLO command.
+	StateUninitialized State = iota
+	// StateIdle is the state of a discovery after HELLO or STOP.
+	StateIdle
+	// StateStarted is the state of a discovery after START.
+	StateStarted
+	// StateSyncing is the state of a discovery after START_SYNC.
+	StateSyncing
+	// StateQuit is the state of a discovery after QUIT.
+	StateQuit
+)
+
+func (s State) String() string {
+	switch s {
+	case StateUninitialized:
+		return "uninitialized"
+	case StateIdle:
+		return "idle"
+	case StateStarted:
+		return "started"
+	case StateSyncing:
+		return "syncing"
+	case StateQuit:
+		return "quit"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// ErrCommandNotAllowed is returned by NextState when a command is not allowed
+// in the current state.
+var ErrCommandNotAllowed = errors.New("command not allowed")
+
+// NextState returns the state reached after the given command is executed
+// successfully in the given state. If the command is not allowed in the state
+// an error wrapping ErrCommandNotAllowed is returned.
+func NextState(from State, command string) (State, error) {
+	if to, ok := transitions[from][command]; ok {
+		return to, nil
+	}
+	return from, fmt.Errorf("%w: %s in state %s", ErrCommandNotAllowed, command, from)
+}
+
+// CanTransition returns true if a command exists that moves the protocol
+// state machine from the state from to the state to.
+func CanTransition(from, to State) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
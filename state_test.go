@@ -0,0 +1,48 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateMachine(t *testing.T) {
+	state, err := NextState(StateUninitialized, CommandHello)
+	require.NoError(t, err)
+	require.Equal(t, StateIdle, state)
+
+	_, err = NextState(StateUninitialized, CommandStart)
+	require.ErrorIs(t, err, ErrCommandNotAllowed)
+	_, err = NextState(StateSyncing, CommandList)
+	require.ErrorIs(t, err, ErrCommandNotAllowed)
+	require.EqualError(t, err, "command not allowed: LIST in state syncing")
+	_, err = NextState(StateQuit, CommandHello)
+	require.ErrorIs(t, err, ErrCommandNotAllowed)
+
+	require.True(t, CanTransition(StateIdle, StateSyncing))
+	require.True(t, CanTransition(StateSyncing, StateIdle))
+	require.True(t, CanTransition(StateStarted, StateStarted))
+	require.False(t, CanTransition(StateStarted, StateSyncing))
+	require.False(t, CanTransition(StateQuit, StateIdle))
+	require.False(t, CanTransition(StateUninitialized, StateStarted))
+
+	require.Equal(t, "started", StateStarted.String())
+	require.Equal(t, "State(42)", State(42).String())
+}
@@ -0,0 +1,181 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// StderrMode is the way the stderr of the discovery process is handled.
+type StderrMode int
+
+const (
+	// StderrDiscard discards the stderr of the discovery process (default).
+	StderrDiscard StderrMode = iota
+	// StderrInherit connects the stderr of the discovery process to the stderr
+	// of the current process.
+	StderrInherit
+	// StderrLog sends each line of the stderr of the discovery process to the
+	// ClientLogger, prefixed with the discovery ID.
+	StderrLog
+	// StderrFile writes the stderr of the discovery process to a file that is
+	// rotated when it grows over a maximum size, see Client.SetStderrFile.
+	StderrFile
+)
+
+// maxStderrLineLength is the maximum length of a line logged in StderrLog mode,
+// longer lines are split in chunks of this length.
+const maxStderrLineLength = 4096
+
+// SetStderr sets how the stderr of the discovery process is handled. To write
+// the stderr to a file use SetStderrFile. It must be called before Run.
+//
+// Deprecated: use the WithStderr option of NewClientWithOptions.
+func (disc *Client) SetStderr(mode StderrMode) {
+	disc.stderrMode = mode
+}
+
+// SetStderrFile writes the stderr of the discovery process to the file at the
+// given path. When the file grows over maxSize bytes it's rotated: the current
+// file is renamed to path.1, the previous path.1 to path.2 and so on, keeping at
+// most maxBackups old files. A maxSize of 0 disables the rotation.
+// It must be called before Run.
+//
+// Deprecated: use the WithStderrFile option of NewClientWithOptions.
+func (disc *Client) SetStderrFile(path string, maxSize int64, maxBackups int) {
+	WithStderrFile(path, maxSize, maxBackups)(disc)
+}
+
+// stderrWriter returns the writer for the stderr of the discovery process
+// according to the configured StderrMode, or nil to discard it.
+func (disc *Client) stderrWriter() io.Writer {
+	switch disc.stderrMode {
+	case StderrInherit:
+		return os.Stderr
+	case StderrLog:
+		return &lineLogger{
+			log: func(line string) { disc.logger.Errorf("[%s] %s", disc.id, line) },
+		}
+	case StderrFile:
+		if disc.stderrFile == nil {
+			return nil
+		}
+		return disc.stderrFile
+	default:
+		return nil
+	}
+}
+
+// lineLogger is an io.Writer that calls the log function for each line written.
+type lineLogger struct {
+	log func(line string)
+	buf bytes.Buffer
+}
+
+func (l *lineLogger) Write(data []byte) (int, error) {
+	l.buf.Write(data)
+	for {
+		line, err := l.buf.ReadBytes('\n')
+		if err == nil {
+			line = bytes.TrimRight(line, "\r\n")
+		}
+		for len(line) > maxStderrLineLength {
+			l.log(string(line[:maxStderrLineLength]))
+			line = line[maxStderrLineLength:]
+		}
+		if err != nil {
+			// Incomplete line, keep the rest for the next write
+			l.buf.Write(line)
+			return len(data), nil
+		}
+		l.log(string(line))
+	}
+}
+
+// rotatingFile is an io.Writer that appends to a file and rotates it when
+// it grows over maxSize bytes. The file is opened at the first write.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file != nil && f.maxSize > 0 && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if f.file == nil {
+		file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return 0, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+		f.file = file
+		f.size = info.Size()
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	if f.maxBackups <= 0 {
+		return os.Remove(f.path)
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", f.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", f.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+// Close closes the file, it will be opened again at the next write.
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
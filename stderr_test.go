@@ -0,0 +1,88 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStderrLineLogger(t *testing.T) {
+	lines := []string{}
+	l := &lineLogger{log: func(line string) { lines = append(lines, line) }}
+	n, err := l.Write([]byte("first line\nsecond "))
+	require.NoError(t, err)
+	require.Equal(t, 18, n)
+	require.Equal(t, []string{"first line"}, lines)
+	_, err = l.Write([]byte("line\r\nthird line\n"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"first line", "second line", "third line"}, lines)
+
+	// Lines too long are split
+	_, err = l.Write([]byte(strings.Repeat("a", maxStderrLineLength+10)))
+	require.NoError(t, err)
+	require.Len(t, lines, 4)
+	require.Len(t, lines[3], maxStderrLineLength)
+	_, err = l.Write([]byte(strings.Repeat("b", 2*maxStderrLineLength+10) + "\n"))
+	require.NoError(t, err)
+	require.Len(t, lines, 7)
+	require.Equal(t, strings.Repeat("a", 10)+strings.Repeat("b", maxStderrLineLength-10), lines[4])
+	require.Equal(t, strings.Repeat("b", maxStderrLineLength), lines[5])
+	require.Equal(t, strings.Repeat("b", 20), lines[6])
+}
+
+func TestStderrRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stderr.log")
+	f := &rotatingFile{path: path, maxSize: 10, maxBackups: 2}
+	for _, data := range []string{"aaaaaaaa", "bbbbbbbb", "cccccccc", "dddddddd"} {
+		_, err := f.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	readFile := func(path string) string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+	require.Equal(t, "dddddddd", readFile(path))
+	require.Equal(t, "cccccccc", readFile(path+".1"))
+	require.Equal(t, "bbbbbbbb", readFile(path+".2"))
+	require.NoFileExists(t, path+".3")
+
+	// The file is appended after being reopened
+	_, err := f.Write([]byte("e"))
+	require.NoError(t, err)
+	require.Equal(t, "dddddddde", readFile(path))
+	require.NoError(t, f.Close())
+}
+
+func TestClientStderrMode(t *testing.T) {
+	disc := NewClient("test")
+	require.Nil(t, disc.stderrWriter())
+	disc.SetStderr(StderrInherit)
+	require.Equal(t, os.Stderr, disc.stderrWriter())
+	disc.SetStderr(StderrFile)
+	require.Nil(t, disc.stderrWriter())
+	disc.SetStderrFile(filepath.Join(t.TempDir(), "stderr.log"), 0, 0)
+	require.Equal(t, disc.stderrFile, disc.stderrWriter())
+}
@@ -0,0 +1,177 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// StdioKeyEnv is the environment variable used by the Client to pass the
+// pre-shared key of the stdio encryption to the discovery process, encoded in
+// hexadecimal, see WithStdioEncryption.
+const StdioKeyEnv = "PLUGGABLE_DISCOVERY_STDIO_KEY"
+
+// stdioKeySize is the size of the pre-shared key of the stdio encryption.
+const stdioKeySize = 32
+
+// The peers of the encrypted stdio, the key of the certificate of each peer
+// is derived from the pre-shared key and its label.
+const (
+	stdioClientLabel    = "pluggable-discovery client"
+	stdioDiscoveryLabel = "pluggable-discovery discovery"
+)
+
+// errStdioPeer is returned by the TLS handshake of the encrypted stdio when
+// the certificate of the peer is not derived from the pre-shared key.
+var errStdioPeer = errors.New("stdio peer not authenticated")
+
+// StdioKeyFromEnv returns the pre-shared key of the stdio encryption passed
+// by the Client in the StdioKeyEnv environment variable, or nil if the stdio
+// encryption is not enabled, see Server.SetStdioEncryption. The variable is
+// removed from the environment, so it's not inherited by the processes spawned
+// by the discovery.
+func StdioKeyFromEnv() ([]byte, error) {
+	value, ok := os.LookupEnv(StdioKeyEnv)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(StdioKeyEnv)
+	key, err := hex.DecodeString(value)
+	if err != nil || len(key) != stdioKeySize {
+		return nil, fmt.Errorf("invalid %s: expected %d hexadecimal bytes", StdioKeyEnv, stdioKeySize)
+	}
+	return key, nil
+}
+
+// SetStdioEncryption enables the encryption of the input and output streams
+// of Run with the given pre-shared key, usually obtained with StdioKeyFromEnv:
+// the streams carry a TLS connection, where the discovery is the server, and
+// the commands and the messages are authenticated, so the other local
+// processes can not inject commands or port events in the streams. A nil key
+// disables the encryption. It must be called before Run.
+func (d *Server) SetStdioEncryption(key []byte) {
+	d.stdioKey = key
+}
+
+// newStdioKey returns a new random pre-shared key.
+func newStdioKey() ([]byte, error) {
+	key := make([]byte, stdioKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating stdio key: %w", err)
+	}
+	return key, nil
+}
+
+// stdioPeerKey returns the Ed25519 key of the peer with the given label,
+// derived from the pre-shared key.
+func stdioPeerKey(key []byte, label string) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+// newStdioTLSConfig returns the TLS configuration of the peer with the given
+// label: the certificate of each peer is self-signed with its key derived
+// from the pre-shared key, and it's accepted only if its public key is the
+// one derived for the other peer.
+func newStdioTLSConfig(key []byte, label, peerLabel string) (*tls.Config, error) {
+	priv := stdioPeerKey(key, label)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, fmt.Errorf("creating stdio certificate: %w", err)
+	}
+	peerKey := stdioPeerKey(key, peerLabel).Public().(ed25519.PublicKey)
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: priv}},
+		// The certificates are not issued by a CA, the peer is verified
+		// by VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) != 1 {
+				return errStdioPeer
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil || !peerKey.Equal(cert.PublicKey) {
+				return errStdioPeer
+			}
+			return nil
+		},
+	}, nil
+}
+
+// stdioConn is the net.Conn carried by the input and output streams, used by
+// the TLS connection of the encrypted stdio. The streams are not closed by
+// the TLS connection, and the deadlines are not supported.
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdioConn) Close() error                       { return nil }
+func (stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// newStdioServer returns the TLS connection of the discovery on the given
+// input and output streams.
+func newStdioServer(key []byte, in io.Reader, out io.Writer) (*tls.Conn, error) {
+	config, err := newStdioTLSConfig(key, stdioDiscoveryLabel, stdioClientLabel)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(stdioConn{in, out}, config), nil
+}
+
+// wrapStdioEncryption returns the commands writer and the messages reader of
+// the Client encrypted with the given key, both are the TLS connection of the
+// Client.
+func wrapStdioEncryption(key []byte, commands io.Writer, messages io.Reader) (io.Writer, io.Reader, error) {
+	config, err := newStdioTLSConfig(key, stdioClientLabel, stdioDiscoveryLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := tls.Client(stdioConn{messages, commands}, config)
+	return conn, conn, nil
+}
@@ -0,0 +1,131 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingWriter records the data written, so the tests can inspect the
+// encrypted stream.
+type recordingWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+	data  bytes.Buffer
+}
+
+func (r *recordingWriter) Write(data []byte) (int, error) {
+	r.mutex.Lock()
+	r.data.Write(data)
+	r.mutex.Unlock()
+	return r.w.Write(data)
+}
+
+func (r *recordingWriter) String() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.data.String()
+}
+
+func TestStdioEncryption(t *testing.T) {
+	key, err := newStdioKey()
+	require.NoError(t, err)
+
+	// connect returns the client and the discovery connected with the keys
+	connect := func(clientKey, discoveryKey []byte) (io.Writer, io.Reader, io.ReadWriter, *recordingWriter) {
+		// The buffered pipes of the operating system, as the stdio of the
+		// discovery process
+		commandsReader, commandsWriter, err := os.Pipe()
+		require.NoError(t, err)
+		messagesReader, messagesWriter, err := os.Pipe()
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			commandsWriter.Close()
+			messagesWriter.Close()
+		})
+		recorder := &recordingWriter{w: commandsWriter}
+		commands, messages, err := wrapStdioEncryption(clientKey, recorder, messagesReader)
+		require.NoError(t, err)
+		discovery, err := newStdioServer(discoveryKey, commandsReader, messagesWriter)
+		require.NoError(t, err)
+		return commands, messages, discovery, recorder
+	}
+
+	// Round trip, with a message larger than a TLS record
+	commands, messages, discovery, recorder := connect(key, key)
+	large := strings.Repeat("x", 100*1024)
+	go func() {
+		line, _ := bufio.NewReader(discovery).ReadString('\n')
+		_, _ = io.WriteString(discovery, line+large+"\n")
+	}()
+	_, err = io.WriteString(commands, "HELLO 1 \"test\"\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(messages)
+	data, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "HELLO 1 \"test\"\n", data)
+	data, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, large+"\n", data)
+	require.NotContains(t, recorder.String(), "HELLO")
+
+	// A discovery with another key is not authenticated
+	discoveryKey, err := newStdioKey()
+	require.NoError(t, err)
+	commands, _, discovery, _ = connect(key, discoveryKey)
+	go func() { _, _ = discovery.Read(make([]byte, 1)) }()
+	_, err = io.WriteString(commands, "HELLO 1 \"test\"\n")
+	require.Error(t, err)
+
+	// Injected plain text is rejected
+	commandsReader, commandsWriter := io.Pipe()
+	defer commandsWriter.Close()
+	server, err := newStdioServer(key, commandsReader, io.Discard)
+	require.NoError(t, err)
+	go func() { _, _ = io.WriteString(commandsWriter, "START_SYNC\n") }()
+	_, err = server.Read(make([]byte, 64))
+	require.Error(t, err)
+}
+
+func TestStdioKeyFromEnv(t *testing.T) {
+	key, err := StdioKeyFromEnv()
+	require.NoError(t, err)
+	require.Nil(t, key)
+
+	expected, err := newStdioKey()
+	require.NoError(t, err)
+	t.Setenv(StdioKeyEnv, hex.EncodeToString(expected))
+	key, err = StdioKeyFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, expected, key)
+	_, ok := os.LookupEnv(StdioKeyEnv)
+	require.False(t, ok)
+
+	t.Setenv(StdioKeyEnv, "00")
+	_, err = StdioKeyFromEnv()
+	require.Error(t, err)
+}
@@ -0,0 +1,265 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrSubscriptionClosed is the terminal error of a Subscription closed by
+// its consumer, see Subscription.Close.
+var ErrSubscriptionClosed = errors.New("subscription closed")
+
+// ErrSyncStopped is the terminal error of a Subscription to a Client whose
+// sync mode has been stopped by someone else than the consumer, for example
+// with Client.Stop or with a new Client.StartSync.
+var ErrSyncStopped = errors.New("sync stopped")
+
+// Subscription is a stream of events with an explicit teardown contract: the
+// events are received from Events until the channel is closed, then Err
+// returns the reason of the termination. The consumer must call Close when
+// it's no more interested in the events, even after the termination, to
+// release the resources of the subscription.
+type Subscription struct {
+	events    chan *Event
+	stop      chan struct{}
+	done      chan struct{}
+	control   chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	err       error
+	// failure is the terminal error of a subscription closed because its
+	// handler panicked, see Handle
+	failure error
+	// paused, pauseLimit and dropped are the state of the delivery, see Pause
+	paused     bool
+	pauseLimit int
+	dropped    int
+}
+
+// newSubscription starts delivering the events from the source: when the
+// source is closed the terminal error is taken from reason, when the
+// subscription is closed teardown is called to stop the source.
+func newSubscription(source <-chan *Event, reason func() error, teardown func()) *Subscription {
+	s := &Subscription{
+		events:  make(chan *Event),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		control: make(chan struct{}, 1),
+	}
+	go func() {
+		defer close(s.done)
+		defer close(s.events)
+		// pending are the events received from the source and not yet
+		// delivered: while the delivery is running the source is read only
+		// when pending is empty, so the source is slowed down by the consumer
+		pending := []*Event{}
+		for {
+			s.mutex.Lock()
+			paused := s.paused
+			s.mutex.Unlock()
+			if source == nil && len(pending) == 0 {
+				s.setErr(reason())
+				return
+			}
+			in := source
+			var out chan *Event
+			var next *Event
+			if !paused && len(pending) > 0 {
+				in = nil
+				out = s.events
+				next = pending[0]
+			}
+			select {
+			case ev, ok := <-in:
+				if !ok {
+					source = nil
+					continue
+				}
+				// The subscription may have been paused meanwhile
+				s.mutex.Lock()
+				if !s.paused || len(pending) < s.pauseLimit {
+					pending = append(pending, ev)
+				} else {
+					s.dropped++
+				}
+				s.mutex.Unlock()
+			case out <- next:
+				pending[0] = nil
+				pending = pending[1:]
+			case <-s.control:
+			case <-s.stop:
+				s.mutex.Lock()
+				s.err = ErrSubscriptionClosed
+				if s.failure != nil {
+					s.err = s.failure
+				}
+				s.mutex.Unlock()
+				teardown()
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Events returns the channel receiving the events, it's closed when the
+// subscription terminates.
+func (s *Subscription) Events() <-chan *Event {
+	return s.events
+}
+
+// Err returns the reason of the termination of the subscription, or nil if
+// the subscription is still active: ErrSubscriptionClosed if the consumer
+// called Close, otherwise the error that terminated the source of the events.
+func (s *Subscription) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+func (s *Subscription) setErr(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.err = err
+}
+
+// Handle delivers the events of the subscription to the handler, called from
+// a goroutine dedicated to the subscription: the handler isolates the
+// consumer from the source of the events, and from the other subscribers.
+// If the handler panics the subscription fails: it's closed, and its terminal
+// error is a *PanicError. The events must not be received from Events when
+// a handler is set. Handle returns immediately, the consumer must still call
+// Close to release the resources of the subscription.
+func (s *Subscription) Handle(handler func(ev *Event)) {
+	go func() {
+		for ev := range s.events {
+			if err := callConsumer("subscription handler", func() { handler(ev) }); err != nil {
+				s.mutex.Lock()
+				s.failure = err
+				s.mutex.Unlock()
+				s.closeOnce.Do(func() { close(s.stop) })
+				return
+			}
+		}
+	}()
+}
+
+// Pause suspends the delivery of the events without stopping their source:
+// the sync mode of the discovery is kept running, and the events received
+// while the subscription is paused are buffered, up to size events, and
+// delivered on Resume. The events exceeding the buffer are dropped, a size
+// of 0 drops all the events. Pausing a paused subscription changes the size
+// of its buffer. If the source terminates while the subscription is paused,
+// the termination is delivered on Resume too.
+func (s *Subscription) Pause(size int) {
+	s.mutex.Lock()
+	s.paused = true
+	s.pauseLimit = max(size, 0)
+	s.mutex.Unlock()
+	s.wakeup()
+}
+
+// Resume resumes the delivery of the events suspended by Pause, the buffered
+// events are delivered first. It returns the number of events dropped while
+// the subscription was paused: if they are not 0, the consumer has missed
+// some changes and should rebuild its state, for example from a LIST or from
+// the ports of the Manager.
+func (s *Subscription) Resume() int {
+	s.mutex.Lock()
+	dropped := s.dropped
+	s.paused = false
+	s.dropped = 0
+	s.mutex.Unlock()
+	s.wakeup()
+	return dropped
+}
+
+// wakeup notifies the delivery goroutine of a change of its state.
+func (s *Subscription) wakeup() {
+	select {
+	case s.control <- struct{}{}:
+	default:
+	}
+}
+
+// Close terminates the subscription and waits until its resources are
+// released. It's safe to call Close more than once, and after the subscription
+// terminated by itself.
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// Watch puts the discovery in sync mode, like StartSync, and returns the
+// events as a Subscription: closing the subscription stops the sync mode.
+// If the discovery terminates, the terminal error of the subscription is the
+// error of the discovery, if the sync mode is stopped by someone else than the
+// consumer it's ErrSyncStopped.
+func (disc *Client) Watch(size int) (*Subscription, error) {
+	events, err := disc.StartSync(size)
+	if err != nil {
+		return nil, err
+	}
+	reason := func() error {
+		if err := disc.terminationError(); err != nil && !disc.Alive() {
+			return fmt.Errorf("discovery %s terminated: %w", disc, err)
+		}
+		return ErrSyncStopped
+	}
+	teardown := func() {
+		if !disc.Alive() {
+			return
+		}
+		if err := disc.Stop(); err != nil {
+			disc.logger.Errorf("Stopping sync of discovery %s: %v", disc, err)
+		}
+	}
+	return newSubscription(events, reason, teardown), nil
+}
+
+// Watch returns the events of the Manager with a sequence number greater than
+// fromSeq as a Subscription, like Subscribe. The sequence number of each event
+// is available in Event.ManagerSeq. If the subscriber falls behind the history
+// the terminal error of the subscription is ErrHistoryTruncated.
+func (m *Manager) Watch(fromSeq uint64) (*Subscription, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sequenced, err := m.Subscribe(ctx, fromSeq)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	events := make(chan *Event)
+	go func() {
+		defer close(events)
+		for ev := range sequenced {
+			select {
+			case events <- ev.Event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	reason := func() error {
+		return ErrHistoryTruncated
+	}
+	return newSubscription(events, reason, cancel), nil
+}
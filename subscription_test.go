@@ -0,0 +1,149 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientWatch(t *testing.T) {
+	cl := NewInProcessClient("1", "test-inprocess")
+	require.NoError(t, cl.Run())
+	defer cl.Quit()
+
+	sub, err := cl.Watch(10)
+	require.NoError(t, err)
+	require.NoError(t, sub.Err())
+	ev := <-sub.Events()
+	require.Equal(t, EventTypeAdd, ev.Type)
+	sub.Close()
+	sub.Close()
+	require.ErrorIs(t, sub.Err(), ErrSubscriptionClosed)
+	for range sub.Events() {
+	}
+	require.Equal(t, StateIdle, cl.State())
+
+	// The sync mode stopped by someone else terminates the subscription
+	sub, err = cl.Watch(10)
+	require.NoError(t, err)
+	defer sub.Close()
+	require.NoError(t, cl.Stop())
+	for range sub.Events() {
+	}
+	require.ErrorIs(t, sub.Err(), ErrSyncStopped)
+}
+
+func TestManagerWatch(t *testing.T) {
+	m := NewManager()
+	sub, err := m.Watch(0)
+	require.NoError(t, err)
+	require.NoError(t, m.AddStaticPort(&Port{Address: "1", Protocol: "network"}))
+	ev := <-sub.Events()
+	require.Equal(t, EventTypeAdd, ev.Type)
+	require.Equal(t, uint64(1), ev.ManagerSeq)
+	sub.Close()
+	require.ErrorIs(t, sub.Err(), ErrSubscriptionClosed)
+
+	// A subscriber falling behind the history is terminated
+	m.SetEventHistorySize(1)
+	sub, err = m.Watch(1)
+	require.NoError(t, err)
+	defer sub.Close()
+	for _, address := range []string{"2", "3", "4"} {
+		require.NoError(t, m.AddStaticPort(&Port{Address: address, Protocol: "network"}))
+	}
+	for range sub.Events() {
+	}
+	require.ErrorIs(t, sub.Err(), ErrHistoryTruncated)
+
+	_, err = m.Watch(100)
+	require.Error(t, err)
+}
+
+func TestSubscriptionPause(t *testing.T) {
+	source := make(chan *Event)
+	sub := newSubscription(source, func() error { return ErrSyncStopped }, func() {})
+	defer sub.Close()
+	event := func(address string) *Event {
+		return &Event{Type: EventTypeAdd, Port: &Port{Address: address, Protocol: "test"}}
+	}
+
+	// The events received while paused are buffered up to the given size
+	sub.Pause(2)
+	for _, address := range []string{"1", "2", "3", "4"} {
+		source <- event(address)
+	}
+	require.Eventually(t, func() bool {
+		sub.mutex.Lock()
+		defer sub.mutex.Unlock()
+		return sub.dropped == 2
+	}, time.Second, time.Millisecond)
+	select {
+	case ev := <-sub.Events():
+		require.FailNow(t, "event delivered while paused", "%v", ev)
+	default:
+	}
+	require.Equal(t, 2, sub.Resume())
+	require.Equal(t, "1", (<-sub.Events()).Port.Address)
+	require.Equal(t, "2", (<-sub.Events()).Port.Address)
+	source <- event("5")
+	require.Equal(t, "5", (<-sub.Events()).Port.Address)
+
+	// The termination of the source is delivered after the buffered events
+	sub.Pause(0)
+	source <- event("6")
+	sub.Pause(10)
+	source <- event("7")
+	close(source)
+	require.Equal(t, 1, sub.Resume())
+	require.Equal(t, "7", (<-sub.Events()).Port.Address)
+	_, ok := <-sub.Events()
+	require.False(t, ok)
+	require.ErrorIs(t, sub.Err(), ErrSyncStopped)
+}
+
+func TestSubscriptionHandle(t *testing.T) {
+	source := make(chan *Event)
+	tornDown := make(chan struct{})
+	sub := newSubscription(source, func() error { return ErrSyncStopped }, func() { close(tornDown) })
+	defer sub.Close()
+	handled := make(chan string, 1)
+	sub.Handle(func(ev *Event) {
+		if ev.Port.Address == "2" {
+			panic("broken handler")
+		}
+		handled <- ev.Port.Address
+	})
+	source <- &Event{Type: EventTypeAdd, Port: &Port{Address: "1"}}
+	require.Equal(t, "1", <-handled)
+	source <- &Event{Type: EventTypeAdd, Port: &Port{Address: "2"}}
+
+	// The panicking handler fails the subscription, the source is stopped
+	select {
+	case <-tornDown:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "subscription not closed")
+	}
+	sub.Close()
+	var panicErr *PanicError
+	require.ErrorAs(t, sub.Err(), &panicErr)
+	require.Equal(t, "subscription handler", panicErr.Method)
+}
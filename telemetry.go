@@ -0,0 +1,82 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync/atomic"
+)
+
+// TelemetryCounters is a snapshot of the telemetry counters of the package.
+type TelemetryCounters struct {
+	// ClientCommands is the number of commands sent by the Clients.
+	ClientCommands uint64 `json:"client_commands"`
+	// ClientEvents is the number of events delivered by the Clients.
+	ClientEvents uint64 `json:"client_events"`
+	// ServerCommands is the number of commands received by the Servers.
+	ServerCommands uint64 `json:"server_commands"`
+	// ServerEvents is the number of port events sent by the Servers.
+	ServerEvents uint64 `json:"server_events"`
+	// Restarts is the number of discoveries restarted by the Managers.
+	Restarts uint64 `json:"restarts"`
+	// DecodeErrors is the number of invalid messages received by the Clients.
+	DecodeErrors uint64 `json:"decode_errors"`
+}
+
+type telemetryCounters struct {
+	enabled        atomic.Bool
+	clientCommands atomic.Uint64
+	clientEvents   atomic.Uint64
+	serverCommands atomic.Uint64
+	serverEvents   atomic.Uint64
+	restarts       atomic.Uint64
+	decodeErrors   atomic.Uint64
+}
+
+var telemetry telemetryCounters
+
+// EnableTelemetry starts counting the commands, the events, the restarts and
+// the decode errors of all the Clients, Servers and Managers of the process.
+// The telemetry is disabled by default. The counters may be published with
+// expvar and over HTTP with the monitoring package.
+func EnableTelemetry() {
+	telemetry.enabled.Store(true)
+}
+
+// DisableTelemetry stops counting, the counters keep their values.
+func DisableTelemetry() {
+	telemetry.enabled.Store(false)
+}
+
+// Telemetry returns the current value of the telemetry counters.
+func Telemetry() TelemetryCounters {
+	return TelemetryCounters{
+		ClientCommands: telemetry.clientCommands.Load(),
+		ClientEvents:   telemetry.clientEvents.Load(),
+		ServerCommands: telemetry.serverCommands.Load(),
+		ServerEvents:   telemetry.serverEvents.Load(),
+		Restarts:       telemetry.restarts.Load(),
+		DecodeErrors:   telemetry.decodeErrors.Load(),
+	}
+}
+
+// count increments the counter if the telemetry is enabled.
+func (t *telemetryCounters) count(counter *atomic.Uint64) {
+	if t.enabled.Load() {
+		counter.Add(1)
+	}
+}
@@ -0,0 +1,57 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTelemetry(t *testing.T) {
+	EnableTelemetry()
+	defer DisableTelemetry()
+	before := Telemetry()
+
+	cl := NewInProcessClient("1", "test-inprocess")
+	require.NoError(t, cl.Run())
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	<-events
+	cl.Quit()
+
+	_, err = decodeMessage(json.NewDecoder(strings.NewReader(`{"eventType": 1}`)))
+	require.Error(t, err)
+	_, err = decodeMessage(json.NewDecoder(strings.NewReader(`{"eventType": "add"}`)))
+	require.Error(t, err)
+
+	after := Telemetry()
+	// HELLO, START_SYNC and QUIT
+	require.GreaterOrEqual(t, after.ClientCommands-before.ClientCommands, uint64(3))
+	require.GreaterOrEqual(t, after.ServerCommands-before.ServerCommands, uint64(3))
+	require.GreaterOrEqual(t, after.ClientEvents-before.ClientEvents, uint64(1))
+	require.GreaterOrEqual(t, after.ServerEvents-before.ServerEvents, uint64(1))
+	require.GreaterOrEqual(t, after.DecodeErrors-before.DecodeErrors, uint64(2))
+
+	// The counters are not incremented while the telemetry is disabled
+	DisableTelemetry()
+	telemetry.count(&telemetry.restarts)
+	require.Equal(t, after.Restarts, Telemetry().Restarts)
+}
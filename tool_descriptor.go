@@ -0,0 +1,88 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// DefaultToolPathPattern is the path of the executable of a tool installed by
+// the Arduino CLI, relative to the packages directory, see ToolDescriptor.
+const DefaultToolPathPattern = "{packager}/tools/{name}/{version}/{name}"
+
+// ToolDescriptor describes a discovery tool installed in the packages
+// directories, see Resolver.ResolveTool and Manager.AddTool.
+type ToolDescriptor struct {
+	// Packager is the vendor of the tool, for example "builtin".
+	Packager string `json:"packager"`
+	// Name is the name of the tool, for example "serial-discovery".
+	Name string `json:"name"`
+	// Version is the version of the tool the executable must report.
+	Version string `json:"version"`
+	// PathPattern is the path of the executable relative to the packages
+	// directory, where "{packager}", "{name}" and "{version}" are replaced by
+	// the fields of the descriptor. The path uses the forward slash as
+	// separator on all platforms and the ".exe" suffix is added on Windows.
+	// If empty DefaultToolPathPattern is used.
+	PathPattern string `json:"pathPattern,omitempty"`
+	// VersionFlag is the flag that makes the executable print its version and
+	// exit, "--version" if empty.
+	VersionFlag string `json:"versionFlag,omitempty"`
+	// Args are the command line arguments of the discovery.
+	Args []string `json:"args,omitempty"`
+}
+
+// executablePath returns the path of the executable relative to the
+// packages directory.
+func (desc *ToolDescriptor) executablePath() string {
+	pattern := desc.PathPattern
+	if pattern == "" {
+		pattern = DefaultToolPathPattern
+	}
+	path := strings.NewReplacer(
+		"{packager}", desc.Packager,
+		"{name}", desc.Name,
+		"{version}", desc.Version,
+	).Replace(pattern)
+	if runtime.GOOS == "windows" && !strings.HasSuffix(strings.ToLower(path), ".exe") {
+		path += ".exe"
+	}
+	return filepath.FromSlash(path)
+}
+
+func (desc *ToolDescriptor) versionFlag() string {
+	if desc.VersionFlag == "" {
+		return "--version"
+	}
+	return desc.VersionFlag
+}
+
+// AddTool resolves the discovery tool described by the descriptor with the
+// given Resolver and adds it to the Manager with the given ID, see Add. In
+// this way the host can add the discoveries installed as platform tools
+// without building their command line.
+func (m *Manager) AddTool(id string, resolver *Resolver, desc *ToolDescriptor) error {
+	disc, err := resolver.NewToolClient(id, desc)
+	if err != nil {
+		return fmt.Errorf("resolving discovery %s: %w", id, err)
+	}
+	return m.Add(disc)
+}
@@ -0,0 +1,30 @@
+module github.com/arduino/pluggable-discovery-protocol-handler/v2/tracing
+
+go 1.21
+
+require (
+	github.com/arduino/pluggable-discovery-protocol-handler/v2 v2.0.0-00010101000000-000000000000
+	github.com/stretchr/testify v1.9.0
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/sdk v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+)
+
+require (
+	github.com/arduino/go-paths-helper v1.10.0 // indirect
+	github.com/arduino/go-properties-orderedmap v1.8.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/fsnotify/fsnotify v1.7.0 // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.opentelemetry.io/otel/metric v1.28.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+	pgregory.net/rapid v1.1.0 // indirect
+)
+
+replace github.com/arduino/pluggable-discovery-protocol-handler/v2 => ../
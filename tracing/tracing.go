@@ -0,0 +1,209 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package tracing instruments the discovery Client with OpenTelemetry spans: a
+// span for each command round trip, a span for each sync session, linked to the
+// span of its START_SYNC command, and a span for each event, linked to the span
+// of its sync session.
+//
+// It's a separate module, so the applications not using OpenTelemetry don't
+// depend on it.
+package tracing
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the Tracer creating the spans.
+const instrumentationName = "github.com/arduino/pluggable-discovery-protocol-handler/v2/tracing"
+
+// The names of the spans.
+const (
+	SpanCommand = "discovery.command"
+	SpanSync    = "discovery.sync"
+	SpanEvent   = "discovery.event"
+)
+
+// The attributes set on the spans.
+const (
+	AttributeDiscoveryID = attribute.Key("discovery.id")
+	AttributeCommand     = attribute.Key("discovery.command")
+	AttributeEventType   = attribute.Key("discovery.event.type")
+	AttributePortAddress = attribute.Key("discovery.port.address")
+	AttributePortProto   = attribute.Key("discovery.port.protocol")
+)
+
+// Instrument adds to the Client a middleware (see discovery.Client.Use) that
+// traces the commands, the sync sessions and the events with a Tracer of the
+// given TracerProvider, or of the global one if nil (see
+// otel.GetTracerProvider). It must be called before Run.
+func Instrument(client *discovery.Client, provider trace.TracerProvider) {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	t := &clientTracer{id: client.GetID(), tracer: provider.Tracer(instrumentationName)}
+	client.Use(t.middleware)
+}
+
+// clientTracer holds the spans in progress of a Client.
+type clientTracer struct {
+	id     string
+	tracer trace.Tracer
+	mutex  sync.Mutex
+	// pending are the spans of the commands waiting for the response,
+	// in the order they've been sent
+	pending []*pendingCommand
+	// session is the span of the current sync session, if any
+	session trace.Span
+}
+
+type pendingCommand struct {
+	name string
+	// response is the event type of the expected response, empty if not
+	// defined by the specification
+	response string
+	span     trace.Span
+}
+
+func (t *clientTracer) middleware(next discovery.Handler) discovery.Handler {
+	return func(x *discovery.Exchange) error {
+		switch {
+		case x.IsResponse():
+			t.response(x)
+			return next(x)
+		case x.Event != nil:
+			t.event(x.Event)
+			return next(x)
+		}
+		name, _, _ := strings.Cut(x.Command, " ")
+		_, span := t.tracer.Start(context.Background(), SpanCommand,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(AttributeDiscoveryID.String(t.id), AttributeCommand.String(name)))
+		if name == discovery.CommandStopList {
+			// STOP_LIST has no response, the span ends once the command is sent
+			err := next(x)
+			fail(span, err)
+			span.End()
+			return err
+		}
+		response, _ := discovery.ResponseEventType(name)
+		cmd := &pendingCommand{name: name, response: response, span: span}
+		t.mutex.Lock()
+		t.pending = append(t.pending, cmd)
+		if name == discovery.CommandStartSync {
+			// The session begins with the command, the events may be
+			// received before the response
+			t.endSession(nil)
+			_, t.session = t.tracer.Start(context.Background(), SpanSync,
+				trace.WithLinks(trace.Link{SpanContext: span.SpanContext()}),
+				trace.WithAttributes(AttributeDiscoveryID.String(t.id)))
+		}
+		t.mutex.Unlock()
+		if err := next(x); err != nil {
+			t.mutex.Lock()
+			t.pending = slices.DeleteFunc(t.pending, func(p *pendingCommand) bool { return p == cmd })
+			if name == discovery.CommandStartSync {
+				t.endSession(err)
+			}
+			t.mutex.Unlock()
+			fail(span, err)
+			span.End()
+			return err
+		}
+		return nil
+	}
+}
+
+// response ends the span of the oldest command waiting for a response of the
+// type received, or of the oldest command if the discovery did not answer or
+// answered with a command_error, and, if the session is terminated, the span
+// of the sync session.
+func (t *clientTracer) response(x *discovery.Exchange) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.pending) == 0 {
+		return
+	}
+	i := 0
+	if x.Response != "" && x.Response != discovery.EventTypeCommandError {
+		if j := slices.IndexFunc(t.pending, func(p *pendingCommand) bool {
+			return p.response == x.Response || p.response == ""
+		}); j != -1 {
+			i = j
+		}
+	}
+	cmd := t.pending[i]
+	t.pending = slices.Delete(t.pending, i, i+1)
+	fail(cmd.span, x.Err)
+	cmd.span.End()
+
+	switch {
+	case cmd.name == discovery.CommandStartSync && x.Err != nil:
+		t.endSession(x.Err)
+	case cmd.name == discovery.CommandStop || cmd.name == discovery.CommandQuit:
+		t.endSession(nil)
+	case x.Err != nil && x.Response == "":
+		// The discovery did not answer, the session is terminated
+		t.endSession(x.Err)
+	}
+}
+
+// endSession ends the span of the sync session, if any. The caller must
+// hold the mutex.
+func (t *clientTracer) endSession(err error) {
+	if t.session == nil {
+		return
+	}
+	fail(t.session, err)
+	t.session.End()
+	t.session = nil
+}
+
+// event records a span for the event, linked to the span of the sync session.
+func (t *clientTracer) event(ev *discovery.Event) {
+	t.mutex.Lock()
+	session := t.session
+	t.mutex.Unlock()
+	attributes := []attribute.KeyValue{AttributeDiscoveryID.String(t.id), AttributeEventType.String(ev.Type)}
+	if ev.Port != nil {
+		attributes = append(attributes, AttributePortAddress.String(ev.Port.Address), AttributePortProto.String(ev.Port.Protocol))
+	}
+	opts := []trace.SpanStartOption{trace.WithAttributes(attributes...)}
+	if session != nil {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: session.SpanContext()}))
+	}
+	_, span := t.tracer.Start(context.Background(), SpanEvent, opts...)
+	span.End()
+}
+
+// fail records the error, if not nil, on the span.
+func fail(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,157 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type testDiscovery struct{}
+
+func (d *testDiscovery) Hello(userAgent string, protocolVersion int) error { return nil }
+func (d *testDiscovery) Stop() error                                       { return nil }
+func (d *testDiscovery) Quit()                                             {}
+func (d *testDiscovery) StartSync(eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	eventCB(discovery.EventTypeAdd, &discovery.Port{Address: "1", Protocol: "test"})
+	return nil
+}
+
+// listingDiscovery blocks the LIST commands until they are cancelled.
+type listingDiscovery struct {
+	testDiscovery
+	listing chan struct{}
+}
+
+func (d *listingDiscovery) List(ctx context.Context) ([]*discovery.Port, error) {
+	d.listing <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+var listing = make(chan struct{})
+
+func init() {
+	discovery.Register("tracing-test", func() discovery.Discovery { return &testDiscovery{} })
+	discovery.Register("tracing-list", func() discovery.Discovery { return &listingDiscovery{listing: listing} })
+}
+
+// newRecorder returns a TracerProvider recording the spans ended.
+func newRecorder() (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	return sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), recorder
+}
+
+// attributeOf returns the value of the attribute of the span.
+func attributeOf(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value.AsString()
+		}
+	}
+	return ""
+}
+
+func TestInstrument(t *testing.T) {
+	provider, recorder := newRecorder()
+	cl := discovery.NewInProcessClient("traced", "tracing-test")
+	Instrument(cl, provider)
+	require.NoError(t, cl.Run())
+	require.NoError(t, cl.Start())
+	_, err := cl.Describe()
+	require.Error(t, err)
+	require.NoError(t, cl.Stop())
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	<-events
+	require.NoError(t, cl.Stop())
+	cl.Quit()
+
+	require.Empty(t, recorder.Started()[len(recorder.Ended()):])
+	commands := []string{}
+	var startSync, session, event sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		require.Equal(t, "traced", attributeOf(span, AttributeDiscoveryID))
+		switch span.Name() {
+		case SpanCommand:
+			command := attributeOf(span, AttributeCommand)
+			commands = append(commands, command)
+			if command == discovery.CommandDescribe {
+				require.Equal(t, codes.Error, span.Status().Code)
+				require.Equal(t, "DESCRIBE not supported by the discovery", span.Status().Description)
+			} else {
+				require.Equal(t, codes.Unset, span.Status().Code, command)
+			}
+			if command == discovery.CommandStartSync {
+				startSync = span
+			}
+		case SpanSync:
+			session = span
+		case SpanEvent:
+			event = span
+		}
+	}
+	require.Equal(t, []string{"HELLO", "START", "DESCRIBE", "STOP", "START_SYNC", "STOP", "QUIT"}, commands)
+	require.NotNil(t, session)
+	require.Len(t, session.Links(), 1)
+	require.Equal(t, startSync.SpanContext(), session.Links()[0].SpanContext)
+	require.NotNil(t, event)
+	require.Len(t, event.Links(), 1)
+	require.Equal(t, session.SpanContext(), event.Links()[0].SpanContext)
+	require.Equal(t, discovery.EventTypeAdd, attributeOf(event, AttributeEventType))
+	require.Equal(t, "1", attributeOf(event, AttributePortAddress))
+}
+
+func TestInstrumentStopList(t *testing.T) {
+	provider, recorder := newRecorder()
+	cl := discovery.NewInProcessClient("traced", "tracing-list")
+	Instrument(cl, provider)
+	require.NoError(t, cl.Run())
+	require.NoError(t, cl.Start())
+	listErr := make(chan error)
+	go func() {
+		_, err := cl.List()
+		listErr <- err
+	}()
+	<-listing
+	require.NoError(t, cl.CancelList())
+	require.ErrorIs(t, <-listErr, discovery.ErrListCancelled)
+	require.NoError(t, cl.Stop())
+	cl.Quit()
+
+	// STOP_LIST has no response, the responses are matched to the right commands
+	require.Len(t, recorder.Ended(), len(recorder.Started()))
+	commands := []string{}
+	for _, span := range recorder.Ended() {
+		command := attributeOf(span, AttributeCommand)
+		commands = append(commands, command)
+		if command == discovery.CommandList {
+			require.Equal(t, codes.Error, span.Status().Code)
+		} else {
+			require.Equal(t, codes.Unset, span.Status().Code, command)
+		}
+	}
+	require.Equal(t, []string{"HELLO", "START", "STOP_LIST", "LIST", "STOP", "QUIT"}, commands)
+}
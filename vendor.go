@@ -0,0 +1,81 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// VendorEventCallback sends a vendor event, see Server.SendVendorEvent.
+type VendorEventCallback func(eventType, message string, payload any) error
+
+// VendorExtension is an optional interface that a Discovery may implement to
+// send vendor events to the client (see VendorEventPrefix), for example to
+// experiment with an extension of the protocol. SetVendorEventCallback is
+// called, before Hello, with the callback sending the vendor events: the
+// callback may be called from any goroutine after Hello returns.
+type VendorExtension interface {
+	SetVendorEventCallback(send VendorEventCallback)
+}
+
+// deliverVendorEvent passes the vendor event to the handler set with
+// WithVendorEventHandler, if any.
+func (disc *Client) deliverVendorEvent(msg *discoveryMessage) {
+	if disc.vendorEventHandler == nil {
+		disc.logger.Debugf("Ignored vendor event %s", msg.EventType)
+		return
+	}
+	ev := &Event{
+		Type:        msg.EventType,
+		DiscoveryID: disc.GetID(),
+		Message:     msg.Message,
+		Payload:     msg.Payload,
+	}
+	if err := callConsumer("vendor event handler", func() { disc.vendorEventHandler(ev) }); err != nil {
+		disc.consumerPanics.Add(1)
+		disc.logger.Errorf("Vendor event handler of discovery %s panicked: %v", disc, err)
+	}
+}
+
+// SendVendorEvent sends a vendor event, with the given message, to the client,
+// see VendorEventPrefix. The payload, if not nil, is encoded as JSON in the
+// "payload" field of the event. The vendor events are available since protocol
+// version 2: an error is returned if the event type is not a vendor event type,
+// or if the client negotiated protocol version 1 (or the HELLO has not been
+// received yet), since the older clients treat the unknown messages as
+// out-of-sync responses. It's safe to call SendVendorEvent from any goroutine.
+func (d *Server) SendVendorEvent(eventType, text string, payload any) error {
+	if !IsVendorEventType(eventType) {
+		return fmt.Errorf("invalid vendor event type %s: it must start with %s", eventType, VendorEventPrefix)
+	}
+	if d.protocolVersion.Load() < 2 {
+		return errors.New("vendor events require protocol version 2")
+	}
+	msg := &message{EventType: eventType, Message: text}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("encoding payload of vendor event %s: %w", eventType, err)
+		}
+		msg.Payload = data
+	}
+	d.send(msg)
+	return nil
+}
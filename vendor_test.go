@@ -0,0 +1,110 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// vendorDiscovery reports the progress of its scan with a vendor event
+type vendorDiscovery struct {
+	nullDiscovery
+	send VendorEventCallback
+}
+
+func (d *vendorDiscovery) SetVendorEventCallback(send VendorEventCallback) {
+	d.send = send
+}
+
+func (d *vendorDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	go func() {
+		_ = d.send("x-acme-progress", "scanning", map[string]int{"percent": 50})
+		eventCB(EventTypeAdd, &Port{Address: "1", Protocol: "acme"})
+	}()
+	return nil
+}
+
+func init() {
+	Register("test-vendor", func() Discovery { return &vendorDiscovery{} })
+}
+
+func TestVendorEventType(t *testing.T) {
+	require.True(t, IsVendorEventType("x-acme-progress"))
+	require.False(t, IsVendorEventType("x-"))
+	require.False(t, IsVendorEventType("add"))
+}
+
+func TestServerSendVendorEvent(t *testing.T) {
+	server := NewServer(&nullDiscovery{})
+	conn := runTestServer(t, server)
+	require.Error(t, server.SendVendorEvent("x-acme-progress", "", nil))
+
+	conn.send(`HELLO 2 "test"`)
+	require.Equal(t, EventTypeHello, conn.recv().EventType)
+	require.Error(t, server.SendVendorEvent("progress", "", nil))
+	go func() {
+		require.NoError(t, server.SendVendorEvent("x-acme-progress", "scanning", map[string]int{"percent": 50}))
+	}()
+	msg := conn.recv()
+	require.Equal(t, "x-acme-progress", msg.EventType)
+	require.Equal(t, "scanning", msg.Message)
+	require.JSONEq(t, `{"percent":50}`, string(msg.Payload))
+	conn.send("QUIT")
+	require.Equal(t, EventTypeQuit, conn.recv().EventType)
+
+	// The older clients don't know the vendor events
+	server = NewServer(&nullDiscovery{})
+	conn = runTestServer(t, server)
+	conn.send(`HELLO 1 "test"`)
+	require.Equal(t, EventTypeHello, conn.recv().EventType)
+	require.Error(t, server.SendVendorEvent("x-acme-progress", "", nil))
+	conn.send("QUIT")
+	require.Equal(t, EventTypeQuit, conn.recv().EventType)
+}
+
+func TestClientVendorEventHandler(t *testing.T) {
+	vendorEvents := make(chan *Event, 1)
+	disc := NewClientWithOptions("vendor", "test-vendor",
+		WithTransport(TransportInProcess),
+		WithVendorEventHandler(func(ev *Event) { vendorEvents <- ev }),
+		WithStrictMode(true))
+	require.NoError(t, disc.Run())
+	defer disc.Quit()
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+
+	select {
+	case ev := <-vendorEvents:
+		require.Equal(t, "x-acme-progress", ev.Type)
+		require.Equal(t, "vendor", ev.DiscoveryID)
+		require.Equal(t, "scanning", ev.Message)
+		progress, err := PayloadAs[map[string]int](ev)
+		require.NoError(t, err)
+		require.Equal(t, 50, progress["percent"])
+	case <-time.After(time.Second):
+		require.FailNow(t, "vendor event not received")
+	}
+	require.Equal(t, EventTypeAdd, (<-events).Type)
+
+	// The vendor events don't disturb the responses to the commands
+	require.NoError(t, disc.Stop())
+	require.True(t, disc.Alive())
+}
@@ -0,0 +1,146 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"time"
+)
+
+// The codes of the warnings that a discovery may send, see Server.SendWarning.
+// The discoveries may use other codes too.
+const (
+	// WarningCodeDeprecated signals the use of a deprecated feature, for
+	// example a command line flag or a protocol version.
+	WarningCodeDeprecated = "deprecated"
+	// WarningCodeDegraded signals that the ports found may be incomplete, for
+	// example because a system library is outdated or a permission is missing.
+	WarningCodeDegraded = "degraded"
+)
+
+// maxClientWarnings is the maximum number of distinct warnings kept by the
+// Client, the oldest are dropped.
+const maxClientWarnings = 32
+
+// Warning is a non-fatal problem signaled by a discovery with a "warning"
+// message, see Server.SendWarning.
+type Warning struct {
+	DiscoveryID string `json:"discoveryId"`
+	Code        string `json:"code,omitempty"`
+	Message     string `json:"message"`
+	// Port is the port affected by the warning, if any.
+	Port *Port `json:"port,omitempty"`
+	// Time is when the warning has been received the last time.
+	Time time.Time `json:"time"`
+	// Count is the number of times the warning has been received.
+	Count int `json:"count"`
+}
+
+// WarningCallback sends a warning, see Server.SendWarning.
+type WarningCallback func(code, message string, port *Port) error
+
+// WarningEmitter is an optional interface that a Discovery may implement to
+// send warnings to the client, for example to explain why some ports may be
+// missing. SetWarningCallback is called, before Hello, with the callback
+// sending the warnings: the callback may be called from any goroutine after
+// Hello returns.
+type WarningEmitter interface {
+	SetWarningCallback(send WarningCallback)
+}
+
+// SendWarning sends a warning to the client, with the given code (see
+// WarningCodeDeprecated) and human readable message. The port affected by the
+// warning, if any, is sent with it. The warnings are available since protocol
+// version 2: an error is returned if the client negotiated protocol version 1
+// (or the HELLO has not been received yet). It's safe to call SendWarning from
+// any goroutine.
+func (d *Server) SendWarning(code, text string, port *Port) error {
+	if text == "" {
+		return errors.New("missing warning message")
+	}
+	if d.protocolVersion.Load() < 2 {
+		return errors.New("warnings require protocol version 2")
+	}
+	d.send(&message{EventType: EventTypeWarning, Code: code, Message: text, Port: port})
+	return nil
+}
+
+// Warnings returns the distinct warnings sent by the discovery across all its
+// runs, sorted by the time they have been received the last time. The warnings
+// are also delivered as EventTypeWarning events in sync mode.
+func (disc *Client) Warnings() []*Warning {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	res := []*Warning{}
+	for _, w := range disc.warnings {
+		clone := *w
+		res = append(res, &clone)
+	}
+	return res
+}
+
+// deliverWarning records the warning sent by the discovery and, in sync mode,
+// sends it to the consumer as an EventTypeWarning event.
+func (disc *Client) deliverWarning(msg *discoveryMessage) {
+	disc.logger.Debugf("Warning from discovery %s: %s", disc, msg.Message)
+	disc.eventsMutex.Lock()
+	defer disc.eventsMutex.Unlock()
+	disc.statusMutex.Lock()
+	disc.recordWarning(msg)
+	forwarder := disc.eventForwarder
+	disc.statusMutex.Unlock()
+	if forwarder == nil {
+		return
+	}
+	disc.sendEvent(forwarder, &Event{
+		Type:        EventTypeWarning,
+		Port:        msg.Port,
+		DiscoveryID: disc.GetID(),
+		Message:     msg.Message,
+		Code:        msg.Code,
+		Seq:         disc.eventSeq.Add(1),
+		Payload:     msg.Payload,
+	})
+}
+
+// recordWarning adds the warning to the distinct warnings received, the caller
+// must hold the statusMutex.
+func (disc *Client) recordWarning(msg *discoveryMessage) {
+	now := disc.clock.Now()
+	for i, w := range disc.warnings {
+		if w.Code == msg.Code && w.Message == msg.Message {
+			w.Count++
+			w.Time = now
+			w.Port = msg.Port
+			// The most recent warnings are the last ones dropped
+			disc.warnings = append(append(disc.warnings[:i:i], disc.warnings[i+1:]...), w)
+			return
+		}
+	}
+	disc.warnings = append(disc.warnings, &Warning{
+		DiscoveryID: disc.GetID(),
+		Code:        msg.Code,
+		Message:     msg.Message,
+		Port:        msg.Port,
+		Time:        now,
+		Count:       1,
+	})
+	if excess := len(disc.warnings) - maxClientWarnings; excess > 0 {
+		disc.warnings = append([]*Warning(nil), disc.warnings[excess:]...)
+	}
+}
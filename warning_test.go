@@ -0,0 +1,112 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// degradedDiscovery warns that its scan is incomplete
+type degradedDiscovery struct {
+	nullDiscovery
+	warn WarningCallback
+}
+
+func (d *degradedDiscovery) SetWarningCallback(send WarningCallback) {
+	d.warn = send
+}
+
+func (d *degradedDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	go func() {
+		_ = d.warn(WarningCodeDegraded, "libusb outdated, results may be incomplete", nil)
+		eventCB(EventTypeAdd, &Port{Address: "1", Protocol: "usb"})
+		_ = d.warn(WarningCodeDegraded, "libusb outdated, results may be incomplete", nil)
+	}()
+	return nil
+}
+
+func init() {
+	Register("test-degraded", func() Discovery { return &degradedDiscovery{} })
+}
+
+func TestServerSendWarning(t *testing.T) {
+	server := NewServer(&nullDiscovery{})
+	conn := runTestServer(t, server)
+	require.Error(t, server.SendWarning(WarningCodeDeprecated, "flag -v is deprecated", nil))
+
+	conn.send(`HELLO 2 "test"`)
+	require.Equal(t, EventTypeHello, conn.recv().EventType)
+	require.Error(t, server.SendWarning(WarningCodeDeprecated, "", nil))
+	go func() {
+		require.NoError(t, server.SendWarning(WarningCodeDeprecated, "flag -v is deprecated", nil))
+	}()
+	msg := conn.recv()
+	require.Equal(t, EventTypeWarning, msg.EventType)
+	require.Equal(t, WarningCodeDeprecated, msg.Code)
+	require.Equal(t, "flag -v is deprecated", msg.Message)
+	conn.send("QUIT")
+	require.Equal(t, EventTypeQuit, conn.recv().EventType)
+
+	// The older clients don't know the warnings
+	server = NewServer(&nullDiscovery{})
+	conn = runTestServer(t, server)
+	conn.send(`HELLO 1 "test"`)
+	require.Equal(t, EventTypeHello, conn.recv().EventType)
+	require.Error(t, server.SendWarning(WarningCodeDeprecated, "flag -v is deprecated", nil))
+	conn.send("QUIT")
+	require.Equal(t, EventTypeQuit, conn.recv().EventType)
+}
+
+func TestClientWarnings(t *testing.T) {
+	m := NewManager()
+	disc := NewInProcessClient("degraded", "test-degraded")
+	disc.SetStrictMode(true)
+	require.NoError(t, m.Add(disc))
+	defer m.QuitAll(context.Background())
+	require.NoError(t, disc.Run())
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+
+	received := []string{}
+	for len(received) < 3 {
+		select {
+		case ev := <-events:
+			received = append(received, ev.Type)
+			if ev.Type == EventTypeWarning {
+				require.Equal(t, WarningCodeDegraded, ev.Code)
+				require.Equal(t, "libusb outdated, results may be incomplete", ev.Message)
+			}
+		case <-time.After(time.Second):
+			require.FailNow(t, "events not received", "%v", received)
+		}
+	}
+	require.Equal(t, []string{EventTypeWarning, EventTypeAdd, EventTypeWarning}, received)
+
+	// The repeated warnings are aggregated
+	status := m.Status()
+	require.Len(t, status.Health, 1)
+	require.Len(t, status.Warnings, 1)
+	require.Equal(t, "degraded", status.Warnings[0].DiscoveryID)
+	require.Equal(t, WarningCodeDegraded, status.Warnings[0].Code)
+	require.Equal(t, 2, status.Warnings[0].Count)
+	require.NoError(t, disc.Stop())
+}